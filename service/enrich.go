@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"intelligence/intelligence"
+)
+
+// Defines the results of a row that has been enriched, as it is recorded in the checkpoint file
+type enrichedRow struct {
+	Row     int               `json:"row"`
+	Results map[string]string `json:"results"`
+}
+
+// Defines the input and services a checkpoint file was written for, recorded on its first line so a run never
+// resumes from the checkpoint of a different input
+type checkpointInput struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Services []string  `json:"services"`
+}
+
+// Enriches the rows of a CSV or Parquet file with the results of intelligence services and writes them to a CSV file
+// with the original columns followed by a column for each service. Rows are recorded in a checkpoint file as they complete,
+// so an interrupted run continues where it left off when it is run again with the same arguments.
+func runEnrich(args []string) error {
+	flags := flag.NewFlagSet("enrich", flag.ExitOnError)
+	inputPath := flags.String("input", "", "the CSV or Parquet file to enrich")
+	outputPath := flags.String("output", "", "the CSV file to write the enriched rows to")
+	services := flags.String("services", "", "the comma separated services to run each row through, such as sentiment,summary")
+	mapping := flags.String("map", "", "the comma separated params and the columns they are read from, such as text=review")
+	configPath := flags.String("config", "intelligence.json", "the intelligence service configuration")
+	checkpointPath := flags.String("checkpoint", "", "the file that records the enriched rows (default is the output file with a .checkpoint extension)")
+	concurrency := flags.Int("concurrency", 4, "the number of rows that are enriched at the same time")
+	rateLimit := flags.Int("rpm", 0, "the maximum number of service requests per minute, or 0 for no limit")
+	flags.Parse(args)
+
+	if *inputPath == "" || *outputPath == "" || *services == "" || *mapping == "" {
+		flags.Usage()
+		return fmt.Errorf("-input, -output, -services and -map are required")
+	}
+	if *checkpointPath == "" {
+		*checkpointPath = *outputPath + ".checkpoint"
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	serviceNames := getServiceNames(*services)
+	if len(serviceNames) == 0 {
+		return fmt.Errorf("-services has no service names")
+	}
+	paramColumns, err := getParamColumns(*mapping)
+	if err != nil {
+		return err
+	}
+
+	intel, err := intelligence.NewIntelligence(*configPath)
+	if err != nil {
+		return fmt.Errorf("intelligence failed to load: %v", err)
+	}
+
+	// Read the input so the header can be checked before any requests are made
+	header, rows, err := readInput(*inputPath)
+	if err != nil {
+		return err
+	}
+	columnIndexes := make(map[string]int, len(header))
+	for index, column := range header {
+		columnIndexes[column] = index
+	}
+	for param, column := range paramColumns {
+		if _, exists := columnIndexes[column]; !exists {
+			return fmt.Errorf("column '%s' for param '%s' is not in the input", column, param)
+		}
+	}
+
+	// Skip the rows that were enriched by a previous run of the same input
+	input, err := getCheckpointInput(*inputPath, serviceNames)
+	if err != nil {
+		return err
+	}
+	enriched, resuming, err := readCheckpoint(*checkpointPath, input)
+	if err != nil {
+		return err
+	}
+	checkpoint, err := os.OpenFile(*checkpointPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening checkpoint file: %v", err)
+	}
+	defer checkpoint.Close()
+	if !resuming {
+		line, _ := json.Marshal(input)
+		if _, err := checkpoint.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("error writing checkpoint file: %v", err)
+		}
+	}
+
+	// Stop when interrupted, keeping the checkpoint of the rows that completed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Space the requests evenly to stay under the rate limit
+	var throttle <-chan time.Time
+	if *rateLimit > 0 {
+		ticker := time.NewTicker(time.Minute / time.Duration(*rateLimit))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var checkpointErr error
+	rowErrors := make(map[int]string)
+	slots := make(chan struct{}, *concurrency)
+	resumed := len(enriched)
+	for rowIndex, row := range rows {
+		if _, done := enriched[rowIndex]; done {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		mu.Lock()
+		failed := checkpointErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(rowIndex int, row []string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			params := make(map[string]interface{}, len(paramColumns))
+			for param, column := range paramColumns {
+				params[param] = getCellValue(row[columnIndexes[column]])
+			}
+
+			// Run the row through each service, stopping at the first one that fails
+			results := make(map[string]string, len(serviceNames))
+			for _, serviceName := range serviceNames {
+				if throttle != nil {
+					select {
+					case <-throttle:
+					case <-ctx.Done():
+					}
+				}
+				result, err := intel.GetIntelligence(ctx, serviceName, params)
+				if err != nil {
+					mu.Lock()
+					rowErrors[rowIndex] = fmt.Sprintf("%s: %v", serviceName, err)
+					mu.Unlock()
+					return
+				}
+				results[serviceName] = formatCellValue(result)
+			}
+
+			// Record the row in the checkpoint as soon as it completes
+			line, _ := json.Marshal(enrichedRow{Row: rowIndex, Results: results})
+			mu.Lock()
+			defer mu.Unlock()
+			enriched[rowIndex] = results
+			if _, err := checkpoint.Write(append(line, '\n')); err != nil && checkpointErr == nil {
+				checkpointErr = fmt.Errorf("error writing checkpoint file: %v", err)
+			}
+		}(rowIndex, row)
+	}
+	wg.Wait()
+
+	// Stop rather than lose the progress of a run that can't be resumed
+	if checkpointErr != nil {
+		return checkpointErr
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted after enriching %d of %d rows, run the same command again to continue", len(enriched), len(rows))
+	}
+
+	// Write the rows in their original order with a column for each service and the error of rows that failed
+	if err := writeEnrichedCSV(*outputPath, header, rows, serviceNames, enriched, rowErrors); err != nil {
+		return err
+	}
+	log.Printf("Enriched %d of %d rows (%d from the checkpoint, %d failed)", len(enriched), len(rows), resumed, len(rowErrors))
+
+	// Keep the checkpoint when rows failed so running again only retries them
+	if len(rowErrors) == 0 {
+		checkpoint.Close()
+		os.Remove(*checkpointPath)
+	}
+	return nil
+}
+
+// Parses a mapping like "text=review,labels=tags" into the column each param is read from
+func getParamColumns(mapping string) (map[string]string, error) {
+	paramColumns := make(map[string]string)
+	for _, pair := range strings.Split(mapping, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid mapping '%s', expected param=column", pair)
+		}
+		paramColumns[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return paramColumns, nil
+}
+
+// Returns the trimmed names of a comma separated list of services, skipping empty names
+func getServiceNames(services string) []string {
+	var serviceNames []string
+	for _, serviceName := range strings.Split(services, ",") {
+		if serviceName = strings.TrimSpace(serviceName); serviceName != "" {
+			serviceNames = append(serviceNames, serviceName)
+		}
+	}
+	return serviceNames
+}
+
+// Reads the header and rows of a Parquet file when it has a .parquet extension and of a CSV file otherwise
+func readInput(path string) ([]string, [][]string, error) {
+	if strings.EqualFold(filepath.Ext(path), ".parquet") {
+		return readParquet(path)
+	}
+	return readCSV(path)
+}
+
+// Reads the header and rows of a CSV file
+func readCSV(path string) ([]string, [][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening input file: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading input header: %v", err)
+	}
+
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading input: %v", err)
+		}
+
+		// Pad short rows so every column can be read
+		for len(row) < len(header) {
+			row = append(row, "")
+		}
+		rows = append(rows, row)
+	}
+	return header, rows, nil
+}
+
+// Returns the input a checkpoint is written for, identified by its absolute path, size and modification time
+func getCheckpointInput(path string, serviceNames []string) (checkpointInput, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return checkpointInput{}, fmt.Errorf("error opening input file: %v", err)
+	}
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return checkpointInput{}, fmt.Errorf("error opening input file: %v", err)
+	}
+	return checkpointInput{Path: absolutePath, Size: info.Size(), Modified: info.ModTime().UTC(), Services: serviceNames}, nil
+}
+
+// Reads the rows that were enriched by a previous run, or none if there is no checkpoint. Returns whether there is
+// a checkpoint to resume from, and an error if the checkpoint was written for a different input or services.
+func readCheckpoint(path string, input checkpointInput) (map[int]map[string]string, bool, error) {
+	enriched := make(map[int]map[string]string)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return enriched, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error opening checkpoint file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	if !scanner.Scan() {
+		// The checkpoint was created but nothing was written to it
+		return enriched, false, scanner.Err()
+	}
+	var checkpointed checkpointInput
+	if err := json.Unmarshal(scanner.Bytes(), &checkpointed); err != nil || checkpointed.Path == "" {
+		return nil, false, fmt.Errorf("checkpoint file %s doesn't record its input, remove it to start over", path)
+	}
+	if checkpointed.Path != input.Path || checkpointed.Size != input.Size || !checkpointed.Modified.Equal(input.Modified) {
+		return nil, false, fmt.Errorf("checkpoint file %s was written for %s (%d bytes, modified %s), which doesn't match the input, remove it to start over", path, checkpointed.Path, checkpointed.Size, checkpointed.Modified.Format(time.RFC3339))
+	}
+	if strings.Join(checkpointed.Services, ",") != strings.Join(input.Services, ",") {
+		return nil, false, fmt.Errorf("checkpoint file %s was written for services %s, remove it to start over", path, strings.Join(checkpointed.Services, ","))
+	}
+
+	// Skip lines that can't be read, such as a line that was cut off when a run was interrupted
+	for scanner.Scan() {
+		var row enrichedRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err == nil {
+			enriched[row.Row] = row.Results
+		}
+	}
+	return enriched, true, scanner.Err()
+}
+
+// Writes the original rows followed by their results and errors
+func writeEnrichedCSV(path string, header []string, rows [][]string, serviceNames []string, enriched map[int]map[string]string, rowErrors map[int]string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating output file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write(append(append(append([]string{}, header...), serviceNames...), "error"))
+	for rowIndex, row := range rows {
+		record := append([]string{}, row...)
+		for _, serviceName := range serviceNames {
+			record = append(record, enriched[rowIndex][serviceName])
+		}
+		record = append(record, rowErrors[rowIndex])
+		writer.Write(record)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Returns the value of a cell as a param, parsing JSON arrays and objects so cells can hold lists like labels
+func getCellValue(cell string) interface{} {
+	trimmed := strings.TrimSpace(cell)
+	if strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{") {
+		var value interface{}
+		if err := json.Unmarshal([]byte(trimmed), &value); err == nil {
+			return value
+		}
+	}
+	return cell
+}
+
+// Formats a result as a cell, encoding anything other than a string as JSON
+func formatCellValue(result interface{}) string {
+	switch v := result.(type) {
+	case string:
+		return v
+	case *string:
+		if v != nil {
+			return *v
+		}
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Sprintf("%v", result)
+	}
+	return string(resultBytes)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Starts a provider that answers every completion with the same content and returns the number of requests it gets
+func newTestProvider(t *testing.T, content string) *atomic.Int32 {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{"message": map[string]interface{}{"content": content}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("OPENAI_BASE_URL", server.URL)
+	t.Setenv("OPENAI_API_KEY", "test")
+	return &requests
+}
+
+// Reads the rows of a CSV file including its header
+func readTestCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestGetServiceNames(t *testing.T) {
+	tests := []struct {
+		services string
+		names    []string
+	}{
+		{services: "sentiment", names: []string{"sentiment"}},
+		{services: "sentiment, summary", names: []string{"sentiment", "summary"}},
+		{services: " sentiment ,,summary, ", names: []string{"sentiment", "summary"}},
+		{services: " , ", names: nil},
+	}
+
+	for _, test := range tests {
+		if names := getServiceNames(test.services); !reflect.DeepEqual(names, test.names) {
+			t.Errorf("got %q for %q, want %q", names, test.services, test.names)
+		}
+	}
+}
+
+func TestRunEnrich(t *testing.T) {
+	requests := newTestProvider(t, "positive")
+	directory := t.TempDir()
+	inputPath := filepath.Join(directory, "reviews.csv")
+	outputPath := filepath.Join(directory, "enriched.csv")
+	os.WriteFile(inputPath, []byte("id,review\n1,great\n2,love it\n"), 0644)
+
+	err := runEnrich([]string{"-input", inputPath, "-output", outputPath, "-services", " sentiment ", "-map", "text=review", "-config", "intelligence.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"id", "review", "sentiment", "error"}, {"1", "great", "positive", ""}, {"2", "love it", "positive", ""}}
+	if rows := readTestCSV(t, outputPath); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("got output %q, want %q", rows, expected)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("got %d provider requests, want 2", requests.Load())
+	}
+	if _, err := os.Stat(outputPath + ".checkpoint"); !os.IsNotExist(err) {
+		t.Errorf("checkpoint was kept after every row succeeded")
+	}
+}
+
+func TestRunEnrichParquet(t *testing.T) {
+	newTestProvider(t, "positive")
+	inputPath := writeTestParquet(t, []testParquetColumn{
+		{name: "id", kind: parquetInt64, values: []interface{}{int64(1), int64(2)}},
+		{name: "review", kind: parquetByteArray, codec: parquetSnappy, values: []interface{}{"great", "love it"}},
+	}, 2)
+	outputPath := filepath.Join(t.TempDir(), "enriched.csv")
+
+	err := runEnrich([]string{"-input", inputPath, "-output", outputPath, "-services", "sentiment", "-map", "text=review", "-config", "intelligence.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"id", "review", "sentiment", "error"}, {"1", "great", "positive", ""}, {"2", "love it", "positive", ""}}
+	if rows := readTestCSV(t, outputPath); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("got output %q, want %q", rows, expected)
+	}
+}
+
+func TestRunEnrichCheckpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		// Changes the input or arguments after the checkpoint is written
+		change   func(inputPath string, args []string) []string
+		error    string
+		requests int32
+	}{
+		{
+			name:     "resumes the same input",
+			change:   func(inputPath string, args []string) []string { return args },
+			requests: 1,
+		},
+		{
+			name: "refuses a changed input",
+			change: func(inputPath string, args []string) []string {
+				os.WriteFile(inputPath, []byte("id,review\n1,great\n2,love it\n3,new row\n"), 0644)
+				return args
+			},
+			error: "doesn't match the input",
+		},
+		{
+			name: "refuses a touched input",
+			change: func(inputPath string, args []string) []string {
+				modified := time.Now().Add(time.Hour)
+				os.Chtimes(inputPath, modified, modified)
+				return args
+			},
+			error: "doesn't match the input",
+		},
+		{
+			name: "refuses different services",
+			change: func(inputPath string, args []string) []string {
+				return append(args, "-services", "sentiment,summary")
+			},
+			error: "was written for services sentiment",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := newTestProvider(t, "positive")
+			directory := t.TempDir()
+			inputPath := filepath.Join(directory, "reviews.csv")
+			outputPath := filepath.Join(directory, "enriched.csv")
+			checkpointPath := outputPath + ".checkpoint"
+			os.WriteFile(inputPath, []byte("id,review\n1,great\n2,love it\n"), 0644)
+
+			// Write the checkpoint of a run that was interrupted after the first row
+			input, err := getCheckpointInput(inputPath, []string{"sentiment"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, _ := json.Marshal(input)
+			row, _ := json.Marshal(enrichedRow{Row: 0, Results: map[string]string{"sentiment": "checkpointed"}})
+			os.WriteFile(checkpointPath, []byte(string(header)+"\n"+string(row)+"\n"), 0644)
+
+			args := []string{"-input", inputPath, "-output", outputPath, "-services", "sentiment", "-map", "text=review", "-config", "intelligence.json"}
+			err = runEnrich(test.change(inputPath, args))
+			if test.error != "" {
+				if err == nil || !strings.Contains(err.Error(), test.error) {
+					t.Fatalf("got error %v, want it to contain %q", err, test.error)
+				}
+				if _, err := os.Stat(checkpointPath); err != nil {
+					t.Errorf("checkpoint was removed: %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if rows := readTestCSV(t, outputPath); rows[1][2] != "checkpointed" || rows[2][2] != "positive" {
+				t.Errorf("got output %q, want the first row from the checkpoint", rows)
+			}
+			if requests.Load() != test.requests {
+				t.Errorf("got %d provider requests, want %d", requests.Load(), test.requests)
+			}
+		})
+	}
+}
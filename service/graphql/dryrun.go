@@ -0,0 +1,94 @@
+package graphql
+
+import (
+	"context"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+
+	"intelligence/intelligence"
+)
+
+// Defines the context key for the dry runs of the fields of a GraphQL request
+type fieldDryRunsContextKey struct{}
+
+// Defines the dry runs of the fields of a GraphQL request by response path, and the errors of the fields that
+// failed to render
+type fieldDryRuns struct {
+	values map[string]*intelligence.DryRun
+	errors []gqlerrors.FormattedError
+	mu     sync.Mutex
+}
+
+// Returns a context where each field that calls an intelligence service returns a dry run instead of calling it
+func withFieldDryRuns(ctx context.Context) (context.Context, *fieldDryRuns) {
+	dryRuns := &fieldDryRuns{values: make(map[string]*intelligence.DryRun)}
+	return context.WithValue(ctx, fieldDryRunsContextKey{}, dryRuns), dryRuns
+}
+
+// Returns the collector of the dry runs of the fields, or nil if the request isn't a dry run
+func getFieldDryRuns(ctx context.Context) *fieldDryRuns {
+	dryRuns, _ := ctx.Value(fieldDryRunsContextKey{}).(*fieldDryRuns)
+	return dryRuns
+}
+
+// Sets the dry run of a field
+func (f *fieldDryRuns) set(path string, dryRun *intelligence.DryRun) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[path] = dryRun
+}
+
+// Adds the error of a field that failed to render, located at the field
+func (f *fieldDryRuns) fail(p graphql.ResolveParams, err *intelligenceError) {
+	nodes := make([]ast.Node, len(p.Info.FieldASTs))
+	for index, field := range p.Info.FieldASTs {
+		nodes[index] = field
+	}
+	formattedErr := gqlerrors.FormatError(gqlerrors.NewLocatedError(err, nodes))
+	formattedErr.Path = p.Info.Path.AsArray()
+	formattedErr.Extensions = err.Extensions()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors = append(f.errors, formattedErr)
+}
+
+// Returns a placeholder of a type for the result of a dry run, so fields that can't be null don't end the execution
+// of the other fields
+func getZeroValue(outputType graphql.Output) interface{} {
+	switch t := outputType.(type) {
+	case *graphql.NonNull:
+		return getZeroValue(t.OfType)
+	case *graphql.List:
+		return []interface{}{}
+	case *graphql.Scalar:
+		switch t.Name() {
+		case "String", "ID":
+			return ""
+		case "Int":
+			return 0
+		case "Float":
+			return 0.0
+		case "Boolean":
+			return false
+		}
+		return map[string]interface{}{}
+	case *graphql.Enum:
+		if values := t.Values(); len(values) > 0 {
+			return values[0].Value
+		}
+	case *graphql.Object:
+		// Only fields that can't be null need a value, which also ends types that refer to themselves
+		object := make(map[string]interface{})
+		for name, field := range t.Fields() {
+			if _, ok := field.Type.(*graphql.NonNull); ok {
+				object[name] = getZeroValue(field.Type)
+			}
+		}
+		return object
+	}
+	return nil
+}
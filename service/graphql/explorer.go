@@ -0,0 +1,127 @@
+package graphql
+
+import (
+	_ "embed"
+	"html/template"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Defines the query used to introspect the schema for the explorer
+const introspectionQuery = `
+query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types { ...FullType }
+    directives {
+      name
+      description
+      locations
+      args { ...InputValue }
+    }
+  }
+}
+
+fragment FullType on __Type {
+  kind
+  name
+  description
+  fields(includeDeprecated: true) {
+    name
+    description
+    args { ...InputValue }
+    type { ...TypeRef }
+    isDeprecated
+    deprecationReason
+  }
+  inputFields { ...InputValue }
+  interfaces { ...TypeRef }
+  enumValues(includeDeprecated: true) {
+    name
+    description
+    isDeprecated
+    deprecationReason
+  }
+  possibleTypes { ...TypeRef }
+}
+
+fragment InputValue on __InputValue {
+  name
+  description
+  type { ...TypeRef }
+  defaultValue
+}
+
+fragment TypeRef on __Type {
+  kind
+  name
+  ofType {
+    kind
+    name
+    ofType {
+      kind
+      name
+      ofType {
+        kind
+        name
+        ofType {
+          kind
+          name
+          ofType {
+            kind
+            name
+            ofType {
+              kind
+              name
+              ofType {
+                kind
+                name
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+}
+`
+
+// Defines the explorer page, which is given the introspected schema so it does not need to fetch it. The page is
+// embedded with everything it needs so the explorer doesn't load scripts from other origins.
+//
+//go:embed explorer.html
+var explorerHTML string
+
+var explorerTemplate = template.Must(template.New("explorer").Parse(explorerHTML))
+
+// Defines the content security policy of the explorer page, which only allows its own inline scripts and styles and
+// requests to this origin
+const explorerContentSecurityPolicy = "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'"
+
+// Sets whether introspection queries and the explorer are enabled
+func (h *GraphQLHandler) SetIntrospection(enabled bool) {
+	h.introspection = enabled
+}
+
+// Determines whether the client accepts an HTML response
+func acceptsHTML(request *http.Request) bool {
+	for _, mediaRange := range strings.Split(request.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err == nil && mediaType == "text/html" {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the explorer page
+func (h *GraphQLHandler) serveExplorer(response http.ResponseWriter) {
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	response.Header().Set("Content-Security-Policy", explorerContentSecurityPolicy)
+	if err := explorerTemplate.Execute(response, h.introspectionResult); err != nil {
+		http.Error(response, "could not render explorer", http.StatusInternalServerError)
+	}
+}
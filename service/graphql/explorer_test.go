@@ -0,0 +1,49 @@
+package graphql
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeExplorer(t *testing.T) {
+	tests := []struct {
+		name          string
+		introspection bool
+		accept        string
+		explorer      bool
+	}{
+		{"browser", true, "text/html,application/xhtml+xml;q=0.9", true},
+		{"introspection disabled", false, "text/html", false},
+		{"not a browser", true, "application/json", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newTestHandler(t, nil)
+			handler.SetIntrospection(test.introspection)
+			request := httptest.NewRequest(http.MethodGet, "/graphql", nil)
+			request.Header.Set("Accept", test.accept)
+			recorder := httptest.NewRecorder()
+			handler.Handler().ServeHTTP(recorder, request)
+
+			isExplorer := strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/html")
+			if isExplorer != test.explorer {
+				t.Fatalf("got explorer %v, want %v", isExplorer, test.explorer)
+			}
+			if !test.explorer {
+				return
+			}
+			body := recorder.Body.String()
+			if strings.Contains(body, "src=") || strings.Contains(body, "href=\"http") {
+				t.Error("explorer loads assets from another origin")
+			}
+			if !strings.Contains(body, `"queryType"`) {
+				t.Error("explorer is not pre-loaded with the schema")
+			}
+			if recorder.Header().Get("Content-Security-Policy") != explorerContentSecurityPolicy {
+				t.Errorf("got content security policy %q", recorder.Header().Get("Content-Security-Policy"))
+			}
+		})
+	}
+}
@@ -1,13 +1,16 @@
 package graphql
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sync"
 
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
 	"github.com/graphql-go/graphql/language/ast"
 	"github.com/graphql-go/graphql/language/parser"
 	"github.com/graphql-go/graphql/language/source"
@@ -18,13 +21,24 @@ import (
 type GraphQLHandler struct {
 	schema              *graphql.Schema
 	intelligenceService *intelligence.Intelligence
+	fieldCosts          map[string]map[string]int
+	limits              Limits
+	persistedQueries    *PersistedQueryStore
+	allowListOnly       bool
+	introspection       bool
+	introspectionResult interface{}
 }
 
 // Initializes a new GraphQL handler by loading the schema and setting up the intelligence service
 func NewGraphQLHandler(schemaFilePath string, intelligenceService *intelligence.Intelligence) (*GraphQLHandler, error) {
 	handler := &GraphQLHandler{
 		intelligenceService: intelligenceService,
+		fieldCosts:          make(map[string]map[string]int),
+		limits:              DefaultLimits,
+		introspection:       true,
 	}
+	// Keep automatically persisted queries in memory unless a store is set
+	handler.persistedQueries, _ = NewPersistedQueryStore("")
 	// Load and parse the GraphQL schema from the provided file path
 	if err := handler.loadSchema(schemaFilePath); err != nil {
 		return nil, fmt.Errorf("error loading schema: %v", err)
@@ -50,23 +64,35 @@ func (h *GraphQLHandler) loadSchema(filePath string) error {
 	if err != nil {
 		log.Fatalf("error creating schema: %v", err)
 	}
+
+	// Introspect the schema once so the explorer can be pre-loaded with it
+	introspectionResult := graphql.Do(graphql.Params{
+		Schema:        *h.schema,
+		RequestString: introspectionQuery,
+	})
+	if len(introspectionResult.Errors) > 0 {
+		return fmt.Errorf("error introspecting schema: %v", introspectionResult.Errors[0].Message)
+	}
+	h.introspectionResult = introspectionResult.Data
 	return nil
 }
 
 // Creates a GraphQL schema from the parsed AST document
 func (h *GraphQLHandler) createSchemaFromAST(document *ast.Document) (*graphql.Schema, error) {
 	typeDefs := make(map[string]*ast.ObjectDefinition)
-	var queryTypeName string
+	var queryTypeName, mutationTypeName string
 
-	// Gather type definitions and identify the query type
+	// Gather type definitions and identify the query and mutation types
 	for _, definition := range document.Definitions {
 		if typeDef, ok := definition.(*ast.ObjectDefinition); ok {
 			typeDefs[typeDef.Name.Value] = typeDef
 		} else if schemaDef, ok := definition.(*ast.SchemaDefinition); ok {
 			for _, opType := range schemaDef.OperationTypes {
-				if opType.Operation == "query" {
+				switch opType.Operation {
+				case "query":
 					queryTypeName = opType.Type.Name.Value
-					break
+				case "mutation":
+					mutationTypeName = opType.Type.Name.Value
 				}
 			}
 		}
@@ -102,9 +128,23 @@ func (h *GraphQLHandler) createSchemaFromAST(document *ast.Document) (*graphql.S
 	for typeName, typeDef := range typeDefs {
 		if customObjectType, exists := customObjectTypes[typeName]; exists {
 			var resolver graphql.FieldResolveFn
+			var operation string
 			if typeName == queryTypeName {
 				// Set resolver for the query type
 				resolver = h.intelligenceResolver
+				operation = "query"
+			} else if typeName == mutationTypeName {
+				// Set resolver for the mutation type
+				resolver = h.intelligenceMutationResolver
+				operation = "mutation"
+			}
+			if operation != "" {
+				// Record the cost of each root field for query analysis
+				costs, err := getFieldCosts(typeDef)
+				if err != nil {
+					return nil, err
+				}
+				h.fieldCosts[operation] = costs
 			}
 			fields := h.createFieldsFromObjectDefinition(typeDef, customObjectTypes, customInputObjectTypes, resolver)
 			for fieldName, field := range fields {
@@ -129,8 +169,15 @@ func (h *GraphQLHandler) createSchemaFromAST(document *ast.Document) (*graphql.S
 		return nil, fmt.Errorf("no query found in the schema")
 	}
 
-	// Construct and return the final schema
+	// Construct and return the final schema, including the mutation type if one is defined
 	schemaConfig := graphql.SchemaConfig{Query: query}
+	if mutationTypeName != "" {
+		mutation, exists := customObjectTypes[mutationTypeName]
+		if !exists {
+			return nil, fmt.Errorf("no mutation type '%s' found in the schema", mutationTypeName)
+		}
+		schemaConfig.Mutation = mutation
+	}
 	schema, err := graphql.NewSchema(schemaConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create schema: %w", err)
@@ -226,18 +273,8 @@ func (h *GraphQLHandler) intelligenceResolver(p graphql.ResolveParams) (interfac
 
 	// Execute the resolver logic asynchronously
 	go func() {
-		params := make(map[string]interface{})
-		for argName, argValue := range p.Args {
-			paramName := camelToUnderscore(argName)
-			params[paramName] = camelToUnderscoreRecursive(argValue)
-		}
-		serviceName := camelToUnderscore(p.Info.FieldName)
-		if intelligence, err := h.intelligenceService.GetIntelligence(ctx, serviceName, params); err == nil {
-			transformedResult := underscoreToCamelCaseRecursive(intelligence)
-			ch <- &result{data: transformedResult, err: err}
-		} else {
-			ch <- &result{data: nil, err: err}
-		}
+		data, err := h.getIntelligence(ctx, p)
+		ch <- &result{data: data, err: err}
 	}()
 
 	// Return a thunk that waits for the result, allowing parallel execution
@@ -247,6 +284,91 @@ func (h *GraphQLHandler) intelligenceResolver(p graphql.ResolveParams) (interfac
 	}, nil
 }
 
+// Resolves mutations related to intelligence services synchronously so they run serially per the GraphQL spec
+func (h *GraphQLHandler) intelligenceMutationResolver(p graphql.ResolveParams) (interface{}, error) {
+	return h.getIntelligence(p.Context, p)
+}
+
+// Calls the intelligence service named by the field, converting the arguments and result between camelCase and underscore_case
+func (h *GraphQLHandler) getIntelligence(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+	params := make(map[string]interface{})
+	for argName, argValue := range p.Args {
+		paramName := camelToUnderscore(argName)
+		params[paramName] = camelToUnderscoreRecursive(argValue)
+	}
+	serviceName := camelToUnderscore(p.Info.FieldName)
+	if err := intelligence.Authorize(ctx, serviceName); err != nil {
+		return nil, &intelligenceError{err: intelligence.AsError(err)}
+	}
+
+	// Render the request of the field instead of calling the service when the request is a dry run, resolving to a
+	// placeholder and collecting any error so the other fields still run
+	if fieldDryRuns := getFieldDryRuns(ctx); fieldDryRuns != nil {
+		if dryRun, err := h.intelligenceService.DryRun(ctx, serviceName, params); err != nil {
+			fieldDryRuns.fail(p, &intelligenceError{err: intelligence.AsError(err)})
+		} else {
+			fieldDryRuns.set(getResponsePath(p.Info.Path), dryRun)
+		}
+		return getZeroValue(p.Info.ReturnType), nil
+	}
+
+	// Collect the metadata of the field by its response path when the request asked for it
+	if fieldMetadata := getFieldMetadata(ctx); fieldMetadata != nil {
+		var metadata *intelligence.Metadata
+		ctx, metadata = intelligence.WithMetadata(ctx)
+		defer metadata.Finish()
+		fieldMetadata.set(getResponsePath(p.Info.Path), metadata)
+	}
+
+	result, err := h.intelligenceService.GetIntelligence(ctx, serviceName, params)
+	if err != nil {
+		return nil, &intelligenceError{err: intelligence.AsError(err)}
+	}
+	return underscoreToCamelCaseRecursive(result), nil
+}
+
+// Returns the extensions of the first error in the chain of wrapped GraphQL errors that has them
+func getErrorExtensions(err error) map[string]interface{} {
+	for err != nil {
+		switch e := err.(type) {
+		case gqlerrors.ExtendedError:
+			return e.Extensions()
+		case gqlerrors.FormattedError:
+			if e.Extensions != nil {
+				return e.Extensions
+			}
+			err = e.OriginalError()
+		case *gqlerrors.Error:
+			err = e.OriginalError
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Defines an intelligence error that carries its code, service and retryability as GraphQL error extensions
+type intelligenceError struct {
+	err *intelligence.Error
+}
+
+// Returns the error message
+func (e *intelligenceError) Error() string {
+	return e.err.Message
+}
+
+// Returns the extensions for the GraphQL error
+func (e *intelligenceError) Extensions() map[string]interface{} {
+	extensions := map[string]interface{}{
+		"code":      e.err.Code,
+		"retryable": e.err.Retryable,
+	}
+	if e.err.Service != "" {
+		extensions["service"] = e.err.Service
+	}
+	return extensions
+}
+
 // Maps AST schema types to GraphQL types, handling non-nullable, named, and list types
 func (h *GraphQLHandler) mapSchemaTypeToGraphQLType(fieldType ast.Type, customObjectTypes map[string]*graphql.Object, customInputObjectTypes map[string]*graphql.InputObject) graphql.Type {
 	switch fieldType := fieldType.(type) {
@@ -267,6 +389,8 @@ func (h *GraphQLHandler) mapSchemaTypeToGraphQLType(fieldType ast.Type, customOb
 			return graphql.ID
 		case "JSON":
 			return jsonScalar
+		case "Upload":
+			return uploadScalar
 		default:
 			// Resolve custom object types
 			if objDef, ok := customObjectTypes[fieldType.Name.Value]; ok {
@@ -358,43 +482,221 @@ func parseValueFromAST(valueAST ast.Value) interface{} {
 	}
 }
 
-// Handles executing GraphQL queries
+// Handles executing GraphQL queries following the GraphQL-over-HTTP specification
 func (h *GraphQLHandler) Handler() http.Handler {
 	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
-		var params struct {
-			Query         string                 `json:"query"`
-			OperationName string                 `json:"operationName"`
-			Variables     map[string]interface{} `json:"variables"`
+		// Serve the explorer to browsers that are not sending a query
+		if h.introspection && request.Method == http.MethodGet && request.URL.Query().Get("query") == "" && acceptsHTML(request) {
+			h.serveExplorer(response)
+			return
 		}
 
-		// Parse the request body into a GraphQL query
-		if err := json.NewDecoder(request.Body).Decode(&params); err != nil {
-			http.Error(response, fmt.Sprintf(`{"error":"could not decode request body: %v"}`, err), http.StatusBadRequest)
+		// Negotiate the media type of the response
+		contentType, ok := getResponseContentType(request)
+		if !ok {
+			http.Error(response, "Not Acceptable", http.StatusNotAcceptable)
 			return
 		}
 
-		// Execute the GraphQL query against the schema
-		result := graphql.Do(graphql.Params{
-			Schema:         *h.schema,
-			RequestString:  params.Query,
-			OperationName:  params.OperationName,
-			VariableValues: params.Variables,
-			Context:        request.Context(),
-		})
+		// Read the GraphQL requests from the query string or body based on the method
+		var params []graphQLRequest
+		var batch bool
+		var err error
+		switch request.Method {
+		case http.MethodGet:
+			params, err = getRequestsFromQuery(request)
+		case http.MethodPost:
+			request.Body = http.MaxBytesReader(response, request.Body, maxRequestSize)
+			params, batch, err = getRequestsFromBody(request)
+		default:
+			response.Header().Set("Allow", "GET, POST")
+			writeErrors(response, contentType, http.StatusMethodNotAllowed, gqlerrors.NewFormattedError("method not allowed"))
+			return
+		}
+		if err != nil {
+			statusCode := http.StatusBadRequest
+			var maxBytesError *http.MaxBytesError
+			if errors.Is(err, errUnsupportedMediaType) {
+				statusCode = http.StatusUnsupportedMediaType
+			} else if errors.As(err, &maxBytesError) {
+				statusCode = http.StatusRequestEntityTooLarge
+			}
+			writeErrors(response, contentType, statusCode, gqlerrors.NewFormattedError(err.Error()))
+			return
+		}
 
-		// Return errors if any occurred during query execution
-		if len(result.Errors) > 0 {
-			response.WriteHeader(http.StatusBadRequest)
+		// Limit the number of operations in a batch
+		if batch && h.limits.MaxBatch > 0 && len(params) > h.limits.MaxBatch {
+			limitErr := newLimitError("batch_limit_exceeded", "batch size", len(params), h.limits.MaxBatch)
+			writeErrors(response, contentType, http.StatusBadRequest, *limitErr)
+			return
 		}
 
-		// Write the GraphQL result as JSON
-		response.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(response).Encode(result); err != nil {
-			http.Error(response, fmt.Sprintf(`{"error":"could not encode response: %v"}`, err), http.StatusInternalServerError)
+		// Limit the operations of a batch together before any of them are executed
+		if batch {
+			if limitErr := h.checkLimits(h.analyzeBatch(params), "batch"); limitErr != nil {
+				writeErrors(response, contentType, http.StatusBadRequest, *limitErr)
+				return
+			}
 		}
+
+		// Authenticate the request so each field can check that its service is allowed
+		ctx, err := h.intelligenceService.Authenticate(request)
+		if err != nil {
+			authErr := gqlerrors.NewFormattedError(err.Error())
+			authErr.Extensions = (&intelligenceError{err: intelligence.AsError(err)}).Extensions()
+			response.Header().Set("WWW-Authenticate", `Bearer realm="intelligence"`)
+			writeErrors(response, contentType, http.StatusUnauthorized, authErr)
+			return
+		}
+
+		// Execute the operations concurrently, taking turns with other requests for the intelligence service
+		ctx = intelligence.WithNewCaller(ctx)
+		results := make([]interface{}, len(params))
+		statusCodes := make([]int, len(params))
+		var wg sync.WaitGroup
+		for i := range params {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], statusCodes[i] = h.execute(ctx, request.Method, params[i], contentType)
+			}(i)
+		}
+		wg.Wait()
+
+		// Write a batch as an array of results, where each result carries its own errors
+		if batch {
+			writeResponse(response, contentType, http.StatusOK, results)
+			return
+		}
+
+		if statusCodes[0] == http.StatusMethodNotAllowed {
+			response.Header().Set("Allow", "POST")
+		}
+		writeResponse(response, contentType, statusCodes[0], results[0])
 	})
 }
 
+// Executes a single GraphQL request and returns the response with the HTTP status code for it
+func (h *GraphQLHandler) execute(ctx context.Context, method string, params graphQLRequest, contentType string) (interface{}, int) {
+	// Errors in the document are only reported with a 4xx status for the GraphQL response media type
+	documentErrors := func(errs ...gqlerrors.FormattedError) (interface{}, int) {
+		statusCode := http.StatusOK
+		if contentType == graphQLResponseContentType {
+			statusCode = http.StatusBadRequest
+		}
+		return &errorsResponse{Errors: errs}, statusCode
+	}
+
+	// Resolve persisted queries sent by hash and enforce the allow-list
+	query, persistedErr := h.resolvePersistedQuery(params.Query, params.Extensions)
+	if persistedErr != nil {
+		return documentErrors(*persistedErr)
+	}
+	if query == "" {
+		return &errorsResponse{Errors: []gqlerrors.FormattedError{gqlerrors.NewFormattedError("must provide a query")}}, http.StatusBadRequest
+	}
+
+	// Parse the query into a document
+	document, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{
+		Body: []byte(query),
+		Name: "GraphQL request",
+	})})
+	if err != nil {
+		return documentErrors(gqlerrors.FormatErrors(err)...)
+	}
+
+	// Only allow queries over GET since it must not cause side effects
+	operation := getOperation(document, params.OperationName)
+	if method == http.MethodGet && operation != nil && operation.Operation != ast.OperationTypeQuery {
+		return &errorsResponse{Errors: []gqlerrors.FormattedError{
+			gqlerrors.NewFormattedError(fmt.Sprintf("%s operations must use POST", operation.Operation)),
+		}}, http.StatusMethodNotAllowed
+	}
+
+	// Reject introspection when it is disabled and queries that exceed the limits before any service is called
+	analysis := h.analyzeOperation(operation, document)
+	if analysis.introspection && !h.introspection {
+		introspectionErr := gqlerrors.NewFormattedError("introspection is disabled")
+		introspectionErr.Extensions = map[string]interface{}{"code": "introspection_disabled"}
+		return documentErrors(introspectionErr)
+	}
+	if limitErr := h.checkLimits(analysis, "query"); limitErr != nil {
+		return documentErrors(*limitErr)
+	}
+
+	// Validate the document against the schema
+	if validationResult := graphql.ValidateDocument(h.schema, document, nil); !validationResult.IsValid {
+		return documentErrors(validationResult.Errors...)
+	}
+
+	// Collect the metadata of each field when the request asks for it in its extensions
+	var metadata *fieldMetadata
+	if includeMetadata, ok := params.Extensions["includeMetadata"].(bool); ok && includeMetadata {
+		ctx, metadata = withFieldMetadata(ctx)
+	}
+
+	// Return what each field would send instead of sending it when the request asks for a dry run in its extensions
+	var dryRuns *fieldDryRuns
+	if dryRun, ok := params.Extensions["dryRun"].(bool); ok && dryRun {
+		ctx, dryRuns = withFieldDryRuns(ctx)
+	}
+
+	// Execute the GraphQL query against the schema, where any errors are part of a successful response
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        *h.schema,
+		AST:           document,
+		OperationName: params.OperationName,
+		Args:          params.Variables,
+		Context:       ctx,
+	})
+
+	if metadata != nil {
+		if result.Extensions == nil {
+			result.Extensions = make(map[string]interface{})
+		}
+		result.Extensions["metadata"] = metadata.values
+	}
+
+	// Restore extensions that are dropped when the executor wraps errors returned by thunks
+	for i := range result.Errors {
+		if result.Errors[i].Extensions == nil {
+			result.Errors[i].Extensions = getErrorExtensions(result.Errors[i].OriginalError())
+		}
+	}
+
+	// A dry run has no data, only the dry runs of the fields and the errors of those that failed to render
+	if dryRuns != nil {
+		if result.Extensions == nil {
+			result.Extensions = make(map[string]interface{})
+		}
+		result.Extensions["dryRun"] = dryRuns.values
+		result.Data = nil
+		result.Errors = append(result.Errors, dryRuns.errors...)
+	}
+
+	return result, http.StatusOK
+}
+
+// Returns the operation to execute from the document, or nil if it cannot be determined
+func getOperation(document *ast.Document, operationName string) *ast.OperationDefinition {
+	var operation *ast.OperationDefinition
+	for _, definition := range document.Definitions {
+		if definition, ok := definition.(*ast.OperationDefinition); ok {
+			if operationName == "" {
+				// An operation name is required when the document has more than one operation
+				if operation != nil {
+					return nil
+				}
+				operation = definition
+			} else if definition.Name != nil && definition.Name.Value == operationName {
+				return definition
+			}
+		}
+	}
+	return operation
+}
+
 // Converts a camelCase string or map to an underscore_case representation recursively
 func camelToUnderscoreRecursive(input interface{}) interface{} {
 	switch v := input.(type) {
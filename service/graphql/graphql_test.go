@@ -0,0 +1,102 @@
+package graphql
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"intelligence/intelligence"
+)
+
+// Returns a handler for the shipped schema and config whose provider requests go to a handler, or fail the test
+// when there is none
+func newTestHandler(t *testing.T, provider http.HandlerFunc) *GraphQLHandler {
+	t.Helper()
+	if provider == nil {
+		provider = func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("unexpected provider request to %s", r.URL)
+			http.Error(w, "unexpected request", http.StatusInternalServerError)
+		}
+	}
+	server := httptest.NewServer(provider)
+	t.Cleanup(server.Close)
+	t.Setenv("OPENAI_BASE_URL", server.URL)
+	t.Setenv("OPENAI_API_KEY", "test")
+
+	intelligenceService, err := intelligence.NewIntelligence("../intelligence.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewGraphQLHandler("../intelligence.graphql", intelligenceService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+// Sends a JSON body to the handler and returns the response
+func postGraphQL(handler *GraphQLHandler, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler.Handler().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestMutations(t *testing.T) {
+	// The provider records the prompts in the order they arrive and how many requests it had at once
+	var mu sync.Mutex
+	var prompts []string
+	inFlight, maxInFlight := 0, 0
+	handler := newTestHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Prompt string `json:"prompt"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		prompts = append(prompts, body.Prompt)
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":[{"b64_json":"aW1hZ2U="}]}`))
+	})
+	handler.SetLimits(Limits{MaxCost: 100})
+
+	// Each mutation costs 50, so two fit in the limit and run one after the other in the order they are written
+	recorder := postGraphQL(handler, `{"query": "mutation { a: generatedImage(prompt: \"a\") { base64 } b: generatedImage(prompt: \"b\") { base64 } }"}`)
+	var response struct {
+		Data   map[string]map[string]string `json:"data"`
+		Errors []interface{}                `json:"errors"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusOK || len(response.Errors) > 0 || response.Data["a"]["base64"] != "aW1hZ2U=" || response.Data["b"]["base64"] != "aW1hZ2U=" {
+		t.Fatalf("got status %d and %s, want both images", recorder.Code, recorder.Body)
+	}
+	if maxInFlight != 1 || strings.Join(prompts, ",") != "a,b" {
+		t.Errorf("got prompts %v with at most %d at once, want a then b one at a time", prompts, maxInFlight)
+	}
+
+	// A third mutation goes over the cost limit, so none of them are sent
+	prompts = nil
+	recorder = postGraphQL(handler, `{"query": "mutation { a: generatedImage(prompt: \"a\") { base64 } b: generatedImage(prompt: \"b\") { base64 } c: generatedImage(prompt: \"c\") { base64 } }"}`)
+	var rejected errorsResponse
+	json.Unmarshal(recorder.Body.Bytes(), &rejected)
+	if len(rejected.Errors) != 1 || rejected.Errors[0].Extensions["code"] != "cost_limit_exceeded" || rejected.Errors[0].Extensions["value"] != float64(150) {
+		t.Errorf("got %s, want cost_limit_exceeded at a cost of 150", recorder.Body)
+	}
+	if len(prompts) > 0 {
+		t.Errorf("got prompts %v sent, want none", prompts)
+	}
+}
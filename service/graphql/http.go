@@ -0,0 +1,137 @@
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// Defines the media types of GraphQL responses
+const (
+	graphQLResponseContentType = "application/graphql-response+json"
+	jsonContentType            = "application/json"
+)
+
+// Indicates that the request body is not in a supported media type
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// Defines the largest request body that is read
+const maxRequestSize = 50 << 20
+
+// Defines a GraphQL request as sent in a POST body or GET query string
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	Extensions    map[string]interface{} `json:"extensions"`
+}
+
+// Defines a response to a request that failed before execution, which has no data entry
+type errorsResponse struct {
+	Errors []gqlerrors.FormattedError `json:"errors"`
+}
+
+// Returns the response media type accepted by the client, preferring the GraphQL response media type
+func getResponseContentType(request *http.Request) (string, bool) {
+	accept := request.Header.Get("Accept")
+	if accept == "" {
+		return jsonContentType, true
+	}
+
+	acceptsJSON := false
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case graphQLResponseContentType:
+			return graphQLResponseContentType, true
+		case jsonContentType, "application/*", "*/*":
+			acceptsJSON = true
+		}
+	}
+
+	if acceptsJSON {
+		return jsonContentType, true
+	}
+	return "", false
+}
+
+// Reads a GraphQL request from the query string parameters of a GET request
+func getRequestsFromQuery(request *http.Request) ([]graphQLRequest, error) {
+	query := request.URL.Query()
+	params := graphQLRequest{
+		Query:         query.Get("query"),
+		OperationName: query.Get("operationName"),
+	}
+
+	// Decode the JSON encoded parameters
+	if variables := query.Get("variables"); variables != "" {
+		if err := json.Unmarshal([]byte(variables), &params.Variables); err != nil {
+			return nil, fmt.Errorf("could not decode variables: %v", err)
+		}
+	}
+	if extensions := query.Get("extensions"); extensions != "" {
+		if err := json.Unmarshal([]byte(extensions), &params.Extensions); err != nil {
+			return nil, fmt.Errorf("could not decode extensions: %v", err)
+		}
+	}
+
+	return []graphQLRequest{params}, nil
+}
+
+// Reads a single GraphQL request or a batch of requests from the JSON or multipart body of a POST request
+func getRequestsFromBody(request *http.Request) ([]graphQLRequest, bool, error) {
+	if contentType := request.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil && mediaType == "multipart/form-data" {
+			return getRequestsFromMultipart(request)
+		}
+		if err != nil || mediaType != jsonContentType {
+			return nil, false, errUnsupportedMediaType
+		}
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not read request body: %w", err)
+	}
+
+	// A body that is a JSON array is a batch of requests
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var params []graphQLRequest
+		if err := json.Unmarshal(trimmed, &params); err != nil {
+			return nil, false, fmt.Errorf("could not decode request body: %v", err)
+		}
+		if len(params) == 0 {
+			return nil, false, fmt.Errorf("batch must contain at least one request")
+		}
+		return params, true, nil
+	}
+
+	var params graphQLRequest
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nil, false, fmt.Errorf("could not decode request body: %v", err)
+	}
+	return []graphQLRequest{params}, false, nil
+}
+
+// Writes a GraphQL response, setting the content type before the status code
+func writeResponse(response http.ResponseWriter, contentType string, statusCode int, value interface{}) {
+	response.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	response.WriteHeader(statusCode)
+	json.NewEncoder(response).Encode(value)
+}
+
+// Writes a GraphQL response that only contains errors
+func writeErrors(response http.ResponseWriter, contentType string, statusCode int, errs ...gqlerrors.FormattedError) {
+	writeResponse(response, contentType, statusCode, &errorsResponse{Errors: errs})
+}
@@ -0,0 +1,223 @@
+package graphql
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Sends a request to the handler with a content type and accepted media types, leaving out the headers that are
+// empty, and returns the response
+func sendGraphQL(handler *GraphQLHandler, method string, target string, contentType string, accept string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	recorder := httptest.NewRecorder()
+	handler.Handler().ServeHTTP(recorder, request)
+	return recorder
+}
+
+// Returns the path of a GET request with query string parameters
+func getGraphQLPath(params map[string]string) string {
+	query := url.Values{}
+	for name, value := range params {
+		query.Set(name, value)
+	}
+	return "/graphql?" + query.Encode()
+}
+
+func TestRequestSize(t *testing.T) {
+	handler := newTestHandler(t, nil)
+	recorder := postGraphQL(handler, `{"query": "{ __typename }", "variables": {"text": "`+strings.Repeat("a", maxRequestSize)+`"}}`)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d: %s", recorder.Code, http.StatusRequestEntityTooLarge, recorder.Body)
+	}
+}
+
+func TestGetRequests(t *testing.T) {
+	const operations = `query Name { __typename } mutation Image { generatedImage(prompt: "a") { base64 } }`
+	tests := []struct {
+		name       string
+		params     map[string]string
+		statusCode int
+		allow      string
+	}{
+		{name: "query", params: map[string]string{"query": "{ __typename }"}, statusCode: http.StatusOK},
+		{
+			name:       "variables",
+			params:     map[string]string{"query": "query ($skip: Boolean!) { __typename @skip(if: $skip) }", "variables": `{"skip": false}`},
+			statusCode: http.StatusOK,
+		},
+		{name: "query operation", params: map[string]string{"query": operations, "operationName": "Name"}, statusCode: http.StatusOK},
+		{name: "mutation", params: map[string]string{"query": `mutation { generatedImage(prompt: "a") { base64 } }`}, statusCode: http.StatusMethodNotAllowed, allow: "POST"},
+		{name: "mutation operation", params: map[string]string{"query": operations, "operationName": "Image"}, statusCode: http.StatusMethodNotAllowed, allow: "POST"},
+		{name: "invalid variables", params: map[string]string{"query": "{ __typename }", "variables": "{"}, statusCode: http.StatusBadRequest},
+		{name: "invalid extensions", params: map[string]string{"query": "{ __typename }", "extensions": "[1"}, statusCode: http.StatusBadRequest},
+		{name: "no query", params: map[string]string{"operationName": "Name"}, statusCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Mutations over GET must be rejected before the provider is called
+			handler := newTestHandler(t, nil)
+			recorder := sendGraphQL(handler, http.MethodGet, getGraphQLPath(test.params), "", "", "")
+			if recorder.Code != test.statusCode {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, test.statusCode, recorder.Body)
+			}
+			if allow := recorder.Header().Get("Allow"); allow != test.allow {
+				t.Errorf("got Allow %q, want %q", allow, test.allow)
+			}
+			if test.statusCode == http.StatusOK && !strings.Contains(recorder.Body.String(), `"__typename":"Query"`) {
+				t.Errorf("got %s, want the query's data", recorder.Body)
+			}
+		})
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		contentType  string
+		accept       string
+		statusCode   int
+		responseType string
+	}{
+		{name: "no accept", method: http.MethodPost, contentType: "application/json", statusCode: http.StatusOK, responseType: jsonContentType},
+		{name: "json", method: http.MethodPost, contentType: "application/json", accept: "application/json", statusCode: http.StatusOK, responseType: jsonContentType},
+		{name: "graphql response", method: http.MethodPost, contentType: "application/json", accept: graphQLResponseContentType, statusCode: http.StatusOK, responseType: graphQLResponseContentType},
+		{
+			name:         "graphql response preferred",
+			method:       http.MethodPost,
+			contentType:  "application/json",
+			accept:       "application/json;q=0.9, application/graphql-response+json",
+			statusCode:   http.StatusOK,
+			responseType: graphQLResponseContentType,
+		},
+		{name: "any type", method: http.MethodPost, contentType: "application/json", accept: "*/*", statusCode: http.StatusOK, responseType: jsonContentType},
+		{name: "any application type", method: http.MethodGet, accept: "application/*", statusCode: http.StatusOK, responseType: jsonContentType},
+		{name: "json with charset", method: http.MethodPost, contentType: "application/json; charset=utf-8", statusCode: http.StatusOK, responseType: jsonContentType},
+		{name: "no content type", method: http.MethodPost, statusCode: http.StatusOK, responseType: jsonContentType},
+		{name: "not acceptable", method: http.MethodPost, contentType: "application/json", accept: "text/plain", statusCode: http.StatusNotAcceptable},
+		{name: "html with a query", method: http.MethodGet, accept: "text/html", statusCode: http.StatusNotAcceptable},
+		{name: "unsupported content type", method: http.MethodPost, contentType: "text/plain", statusCode: http.StatusUnsupportedMediaType, responseType: jsonContentType},
+		{name: "invalid content type", method: http.MethodPost, contentType: "application/", statusCode: http.StatusUnsupportedMediaType, responseType: jsonContentType},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newTestHandler(t, nil)
+			target, body := "/graphql", `{"query": "{ __typename }"}`
+			if test.method == http.MethodGet {
+				target, body = getGraphQLPath(map[string]string{"query": "{ __typename }"}), ""
+			}
+			recorder := sendGraphQL(handler, test.method, target, test.contentType, test.accept, body)
+			if recorder.Code != test.statusCode {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, test.statusCode, recorder.Body)
+			}
+			if test.responseType != "" {
+				if contentType := recorder.Header().Get("Content-Type"); contentType != test.responseType+"; charset=utf-8" {
+					t.Errorf("got content type %q, want %s", contentType, test.responseType)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	operation := `{"query": "{ __typename }"}`
+	tests := []struct {
+		name       string
+		operations int
+		statusCode int
+	}{
+		{name: "single operation", operations: 1, statusCode: http.StatusOK},
+		{name: "at the limit", operations: 3, statusCode: http.StatusOK},
+		{name: "over the limit", operations: 4, statusCode: http.StatusBadRequest},
+		{name: "empty batch", operations: 0, statusCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newTestHandler(t, nil)
+			handler.SetLimits(Limits{MaxBatch: 3})
+			operations := make([]string, test.operations)
+			for i := range operations {
+				operations[i] = operation
+			}
+			recorder := postGraphQL(handler, "["+strings.Join(operations, ",")+"]")
+			if recorder.Code != test.statusCode {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, test.statusCode, recorder.Body)
+			}
+			if test.statusCode != http.StatusOK {
+				return
+			}
+
+			// A batch responds with a result for each operation
+			var results []map[string]interface{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != test.operations {
+				t.Errorf("got %d results, want %d", len(results), test.operations)
+			}
+		})
+	}
+
+	handler := newTestHandler(t, nil)
+	handler.SetLimits(Limits{MaxBatch: 1})
+	var response errorsResponse
+	json.Unmarshal(postGraphQL(handler, "["+operation+","+operation+"]").Body.Bytes(), &response)
+	if len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != "batch_limit_exceeded" {
+		t.Errorf("got errors %+v, want batch_limit_exceeded", response.Errors)
+	}
+}
+
+func TestStatusCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		accept     string
+		body       string
+		statusCode int
+		allow      string
+	}{
+		{name: "valid query", method: http.MethodPost, accept: graphQLResponseContentType, body: `{"query": "{ __typename }"}`, statusCode: http.StatusOK},
+		{name: "parse error", method: http.MethodPost, accept: graphQLResponseContentType, body: `{"query": "{"}`, statusCode: http.StatusBadRequest},
+		{name: "parse error as json", method: http.MethodPost, accept: jsonContentType, body: `{"query": "{"}`, statusCode: http.StatusOK},
+		{name: "validation error", method: http.MethodPost, accept: graphQLResponseContentType, body: `{"query": "{ missing }"}`, statusCode: http.StatusBadRequest},
+		{name: "validation error as json", method: http.MethodPost, accept: jsonContentType, body: `{"query": "{ missing }"}`, statusCode: http.StatusOK},
+		{name: "missing query", method: http.MethodPost, accept: jsonContentType, body: `{}`, statusCode: http.StatusBadRequest},
+		{name: "invalid body", method: http.MethodPost, accept: jsonContentType, body: `{"query":`, statusCode: http.StatusBadRequest},
+		{name: "other method", method: http.MethodPut, accept: jsonContentType, body: `{"query": "{ __typename }"}`, statusCode: http.StatusMethodNotAllowed, allow: "GET, POST"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newTestHandler(t, nil)
+			recorder := sendGraphQL(handler, test.method, "/graphql", "application/json", test.accept, test.body)
+			if recorder.Code != test.statusCode {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, test.statusCode, recorder.Body)
+			}
+			if allow := recorder.Header().Get("Allow"); allow != test.allow {
+				t.Errorf("got Allow %q, want %q", allow, test.allow)
+			}
+
+			// Every response is a GraphQL response, where only those with errors before execution have no data
+			var response map[string]interface{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("got %s, want a GraphQL response: %v", recorder.Body, err)
+			}
+			if _, hasData := response["data"]; hasData != (test.name == "valid query") {
+				t.Errorf("got %s, want data only for the valid query", recorder.Body)
+			}
+		})
+	}
+}
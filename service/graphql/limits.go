@@ -0,0 +1,232 @@
+package graphql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// Defines the per-request limits checked before a GraphQL query is executed
+type Limits struct {
+	MaxCost    int
+	MaxAliases int
+	MaxDepth   int
+	MaxBatch   int
+}
+
+// Defines the limits used when none are configured
+var DefaultLimits = Limits{
+	MaxCost:    100,
+	MaxAliases: 50,
+	MaxDepth:   10,
+	MaxBatch:   10,
+}
+
+// Defines the cost of a root field that has no @cost directive
+const defaultFieldCost = 1
+
+// Defines the largest cost or alias count a query is measured at, which keeps fragments that spread other fragments
+// many times from overflowing the measurements
+const maxQueryMeasurement = math.MaxInt32
+
+// Sets the per-request limits, where a zero value disables that limit
+func (h *GraphQLHandler) SetLimits(limits Limits) {
+	h.limits = limits
+}
+
+// Reads the @cost directive values of the fields of a root operation type
+func getFieldCosts(typeDef *ast.ObjectDefinition) (map[string]int, error) {
+	costs := make(map[string]int)
+	for _, field := range typeDef.Fields {
+		for _, directive := range field.Directives {
+			if directive.Name.Value != "cost" {
+				continue
+			}
+			for _, arg := range directive.Arguments {
+				if arg.Name.Value != "value" {
+					continue
+				}
+				intValue, ok := arg.Value.(*ast.IntValue)
+				if !ok {
+					return nil, fmt.Errorf("cost of field '%s' must be an integer", field.Name.Value)
+				}
+				cost, err := strconv.Atoi(intValue.Value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid cost for field '%s': %v", field.Name.Value, err)
+				}
+				costs[field.Name.Value] = cost
+			}
+		}
+	}
+	return costs, nil
+}
+
+// Defines the measurements of a query used to enforce the limits
+type queryAnalysis struct {
+	cost          int
+	aliases       int
+	depth         int
+	introspection bool
+}
+
+// Adds the measurements of a selection set nested a number of levels deeper
+func (a *queryAnalysis) add(nested *queryAnalysis, levels int) {
+	a.cost = min(a.cost+nested.cost, maxQueryMeasurement)
+	a.aliases = min(a.aliases+nested.aliases, maxQueryMeasurement)
+	a.depth = max(a.depth, nested.depth+levels)
+	a.introspection = a.introspection || nested.introspection
+}
+
+// Defines a walk of the selection sets of an operation, which remembers the measurements of each fragment so a
+// fragment that is spread many times is only walked once
+type queryAnalyzer struct {
+	fragments map[string]*ast.FragmentDefinition
+	measured  map[fragmentMeasurement]*queryAnalysis
+	visiting  map[string]bool
+}
+
+// Defines a fragment by its name and whether it is spread among the root fields, where its fields have a cost
+type fragmentMeasurement struct {
+	name string
+	root bool
+}
+
+// Measures the cost, alias count and depth of an operation and whether it uses introspection
+func (h *GraphQLHandler) analyzeOperation(operation *ast.OperationDefinition, document *ast.Document) *queryAnalysis {
+	analysis := &queryAnalysis{}
+	if operation == nil {
+		// Leave ambiguous or missing operations to be reported by the executor
+		return analysis
+	}
+
+	// Gather the fragments the operation may spread
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, definition := range document.Definitions {
+		if fragment, ok := definition.(*ast.FragmentDefinition); ok {
+			fragments[fragment.Name.Value] = fragment
+		}
+	}
+
+	// Measure the operation starting from its root fields
+	analyzer := &queryAnalyzer{
+		fragments: fragments,
+		measured:  make(map[fragmentMeasurement]*queryAnalysis),
+		visiting:  make(map[string]bool),
+	}
+	return analyzer.measure(operation.SelectionSet, h.fieldCosts[operation.Operation])
+}
+
+// Measures the operations of a batch together, adding up their cost and alias count and taking the deepest depth, so
+// a batch can't run more than one query's worth of work. Operations that can't be parsed are skipped since they fail
+// when they are executed.
+func (h *GraphQLHandler) analyzeBatch(params []graphQLRequest) *queryAnalysis {
+	total := &queryAnalysis{}
+	for _, param := range params {
+		// Look up queries sent by hash without registering them, which happens when they are executed
+		query := param.Query
+		if persistedQuery, ok := param.Extensions["persistedQuery"].(map[string]interface{}); ok && query == "" {
+			hash, _ := persistedQuery["sha256Hash"].(string)
+			query, _ = h.persistedQueries.Get(hash)
+		}
+		document, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{
+			Body: []byte(query),
+			Name: "GraphQL request",
+		})})
+		if err != nil {
+			continue
+		}
+
+		analysis := h.analyzeOperation(getOperation(document, param.OperationName), document)
+		total.add(analysis, 0)
+	}
+	return total
+}
+
+// Returns an error if the analyzed operation, or batch of operations, exceeds any of the limits
+func (h *GraphQLHandler) checkLimits(analysis *queryAnalysis, measured string) *gqlerrors.FormattedError {
+	switch {
+	case h.limits.MaxDepth > 0 && analysis.depth > h.limits.MaxDepth:
+		return newLimitError("depth_limit_exceeded", measured+" depth", analysis.depth, h.limits.MaxDepth)
+	case h.limits.MaxAliases > 0 && analysis.aliases > h.limits.MaxAliases:
+		return newLimitError("alias_limit_exceeded", measured+" alias count", analysis.aliases, h.limits.MaxAliases)
+	case h.limits.MaxCost > 0 && analysis.cost > h.limits.MaxCost:
+		return newLimitError("cost_limit_exceeded", measured+" cost", analysis.cost, h.limits.MaxCost)
+	}
+	return nil
+}
+
+// Measures a selection set, adding the cost of root fields and tracking the alias count and the depth below it
+func (z *queryAnalyzer) measure(selectionSet *ast.SelectionSet, costs map[string]int) *queryAnalysis {
+	analysis := &queryAnalysis{}
+	if selectionSet == nil {
+		return analysis
+	}
+
+	for _, selection := range selectionSet.Selections {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			// Introspection fields are not charged so schema explorers keep working
+			if strings.HasPrefix(selection.Name.Value, "__") {
+				if selection.Name.Value == "__schema" || selection.Name.Value == "__type" {
+					analysis.introspection = true
+				}
+				continue
+			}
+			field := &queryAnalysis{}
+			if selection.Alias != nil && selection.Alias.Value != selection.Name.Value {
+				field.aliases++
+			}
+			if costs != nil {
+				if cost, exists := costs[selection.Name.Value]; exists {
+					field.cost += cost
+				} else {
+					field.cost += defaultFieldCost
+				}
+			}
+			// Only root fields call services, so nested fields add depth but not cost
+			field.add(z.measure(selection.SelectionSet, nil), 0)
+			analysis.add(field, 1)
+		case *ast.InlineFragment:
+			analysis.add(z.measure(selection.SelectionSet, costs), 0)
+		case *ast.FragmentSpread:
+			analysis.add(z.measureFragment(selection.Name.Value, costs), 0)
+		}
+	}
+	return analysis
+}
+
+// Measures the selection set of a fragment the first time it is spread and returns the same measurements after that
+func (z *queryAnalyzer) measureFragment(name string, costs map[string]int) *queryAnalysis {
+	key := fragmentMeasurement{name: name, root: costs != nil}
+	if analysis, exists := z.measured[key]; exists {
+		return analysis
+	}
+
+	// Guard against fragment cycles, which are rejected later by validation
+	fragment, exists := z.fragments[name]
+	if !exists || z.visiting[name] {
+		return &queryAnalysis{}
+	}
+	z.visiting[name] = true
+	analysis := z.measure(fragment.SelectionSet, costs)
+	delete(z.visiting, name)
+	z.measured[key] = analysis
+	return analysis
+}
+
+// Creates a structured error describing which limit was exceeded
+func newLimitError(code string, measure string, value int, limit int) *gqlerrors.FormattedError {
+	err := gqlerrors.NewFormattedError(fmt.Sprintf("%s of %d exceeds the maximum of %d", measure, value, limit))
+	err.Extensions = map[string]interface{}{
+		"code":  code,
+		"value": value,
+		"limit": limit,
+	}
+	return &err
+}
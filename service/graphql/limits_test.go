@@ -0,0 +1,96 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeBatch(t *testing.T) {
+	handler := newTestHandler(t, nil)
+	tests := []struct {
+		name    string
+		queries []string
+		cost    int
+		aliases int
+		depth   int
+	}{
+		{"single", []string{`{ sentiment(text: "a") }`}, 1, 0, 1},
+		{"costs add up", []string{`{ generatedImage(prompt: "a") { base64 } }`, `{ generatedImage(prompt: "b") { base64 } }`}, 100, 0, 2},
+		{"aliases add up", []string{`{ a: sentiment(text: "a") b: sentiment(text: "b") }`, `{ c: sentiment(text: "c") }`}, 3, 3, 1},
+		{"deepest depth", []string{`{ sentiment(text: "a") }`, `{ generatedImage(prompt: "a") { base64 } }`}, 51, 0, 2},
+		{"unparsable skipped", []string{`{ sentiment(text: "a") }`, `{`}, 1, 0, 1},
+		{"fragments count each time they are spread", []string{`{ ...A ...B } fragment A on Query { sentiment(text: "a") } fragment B on Query { ...A b: sentiment(text: "b") }`}, 3, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := make([]graphQLRequest, len(test.queries))
+			for index, query := range test.queries {
+				params[index] = graphQLRequest{Query: query}
+			}
+			analysis := handler.analyzeBatch(params)
+			if analysis.cost != test.cost || analysis.aliases != test.aliases || analysis.depth != test.depth {
+				t.Errorf("got cost %d, aliases %d, depth %d, want %d, %d, %d", analysis.cost, analysis.aliases, analysis.depth, test.cost, test.aliases, test.depth)
+			}
+		})
+	}
+}
+
+func TestAnalyzeFragmentSpreads(t *testing.T) {
+	handler := newTestHandler(t, nil)
+	handler.SetLimits(Limits{MaxCost: 100})
+
+	// Each fragment spreads the next one twice, which would take 2^60 visits to walk
+	var query strings.Builder
+	query.WriteString(`{ ...F0 }`)
+	for index := 0; index < 60; index++ {
+		fmt.Fprintf(&query, ` fragment F%d on Query { ...F%d a%d: sentiment(text: "a") ...F%d }`, index, index+1, index, index+1)
+	}
+	query.WriteString(` fragment F60 on Query { sentiment(text: "a") }`)
+
+	start := time.Now()
+	analysis := handler.analyzeBatch([]graphQLRequest{{Query: query.String()}})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("got %v to analyze the query, want it to be quick", elapsed)
+	}
+	if analysis.cost != maxQueryMeasurement || analysis.aliases != maxQueryMeasurement || analysis.depth != 1 {
+		t.Errorf("got cost %d, aliases %d, depth %d, want the cost and aliases at their maximum", analysis.cost, analysis.aliases, analysis.depth)
+	}
+	if limitErr := handler.checkLimits(analysis, "query"); limitErr == nil || limitErr.Extensions["code"] != "cost_limit_exceeded" {
+		t.Errorf("got error %v, want cost_limit_exceeded", limitErr)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		code   string
+	}{
+		{"cost", Limits{MaxCost: 100}, "cost_limit_exceeded"},
+		{"aliases", Limits{MaxAliases: 2}, "alias_limit_exceeded"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Each operation is within the limits, but the batch is not, so the provider must not be called
+			handler := newTestHandler(t, nil)
+			handler.SetLimits(test.limits)
+			operation := `{"query": "{ image: generatedImage(prompt: \"a\") { base64 } }"}`
+			recorder := postGraphQL(handler, "["+strings.Repeat(operation+",", 2)+operation+"]")
+
+			if recorder.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusBadRequest, recorder.Body)
+			}
+			var response errorsResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != test.code {
+				t.Errorf("got errors %+v, want %s", response.Errors, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package graphql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+
+	"intelligence/intelligence"
+)
+
+// Defines the context key for the metadata of the fields of a GraphQL request
+type fieldMetadataContextKey struct{}
+
+// Defines the metadata of the fields of a GraphQL request by response path
+type fieldMetadata struct {
+	values map[string]*intelligence.Metadata
+	mu     sync.Mutex
+}
+
+// Returns a context that collects the metadata of each field that calls an intelligence service
+func withFieldMetadata(ctx context.Context) (context.Context, *fieldMetadata) {
+	metadata := &fieldMetadata{values: make(map[string]*intelligence.Metadata)}
+	return context.WithValue(ctx, fieldMetadataContextKey{}, metadata), metadata
+}
+
+// Returns the collector of the metadata of the fields, or nil if metadata isn't collected
+func getFieldMetadata(ctx context.Context) *fieldMetadata {
+	metadata, _ := ctx.Value(fieldMetadataContextKey{}).(*fieldMetadata)
+	return metadata
+}
+
+// Sets the metadata of a field
+func (f *fieldMetadata) set(path string, metadata *intelligence.Metadata) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[path] = metadata
+}
+
+// Returns the response path of a field joined by dots, such as "review.sentiment"
+func getResponsePath(path *graphql.ResponsePath) string {
+	keys := path.AsArray()
+	parts := make([]string, len(keys))
+	for index, key := range keys {
+		parts[index] = fmt.Sprintf("%v", key)
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,151 @@
+package graphql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// Defines the maximum number of queries that clients can register in memory
+const maxPersistedQueries = 10000
+
+// Stores persisted queries by their SHA-256 hash in memory, optionally backed by a directory of .graphql files
+type PersistedQueryStore struct {
+	dir     string
+	queries map[string]string
+	mu      sync.RWMutex
+}
+
+// Initializes a new persisted query store, loading any .graphql files from the directory if one is provided
+func NewPersistedQueryStore(dir string) (*PersistedQueryStore, error) {
+	store := &PersistedQueryStore{
+		dir:     dir,
+		queries: make(map[string]string),
+	}
+	if dir == "" {
+		return store, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating persisted query directory: %v", err)
+	}
+
+	// Load the queries keyed by the hash of their contents so files can be named freely
+	paths, err := filepath.Glob(filepath.Join(dir, "*.graphql"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		queryBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading persisted query '%s': %v", path, err)
+		}
+		query := string(queryBytes)
+		store.queries[hashQuery(query)] = query
+	}
+
+	return store, nil
+}
+
+// Returns the query for a hash
+func (s *PersistedQueryStore) Get(hash string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	query, exists := s.queries[strings.ToLower(hash)]
+	return query, exists
+}
+
+// Stores a query, writing it to disk when the store has a directory, and returns its hash
+func (s *PersistedQueryStore) Put(query string) (string, error) {
+	hash := hashQuery(query)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.queries[hash]; exists {
+		return hash, nil
+	}
+	if len(s.queries) >= maxPersistedQueries {
+		return hash, fmt.Errorf("persisted query store is full")
+	}
+
+	if s.dir != "" {
+		path := filepath.Join(s.dir, hash+".graphql")
+		if err := os.WriteFile(path, []byte(query), 0644); err != nil {
+			return hash, fmt.Errorf("error writing persisted query: %v", err)
+		}
+	}
+	s.queries[hash] = query
+
+	return hash, nil
+}
+
+// Returns the hex encoded SHA-256 hash of a query
+func hashQuery(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// Sets the persisted query store, and when allowListOnly is true only queries already in the store are executed
+func (h *GraphQLHandler) SetPersistedQueries(store *PersistedQueryStore, allowListOnly bool) {
+	h.persistedQueries = store
+	h.allowListOnly = allowListOnly
+}
+
+// Resolves the query text for a request using the automatic persisted query extension and the allow-list
+func (h *GraphQLHandler) resolvePersistedQuery(query string, extensions map[string]interface{}) (string, *gqlerrors.FormattedError) {
+	var hash string
+	if persistedQuery, ok := extensions["persistedQuery"].(map[string]interface{}); ok {
+		if version, ok := persistedQuery["version"].(float64); ok && version != 1 {
+			return "", newPersistedQueryError("PERSISTED_QUERY_VERSION_NOT_SUPPORTED", "PersistedQueryVersionNotSupported")
+		}
+		hash, _ = persistedQuery["sha256Hash"].(string)
+	}
+
+	// Look up the query by hash when the client only sends the hash
+	if query == "" {
+		if hash == "" {
+			return "", nil
+		}
+		storedQuery, exists := h.persistedQueries.Get(hash)
+		if !exists {
+			if h.allowListOnly {
+				return "", newPersistedQueryError("PERSISTED_QUERY_NOT_ALLOWED", "PersistedQueryNotAllowed")
+			}
+			return "", newPersistedQueryError("PERSISTED_QUERY_NOT_FOUND", "PersistedQueryNotFound")
+		}
+		return storedQuery, nil
+	}
+
+	// Ensure the query matches the hash it is registered under
+	queryHash := hashQuery(query)
+	if hash != "" && !strings.EqualFold(hash, queryHash) {
+		return "", newPersistedQueryError("PERSISTED_QUERY_HASH_MISMATCH", "provided sha256Hash does not match query")
+	}
+
+	// Only execute pre-registered queries in allow-list mode, otherwise register the query for later requests
+	if h.allowListOnly {
+		if _, exists := h.persistedQueries.Get(queryHash); !exists {
+			return "", newPersistedQueryError("PERSISTED_QUERY_NOT_ALLOWED", "PersistedQueryNotAllowed")
+		}
+	} else if hash != "" {
+		// Registration is best effort, so the query still runs if the store is full or cannot be written
+		h.persistedQueries.Put(query)
+	}
+
+	return query, nil
+}
+
+// Creates a structured persisted query error using the codes expected by APQ clients
+func newPersistedQueryError(code string, message string) *gqlerrors.FormattedError {
+	err := gqlerrors.NewFormattedError(message)
+	err.Extensions = map[string]interface{}{
+		"code": code,
+	}
+	return &err
+}
@@ -0,0 +1,158 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// Defines the query the persisted query tests run, which doesn't call a provider
+const testPersistedQuery = "{ __typename }"
+
+// Returns the body of a request with a query and the automatic persisted query extension for a hash
+func persistedQueryBody(query string, hash string) string {
+	return fmt.Sprintf(`{"query": %q, "extensions": {"persistedQuery": {"version": 1, "sha256Hash": %q}}}`, query, hash)
+}
+
+// Sends a persisted query request and returns the code of its error, or an empty string when the query ran
+func postPersistedQuery(t *testing.T, handler *GraphQLHandler, body string) string {
+	t.Helper()
+	recorder := postGraphQL(handler, body)
+	var response struct {
+		Data   map[string]interface{}     `json:"data"`
+		Errors []gqlerrors.FormattedError `json:"errors"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("got %s, want a GraphQL response: %v", recorder.Body, err)
+	}
+	if len(response.Errors) > 0 {
+		code, _ := response.Errors[0].Extensions["code"].(string)
+		return code
+	}
+	if recorder.Code != http.StatusOK || response.Data["__typename"] != "Query" {
+		t.Fatalf("got status %d and %s, want the query to run", recorder.Code, recorder.Body)
+	}
+	return ""
+}
+
+func TestAutomaticPersistedQueries(t *testing.T) {
+	handler := newTestHandler(t, nil)
+	hash := hashQuery(testPersistedQuery)
+
+	// A client sends the hash first, then the query with its hash when the hash is unknown, and then only the hash
+	steps := []struct {
+		name string
+		body string
+		code string
+	}{
+		{name: "unknown hash", body: persistedQueryBody("", hash), code: "PERSISTED_QUERY_NOT_FOUND"},
+		{name: "register the query", body: persistedQueryBody(testPersistedQuery, hash)},
+		{name: "known hash", body: persistedQueryBody("", hash)},
+		{name: "uppercase hash", body: persistedQueryBody("", strings.ToUpper(hash))},
+		{name: "hash mismatch", body: persistedQueryBody("{ __schema { queryType { name } } }", hash), code: "PERSISTED_QUERY_HASH_MISMATCH"},
+		{name: "unsupported version", body: `{"extensions": {"persistedQuery": {"version": 2, "sha256Hash": "` + hash + `"}}}`, code: "PERSISTED_QUERY_VERSION_NOT_SUPPORTED"},
+		{name: "query without a hash", body: `{"query": "{ __typename }"}`},
+	}
+	for _, step := range steps {
+		if code := postPersistedQuery(t, handler, step.body); code != step.code {
+			t.Errorf("%s: got code %q, want %q", step.name, code, step.code)
+		}
+	}
+
+	// A mismatched query isn't registered under the hash it was sent with
+	if query, _ := handler.persistedQueries.Get(hash); query != testPersistedQuery {
+		t.Errorf("got query %q for the hash, want %q", query, testPersistedQuery)
+	}
+}
+
+func TestPersistedQueryAllowList(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "typename.graphql"), []byte(testPersistedQuery), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPersistedQueryStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, nil)
+	handler.SetPersistedQueries(store, true)
+
+	otherQuery := "{ __schema { queryType { name } } }"
+	tests := []struct {
+		name string
+		body string
+		code string
+	}{
+		{name: "allowed hash", body: persistedQueryBody("", hashQuery(testPersistedQuery))},
+		{name: "allowed query", body: `{"query": "{ __typename }"}`},
+		{name: "allowed query with its hash", body: persistedQueryBody(testPersistedQuery, hashQuery(testPersistedQuery))},
+		{name: "other hash", body: persistedQueryBody("", hashQuery(otherQuery)), code: "PERSISTED_QUERY_NOT_ALLOWED"},
+		{name: "other query", body: fmt.Sprintf(`{"query": %q}`, otherQuery), code: "PERSISTED_QUERY_NOT_ALLOWED"},
+		{name: "other query with its hash", body: persistedQueryBody(otherQuery, hashQuery(otherQuery)), code: "PERSISTED_QUERY_NOT_ALLOWED"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := postPersistedQuery(t, handler, test.body); code != test.code {
+				t.Errorf("got code %q, want %q", code, test.code)
+			}
+		})
+	}
+
+	// Queries that aren't allowed are never registered
+	if _, exists := store.Get(hashQuery(otherQuery)); exists {
+		t.Error("got the rejected query registered")
+	}
+}
+
+func TestPersistedQueryStoreLimit(t *testing.T) {
+	store, _ := NewPersistedQueryStore("")
+	for query := 0; query < maxPersistedQueries; query++ {
+		if _, err := store.Put(fmt.Sprintf("{ q%d: __typename }", query)); err != nil {
+			t.Fatalf("got error %v for query %d, want it stored", err, query)
+		}
+	}
+	if _, err := store.Put(testPersistedQuery); err == nil {
+		t.Fatal("got no error for a query over the limit")
+	}
+	if _, err := store.Put("{ q0: __typename }"); err != nil {
+		t.Errorf("got error %v for a query already stored, want its hash", err)
+	}
+
+	// A full store doesn't stop the query from running, it just isn't registered
+	handler := newTestHandler(t, nil)
+	handler.SetPersistedQueries(store, false)
+	hash := hashQuery(testPersistedQuery)
+	if code := postPersistedQuery(t, handler, persistedQueryBody(testPersistedQuery, hash)); code != "" {
+		t.Errorf("got code %q, want the query to run", code)
+	}
+	if code := postPersistedQuery(t, handler, persistedQueryBody("", hash)); code != "PERSISTED_QUERY_NOT_FOUND" {
+		t.Errorf("got code %q, want PERSISTED_QUERY_NOT_FOUND", code)
+	}
+}
+
+func TestPersistedQueryStoreDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "queries")
+	store, err := NewPersistedQueryStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := store.Put(testPersistedQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Registered queries are loaded again from the directory
+	reloaded, err := NewPersistedQueryStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query, exists := reloaded.Get(hash); !exists || query != testPersistedQuery {
+		t.Errorf("got query %q, want %q", query, testPersistedQuery)
+	}
+}
@@ -0,0 +1,148 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+
+	"intelligence/intelligence"
+)
+
+// Defines a custom scalar for files uploaded with a GraphQL multipart request
+var uploadScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name: "Upload",
+	Serialize: func(value interface{}) interface{} {
+		return nil
+	},
+	ParseValue: func(value interface{}) interface{} {
+		// Only files mapped into the variables by a multipart request are uploads
+		if blob, ok := value.(intelligence.Blob); ok {
+			return blob
+		}
+		return nil
+	},
+	ParseLiteral: func(valueAST ast.Value) interface{} {
+		return nil
+	},
+})
+
+// Reads GraphQL requests from a multipart request, placing each uploaded file at the variable paths in the map
+func getRequestsFromMultipart(request *http.Request) ([]graphQLRequest, bool, error) {
+	if err := request.ParseMultipartForm(50 << 20); err != nil { // Limit size to 50MB
+		return nil, false, fmt.Errorf("failed to parse multipart form: %w", err)
+	}
+
+	// Decode the operations and the map of files to the paths that they are used at
+	operationsValues := request.MultipartForm.Value["operations"]
+	if len(operationsValues) == 0 {
+		return nil, false, fmt.Errorf("missing operations")
+	}
+	var operations interface{}
+	if err := json.Unmarshal([]byte(operationsValues[0]), &operations); err != nil {
+		return nil, false, fmt.Errorf("could not decode operations: %v", err)
+	}
+	var fileMap map[string][]string
+	if mapValues := request.MultipartForm.Value["map"]; len(mapValues) > 0 {
+		if err := json.Unmarshal([]byte(mapValues[0]), &fileMap); err != nil {
+			return nil, false, fmt.Errorf("could not decode map: %v", err)
+		}
+	}
+
+	// Read each file as a blob and set it at its paths
+	for partName, paths := range fileMap {
+		fileHeaders := request.MultipartForm.File[partName]
+		if len(fileHeaders) == 0 {
+			return nil, false, fmt.Errorf("missing file '%s'", partName)
+		}
+
+		file, err := fileHeaders[0].Open()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to open file '%s': %v", fileHeaders[0].Filename, err)
+		}
+		fileData, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read file '%s': %v", fileHeaders[0].Filename, err)
+		}
+
+		blob := intelligence.Blob{
+			ContentType: fileHeaders[0].Header.Get("Content-Type"),
+			Content:     fileData,
+		}
+		for _, path := range paths {
+			if err := setValueAtPath(operations, path, blob); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	// Convert the operations to requests, where an array of operations is a batch
+	switch operations := operations.(type) {
+	case map[string]interface{}:
+		return []graphQLRequest{graphQLRequestFromMap(operations)}, false, nil
+	case []interface{}:
+		if len(operations) == 0 {
+			return nil, false, fmt.Errorf("batch must contain at least one request")
+		}
+		params := make([]graphQLRequest, len(operations))
+		for i, operation := range operations {
+			operationMap, ok := operation.(map[string]interface{})
+			if !ok {
+				return nil, false, fmt.Errorf("invalid operation at index %d", i)
+			}
+			params[i] = graphQLRequestFromMap(operationMap)
+		}
+		return params, true, nil
+	default:
+		return nil, false, fmt.Errorf("invalid operations")
+	}
+}
+
+// Sets a value at a dot separated path of object keys and array indexes, such as "variables.files.0"
+func setValueAtPath(root interface{}, path string, value interface{}) error {
+	keys := strings.Split(path, ".")
+	current := root
+
+	// Traverse to the parent of the last key
+	for i, key := range keys {
+		last := i == len(keys)-1
+		switch container := current.(type) {
+		case map[string]interface{}:
+			if last {
+				container[key] = value
+				return nil
+			}
+			current = container[key]
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(container) {
+				return fmt.Errorf("invalid file path '%s'", path)
+			}
+			if last {
+				container[index] = value
+				return nil
+			}
+			current = container[index]
+		default:
+			return fmt.Errorf("invalid file path '%s'", path)
+		}
+	}
+
+	return fmt.Errorf("invalid file path '%s'", path)
+}
+
+// Creates a GraphQL request from a decoded JSON object
+func graphQLRequestFromMap(operation map[string]interface{}) graphQLRequest {
+	var params graphQLRequest
+	params.Query, _ = operation["query"].(string)
+	params.OperationName, _ = operation["operationName"].(string)
+	params.Variables, _ = operation["variables"].(map[string]interface{})
+	params.Extensions, _ = operation["extensions"].(map[string]interface{})
+	return params
+}
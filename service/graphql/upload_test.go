@@ -0,0 +1,111 @@
+package graphql
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// Defines a file part of a multipart request
+type testUpload struct {
+	name        string
+	contentType string
+	content     []byte
+}
+
+// Sends a GraphQL multipart request with operations, a map of files to paths and the files, leaving out the map when
+// it is empty, and returns the response
+func postMultipart(handler *GraphQLHandler, operations string, fileMap string, uploads ...testUpload) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("operations", operations)
+	if fileMap != "" {
+		writer.WriteField("map", fileMap)
+	}
+	for _, upload := range uploads {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="`+upload.name+`"; filename="`+upload.name+`.png"`)
+		header.Set("Content-Type", upload.contentType)
+		part, _ := writer.CreatePart(header)
+		part.Write(upload.content)
+	}
+	writer.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "/graphql", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	handler.Handler().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestUpload(t *testing.T) {
+	image := []byte("\x89PNG triangle")
+	var providerBody string
+	handler := newTestHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		providerBody = string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"content":"triangle"}}]}`))
+	})
+
+	operations := `{"query": "query ($image: Upload!) { classification(labels: [\"circle\", \"triangle\"], files: [{ upload: $image }]) }", "variables": {"image": null}}`
+	recorder := postMultipart(handler, operations, `{"0": ["variables.image"]}`, testUpload{name: "0", contentType: "image/png", content: image})
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"classification":"triangle"`) {
+		t.Fatalf("got status %d and %s, want the classification", recorder.Code, recorder.Body)
+	}
+
+	// The uploaded bytes are sent to the provider as the image of the request
+	if url := "data:image/png;base64," + base64.StdEncoding.EncodeToString(image); !strings.Contains(providerBody, url) {
+		t.Errorf("got provider request %s, want the image %s", providerBody, url)
+	}
+}
+
+func TestUploadErrors(t *testing.T) {
+	const operations = `{"query": "query ($files: [InputBlob!]) { classification(labels: [\"circle\"], files: $files) }", "variables": {"files": [{"upload": null}]}}`
+	file := testUpload{name: "0", contentType: "image/png", content: []byte("\x89PNG")}
+	tests := []struct {
+		name       string
+		operations string
+		fileMap    string
+		uploads    []testUpload
+		statusCode int
+		message    string
+	}{
+		{name: "path to a missing key", operations: operations, fileMap: `{"0": ["variables.missing.upload"]}`, uploads: []testUpload{file}, statusCode: http.StatusBadRequest, message: "invalid file path"},
+		{name: "index out of range", operations: operations, fileMap: `{"0": ["variables.files.1.upload"]}`, uploads: []testUpload{file}, statusCode: http.StatusBadRequest, message: "invalid file path"},
+		{name: "index that isn't a number", operations: operations, fileMap: `{"0": ["variables.files.first.upload"]}`, uploads: []testUpload{file}, statusCode: http.StatusBadRequest, message: "invalid file path"},
+		{name: "path through a value", operations: operations, fileMap: `{"0": ["query.0"]}`, uploads: []testUpload{file}, statusCode: http.StatusBadRequest, message: "invalid file path"},
+		{name: "missing file part", operations: operations, fileMap: `{"1": ["variables.files.0.upload"]}`, uploads: []testUpload{file}, statusCode: http.StatusBadRequest, message: "missing file '1'"},
+		{name: "invalid map", operations: operations, fileMap: `["variables.files.0.upload"]`, uploads: []testUpload{file}, statusCode: http.StatusBadRequest, message: "could not decode map"},
+		{name: "missing operations", fileMap: `{"0": ["variables.files.0.upload"]}`, uploads: []testUpload{file}, statusCode: http.StatusBadRequest, message: "could not decode operations"},
+		{name: "invalid operations", operations: `"query"`, statusCode: http.StatusBadRequest, message: "invalid operations"},
+		{name: "empty batch", operations: `[]`, statusCode: http.StatusBadRequest, message: "at least one request"},
+		{
+			name:       "oversized file",
+			operations: operations,
+			fileMap:    `{"0": ["variables.files.0.upload"]}`,
+			uploads:    []testUpload{{name: "0", contentType: "image/png", content: bytes.Repeat([]byte("a"), maxRequestSize)}},
+			statusCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Requests with invalid uploads are rejected before the provider is called
+			handler := newTestHandler(t, nil)
+			recorder := postMultipart(handler, test.operations, test.fileMap, test.uploads...)
+			if recorder.Code != test.statusCode {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, test.statusCode, recorder.Body)
+			}
+			if !strings.Contains(recorder.Body.String(), test.message) {
+				t.Errorf("got %s, want an error about %s", recorder.Body, test.message)
+			}
+		})
+	}
+}
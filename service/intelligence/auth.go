@@ -0,0 +1,179 @@
+package intelligence
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Defines an API key by the hash of the key, the services it can use, where "*" allows every service, its quota and
+// whether it can see the usage of every principal
+type APIKey struct {
+	Name     string   `json:"name"`
+	Hash     string   `json:"hash"`
+	Services []string `json:"services"`
+	Quota    *Quota   `json:"quota,omitempty"`
+	Admin    bool     `json:"admin,omitempty"`
+}
+
+// Defines who a request is made by, the services they can use, their quota, whether they can see the usage of every
+// principal, and the claims of their token when they were authenticated by one. The ID is the name with where it
+// comes from, key:<name> for API keys and jwt:<issuer>/<principal claim> for tokens, so an API key and a token with
+// the same name are different principals.
+type Principal struct {
+	ID       string                 `json:"id"`
+	Name     string                 `json:"name"`
+	Services []string               `json:"services"`
+	Quota    *Quota                 `json:"quota,omitempty"`
+	Admin    bool                   `json:"admin,omitempty"`
+	Claims   map[string]interface{} `json:"-"`
+}
+
+// Defines the prefix of API key hashes, which names the hash function
+const apiKeyHashPrefix = "sha256:"
+
+// Defines the context key for the principal a request is made by
+type principalContextKey struct{}
+
+// Loads API keys from a JSON file with a list of keys
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	keysBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading API keys file: %v", err)
+	}
+
+	var keys []APIKey
+	if err := json.Unmarshal(keysBytes, &keys); err != nil {
+		return nil, fmt.Errorf("error parsing API keys file: %v", err)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key.Hash, apiKeyHashPrefix) {
+			return nil, fmt.Errorf("API key '%s' has an invalid hash, expected a %s hash", key.Name, strings.TrimSuffix(apiKeyHashPrefix, ":"))
+		}
+	}
+	return keys, nil
+}
+
+// Returns the hash of an API key as it is stored in the API keys file
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return apiKeyHashPrefix + hex.EncodeToString(hash[:])
+}
+
+// Creates a random API key
+func NewAPIKey() (string, error) {
+	keyBytes := make([]byte, 32)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return "", err
+	}
+	return "sk-intel-" + hex.EncodeToString(keyBytes), nil
+}
+
+// Sets the API keys that requests must have, where no keys means requests don't need one
+func (i *Intelligence) SetAPIKeys(keys []APIKey) {
+	keysByHash := make(map[string]APIKey, len(keys))
+	for _, key := range keys {
+		keysByHash[strings.ToLower(key.Hash)] = key
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.apiKeys = keysByHash
+}
+
+// Authenticates a request by the API key in its X-API-Key header, or by its bearer token which can be an API key or a
+// JWT, and returns a context with the principal the request is made by
+func (i *Intelligence) Authenticate(r *http.Request) (context.Context, error) {
+	i.mu.RLock()
+	keys := i.apiKeys
+	jwt := i.jwt
+	i.mu.RUnlock()
+	if len(keys) == 0 && jwt == nil {
+		return r.Context(), nil
+	}
+
+	key := r.Header.Get("X-API-Key")
+	if authorization := r.Header.Get("Authorization"); key == "" && len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		token := strings.TrimSpace(authorization[len("Bearer "):])
+		if jwt != nil && isJWT(token) {
+			principal, err := jwt.validate(r.Context(), token)
+			if err != nil {
+				return nil, err
+			}
+			return WithPrincipal(r.Context(), principal), nil
+		}
+		key = token
+	}
+	if key == "" {
+		return nil, newError(ErrorCodeUnauthorized, "", "an API key or token is required")
+	}
+
+	apiKey, exists := keys[HashAPIKey(key)]
+	if !exists {
+		return nil, newError(ErrorCodeUnauthorized, "", "invalid API key")
+	}
+	return WithPrincipal(r.Context(), &Principal{ID: "key:" + apiKey.Name, Name: apiKey.Name, Services: apiKey.Services, Quota: apiKey.Quota, Admin: apiKey.Admin}), nil
+}
+
+// Returns a context for requests made by a principal
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// Returns the principal a request is made by, or nil when requests aren't authenticated
+func GetPrincipal(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return principal
+}
+
+// Checks that the principal of the context can use a service, where requests without a principal can use any service
+func Authorize(ctx context.Context, serviceName string) error {
+	principal := GetPrincipal(ctx)
+	if principal == nil || principal.allows(serviceName) {
+		return nil
+	}
+	return newError(ErrorCodeForbidden, serviceName, "'%s' is not allowed to use '%s' service", principal.Name, serviceName)
+}
+
+// Returns whether the principal can use a service
+func (p *Principal) allows(serviceName string) bool {
+	for _, allowed := range p.Services {
+		if allowed == "*" || allowed == serviceName {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the principal of the context can use the service of every request, and returns the errors of those
+// it can't use
+func authorizeRequests(ctx context.Context, requests Requests) Errors {
+	errors := make(Errors)
+	for key, request := range requests {
+		model, _ := request["model"].(string)
+		if model == "" {
+			continue
+		}
+		if err := Authorize(ctx, model); err != nil {
+			errors[key] = AsError(err)
+		}
+	}
+	return errors
+}
+
+// Writes the error of a request that failed authentication or authorization
+func writeAuthError(w http.ResponseWriter, errors Errors) {
+	statusCode := getErrorsStatusCode(len(errors), errors)
+	if statusCode == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="intelligence"`)
+	}
+	writeJSON(w, statusCode, map[string]interface{}{
+		"errors": errors,
+	})
+}
@@ -0,0 +1,156 @@
+package intelligence
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Defines the API keys of the tests, where bob can only use sentiment
+var testAPIKeys = []APIKey{
+	{Name: "alice", Hash: HashAPIKey("alice-key"), Services: []string{"*"}},
+	{Name: "bob", Hash: HashAPIKey("bob-key"), Services: []string{"sentiment"}},
+	{Name: "admin", Hash: HashAPIKey("admin-key"), Services: []string{"*"}, Admin: true},
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      []APIKey
+		header    http.Header
+		principal string
+		code      string
+	}{
+		{name: "no keys", header: http.Header{}},
+		{name: "X-API-Key header", keys: testAPIKeys, header: http.Header{"X-Api-Key": {"alice-key"}}, principal: "key:alice"},
+		{name: "bearer API key", keys: testAPIKeys, header: http.Header{"Authorization": {"Bearer bob-key"}}, principal: "key:bob"},
+		{name: "lowercase bearer", keys: testAPIKeys, header: http.Header{"Authorization": {"bearer bob-key"}}, principal: "key:bob"},
+		{name: "missing key", keys: testAPIKeys, header: http.Header{}, code: ErrorCodeUnauthorized},
+		{name: "invalid key", keys: testAPIKeys, header: http.Header{"X-Api-Key": {"mallory-key"}}, code: ErrorCodeUnauthorized},
+		{name: "basic authorization", keys: testAPIKeys, header: http.Header{"Authorization": {"Basic YWxpY2U6a2V5"}}, code: ErrorCodeUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := newTestIntelligence(t, nil)
+			i.SetAPIKeys(test.keys)
+			request := httptest.NewRequest(http.MethodPost, "/intelligence", nil)
+			request.Header = test.header
+
+			ctx, err := i.Authenticate(request)
+			if test.code != "" {
+				if AsError(err) == nil || AsError(err).Code != test.code {
+					t.Fatalf("got error %v, want %s", err, test.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			principal := GetPrincipal(ctx)
+			if (principal == nil && test.principal != "") || (principal != nil && principal.ID != test.principal) {
+				t.Errorf("got principal %+v, want %q", principal, test.principal)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *Principal
+		service   string
+		allowed   bool
+	}{
+		{name: "no principal", service: "summary", allowed: true},
+		{name: "every service", principal: &Principal{Name: "alice", Services: []string{"*"}}, service: "summary", allowed: true},
+		{name: "allowed service", principal: &Principal{Name: "bob", Services: []string{"sentiment"}}, service: "sentiment", allowed: true},
+		{name: "other service", principal: &Principal{Name: "bob", Services: []string{"sentiment"}}, service: "summary"},
+		{name: "no services", principal: &Principal{Name: "carol"}, service: "sentiment"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.principal != nil {
+				ctx = WithPrincipal(ctx, test.principal)
+			}
+			err := Authorize(ctx, test.service)
+			if test.allowed != (err == nil) {
+				t.Fatalf("got error %v, want allowed %v", err, test.allowed)
+			}
+			if err != nil && AsError(err).Code != ErrorCodeForbidden {
+				t.Errorf("got %s error, want %s", AsError(err).Code, ErrorCodeForbidden)
+			}
+		})
+	}
+}
+
+func TestJobsHandlerOwnership(t *testing.T) {
+	i := newTestIntelligence(t, func(r *http.Request) (*http.Response, error) {
+		return stubResponse(`{"choices":[{"message":{"content":"positive"}}]}`), nil
+	})
+	i.SetAPIKeys(testAPIKeys)
+	store, _ := NewJobStore("")
+	i.StartJobs(store, 1, 10)
+	handler := i.JobsHandler()
+
+	// Sends a jobs request with an API key and returns the response
+	send := func(method string, path string, key string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("X-API-Key", key)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	submitted := send(http.MethodPost, "/intelligence/jobs", "alice-key", `{"positive": {"model": "sentiment", "text": "I love it"}}`)
+	if submitted.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d: %s", submitted.Code, http.StatusAccepted, submitted.Body)
+	}
+	var job Job
+	json.Unmarshal(submitted.Body.Bytes(), &job)
+	waitForJob(t, store, job.ID, func(job Job) bool { return job.isFinished() })
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		status int
+	}{
+		{name: "owner gets the job", method: http.MethodGet, path: "/intelligence/jobs/" + job.ID, key: "alice-key", status: http.StatusOK},
+		{name: "admin gets the job", method: http.MethodGet, path: "/intelligence/jobs/" + job.ID, key: "admin-key", status: http.StatusOK},
+		{name: "other principal can't get the job", method: http.MethodGet, path: "/intelligence/jobs/" + job.ID, key: "bob-key", status: http.StatusNotFound},
+		{name: "other principal can't cancel the job", method: http.MethodPost, path: "/intelligence/jobs/" + job.ID + "/cancel", key: "bob-key", status: http.StatusNotFound},
+		{name: "owner cancels the job", method: http.MethodPost, path: "/intelligence/jobs/" + job.ID + "/cancel", key: "alice-key", status: http.StatusOK},
+		{name: "admin cancels the job", method: http.MethodPost, path: "/intelligence/jobs/" + job.ID + "/cancel", key: "admin-key", status: http.StatusOK},
+		{name: "missing job", method: http.MethodGet, path: "/intelligence/jobs/missing", key: "admin-key", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := send(test.method, test.path, test.key, "")
+			if recorder.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+
+			// A job of another principal looks the same as a job that doesn't exist
+			if test.status == http.StatusNotFound {
+				var response struct {
+					Errors Errors `json:"errors"`
+				}
+				json.Unmarshal(recorder.Body.Bytes(), &response)
+				if response.Errors["request"] == nil || response.Errors["request"].Code != ErrorCodeNotFound {
+					t.Errorf("got errors %v, want %s", response.Errors, ErrorCodeNotFound)
+				}
+				if strings.Contains(recorder.Body.String(), "positive") {
+					t.Errorf("got %s, want nothing about the job", recorder.Body)
+				}
+			}
+		})
+	}
+}
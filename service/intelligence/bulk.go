@@ -0,0 +1,159 @@
+package intelligence
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Defines the largest record that can be read from a bulk request
+const maxBulkRecordSize = 10 << 20
+
+// Defines a record in a bulk request
+type BulkRecord struct {
+	ID     interface{}            `json:"id"`
+	Model  string                 `json:"model"`
+	Params map[string]interface{} `json:"params"`
+}
+
+// Defines the result of a record in a bulk response, which has either a result or an error
+type BulkResult struct {
+	ID     interface{} `json:"id,omitempty"`
+	Line   int         `json:"line,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+	Error  *Error      `json:"error,omitempty"`
+}
+
+// Processes newline-delimited JSON records, running up to maxConcurrency of them at a time, and writes a
+// newline-delimited JSON result for each record as soon as it completes. Records are read as they arrive so the
+// request can be any size.
+func (i *Intelligence) BulkHandler(maxConcurrency int) http.Handler {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{
+				"errors": Errors{"request": newError(ErrorCodeValidation, "", "method not allowed")},
+			})
+			return
+		}
+		ctx, err := i.Authenticate(r)
+		if err != nil {
+			writeAuthError(w, Errors{"request": AsError(err)})
+			return
+		}
+		ctx = WithNewCaller(ctx)
+
+		// Read the rest of the records while results are written, which HTTP/1.1 doesn't allow by default
+		http.NewResponseController(w).EnableFullDuplex()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+
+		// Serialize writes since the records are processed concurrently
+		var mu sync.Mutex
+		writeResult := func(result BulkResult) {
+			resultBytes, err := json.Marshal(result)
+			if err != nil {
+				resultBytes, _ = json.Marshal(BulkResult{ID: result.ID, Line: result.Line, Error: newError(ErrorCodeInternal, "", "failed to write result: %v", err)})
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			w.Write(append(resultBytes, '\n'))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, maxConcurrency)
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64*1024), maxBulkRecordSize)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+
+			record, err := getBulkRecord([]byte(text))
+			if err == nil {
+				err = Authorize(ctx, record.Model)
+			}
+			if err != nil {
+				writeResult(BulkResult{ID: record.ID, Line: line, Error: AsError(err)})
+				continue
+			}
+
+			// Wait for a slot so only a bounded number of records are read ahead of their results
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+
+			wg.Add(1)
+			go func(record BulkRecord, line int) {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				var result interface{}
+				var err error
+				if isDryRunRequest(record.Params) {
+					result, err = i.DryRun(ctx, record.Model, record.Params)
+				} else {
+					result, err = i.GetIntelligence(ctx, record.Model, record.Params)
+				}
+				if err != nil {
+					writeResult(BulkResult{ID: record.ID, Line: line, Error: AsError(err)})
+				} else {
+					writeResult(BulkResult{ID: record.ID, Line: line, Result: result})
+				}
+			}(record, line)
+		}
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			writeResult(BulkResult{Line: line + 1, Error: newError(ErrorCodeValidation, "", "failed to read records: %v", err)})
+		}
+
+		wg.Wait()
+	})
+}
+
+// Parses a bulk record, taking its params from the fields other than the id and model when it has no params
+func getBulkRecord(data []byte) (BulkRecord, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return BulkRecord{}, newError(ErrorCodeValidation, "", "invalid record: %v", err)
+	}
+
+	record := BulkRecord{ID: fields["id"]}
+	model, ok := fields["model"].(string)
+	if !ok || model == "" {
+		return record, newError(ErrorCodeValidation, "", "invalid record: 'model' is required")
+	}
+	record.Model = model
+
+	if params, exists := fields["params"]; exists {
+		paramsMap, ok := params.(map[string]interface{})
+		if !ok {
+			return record, newError(ErrorCodeValidation, model, "invalid record: 'params' must be an object")
+		}
+		record.Params = paramsMap
+	} else {
+		delete(fields, "id")
+		delete(fields, "model")
+		record.Params = fields
+	}
+
+	return record, nil
+}
@@ -0,0 +1,185 @@
+package intelligence
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns the results of a bulk response by record ID
+func getBulkResults(t *testing.T, body io.Reader) map[string]BulkResult {
+	t.Helper()
+	results := make(map[string]BulkResult)
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var result BulkResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatalf("got line %s, want a result: %v", scanner.Text(), err)
+		}
+		id, _ := result.ID.(string)
+		results[id] = result
+	}
+	return results
+}
+
+func TestBulkHandlerStreamsResults(t *testing.T) {
+	// The provider holds the first record until the result of the second has been read by the client
+	release := make(chan struct{})
+	i := newTestIntelligence(t, func(r *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "slow") {
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		return stubResponse(`{"choices":[{"message":{"content":"positive"}}]}`), nil
+	})
+	server := httptest.NewServer(i.BulkHandler(2))
+	defer server.Close()
+
+	records := `{"id": "slow", "model": "sentiment", "text": "slow"}` + "\n" + `{"id": "fast", "model": "sentiment", "params": {"text": "fast"}}` + "\n"
+	response, err := http.Post(server.URL, "application/x-ndjson", strings.NewReader(records))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("got content type %q, want application/x-ndjson", contentType)
+	}
+
+	// Each result is written as soon as its record completes, with the ID and line of the record
+	reader := bufio.NewReader(response.Body)
+	var ids []string
+	for _, want := range []BulkResult{{ID: "fast", Line: 2}, {ID: "slow", Line: 1}} {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("got error %v, want the result of '%s'", err, want.ID)
+		}
+		var result BulkResult
+		json.Unmarshal(line, &result)
+		if result.ID != want.ID || result.Line != want.Line || result.Result != "positive" || result.Error != nil {
+			t.Errorf("got result %s, want '%s' at line %d to be positive", line, want.ID, want.Line)
+		}
+		ids = append(ids, result.ID.(string))
+		if result.ID == "fast" {
+			close(release)
+		}
+	}
+	if strings.Join(ids, ",") != "fast,slow" {
+		t.Errorf("got results %v, want fast before slow", ids)
+	}
+}
+
+func TestBulkHandlerInvalidRecords(t *testing.T) {
+	i := newTestIntelligence(t, nil)
+	i.SetAPIKeys(testAPIKeys)
+	records := strings.Join([]string{
+		`{"id": "dry run", "model": "sentiment", "text": "I love it", "dry_run": true}`,
+		``,
+		`not json`,
+		`{"id": "no model", "text": "I love it"}`,
+		`{"id": "params", "model": "sentiment", "params": "I love it"}`,
+		`{"id": "not allowed", "model": "summary", "text": "I love it"}`,
+		`{"id": "no text", "model": "sentiment", "params": {"dry_run": true}}`,
+	}, "\n")
+	request := httptest.NewRequest(http.MethodPost, "/intelligence/bulk", strings.NewReader(records))
+	request.Header.Set("X-API-Key", "bob-key")
+	recorder := httptest.NewRecorder()
+	i.BulkHandler(4).ServeHTTP(recorder, request)
+
+	// Each invalid record has an error line, and the other records still run
+	tests := []struct {
+		id   string
+		line int
+		code string
+	}{
+		{id: "dry run", line: 1},
+		{id: "", line: 3, code: ErrorCodeValidation},
+		{id: "no model", line: 4, code: ErrorCodeValidation},
+		{id: "params", line: 5, code: ErrorCodeValidation},
+		{id: "not allowed", line: 6, code: ErrorCodeForbidden},
+		{id: "no text", line: 7, code: ErrorCodeValidation},
+	}
+	results := getBulkResults(t, recorder.Body)
+	if len(results) != len(tests) {
+		t.Errorf("got %d results, want %d: %s", len(results), len(tests), recorder.Body)
+	}
+	for _, test := range tests {
+		result, exists := results[test.id]
+		if !exists {
+			t.Errorf("got no result for '%s'", test.id)
+			continue
+		}
+		if result.Line != test.line {
+			t.Errorf("got line %d for '%s', want %d", result.Line, test.id, test.line)
+		}
+		if test.code == "" && (result.Error != nil || result.Result == nil) {
+			t.Errorf("got %+v for '%s', want a result", result, test.id)
+		}
+		if test.code != "" && (result.Error == nil || result.Error.Code != test.code) {
+			t.Errorf("got %+v for '%s', want %s", result, test.id, test.code)
+		}
+	}
+}
+
+func TestBulkHandlerConcurrency(t *testing.T) {
+	// The provider records how many requests it has at once
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	i := newTestIntelligence(t, func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return stubResponse(`{"choices":[{"message":{"content":"positive"}}]}`), nil
+	})
+
+	var records strings.Builder
+	ids := []string{"a", "b", "c", "d", "e", "f"}
+	for _, id := range ids {
+		records.WriteString(`{"id": "` + id + `", "model": "sentiment", "text": "I love it"}` + "\n")
+	}
+	request := httptest.NewRequest(http.MethodPost, "/intelligence/bulk", strings.NewReader(records.String()))
+	recorder := httptest.NewRecorder()
+	i.BulkHandler(2).ServeHTTP(recorder, request)
+
+	results := getBulkResults(t, recorder.Body)
+	for _, id := range ids {
+		if results[id].Result != "positive" {
+			t.Errorf("got %+v for '%s', want positive", results[id], id)
+		}
+	}
+	if maxInFlight > 2 {
+		t.Errorf("got %d records at once, want at most 2", maxInFlight)
+	}
+}
+
+func TestBulkHandlerRecordSize(t *testing.T) {
+	i := newTestIntelligence(t, nil)
+	records := `{"id": "first", "model": "sentiment", "text": "I love it", "dry_run": true}` + "\n" +
+		`{"id": "large", "model": "sentiment", "text": "` + strings.Repeat("a", maxBulkRecordSize) + `"}` + "\n" +
+		`{"id": "after", "model": "sentiment", "text": "I love it", "dry_run": true}` + "\n"
+	request := httptest.NewRequest(http.MethodPost, "/intelligence/bulk", strings.NewReader(records))
+	recorder := httptest.NewRecorder()
+	i.BulkHandler(2).ServeHTTP(recorder, request)
+
+	// The records before the large record run, and reading stops at it with an error for its line
+	results := getBulkResults(t, recorder.Body)
+	if results["first"].Result == nil || len(results) != 2 {
+		t.Fatalf("got %s, want the first result and an error", recorder.Body)
+	}
+	if failed := results[""]; failed.Error == nil || failed.Error.Code != ErrorCodeValidation || failed.Line != 2 || !strings.Contains(failed.Error.Message, "too long") {
+		t.Errorf("got %+v, want a validation error for line 2", failed)
+	}
+}
@@ -0,0 +1,283 @@
+package intelligence
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Defines the states of a callback delivery
+const (
+	CallbackStatusPending   = "pending"
+	CallbackStatusDelivered = "delivered"
+	CallbackStatusFailed    = "failed"
+)
+
+// Defines how many times a callback is attempted before it is given up on
+const maxCallbackAttempts = 5
+
+// Defines the delay before the first callback retry, which doubles with each retry after it
+var callbackRetryDelay = time.Second
+
+// Defines where the results of a job are posted when it finishes and the record of attempts to post them
+type JobCallback struct {
+	URL      string            `json:"url"`
+	Secret   string            `json:"secret,omitempty"`
+	Status   string            `json:"status"`
+	Attempts []CallbackAttempt `json:"attempts,omitempty"`
+}
+
+// Defines a single attempt to post the results of a job to its callback
+type CallbackAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Creates a callback from the callback_url query parameter and X-Callback-Secret header of a request, or returns nil
+// if there is no callback
+func (i *Intelligence) getJobCallback(r *http.Request) (*JobCallback, error) {
+	callbackURL := r.URL.Query().Get("callback_url")
+	if callbackURL == "" {
+		return nil, nil
+	}
+
+	parsedURL, err := url.Parse(callbackURL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Hostname() == "" {
+		return nil, fmt.Errorf("invalid callback_url '%s'", callbackURL)
+	}
+
+	// Only hosts the operator allows can be sent results over http or at addresses inside the network, which are
+	// checked again when the callback is posted since a name can resolve to a different address by then
+	if !i.isAllowedCallbackHost(parsedURL.Hostname()) {
+		if parsedURL.Scheme != "https" {
+			return nil, fmt.Errorf("callback_url '%s' must use https", callbackURL)
+		}
+		if address, err := netip.ParseAddr(parsedURL.Hostname()); err == nil && isBlockedCallbackAddress(address) {
+			return nil, fmt.Errorf("callback_url '%s' must not be a private, loopback or link-local address", callbackURL)
+		}
+	}
+
+	return &JobCallback{
+		URL:    callbackURL,
+		Secret: r.Header.Get("X-Callback-Secret"),
+		Status: CallbackStatusPending,
+	}, nil
+}
+
+// Defines the address ranges that callbacks can't be posted to unless their host is allowed, on top of the private,
+// loopback, link-local and multicast ranges
+var blockedCallbackPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+}
+
+// Determines whether an address is inside the network, such as a private, loopback or link-local address, where
+// callbacks can't be posted unless their host is allowed
+func isBlockedCallbackAddress(address netip.Addr) bool {
+	address = address.Unmap()
+	if address.IsPrivate() || address.IsLoopback() || address.IsLinkLocalUnicast() || address.IsLinkLocalMulticast() ||
+		address.IsInterfaceLocalMulticast() || address.IsMulticast() || address.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range blockedCallbackPrefixes {
+		if prefix.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the hosts that callbacks can be posted to over http and at private, loopback or link-local addresses, such as
+// receivers inside the network
+func (i *Intelligence) SetCallbackHosts(hosts []string) {
+	allowed := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			allowed[host] = true
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.callbackHosts = allowed
+}
+
+// Determines whether the operator allows callbacks to a host
+func (i *Intelligence) isAllowedCallbackHost(host string) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.callbackHosts[strings.ToLower(host)]
+}
+
+// Creates the client callbacks are posted with, which checks the address a host resolves to when it connects so a
+// callback can't reach inside the network unless its host is allowed, and doesn't follow redirects
+func (i *Intelligence) newCallbackClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	blockingDialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if isBlockedCallbackAddress(addrPort.Addr()) {
+				return fmt.Errorf("callback address %s is private, loopback or link-local", addrPort.Addr())
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return nil, err
+				}
+				if i.isAllowedCallbackHost(host) {
+					return dialer.DialContext(ctx, network, address)
+				}
+				return blockingDialer.DialContext(ctx, network, address)
+			},
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Posts the results of a finished job to its callback, retrying with backoff until it is delivered or it runs out
+// of attempts, and records each attempt on the job
+func (i *Intelligence) deliverJobCallback(store *JobStore, id string) {
+	job, exists := store.Get(id)
+	if !exists || job.Callback == nil || job.Callback.Status != CallbackStatusPending {
+		return
+	}
+
+	// Post the job as clients see it, without the record of the delivery
+	payload := jobResponse(job)
+	payload.Callback = nil
+	body, err := json.Marshal(payload)
+	if err != nil {
+		store.update(id, func(job *Job) {
+			job.Callback.Status = CallbackStatusFailed
+			job.Callback.Attempts = append(job.Callback.Attempts, CallbackAttempt{At: time.Now(), Error: err.Error()})
+		})
+		return
+	}
+
+	// Continue from the attempts already made, such as before a restart
+	for attempt := len(job.Callback.Attempts); attempt < maxCallbackAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(callbackRetryDelay << (attempt - 1))
+		}
+
+		statusCode, err := i.postJobCallback(job.ID, job.Callback, body)
+		record := CallbackAttempt{At: time.Now(), StatusCode: statusCode}
+		if err != nil {
+			record.Error = err.Error()
+		}
+
+		// Stop retrying once it is delivered or when the receiver rejects it for a reason retrying will not fix
+		status := CallbackStatusPending
+		if err == nil {
+			status = CallbackStatusDelivered
+		} else if !isRetryableCallbackStatus(statusCode) || attempt == maxCallbackAttempts-1 {
+			status = CallbackStatusFailed
+		}
+		store.update(id, func(job *Job) {
+			job.Callback.Status = status
+			job.Callback.Attempts = append(job.Callback.Attempts, record)
+		})
+		if status != CallbackStatusPending {
+			return
+		}
+	}
+
+	store.update(id, func(job *Job) {
+		job.Callback.Status = CallbackStatusFailed
+	})
+}
+
+// Posts the body to the callback URL, signing it when the callback has a secret, and returns the status code of the
+// response
+func (i *Intelligence) postJobCallback(id string, callback *JobCallback, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Intelligence-Job-ID", id)
+	if callback.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Intelligence-Timestamp", timestamp)
+		req.Header.Set("X-Intelligence-Signature", "sha256="+signCallbackBody(callback.Secret, timestamp, body))
+	}
+
+	resp, err := i.callbacks.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Returns the hex encoded HMAC-SHA256 of the timestamp and body joined by a dot with the secret, where signing the
+// timestamp keeps a callback from being replayed later
+func signCallbackBody(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the X-Intelligence-Signature and X-Intelligence-Timestamp headers of a callback against its body, and that
+// it was signed within the tolerance of now, for receivers of callbacks written in Go
+func VerifyCallbackSignature(secret string, header http.Header, body []byte, tolerance time.Duration, now time.Time) error {
+	timestamp := header.Get("X-Intelligence-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid callback timestamp '%s'", timestamp)
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("callback timestamp is %s from now, more than the tolerance of %s", age.Round(time.Second), tolerance)
+	}
+
+	signature, found := strings.CutPrefix(header.Get("X-Intelligence-Signature"), "sha256=")
+	if !found || !hmac.Equal([]byte(signature), []byte(signCallbackBody(secret, timestamp, body))) {
+		return fmt.Errorf("invalid callback signature")
+	}
+	return nil
+}
+
+// Determines whether a callback that failed with a status code should be retried, which is when the receiver could
+// not be reached, failed or asked to slow down
+func isRetryableCallbackStatus(statusCode int) bool {
+	return statusCode == 0 ||
+		statusCode == http.StatusRequestTimeout ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode >= http.StatusInternalServerError
+}
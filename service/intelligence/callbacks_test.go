@@ -0,0 +1,160 @@
+package intelligence
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetJobCallback(t *testing.T) {
+	tests := []struct {
+		name  string
+		url   string
+		hosts []string
+		valid bool
+	}{
+		{"https", "https://example.com/results", nil, true},
+		{"http", "http://example.com/results", nil, false},
+		{"other scheme", "ftp://example.com/results", nil, false},
+		{"no host", "https:///results", nil, false},
+		{"loopback", "https://127.0.0.1/results", nil, false},
+		{"private", "https://10.1.2.3/results", nil, false},
+		{"link-local metadata", "https://169.254.169.254/latest/meta-data", nil, false},
+		{"IPv6 loopback", "https://[::1]/results", nil, false},
+		{"IPv4-mapped IPv6 private", "https://[::ffff:192.168.0.1]/results", nil, false},
+		{"allowed host over http", "http://results.internal/results", []string{"results.internal"}, true},
+		{"allowed private address", "https://10.1.2.3/results", []string{" 10.1.2.3 "}, true},
+		{"other host than allowed", "http://example.com/results", []string{"results.internal"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := newTestIntelligence(t, nil)
+			i.SetCallbackHosts(test.hosts)
+			r := httptest.NewRequest(http.MethodPost, "/intelligence/jobs?callback_url="+test.url, nil)
+			callback, err := i.getJobCallback(r)
+			if valid := err == nil && callback != nil; valid != test.valid {
+				t.Errorf("got callback %v and error %v, want valid %v", callback, err, test.valid)
+			}
+		})
+	}
+}
+
+func TestIsBlockedCallbackAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		blocked bool
+	}{
+		{"93.184.216.34", false},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+		{"127.0.0.1", true},
+		{"10.0.0.1", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:127.0.0.1", true},
+	}
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			if blocked := isBlockedCallbackAddress(netip.MustParseAddr(test.address)); blocked != test.blocked {
+				t.Errorf("got blocked %v, want %v", blocked, test.blocked)
+			}
+		})
+	}
+}
+
+func TestVerifyCallbackSignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":"job","status":"completed"}`)
+	signedHeader := func(secret string, at time.Time, body []byte) http.Header {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		return http.Header{
+			"X-Intelligence-Timestamp": {timestamp},
+			"X-Intelligence-Signature": {"sha256=" + signCallbackBody(secret, timestamp, body)},
+		}
+	}
+	tests := []struct {
+		name   string
+		header http.Header
+		body   []byte
+		valid  bool
+	}{
+		{"valid", signedHeader("secret", now, body), body, true},
+		{"slightly early clock", signedHeader("secret", now.Add(time.Minute), body), body, true},
+		{"other secret", signedHeader("other", now, body), body, false},
+		{"changed body", signedHeader("secret", now, body), []byte(`{"id":"job","status":"canceled"}`), false},
+		{"replayed", signedHeader("secret", now.Add(-10*time.Minute), body), body, false},
+		{"changed timestamp", func() http.Header {
+			header := signedHeader("secret", now.Add(-10*time.Minute), body)
+			header.Set("X-Intelligence-Timestamp", strconv.FormatInt(now.Unix(), 10))
+			return header
+		}(), body, false},
+		{"no timestamp", http.Header{"X-Intelligence-Signature": {"sha256=00"}}, body, false},
+		{"no signature", http.Header{"X-Intelligence-Timestamp": {strconv.FormatInt(now.Unix(), 10)}}, body, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyCallbackSignature("secret", test.header, test.body, 5*time.Minute, now)
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("got error %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestDeliverJobCallbackIsVerifiedByReceiver(t *testing.T) {
+	received := make(chan error, 1)
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- VerifyCallbackSignature("secret", r.Header, body, 5*time.Minute, time.Now())
+	}))
+	defer receiver.Close()
+
+	retryDelay := callbackRetryDelay
+	callbackRetryDelay = time.Millisecond
+	defer func() { callbackRetryDelay = retryDelay }()
+
+	i := newTestIntelligence(t, nil)
+	i.callbacks.Transport.(*http.Transport).TLSClientConfig = receiver.Client().Transport.(*http.Transport).TLSClientConfig
+	store, _ := NewJobStore("")
+	addJob := func(id string) {
+		store.add(&Job{
+			ID:       id,
+			Status:   JobStatusCompleted,
+			Results:  Results{"sentiment": "positive"},
+			Callback: &JobCallback{URL: receiver.URL + "/results", Secret: "secret", Status: CallbackStatusPending},
+		})
+	}
+
+	// The receiver is on a loopback address, so the callback isn't posted until its host is allowed
+	addJob("blocked")
+	i.deliverJobCallback(store, "blocked")
+	job, _ := store.Get("blocked")
+	if job.Callback.Status != CallbackStatusFailed || len(job.Callback.Attempts) == 0 || !strings.Contains(job.Callback.Attempts[0].Error, "loopback") {
+		t.Fatalf("got callback %+v, want it to fail without reaching the receiver", job.Callback)
+	}
+	select {
+	case <-received:
+		t.Fatal("callback to a loopback address reached the receiver")
+	default:
+	}
+
+	i.SetCallbackHosts([]string{"127.0.0.1"})
+	addJob("allowed")
+	i.deliverJobCallback(store, "allowed")
+	if err := <-received; err != nil {
+		t.Errorf("receiver rejected callback: %v", err)
+	}
+	if job, _ := store.Get("allowed"); job.Callback.Status != CallbackStatusDelivered {
+		t.Errorf("got callback %+v, want it delivered", job.Callback)
+	}
+}
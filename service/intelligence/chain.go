@@ -0,0 +1,217 @@
+package intelligence
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Matches placeholders that reference the result of another request, such as {{results.translated}} or
+// {{results.extracted.person}}
+var resultPlaceholderPattern = regexp.MustCompile(`\{\{results\.([^.{}]+)((?:\.[^.{}]+)*)\}\}`)
+
+// Returns the keys of the requests that each request references, along with errors for requests that reference
+// unknown keys or are part of a dependency cycle
+func getRequestDependencies(requests Requests) (map[string][]string, Errors) {
+	dependencies := make(map[string][]string)
+	errors := make(Errors)
+
+	// Gather the unique keys referenced by each request
+	for key, request := range requests {
+		referenced := make(map[string]bool)
+		collectResultReferences(map[string]interface{}(request), referenced)
+		for dependency := range referenced {
+			if _, exists := requests[dependency]; !exists {
+				errors[key] = newError(ErrorCodeValidation, "", "request '%s' references unknown request '%s'", key, dependency)
+				continue
+			}
+			dependencies[key] = append(dependencies[key], dependency)
+		}
+		sort.Strings(dependencies[key])
+	}
+
+	// Find the requests that are part of a cycle with a depth-first search
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(key string)
+	visit = func(key string) {
+		state[key] = visiting
+		stack = append(stack, key)
+		for _, dependency := range dependencies[key] {
+			switch state[dependency] {
+			case unvisited:
+				visit(dependency)
+			case visiting:
+				// Every request on the stack from the dependency to here is part of the cycle
+				for i := len(stack) - 1; i >= 0; i-- {
+					errors[stack[i]] = newError(ErrorCodeValidation, "", "request '%s' is part of a dependency cycle", stack[i])
+					if stack[i] == dependency {
+						break
+					}
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[key] = visited
+	}
+
+	keys := make([]string, 0, len(requests))
+	for key := range requests {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if state[key] == unvisited {
+			visit(key)
+		}
+	}
+
+	return dependencies, errors
+}
+
+// Recursively collects the request keys referenced by result placeholders in a value
+func collectResultReferences(value interface{}, referenced map[string]bool) {
+	switch v := value.(type) {
+	case string:
+		for _, match := range resultPlaceholderPattern.FindAllStringSubmatch(v, -1) {
+			referenced[match[1]] = true
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectResultReferences(item, referenced)
+		}
+	case map[string]interface{}:
+		for _, nestedValue := range v {
+			collectResultReferences(nestedValue, referenced)
+		}
+	}
+}
+
+// Returns a copy of the request with the result placeholders replaced by the results of its dependencies, or an
+// error if a dependency failed or a placeholder cannot be resolved
+func resolveRequestResults(key string, request Request, dependencies []string, results Results, errors Errors) (Request, error) {
+	if len(dependencies) == 0 {
+		return request, nil
+	}
+
+	for _, dependency := range dependencies {
+		if _, failed := errors[dependency]; failed {
+			return nil, newError(ErrorCodeDependencyFailed, "", "request '%s' was skipped because request '%s' failed", key, dependency)
+		}
+	}
+
+	resolved, err := resolveResultPlaceholders(map[string]interface{}(request), results)
+	if err != nil {
+		return nil, newError(ErrorCodeValidation, "", "request '%s' could not be resolved: %v", key, err)
+	}
+	return Request(resolved.(map[string]interface{})), nil
+}
+
+// Recursively replaces result placeholders in a value, keeping the type of the result when a string is only a
+// placeholder and otherwise formatting the result into the string
+func resolveResultPlaceholders(value interface{}, results Results) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		matches := resultPlaceholderPattern.FindAllStringSubmatchIndex(v, -1)
+		if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(v) {
+			return getResultAtPath(results, v[matches[0][2]:matches[0][3]], v[matches[0][4]:matches[0][5]])
+		}
+
+		var resolveErr error
+		resolved := resultPlaceholderPattern.ReplaceAllStringFunc(v, func(placeholder string) string {
+			match := resultPlaceholderPattern.FindStringSubmatch(placeholder)
+			result, err := getResultAtPath(results, match[1], match[2])
+			if err != nil {
+				resolveErr = err
+				return placeholder
+			}
+			return formatResult(result)
+		})
+		return resolved, resolveErr
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, item := range v {
+			resolvedItem, err := resolveResultPlaceholders(item, results)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = resolvedItem
+		}
+		return resolved, nil
+	case map[string]interface{}:
+		resolved := make(map[string]interface{}, len(v))
+		for nestedKey, nestedValue := range v {
+			resolvedValue, err := resolveResultPlaceholders(nestedValue, results)
+			if err != nil {
+				return nil, err
+			}
+			resolved[nestedKey] = resolvedValue
+		}
+		return resolved, nil
+	default:
+		return v, nil
+	}
+}
+
+// Returns the value at a dot separated path, such as ".person" or ".0", within the result of a request
+func getResultAtPath(results Results, key string, path string) (interface{}, error) {
+	result, exists := results[key]
+	if !exists {
+		return nil, fmt.Errorf("no result for request '%s'", key)
+	}
+
+	// Convert typed results, such as blobs and embeddings, to their JSON form so they can be traversed and
+	// passed as parameters
+	var value interface{}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(resultBytes, &value); err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		return value, nil
+	}
+	for _, segment := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			nestedValue, exists := v[segment]
+			if !exists {
+				return nil, fmt.Errorf("no '%s' in result of request '%s'", segment, key)
+			}
+			value = nestedValue
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, fmt.Errorf("no index '%s' in result of request '%s'", segment, key)
+			}
+			value = v[index]
+		default:
+			return nil, fmt.Errorf("no '%s' in result of request '%s'", segment, key)
+		}
+	}
+	return value, nil
+}
+
+// Formats a result for use within a string, encoding objects and arrays as JSON
+func formatResult(result interface{}) string {
+	switch v := result.(type) {
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		if resultBytes, err := json.Marshal(v); err == nil {
+			return string(resultBytes)
+		}
+	}
+	return fmt.Sprintf("%v", result)
+}
@@ -0,0 +1,165 @@
+package intelligence
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGetRequestDependencies(t *testing.T) {
+	tests := []struct {
+		name         string
+		requests     Requests
+		dependencies map[string][]string
+		invalid      []string
+	}{
+		{
+			name:         "independent",
+			requests:     Requests{"a": {"text": "x"}, "b": {"text": "y"}},
+			dependencies: map[string][]string{},
+		},
+		{
+			name: "chain",
+			requests: Requests{
+				"a": {"text": "x"},
+				"b": {"text": "{{results.a}}"},
+				"c": {"texts": []interface{}{"{{results.b.0}}", "and {{results.a}}"}},
+			},
+			dependencies: map[string][]string{"b": {"a"}, "c": {"a", "b"}},
+		},
+		{
+			name: "diamond",
+			requests: Requests{
+				"a": {"text": "x"},
+				"b": {"text": "{{results.a}}"},
+				"c": {"text": "{{results.a}}"},
+				"d": {"params": map[string]interface{}{"first": "{{results.b}}", "second": "{{results.c.name}}"}},
+			},
+			dependencies: map[string][]string{"b": {"a"}, "c": {"a"}, "d": {"b", "c"}},
+		},
+		{
+			name:         "unknown request",
+			requests:     Requests{"a": {"text": "{{results.missing}}"}},
+			dependencies: map[string][]string{},
+			invalid:      []string{"a"},
+		},
+		{
+			name:         "self reference",
+			requests:     Requests{"a": {"text": "{{results.a}}"}},
+			dependencies: map[string][]string{"a": {"a"}},
+			invalid:      []string{"a"},
+		},
+		{
+			name: "cycle with a dependent outside it",
+			requests: Requests{
+				"a": {"text": "{{results.b}}"},
+				"b": {"text": "{{results.c}}"},
+				"c": {"text": "{{results.a}}"},
+				"d": {"text": "{{results.a}}"},
+			},
+			dependencies: map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}, "d": {"a"}},
+			invalid:      []string{"a", "b", "c"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dependencies, errors := getRequestDependencies(test.requests)
+
+			// Requests without dependencies have none or an empty list
+			for key, keys := range dependencies {
+				if len(keys) == 0 {
+					delete(dependencies, key)
+				}
+			}
+			if !reflect.DeepEqual(dependencies, test.dependencies) {
+				t.Errorf("got dependencies %v, want %v", dependencies, test.dependencies)
+			}
+
+			invalid := make([]string, 0, len(errors))
+			for key, err := range errors {
+				if err.Code != ErrorCodeValidation {
+					t.Errorf("got %s error for '%s', want %s", err.Code, key, ErrorCodeValidation)
+				}
+				invalid = append(invalid, key)
+			}
+			sort.Strings(invalid)
+			if strings.Join(invalid, ",") != strings.Join(test.invalid, ",") {
+				t.Errorf("got errors for %v, want %v", invalid, test.invalid)
+			}
+		})
+	}
+}
+
+func TestResolveResultPlaceholders(t *testing.T) {
+	results := Results{
+		"text":   "hello",
+		"object": map[string]interface{}{"name": "Ada", "tags": []interface{}{"a", "b"}},
+		"list":   []interface{}{1.0, 2.0},
+		"image":  &Blob{ContentType: "image/png", Base64: "AA=="},
+	}
+	tests := []struct {
+		name     string
+		value    interface{}
+		resolved interface{}
+		err      string
+	}{
+		{"string result", "{{results.text}}", "hello", ""},
+		{"keeps type of a whole placeholder", "{{results.list}}", []interface{}{1.0, 2.0}, ""},
+		{"field", "{{results.object.name}}", "Ada", ""},
+		{"index", "{{results.object.tags.1}}", "b", ""},
+		{"formatted into text", "say {{results.text}} to {{results.object.name}}", "say hello to Ada", ""},
+		{"object formatted as JSON", "tags: {{results.object.tags}}", `tags: ["a","b"]`, ""},
+		{"blob", "{{results.image}}", map[string]interface{}{"content_type": "image/png", "base64": "AA=="}, ""},
+		{"nested", map[string]interface{}{"texts": []interface{}{"{{results.text}}", 1.0}}, map[string]interface{}{"texts": []interface{}{"hello", 1.0}}, ""},
+		{"no placeholder", "{{text}}", "{{text}}", ""},
+		{"missing result", "{{results.missing}}", nil, "no result for request 'missing'"},
+		{"missing field", "{{results.object.age}}", nil, "no 'age' in result of request 'object'"},
+		{"index out of range", "{{results.list.2}}", nil, "no index '2' in result of request 'list'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolved, err := resolveResultPlaceholders(test.value, results)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resolved, test.resolved) {
+				t.Errorf("got %#v, want %#v", resolved, test.resolved)
+			}
+		})
+	}
+}
+
+func TestDoRequestsSkipsDependentsOfFailedRequests(t *testing.T) {
+	i := newTestIntelligence(t, nil)
+	requests := Requests{
+		"failed":   {"model": "unknown_model"},
+		"skipped":  {"model": "sentiment", "text": "{{results.failed}}"},
+		"cycle":    {"model": "sentiment", "text": "{{results.cycle}}"},
+		"unknown":  {"model": "sentiment", "text": "{{results.nothing}}"},
+		"indirect": {"model": "sentiment", "text": "{{results.skipped}}"},
+	}
+	results, errors := i.doRequests(context.Background(), requests, nil)
+
+	if len(results) != 0 {
+		t.Errorf("got results %v, want none", results)
+	}
+	for key, code := range map[string]string{
+		"failed":   ErrorCodeNotFound,
+		"skipped":  ErrorCodeDependencyFailed,
+		"indirect": ErrorCodeDependencyFailed,
+		"cycle":    ErrorCodeValidation,
+		"unknown":  ErrorCodeValidation,
+	} {
+		if errors[key] == nil || errors[key].Code != code {
+			t.Errorf("got error %v for '%s', want %s", errors[key], key, code)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package intelligence
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defines how many requests can be sent to providers at the same time, and how many requests can wait and for how
+// long when they can't be sent yet. A limit of zero means there is no limit.
+type ConcurrencyLimits struct {
+	Global      int
+	PerProvider map[string]int
+	MaxQueue    int
+	MaxWait     time.Duration
+}
+
+// Defines the concurrency limits used unless others are set
+var DefaultConcurrencyLimits = ConcurrencyLimits{
+	Global:   50,
+	MaxQueue: 1000,
+	MaxWait:  30 * time.Second,
+}
+
+// Defines the context key for the caller a request is made for
+type callerContextKey struct{}
+
+// Counts the callers so each gets a unique ID
+var callerCount uint64
+
+// Returns a context for a new caller, such as an HTTP request, so its requests take turns for concurrency slots with
+// the requests of other callers
+func WithNewCaller(ctx context.Context) context.Context {
+	return withCaller(ctx, fmt.Sprintf("caller-%d", atomic.AddUint64(&callerCount, 1)))
+}
+
+// Returns a context for a caller with an ID
+func withCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerContextKey{}, caller)
+}
+
+// Returns the caller of a context, or an empty string for requests without a caller
+func getCaller(ctx context.Context) string {
+	caller, _ := ctx.Value(callerContextKey{}).(string)
+	return caller
+}
+
+// Sets the concurrency limits for requests to providers, where services can also set their own limit with
+// max_concurrency in the config
+func (i *Intelligence) SetConcurrencyLimits(limits ConcurrencyLimits) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.concurrency = newConcurrencyLimiter(limits)
+}
+
+// Limits the requests to providers globally, by provider and by service
+type concurrencyLimiter struct {
+	limits    ConcurrencyLimits
+	global    *fairSemaphore
+	providers map[string]*fairSemaphore
+	services  map[string]*fairSemaphore
+	mu        sync.Mutex
+}
+
+// Creates a concurrency limiter for the limits
+func newConcurrencyLimiter(limits ConcurrencyLimits) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		limits:    limits,
+		global:    newFairSemaphore(limits.Global, limits.MaxQueue),
+		providers: make(map[string]*fairSemaphore),
+		services:  make(map[string]*fairSemaphore),
+	}
+}
+
+// Waits for a slot to send a request to the service, failing with a retryable error when too many requests are
+// waiting or the wait is too long, and returns a function that gives the slot back
+func (l *concurrencyLimiter) acquire(ctx context.Context, service Service) (func(), error) {
+	l.mu.Lock()
+	provider, exists := l.providers[service.Provider]
+	if !exists {
+		provider = newFairSemaphore(l.limits.PerProvider[service.Provider], l.limits.MaxQueue)
+		l.providers[service.Provider] = provider
+	}
+	serviceSemaphore, exists := l.services[service.Name]
+	if !exists || serviceSemaphore.limit != service.MaxConcurrency {
+		serviceSemaphore = newFairSemaphore(service.MaxConcurrency, l.limits.MaxQueue)
+		l.services[service.Name] = serviceSemaphore
+	}
+	l.mu.Unlock()
+
+	waitCtx := ctx
+	if l.limits.MaxWait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, l.limits.MaxWait)
+		defer cancel()
+	}
+
+	// Take the most specific slot first so a request waiting on a busy service doesn't hold a global slot
+	caller := getCaller(ctx)
+	semaphores := []*fairSemaphore{serviceSemaphore, provider, l.global}
+	var acquired []*fairSemaphore
+	release := func() {
+		for _, semaphore := range acquired {
+			semaphore.release()
+		}
+	}
+	for _, semaphore := range semaphores {
+		if err := semaphore.acquire(waitCtx, caller); err != nil {
+			release()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err == errQueueFull {
+				return nil, newOverloadedError(service.Name, "too many requests are waiting to be sent to '%s' service", service.Name)
+			}
+			return nil, newOverloadedError(service.Name, "request to '%s' service waited longer than %v to be sent", service.Name, l.limits.MaxWait)
+		}
+		acquired = append(acquired, semaphore)
+	}
+	return release, nil
+}
+
+// Creates a retryable error for a request that was rejected because the service is too busy
+func newOverloadedError(service string, format string, args ...interface{}) *Error {
+	err := newError(ErrorCodeOverloaded, service, format, args...)
+	err.RetryAfter = time.Second
+	return err
+}
+
+// Defines the error for a semaphore whose queue is full
+var errQueueFull = fmt.Errorf("queue is full")
+
+// Limits how many holders a resource has at the same time, and when it is full, gives the next free slot to the
+// callers that are waiting in turn so one caller with many requests can't starve the others
+type fairSemaphore struct {
+	limit    int
+	maxQueue int
+	active   int
+	waiting  int
+	queues   map[string][]*semaphoreWaiter
+	callers  []string
+	mu       sync.Mutex
+}
+
+// Defines a request waiting for a slot
+type semaphoreWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// Creates a semaphore with a limit and a maximum number of waiters, where zero means there is no limit
+func newFairSemaphore(limit int, maxQueue int) *fairSemaphore {
+	return &fairSemaphore{
+		limit:    limit,
+		maxQueue: maxQueue,
+		queues:   make(map[string][]*semaphoreWaiter),
+	}
+}
+
+// Waits for a slot for the caller until the context is done
+func (s *fairSemaphore) acquire(ctx context.Context, caller string) error {
+	if s.limit <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	if s.active < s.limit && s.waiting == 0 {
+		s.active++
+		s.mu.Unlock()
+		return nil
+	}
+	if s.maxQueue > 0 && s.waiting >= s.maxQueue {
+		s.mu.Unlock()
+		return errQueueFull
+	}
+
+	// Wait in the caller's queue, adding the caller to the turn order if it wasn't waiting already
+	waiter := &semaphoreWaiter{ready: make(chan struct{})}
+	if len(s.queues[caller]) == 0 {
+		s.callers = append(s.callers, caller)
+	}
+	s.queues[caller] = append(s.queues[caller], waiter)
+	s.waiting++
+	s.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// Give back a slot that was granted while the wait ended
+		if waiter.granted {
+			s.active--
+			s.dispatch()
+			return ctx.Err()
+		}
+		s.removeWaiter(caller, waiter)
+		return ctx.Err()
+	}
+}
+
+// Gives a slot back
+func (s *fairSemaphore) release() {
+	if s.limit <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	s.dispatch()
+}
+
+// Grants the free slots to the waiting callers in turn, which must be called with the lock held
+func (s *fairSemaphore) dispatch() {
+	for s.active < s.limit && len(s.callers) > 0 {
+		caller := s.callers[0]
+		s.callers = s.callers[1:]
+
+		queue := s.queues[caller]
+		waiter := queue[0]
+		if len(queue) > 1 {
+			s.queues[caller] = queue[1:]
+			s.callers = append(s.callers, caller)
+		} else {
+			delete(s.queues, caller)
+		}
+
+		s.waiting--
+		s.active++
+		waiter.granted = true
+		close(waiter.ready)
+	}
+}
+
+// Removes a waiter that stopped waiting, which must be called with the lock held
+func (s *fairSemaphore) removeWaiter(caller string, waiter *semaphoreWaiter) {
+	queue := s.queues[caller]
+	for index, queued := range queue {
+		if queued == waiter {
+			queue = append(queue[:index], queue[index+1:]...)
+			s.waiting--
+			break
+		}
+	}
+	if len(queue) > 0 {
+		s.queues[caller] = queue
+		return
+	}
+
+	delete(s.queues, caller)
+	for index, queued := range s.callers {
+		if queued == caller {
+			s.callers = append(s.callers[:index], s.callers[index+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package intelligence
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts waiting for a slot of a semaphore and returns once the caller is queued, with the channel its result is
+// sent to
+func startSemaphoreWaiter(t *testing.T, semaphore *fairSemaphore, ctx context.Context, caller string) chan error {
+	t.Helper()
+	semaphore.mu.Lock()
+	waiting := semaphore.waiting
+	semaphore.mu.Unlock()
+
+	result := make(chan error, 1)
+	go func() { result <- semaphore.acquire(ctx, caller) }()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		semaphore.mu.Lock()
+		queued := semaphore.waiting > waiting
+		semaphore.mu.Unlock()
+		if queued {
+			return result
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not queued", caller)
+		}
+	}
+}
+
+func TestFairSemaphoreTurns(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		callers []string
+		order   []string
+	}{
+		{
+			name:    "callers take turns",
+			limit:   1,
+			callers: []string{"a", "a", "a", "b", "b"},
+			order:   []string{"a", "b", "a", "b", "a"},
+		},
+		{
+			name:    "a caller that joins late gets the next turn",
+			limit:   1,
+			callers: []string{"a", "a", "a", "a", "b", "c"},
+			order:   []string{"a", "b", "c", "a", "a", "a"},
+		},
+		{
+			name:    "one caller keeps its order",
+			limit:   1,
+			callers: []string{"a", "a", "a"},
+			order:   []string{"a", "a", "a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			semaphore := newFairSemaphore(test.limit, 0)
+			for slot := 0; slot < test.limit; slot++ {
+				if err := semaphore.acquire(context.Background(), "holder"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			granted := make(chan string, len(test.callers))
+			for _, caller := range test.callers {
+				result := startSemaphoreWaiter(t, semaphore, context.Background(), caller)
+				go func(caller string) {
+					if err := <-result; err == nil {
+						granted <- caller
+					}
+				}(caller)
+			}
+
+			// Free one slot at a time and record which caller gets it
+			var order []string
+			for range test.callers {
+				semaphore.release()
+				select {
+				case caller := <-granted:
+					order = append(order, caller)
+				case <-time.After(time.Second):
+					t.Fatalf("no waiter got the slot after %v", order)
+				}
+			}
+			if !reflect.DeepEqual(order, test.order) {
+				t.Errorf("got order %v, want %v", order, test.order)
+			}
+		})
+	}
+}
+
+func TestFairSemaphoreLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		maxQueue int
+		active   int
+		waiting  int
+		err      error
+	}{
+		{name: "no limit", limit: 0, active: 10},
+		{name: "free slot", limit: 2, active: 1},
+		{name: "full queue", limit: 1, maxQueue: 2, active: 1, waiting: 2, err: errQueueFull},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			semaphore := newFairSemaphore(test.limit, test.maxQueue)
+			for slot := 0; slot < test.active; slot++ {
+				if err := semaphore.acquire(context.Background(), "holder"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			for waiter := 0; waiter < test.waiting; waiter++ {
+				startSemaphoreWaiter(t, semaphore, ctx, "waiter")
+			}
+
+			acquired := make(chan error, 1)
+			go func() { acquired <- semaphore.acquire(ctx, "caller") }()
+			select {
+			case err := <-acquired:
+				if err != test.err {
+					t.Errorf("got error %v, want %v", err, test.err)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("acquire waited, want it to return %v", test.err)
+			}
+		})
+	}
+}
+
+func TestFairSemaphoreCanceledWaiter(t *testing.T) {
+	semaphore := newFairSemaphore(1, 0)
+	semaphore.acquire(context.Background(), "holder")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := startSemaphoreWaiter(t, semaphore, ctx, "a")
+	waiting := startSemaphoreWaiter(t, semaphore, context.Background(), "b")
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+
+	// The canceled waiter leaves the queue so the slot goes to the caller still waiting
+	semaphore.mu.Lock()
+	if semaphore.waiting != 1 || len(semaphore.callers) != 1 || semaphore.queues["a"] != nil {
+		t.Errorf("waiting = %d, callers = %v after the waiter was canceled", semaphore.waiting, semaphore.callers)
+	}
+	semaphore.mu.Unlock()
+	semaphore.release()
+	select {
+	case err := <-waiting:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiting caller didn't get the free slot")
+	}
+
+	semaphore.release()
+	if semaphore.active != 0 || semaphore.waiting != 0 {
+		t.Errorf("active = %d, waiting = %d after every slot was released", semaphore.active, semaphore.waiting)
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  ConcurrencyLimits
+		service Service
+		message string
+	}{
+		{
+			name:    "wait is too long",
+			limits:  ConcurrencyLimits{Global: 1, MaxWait: 10 * time.Millisecond},
+			service: Service{Name: "sentiment", Provider: "openai"},
+			message: "waited longer than 10ms",
+		},
+		{
+			name:    "queue is full",
+			limits:  ConcurrencyLimits{PerProvider: map[string]int{"openai": 1}, MaxQueue: 1, MaxWait: time.Second},
+			service: Service{Name: "sentiment", Provider: "openai"},
+			message: "too many requests are waiting",
+		},
+		{
+			name:    "service limit",
+			limits:  ConcurrencyLimits{MaxWait: 10 * time.Millisecond},
+			service: Service{Name: "sentiment", Provider: "openai", MaxConcurrency: 1},
+			message: "waited longer than 10ms",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newConcurrencyLimiter(test.limits)
+			release, err := limiter.acquire(context.Background(), test.service)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Fill the queue so the next request is over the limit
+			cancelWaiter := func() {}
+			if test.limits.MaxQueue > 0 {
+				ctx, cancel := context.WithCancel(withCaller(context.Background(), "waiter"))
+				defer cancel()
+				waiterDone := make(chan struct{})
+				cancelWaiter = func() {
+					cancel()
+					<-waiterDone
+				}
+				go func() {
+					limiter.acquire(ctx, test.service)
+					close(waiterDone)
+				}()
+				for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+					limiter.mu.Lock()
+					semaphore := limiter.providers[test.service.Provider]
+					limiter.mu.Unlock()
+					semaphore.mu.Lock()
+					waiting := semaphore.waiting
+					semaphore.mu.Unlock()
+					if waiting > 0 {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatal("waiter was not queued")
+					}
+				}
+			}
+
+			_, err = limiter.acquire(context.Background(), test.service)
+			intelligenceErr := AsError(err)
+			if intelligenceErr == nil || intelligenceErr.Code != ErrorCodeOverloaded || !intelligenceErr.Retryable || intelligenceErr.RetryAfter <= 0 {
+				t.Fatalf("got error %#v, want a retryable overloaded error", err)
+			}
+			if !strings.Contains(intelligenceErr.Message, test.message) {
+				t.Errorf("got message %q, want it to contain %q", intelligenceErr.Message, test.message)
+			}
+
+			// Once the slot is given back and nothing is waiting the next request gets it
+			cancelWaiter()
+			release()
+			next, err := limiter.acquire(context.Background(), test.service)
+			if err != nil {
+				t.Fatalf("error = %v after the slot was released", err)
+			}
+			next()
+		})
+	}
+}
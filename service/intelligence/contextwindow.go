@@ -0,0 +1,151 @@
+package intelligence
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Defines the tokens a service's model can take, which default to the context window of the model, and the param to
+// truncate when a request has more, where requests that have more are rejected when there is no param to truncate.
+// For embeddings, the tokens are the most each input can have.
+type ContextWindowConfig struct {
+	Tokens   int    `json:"tokens,omitempty"`
+	Truncate string `json:"truncate,omitempty"`
+}
+
+// Defines the context windows of the models that start with each prefix, where the longest prefix of a model is used
+var modelContextWindows = map[string]int{
+	"gpt-4o":                 128000,
+	"gpt-4o-mini":            128000,
+	"gpt-4.1":                1047576,
+	"gpt-4-turbo":            128000,
+	"gpt-4":                  8192,
+	"gpt-3.5-turbo":          16385,
+	"o1":                     200000,
+	"o3":                     200000,
+	"o4-mini":                200000,
+	"text-embedding-3-small": 8191,
+	"text-embedding-3-large": 8191,
+	"text-embedding-ada-002": 8191,
+}
+
+// Defines the tokens each chat message adds to its role and content, and that every completion adds for the reply
+const (
+	messageTokens = 3
+	replyTokens   = 3
+)
+
+// Defines how many times a param is truncated to fit a request in its context window, since truncating it can change
+// the max tokens computed from it
+const maxTruncateAttempts = 3
+
+// Returns the context window of a service, or zero if it isn't known
+func getContextWindow(service Service) int {
+	if service.ContextWindow.Tokens > 0 {
+		return service.ContextWindow.Tokens
+	}
+
+	contextWindow, longestPrefix := 0, 0
+	for prefix, tokens := range modelContextWindows {
+		if strings.HasPrefix(service.Model, prefix) && len(prefix) > longestPrefix {
+			contextWindow, longestPrefix = tokens, len(prefix)
+		}
+	}
+	return contextWindow
+}
+
+// Checks that a request to a service fits in the context window of its model, so it fails here instead of at the
+// provider, and returns the params with the param to truncate cut to fit when the service has one
+func (i *Intelligence) fitContextWindow(service Service, params map[string]interface{}) (map[string]interface{}, error) {
+	contextWindow := getContextWindow(service)
+	if contextWindow == 0 {
+		return params, nil
+	}
+	encoding := i.getEncoding(service.Model)
+	truncate := service.ContextWindow.Truncate
+
+	switch service.Type {
+	case "v1/completions":
+		for attempt := 0; ; attempt++ {
+			requestBody := i.getCompletionRequestBody(service, params)
+			promptTokens := countCompletionTokens(encoding, requestBody)
+			maxTokens, _ := requestBody["max_tokens"].(int)
+			overflow := promptTokens + maxTokens - contextWindow
+			if overflow <= 0 {
+				return params, nil
+			}
+
+			// Cut the overflow from the end of the param to truncate, unless there is nothing left to cut
+			text, ok := params[truncate].(string)
+			if truncate == "" || !ok || text == "" || attempt == maxTruncateAttempts {
+				return nil, newError(ErrorCodeValidation, service.Name, "request of %d prompt tokens and %d max tokens exceeds the context window of %d tokens of '%s'", promptTokens, maxTokens, contextWindow, service.Model)
+			}
+			params = copyParams(params)
+			params[truncate] = encoding.truncate(text, encoding.count(text)-overflow)
+		}
+	case "v1/embeddings":
+		texts, ok := params["texts"].([]interface{})
+		if !ok {
+			return params, nil
+		}
+		var truncated []interface{}
+		for index, text := range texts {
+			tokens := encoding.count(fmt.Sprintf("%v", text))
+			if tokens <= contextWindow {
+				continue
+			}
+			if truncate != "texts" {
+				return nil, newError(ErrorCodeValidation, service.Name, "text %d of %d tokens exceeds the context window of %d tokens of '%s'", index, tokens, contextWindow, service.Model)
+			}
+			if truncated == nil {
+				truncated = append([]interface{}(nil), texts...)
+			}
+			truncated[index] = encoding.truncate(fmt.Sprintf("%v", text), contextWindow)
+		}
+		if truncated != nil {
+			params = copyParams(params)
+			params["texts"] = truncated
+		}
+	}
+	return params, nil
+}
+
+// Returns the prompt tokens of a completions request body, counting the role and content of each message, the
+// images in them, and the response format
+func countCompletionTokens(encoding *Encoding, requestBody map[string]interface{}) int {
+	tokens := replyTokens
+	messages, _ := requestBody["messages"].([]CompletionsMessage)
+	for _, message := range messages {
+		tokens += messageTokens + encoding.count(message.Role)
+		switch content := message.Content.(type) {
+		case string:
+			tokens += encoding.count(content)
+		case []interface{}:
+			for _, part := range content {
+				if partMap, ok := part.(map[string]interface{}); ok {
+					if text, ok := partMap["text"].(string); ok {
+						tokens += encoding.count(text)
+					} else if _, ok := partMap["image_url"]; ok {
+						tokens += imageTokenEstimate
+					}
+				}
+			}
+		}
+	}
+	if responseFormat, ok := requestBody["response_format"]; ok {
+		if responseFormatBytes, err := json.Marshal(responseFormat); err == nil {
+			tokens += encoding.count(string(responseFormatBytes))
+		}
+	}
+	return tokens
+}
+
+// Returns a copy of params that can be changed without changing the params it was copied from
+func copyParams(params map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(params))
+	for key, value := range params {
+		copied[key] = value
+	}
+	return copied
+}
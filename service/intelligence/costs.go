@@ -0,0 +1,353 @@
+package intelligence
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defines what a provider charges for a model in US dollars, by million input, cached input and output tokens, and
+// by image, where images are priced by "size/quality", such as "1024x1024/hd", or by "size" alone. Requests sent
+// through the provider's Batch API are charged the price times the batch multiplier, such as 0.5 for half price, or
+// the full price when there is none.
+type Price struct {
+	InputPerMillion       float64            `json:"input_per_million,omitempty"`
+	CachedInputPerMillion float64            `json:"cached_input_per_million,omitempty"`
+	OutputPerMillion      float64            `json:"output_per_million,omitempty"`
+	Images                map[string]float64 `json:"images,omitempty"`
+	BatchMultiplier       float64            `json:"batch_multiplier,omitempty"`
+}
+
+// Defines the size and quality of generated images when a request doesn't set them
+const (
+	defaultImageSize    = "1024x1024"
+	defaultImageQuality = "standard"
+)
+
+// Defines the currency costs are reported in
+const costCurrency = "USD"
+
+// Loads prices from a JSON file that maps "provider/model" to its price, such as
+// {"openai/gpt-4o-mini": {"input_per_million": 0.15, "output_per_million": 0.6}}
+func LoadPrices(path string) (map[string]Price, error) {
+	pricesBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading prices file: %v", err)
+	}
+
+	var prices map[string]Price
+	if err := json.Unmarshal(pricesBytes, &prices); err != nil {
+		return nil, fmt.Errorf("error parsing prices file: %v", err)
+	}
+	return prices, nil
+}
+
+// Sets the prices of each provider and model that the cost of requests is computed from
+func (i *Intelligence) SetPrices(prices map[string]Price) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.prices = prices
+}
+
+// Returns the cost of the usage of a request to a service, or of a request in a provider batch, which is zero when
+// the model has no price
+func getCost(prices map[string]Price, service Service, requestBody []byte, usage Usage, batch bool) float64 {
+	price, exists := prices[service.Provider+"/"+service.Model]
+	if !exists {
+		return 0
+	}
+
+	// Cached prompt tokens are charged at the cached input price when the model has one
+	cachedPrice := price.CachedInputPerMillion
+	if cachedPrice == 0 {
+		cachedPrice = price.InputPerMillion
+	}
+	cost := float64(usage.PromptTokens-usage.CachedTokens)*price.InputPerMillion/1e6 +
+		float64(usage.CachedTokens)*cachedPrice/1e6 +
+		float64(usage.CompletionTokens)*price.OutputPerMillion/1e6
+
+	if usage.Images > 0 {
+		cost += float64(usage.Images) * getImagePrice(price, requestBody)
+	}
+	if batch && price.BatchMultiplier > 0 {
+		cost *= price.BatchMultiplier
+	}
+	return cost
+}
+
+// Returns the price of an image by the size and quality the request asked for
+func getImagePrice(price Price, requestBody []byte) float64 {
+	var request struct {
+		Size    string `json:"size"`
+		Quality string `json:"quality"`
+	}
+	json.Unmarshal(requestBody, &request)
+	if request.Size == "" {
+		request.Size = defaultImageSize
+	}
+	if request.Quality == "" {
+		request.Quality = defaultImageQuality
+	}
+
+	if imagePrice, exists := price.Images[request.Size+"/"+request.Quality]; exists {
+		return imagePrice
+	}
+	return price.Images[request.Size]
+}
+
+// Defines the usage and cost of a group of requests in a cost report
+type CostRow struct {
+	Service   string `json:"service,omitempty"`
+	Principal string `json:"principal,omitempty"`
+	Day       string `json:"day,omitempty"`
+	Usage
+}
+
+// Defines the usage of a principal for a service in a day
+type serviceUsage struct {
+	principal string
+	service   string
+	day       string
+	usage     Usage
+}
+
+// Returns the usage of every principal by service for each day from one day to another, inclusive
+func (s *UsageStore) serviceUsage(from string, to string) []serviceUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var usages []serviceUsage
+	for principal, entry := range s.usage {
+		for service, days := range entry.Services {
+			for day, usage := range days {
+				if day >= from && day <= to {
+					usages = append(usages, serviceUsage{principal: principal, service: service, day: day, usage: *usage})
+				}
+			}
+		}
+	}
+	return usages
+}
+
+// Reports the cost of requests from the from date to the to date, which default to this month so far, grouped by
+// any of service, principal and day as given by the group_by parameter. Admins, and every request when requests
+// aren't authenticated, get the cost of every principal, or of the one named by the principal parameter.
+func (i *Intelligence) CostsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{
+				"errors": Errors{"request": newError(ErrorCodeValidation, "", "method not allowed")},
+			})
+			return
+		}
+		ctx, err := i.Authenticate(r)
+		if err != nil {
+			writeAuthError(w, Errors{"request": AsError(err)})
+			return
+		}
+
+		// Get the dates and groups of the report
+		now := time.Now().UTC()
+		query := r.URL.Query()
+		from := query.Get("from")
+		if from == "" {
+			from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Format(usageDayLayout)
+		}
+		to := query.Get("to")
+		if to == "" {
+			to = now.Format(usageDayLayout)
+		}
+		for name, date := range map[string]string{"from": from, "to": to} {
+			if _, err := time.Parse(usageDayLayout, date); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"errors": Errors{"request": newError(ErrorCodeValidation, "", "'%s' must be a date like %s", name, usageDayLayout)},
+				})
+				return
+			}
+		}
+		groupBy := []string{"service", "principal"}
+		if value := query.Get("group_by"); value != "" {
+			groupBy = strings.Split(value, ",")
+			for _, group := range groupBy {
+				if group != "service" && group != "principal" && group != "day" {
+					writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+						"errors": Errors{"request": newError(ErrorCodeValidation, "", "'group_by' must be a list of service, principal and day")},
+					})
+					return
+				}
+			}
+		}
+
+		// Only report the principal's own cost unless it can see everyone's
+		principalName := query.Get("principal")
+		if principal := GetPrincipal(ctx); principal != nil && !principal.Admin {
+			principalName = principal.ID
+		}
+
+		i.mu.RLock()
+		store := i.usage
+		i.mu.RUnlock()
+
+		// Add up the usage of each group
+		var total Usage
+		rowsByKey := make(map[string]*CostRow)
+		for _, usage := range store.serviceUsage(from, to) {
+			if principalName != "" && usage.principal != principalName {
+				continue
+			}
+			var row CostRow
+			for _, group := range groupBy {
+				switch group {
+				case "service":
+					row.Service = usage.service
+				case "principal":
+					row.Principal = usage.principal
+				case "day":
+					row.Day = usage.day
+				}
+			}
+			key := row.Service + "\x00" + row.Principal + "\x00" + row.Day
+			if existing, exists := rowsByKey[key]; exists {
+				existing.add(usage.usage)
+			} else {
+				row.Usage = usage.usage
+				rowsByKey[key] = &row
+			}
+			total.add(usage.usage)
+		}
+
+		keys := make([]string, 0, len(rowsByKey))
+		for key := range rowsByKey {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		rows := make([]CostRow, 0, len(keys))
+		for _, key := range keys {
+			row := *rowsByKey[key]
+			row.Cost = roundCost(row.Cost)
+			rows = append(rows, row)
+		}
+		total.Cost = roundCost(total.Cost)
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"from":     from,
+			"to":       to,
+			"currency": costCurrency,
+			"total":    total,
+			"costs":    rows,
+		})
+	})
+}
+
+// Returns a cost rounded to a millionth of a dollar, which hides the error of adding up many small costs
+func roundCost(cost float64) float64 {
+	return math.Round(cost*1e6) / 1e6
+}
+
+// Counts the usage and cost of requests by service and principal since the service started
+type usageMetrics struct {
+	values map[usageMetricsKey]*Usage
+	mu     sync.Mutex
+}
+
+// Defines the service and principal usage metrics are counted by
+type usageMetricsKey struct {
+	service   string
+	principal string
+}
+
+// Creates usage metrics with nothing counted
+func newUsageMetrics() *usageMetrics {
+	return &usageMetrics{values: make(map[usageMetricsKey]*Usage)}
+}
+
+// Adds the usage of a request to a service by a principal
+func (m *usageMetrics) record(principal string, service string, usage Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := usageMetricsKey{service: service, principal: principal}
+	total, exists := m.values[key]
+	if !exists {
+		total = &Usage{}
+		m.values[key] = total
+	}
+	total.add(usage)
+}
+
+// Reports the usage and cost of requests since the service started in the Prometheus text format. Only admins can
+// get the metrics when requests are authenticated.
+func (i *Intelligence) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := i.Authenticate(r)
+		if err != nil {
+			writeAuthError(w, Errors{"request": AsError(err)})
+			return
+		}
+		if principal := GetPrincipal(ctx); principal != nil && !principal.Admin {
+			writeAuthError(w, Errors{"request": newError(ErrorCodeForbidden, "", "'%s' is not allowed to get metrics", principal.Name)})
+			return
+		}
+
+		i.mu.RLock()
+		metrics := i.metrics
+		i.mu.RUnlock()
+
+		metrics.mu.Lock()
+		keys := make([]usageMetricsKey, 0, len(metrics.values))
+		values := make(map[usageMetricsKey]Usage, len(metrics.values))
+		for key, usage := range metrics.values {
+			keys = append(keys, key)
+			values[key] = *usage
+		}
+		metrics.mu.Unlock()
+		sort.Slice(keys, func(a, b int) bool {
+			if keys[a].service != keys[b].service {
+				return keys[a].service < keys[b].service
+			}
+			return keys[a].principal < keys[b].principal
+		})
+
+		var b strings.Builder
+		for _, metric := range []struct {
+			name  string
+			help  string
+			label string
+			value func(Usage) float64
+		}{
+			{"intelligence_requests_total", "Requests made to providers.", "", func(u Usage) float64 { return float64(u.Requests) }},
+			{"intelligence_tokens_total", "Tokens used by requests to providers.", `type="prompt"`, func(u Usage) float64 { return float64(u.PromptTokens) }},
+			{"intelligence_tokens_total", "", `type="cached"`, func(u Usage) float64 { return float64(u.CachedTokens) }},
+			{"intelligence_tokens_total", "", `type="completion"`, func(u Usage) float64 { return float64(u.CompletionTokens) }},
+			{"intelligence_images_total", "Images generated by requests to providers.", "", func(u Usage) float64 { return float64(u.Images) }},
+			{"intelligence_cost_usd_total", "Cost of requests to providers in US dollars.", "", func(u Usage) float64 { return u.Cost }},
+		} {
+			if metric.help != "" {
+				fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+			}
+			for _, key := range keys {
+				labels := fmt.Sprintf(`service="%s",principal="%s"`, escapeMetricLabel(key.service), escapeMetricLabel(key.principal))
+				if metric.label != "" {
+					labels += "," + metric.label
+				}
+				fmt.Fprintf(&b, "%s{%s} %s\n", metric.name, labels, strconv.FormatFloat(metric.value(values[key]), 'f', -1, 64))
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(b.String()))
+	})
+}
+
+// Returns a metric label value with its backslashes, quotes and newlines escaped
+func escapeMetricLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
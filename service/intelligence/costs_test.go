@@ -0,0 +1,119 @@
+package intelligence
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestGetCost(t *testing.T) {
+	prices := map[string]Price{
+		"openai/gpt-4o-mini": {InputPerMillion: 0.15, CachedInputPerMillion: 0.075, OutputPerMillion: 0.6, BatchMultiplier: 0.5},
+		"openai/gpt-4o":      {InputPerMillion: 2.5, OutputPerMillion: 10},
+		"openai/dall-e-3":    {Images: map[string]float64{"1024x1024/standard": 0.04, "1024x1024/hd": 0.08, "1792x1024": 0.08}},
+	}
+	completions := Service{Name: "sentiment", Provider: "openai", Model: "gpt-4o-mini"}
+	images := Service{Name: "generated_image", Provider: "openai", Model: "dall-e-3", Type: "v1/images/generations"}
+	tests := []struct {
+		name        string
+		service     Service
+		requestBody string
+		usage       Usage
+		batch       bool
+		cost        float64
+	}{
+		{
+			name:    "tokens",
+			service: completions,
+			usage:   Usage{PromptTokens: 1000000, CompletionTokens: 1000000},
+			cost:    0.75,
+		},
+		{
+			name:    "cached tokens",
+			service: completions,
+			usage:   Usage{PromptTokens: 1000000, CachedTokens: 500000},
+			cost:    0.1125,
+		},
+		{
+			name:    "batch multiplier",
+			service: completions,
+			usage:   Usage{PromptTokens: 1000000, CompletionTokens: 1000000},
+			batch:   true,
+			cost:    0.375,
+		},
+		{
+			name:    "batch without a multiplier",
+			service: Service{Provider: "openai", Model: "gpt-4o"},
+			usage:   Usage{PromptTokens: 1000000},
+			batch:   true,
+			cost:    2.5,
+		},
+		{
+			name:    "no price",
+			service: Service{Provider: "openai", Model: "unknown"},
+			usage:   Usage{PromptTokens: 1000000},
+		},
+		{
+			name:    "default image size and quality",
+			service: images,
+			usage:   Usage{Images: 2},
+			cost:    0.08,
+		},
+		{
+			name:        "image size and quality",
+			service:     images,
+			requestBody: `{"size":"1024x1024","quality":"hd"}`,
+			usage:       Usage{Images: 1},
+			cost:        0.08,
+		},
+		{
+			name:        "image priced by size",
+			service:     images,
+			requestBody: `{"size":"1792x1024","quality":"hd"}`,
+			usage:       Usage{Images: 1},
+			cost:        0.08,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cost := getCost(prices, test.service, []byte(test.requestBody), test.usage, test.batch)
+			if math.Abs(cost-test.cost) > 1e-9 {
+				t.Errorf("got cost %v, want %v", cost, test.cost)
+			}
+		})
+	}
+}
+
+func TestProviderBatchCost(t *testing.T) {
+	provider := newStubBatchProvider(t)
+	i := newTestIntelligence(t, provider.roundTrip)
+	i.SetPrices(map[string]Price{"openai/gpt-4o-mini": {InputPerMillion: 0.15, OutputPerMillion: 0.6, BatchMultiplier: 0.5}})
+	ctx := WithPrincipal(context.Background(), &Principal{ID: "key:ada", Name: "ada", Services: []string{"*"}})
+
+	batches := make(map[string]*ProviderBatch)
+	_, errors := i.doProviderBatchRequests(ctx, Requests{"positive": {"model": "sentiment", "text": "I love it"}}, nil, func(key string, batch *ProviderBatch) {
+		batches[key] = batch
+	})
+	if len(errors) != 0 || len(batches) != 1 {
+		t.Fatalf("got errors %v and batches %v, want one batch", errors, batches)
+	}
+
+	// The batch keeps the body of each request for the cost of its result
+	provider.finish()
+	for _, batch := range batches {
+		if len(batch.Bodies["positive"]) == 0 {
+			t.Errorf("got bodies %v, want the body of 'positive'", batch.Bodies)
+		}
+		if _, _, finished := i.getProviderBatchResults(ctx, batch); !finished {
+			t.Fatal("got the batch unfinished")
+		}
+	}
+
+	// The stub provider reports 10 prompt and 2 completion tokens, which cost half the direct price in a batch
+	report := i.usage.report("key:ada", time.Now())
+	if cost := (10*0.15 + 2*0.6) / 1e6 * 0.5; math.Abs(report.Day.Cost-cost) > 1e-12 {
+		t.Errorf("got cost %v, want %v", report.Day.Cost, cost)
+	}
+}
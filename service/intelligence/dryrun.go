@@ -0,0 +1,142 @@
+package intelligence
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+)
+
+// Defines what a request to a service would send to its provider, without sending it. Pipelines have a dry run for
+// each step, where steps that use the results of other steps only have the request they would be given.
+type DryRun struct {
+	Service       Service                `json:"service"`
+	Params        map[string]interface{} `json:"params"`
+	URL           string                 `json:"url,omitempty"`
+	Request       interface{}            `json:"request,omitempty"`
+	MaxTokens     int                    `json:"max_tokens,omitempty"`
+	EstimatedCost float64                `json:"estimated_cost"`
+	Steps         map[string]*DryRun     `json:"steps,omitempty"`
+	DependsOn     []string               `json:"depends_on,omitempty"`
+}
+
+// Returns what a request to a service would send to its provider, with the params validated and their defaults
+// applied, without waiting for limits or quotas or sending anything. The estimated cost counts the prompt tokens with
+// the model's encoding and every max token as output, so it is what the request costs at most.
+func (i *Intelligence) DryRun(ctx context.Context, modelName string, params map[string]interface{}) (*DryRun, error) {
+	return i.dryRun(ctx, modelName, params, false)
+}
+
+// Returns the dry run of a request, which is estimated at the provider's batch price when it would be sent in a
+// provider batch
+func (i *Intelligence) dryRun(ctx context.Context, modelName string, params map[string]interface{}, batch bool) (*DryRun, error) {
+	i.mu.RLock()
+	service, exists := i.config[modelName]
+	prices := i.prices
+	i.mu.RUnlock()
+	if !exists {
+		return nil, newError(ErrorCodeNotFound, modelName, "model '%s' not found", modelName)
+	}
+
+	preparedParams, err := i.prepareParams(service, params)
+	if err != nil {
+		return nil, err
+	}
+	if preparedParams, err = i.fitContextWindow(service, preparedParams); err != nil {
+		return nil, err
+	}
+	dryRun := &DryRun{Service: service, Params: preparedParams}
+	if service.Type == "pipeline" {
+		if err := i.dryRunPipeline(ctx, service, preparedParams, dryRun); err != nil {
+			return nil, err
+		}
+		return dryRun, nil
+	}
+
+	// Render the request body the same way the request would
+	var requestBody interface{}
+	switch service.Type {
+	case "v1/completions":
+		requestBodyMap := i.getCompletionRequestBody(service, preparedParams)
+		dryRun.MaxTokens, _ = requestBodyMap["max_tokens"].(int)
+		requestBody = requestBodyMap
+	case "v1/embeddings":
+		requestBody, err = getEmbeddingsRequestBody(service, preparedParams)
+	case "v1/moderations":
+		requestBody, err = getModerationRequestBody(service, preparedParams)
+	case "v1/images/generations":
+		requestBody, err = getImageGenerationsRequestBody(service, preparedParams)
+	default:
+		err = newError(ErrorCodeInternal, service.Name, "unsupported service type: %s", service.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dryRun.Request = requestBody
+
+	if dryRun.URL, err = i.getServiceURL(service); err != nil {
+		return nil, err
+	}
+
+	// Estimate the cost from the rendered body, counting one image for image generations
+	requestBytes, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, err
+	}
+	usage := Usage{
+		PromptTokens:     estimateRequestTokens(i.getEncoding(service.Model), requestBytes) - dryRun.MaxTokens,
+		CompletionTokens: dryRun.MaxTokens,
+	}
+	if service.Type == "v1/images/generations" {
+		usage.Images = 1
+	}
+	dryRun.EstimatedCost = roundCost(getCost(prices, service, requestBytes, usage, batch))
+
+	return dryRun, nil
+}
+
+// Adds a dry run of each step of a pipeline, where the steps that use the results of other steps can't be rendered
+// and only have the request they would be given and the steps they wait for
+func (i *Intelligence) dryRunPipeline(ctx context.Context, service Service, params map[string]interface{}, dryRun *DryRun) error {
+	requests := make(Requests, len(service.Pipeline.Steps))
+	for key, step := range service.Pipeline.Steps {
+		request := Request(expandParams(step.Params, params).(map[string]interface{}))
+		model := step.Model
+		if model == "" {
+			model = key
+		}
+		request["model"] = model
+		requests[key] = request
+	}
+	if authErrors := authorizeRequests(ctx, requests); len(authErrors) > 0 {
+		return getPipelineError(service, authErrors)
+	}
+	dependencies, _ := getRequestDependencies(requests)
+
+	dryRun.Steps = make(map[string]*DryRun, len(requests))
+	for key, request := range requests {
+		if len(dependencies[key]) > 0 {
+			dependsOn := append([]string(nil), dependencies[key]...)
+			sort.Strings(dependsOn)
+			i.mu.RLock()
+			stepService := i.config[request["model"].(string)]
+			i.mu.RUnlock()
+			dryRun.Steps[key] = &DryRun{Service: stepService, Request: request, DependsOn: dependsOn}
+			continue
+		}
+
+		stepDryRun, err := i.DryRun(ctx, request["model"].(string), request)
+		if err != nil {
+			stepErr := AsError(err)
+			return newError(stepErr.Code, service.Name, "step '%s' of '%s' pipeline failed: %s", key, service.Name, stepErr.Message)
+		}
+		dryRun.Steps[key] = stepDryRun
+		dryRun.EstimatedCost = roundCost(dryRun.EstimatedCost + stepDryRun.EstimatedCost)
+	}
+	return nil
+}
+
+// Determines whether a request asks for a dry run instead of being sent
+func isDryRunRequest(request Request) bool {
+	dryRun, ok := request["dry_run"].(bool)
+	return ok && dryRun
+}
@@ -0,0 +1,65 @@
+package intelligence
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProviderBatchDryRun(t *testing.T) {
+	// The provider fails the test if a dry run reaches it
+	i := newTestIntelligence(t, nil)
+	i.SetPrices(map[string]Price{"openai/gpt-4o-mini": {InputPerMillion: 0.15, OutputPerMillion: 0.6, BatchMultiplier: 0.5}})
+	request := Request{"model": "sentiment", "text": "I love it", "dry_run": true}
+
+	results, errors := i.doProviderBatchRequests(context.Background(), Requests{"positive": request}, nil, func(key string, batch *ProviderBatch) {
+		t.Errorf("got batch %+v for a dry run", batch)
+	})
+	if len(errors) != 0 {
+		t.Fatalf("got errors %v, want a dry run", errors)
+	}
+	dryRun, ok := results["positive"].(*DryRun)
+	if !ok {
+		t.Fatalf("got result %#v, want a dry run", results["positive"])
+	}
+
+	// A request in a provider batch is estimated at the batch price
+	direct, err := i.DryRun(context.Background(), "sentiment", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if direct.EstimatedCost == 0 || math.Abs(dryRun.EstimatedCost-direct.EstimatedCost/2) > 1e-6 {
+		t.Errorf("got estimated cost %v, want half of the direct %v", dryRun.EstimatedCost, direct.EstimatedCost)
+	}
+}
+
+func TestBulkDryRun(t *testing.T) {
+	i := newTestIntelligence(t, nil)
+	request := httptest.NewRequest(http.MethodPost, "/intelligence/bulk", strings.NewReader(
+		`{"id": 1, "model": "sentiment", "params": {"text": "I love it", "dry_run": true}}`+"\n"+
+			`{"id": 2, "model": "sentiment", "text": "It broke", "dry_run": true}`+"\n",
+	))
+	recorder := httptest.NewRecorder()
+	i.BulkHandler(2).ServeHTTP(recorder, request)
+
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d results, want 2: %s", len(lines), recorder.Body)
+	}
+	for _, line := range lines {
+		var result struct {
+			Error  *Error  `json:"error"`
+			Result *DryRun `json:"result"`
+		}
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Error != nil || result.Result == nil || result.Result.Request == nil {
+			t.Errorf("got %s, want a dry run", line)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package intelligence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Defines the codes that classify intelligence errors
+const (
+	ErrorCodeValidation          = "validation"
+	ErrorCodeNotFound            = "not_found"
+	ErrorCodeUpstreamRateLimited = "upstream_rate_limited"
+	ErrorCodeUpstreamError       = "upstream_error"
+	ErrorCodeTimeout             = "timeout"
+	ErrorCodeInternal            = "internal"
+	ErrorCodeDependencyFailed    = "dependency_failed"
+	ErrorCodeOverloaded          = "overloaded"
+	ErrorCodeUnauthorized        = "unauthorized"
+	ErrorCodeForbidden           = "forbidden"
+	ErrorCodeQuotaExceeded       = "quota_exceeded"
+)
+
+// Defines an error with a code, the service it came from and whether the request can be retried
+type Error struct {
+	Code       string        `json:"code"`
+	Message    string        `json:"message"`
+	Service    string        `json:"service,omitempty"`
+	Retryable  bool          `json:"retryable"`
+	StatusCode int           `json:"-"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+// Returns the error message
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Creates an error with a code for a service
+func newError(code string, service string, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:      code,
+		Message:   fmt.Sprintf(format, args...),
+		Service:   service,
+		Retryable: code == ErrorCodeUpstreamRateLimited || code == ErrorCodeTimeout || code == ErrorCodeOverloaded,
+	}
+}
+
+// Creates an error for a failed service response based on its status code
+func newServiceResponseError(service Service, resp *http.Response, message string) *Error {
+	var err *Error
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		err = newError(ErrorCodeUpstreamRateLimited, service.Name, "%s", message)
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusGatewayTimeout:
+		err = newError(ErrorCodeTimeout, service.Name, "%s", message)
+	default:
+		err = newError(ErrorCodeUpstreamError, service.Name, "%s", message)
+		err.Retryable = resp.StatusCode >= http.StatusInternalServerError
+	}
+	err.StatusCode = resp.StatusCode
+
+	// Keep the time the provider asked to wait before retrying
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, parseErr := strconv.Atoi(retryAfter); parseErr == nil {
+			err.RetryAfter = time.Duration(seconds) * time.Second
+		} else if date, parseErr := http.ParseTime(retryAfter); parseErr == nil {
+			err.RetryAfter = time.Until(date)
+		}
+	}
+
+	return err
+}
+
+// Creates an error for a service request that could not be completed
+func newServiceRequestError(service Service, requestErr error) *Error {
+	var netErr net.Error
+	if errors.Is(requestErr, context.DeadlineExceeded) || (errors.As(requestErr, &netErr) && netErr.Timeout()) {
+		return newError(ErrorCodeTimeout, service.Name, "request to '%s' service timed out: %v", service.Name, requestErr)
+	}
+	err := newError(ErrorCodeUpstreamError, service.Name, "error making request to '%s' service: %v", service.Name, requestErr)
+	err.Retryable = !errors.Is(requestErr, context.Canceled)
+	return err
+}
+
+// Converts any error to an intelligence error, classifying errors without a code as internal
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	var intelligenceErr *Error
+	if errors.As(err, &intelligenceErr) {
+		return intelligenceErr
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return newError(ErrorCodeTimeout, "", "%v", err)
+	}
+	return newError(ErrorCodeInternal, "", "%v", err)
+}
+
+// Returns the HTTP status code for an error code
+func getErrorCodeStatusCode(code string) int {
+	switch code {
+	case ErrorCodeValidation:
+		return http.StatusBadRequest
+	case ErrorCodeNotFound:
+		return http.StatusNotFound
+	case ErrorCodeUpstreamRateLimited, ErrorCodeQuotaExceeded:
+		return http.StatusTooManyRequests
+	case ErrorCodeUpstreamError:
+		return http.StatusBadGateway
+	case ErrorCodeTimeout:
+		return http.StatusGatewayTimeout
+	case ErrorCodeDependencyFailed:
+		return http.StatusFailedDependency
+	case ErrorCodeOverloaded:
+		return http.StatusServiceUnavailable
+	case ErrorCodeUnauthorized:
+		return http.StatusUnauthorized
+	case ErrorCodeForbidden:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Returns the HTTP status code for a batch of requests with errors, which is Multi-Status when only some requests
+// failed, and otherwise the status of the most severe error
+func getErrorsStatusCode(requestCount int, errors Errors) int {
+	if len(errors) < requestCount {
+		return http.StatusMultiStatus
+	}
+
+	// Rank the codes so server and provider failures take precedence over client errors
+	severity := []string{
+		ErrorCodeInternal,
+		ErrorCodeUpstreamError,
+		ErrorCodeTimeout,
+		ErrorCodeOverloaded,
+		ErrorCodeUpstreamRateLimited,
+		ErrorCodeQuotaExceeded,
+		ErrorCodeUnauthorized,
+		ErrorCodeForbidden,
+		ErrorCodeNotFound,
+		ErrorCodeValidation,
+		ErrorCodeDependencyFailed,
+	}
+	for _, code := range severity {
+		for _, err := range errors {
+			if err.Code == code {
+				return getErrorCodeStatusCode(code)
+			}
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// Returns the longest time the provider asked to wait before retrying any of the requests
+func getErrorsRetryAfter(errors Errors) time.Duration {
+	var retryAfter time.Duration
+	for _, err := range errors {
+		if err.RetryAfter > retryAfter {
+			retryAfter = err.RetryAfter
+		}
+	}
+	return retryAfter
+}
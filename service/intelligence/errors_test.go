@@ -0,0 +1,55 @@
+package intelligence
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGetErrorsStatusCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		requests   int
+		codes      []string
+		statusCode int
+	}{
+		{name: "some requests failed", requests: 3, codes: []string{ErrorCodeUpstreamError}, statusCode: http.StatusMultiStatus},
+		{name: "some requests rate limited", requests: 2, codes: []string{ErrorCodeUpstreamRateLimited}, statusCode: http.StatusMultiStatus},
+		{name: "rate limited", requests: 1, codes: []string{ErrorCodeUpstreamRateLimited}, statusCode: http.StatusTooManyRequests},
+		{name: "quota exceeded", requests: 2, codes: []string{ErrorCodeQuotaExceeded, ErrorCodeQuotaExceeded}, statusCode: http.StatusTooManyRequests},
+		{name: "upstream error", requests: 1, codes: []string{ErrorCodeUpstreamError}, statusCode: http.StatusBadGateway},
+		{name: "timeout", requests: 1, codes: []string{ErrorCodeTimeout}, statusCode: http.StatusGatewayTimeout},
+		{name: "upstream error over timeout", requests: 2, codes: []string{ErrorCodeTimeout, ErrorCodeUpstreamError}, statusCode: http.StatusBadGateway},
+		{name: "timeout over rate limit", requests: 2, codes: []string{ErrorCodeUpstreamRateLimited, ErrorCodeTimeout}, statusCode: http.StatusGatewayTimeout},
+		{name: "rate limit over validation", requests: 2, codes: []string{ErrorCodeValidation, ErrorCodeUpstreamRateLimited}, statusCode: http.StatusTooManyRequests},
+		{name: "validation over dependency", requests: 2, codes: []string{ErrorCodeDependencyFailed, ErrorCodeValidation}, statusCode: http.StatusBadRequest},
+		{name: "dependency failed", requests: 1, codes: []string{ErrorCodeDependencyFailed}, statusCode: http.StatusFailedDependency},
+		{name: "overloaded", requests: 1, codes: []string{ErrorCodeOverloaded}, statusCode: http.StatusServiceUnavailable},
+		{name: "internal over everything", requests: 3, codes: []string{ErrorCodeUpstreamError, ErrorCodeInternal, ErrorCodeTimeout}, statusCode: http.StatusInternalServerError},
+		{name: "unknown code", requests: 1, codes: []string{"unknown"}, statusCode: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := make(Errors)
+			for index, code := range test.codes {
+				errors[strconv.Itoa(index)] = &Error{Code: code}
+			}
+			if statusCode := getErrorsStatusCode(test.requests, errors); statusCode != test.statusCode {
+				t.Errorf("got status %d, want %d", statusCode, test.statusCode)
+			}
+		})
+	}
+}
+
+func TestGetErrorsRetryAfter(t *testing.T) {
+	errors := Errors{
+		"a": &Error{Code: ErrorCodeUpstreamRateLimited, RetryAfter: 3 * time.Second},
+		"b": &Error{Code: ErrorCodeQuotaExceeded, RetryAfter: 7 * time.Second},
+		"c": &Error{Code: ErrorCodeValidation},
+	}
+	if retryAfter := getErrorsRetryAfter(errors); retryAfter != 7*time.Second {
+		t.Errorf("got %v, want the longest wait of 7s", retryAfter)
+	}
+}
@@ -8,17 +8,31 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 type Intelligence struct {
-	config     map[string]Service
-	httpClient *http.Client
-	mu         sync.RWMutex
+	config            map[string]Service
+	httpClient        *http.Client
+	jobs              *jobRunner
+	concurrency       *concurrencyLimiter
+	rateLimits        *rateLimiter
+	apiKeys           map[string]APIKey
+	jwt               *jwtValidator
+	usage             *UsageStore
+	prices            map[string]Price
+	metrics           *usageMetrics
+	encodings         map[string]*Encoding
+	callbacks         *http.Client
+	callbackHosts     map[string]bool
+	batchReservations map[string]func()
+	mu                sync.RWMutex
 }
 
 // Initializes a new Intelligence object loding the configuration from a file
@@ -27,7 +41,13 @@ func NewIntelligence(configPath string) (*Intelligence, error) {
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		usage:             newUsageStore(""),
+		concurrency:       newConcurrencyLimiter(DefaultConcurrencyLimits),
+		rateLimits:        newRateLimiter(nil, DefaultConcurrencyLimits.MaxWait),
+		batchReservations: make(map[string]func()),
 	}
+	intel.metrics = newUsageMetrics()
+	intel.callbacks = intel.newCallbackClient()
 	if err := intel.loadConfig(configPath); err != nil {
 		return nil, err
 	}
@@ -52,6 +72,11 @@ func (i *Intelligence) loadConfig(filePath string) error {
 		config[key] = service
 	}
 
+	// Ensure pipelines only call services that exist and never call themselves
+	if err := validatePipelines(config); err != nil {
+		return err
+	}
+
 	i.mu.Lock()
 	i.config = config
 	i.mu.Unlock()
@@ -61,13 +86,16 @@ func (i *Intelligence) loadConfig(filePath string) error {
 
 // Defines a service with its parameters and configuration
 type Service struct {
-	Name        string
-	Model       string                 `json:"model"`
-	Provider    string                 `json:"provider"`
-	Type        string                 `json:"type"`
-	Params      map[string]ParamConfig `json:"params"`
-	Completions CompletionsConfig      `json:"completions,omitempty"`
-	Images      ImagesConfig           `json:"images,omitempty"`
+	Name           string                 `json:"name"`
+	Model          string                 `json:"model"`
+	Provider       string                 `json:"provider"`
+	Type           string                 `json:"type"`
+	Params         map[string]ParamConfig `json:"params"`
+	Completions    CompletionsConfig      `json:"completions,omitempty"`
+	Images         ImagesConfig           `json:"images,omitempty"`
+	Pipeline       PipelineConfig         `json:"pipeline,omitempty"`
+	MaxConcurrency int                    `json:"max_concurrency,omitempty"`
+	ContextWindow  ContextWindowConfig    `json:"context_window,omitempty"`
 }
 
 // Defines whether a parameter is required and provides default values
@@ -122,6 +150,18 @@ type ImagesGenerationsConfig struct {
 	MaxCount int `json:"max_count,omitempty"`
 }
 
+// Defines the steps of a pipeline and how its output is projected from their results
+type PipelineConfig struct {
+	Steps  map[string]PipelineStep `json:"steps,omitempty"`
+	Output interface{}             `json:"output,omitempty"`
+}
+
+// Defines a pipeline step that calls a service with params mapped from the pipeline params and other step results
+type PipelineStep struct {
+	Model  string                 `json:"model,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
 // Defines the payload for completion requests
 type CompletionsRequest struct {
 	Model       string               `json:"model"`
@@ -167,57 +207,93 @@ type Request map[string]interface{}
 type Results map[string]interface{}
 
 // Defines a map of errors encountered during request processing
-type Errors map[string]string
+type Errors map[string]*Error
 
 // Handles incoming intelligence requests based on the specified service model
 func (i *Intelligence) GetIntelligence(ctx context.Context, modelName string, params map[string]interface{}) (interface{}, error) {
+	return i.getIntelligence(ctx, modelName, params, nil)
+}
+
+// Handles incoming intelligence requests, passing completion deltas to the callback as they are generated
+func (i *Intelligence) GetIntelligenceStream(ctx context.Context, modelName string, params map[string]interface{}, onDelta func(delta string)) (interface{}, error) {
+	return i.getIntelligence(ctx, modelName, params, onDelta)
+}
+
+// Resolves the service for a model and calls it, streaming completions when a delta callback is provided
+func (i *Intelligence) getIntelligence(ctx context.Context, modelName string, params map[string]interface{}, onDelta func(delta string)) (interface{}, error) {
 	i.mu.RLock()
 	service, exists := i.config[modelName] // Retrieve the service configuration
 	i.mu.RUnlock()
 	if !exists {
-		return nil, fmt.Errorf("model '%s' not found", modelName)
+		return nil, newError(ErrorCodeNotFound, modelName, "model '%s' not found", modelName)
 	}
 
-	// Prepare and validate parameters
+	// Prepare and validate parameters, and fit them in the context window of the model
 	preparedParams, err := i.prepareParams(service, params)
 	if err != nil {
 		return nil, err
 	}
+	if preparedParams, err = i.fitContextWindow(service, preparedParams); err != nil {
+		return nil, err
+	}
+
+	// Wait for a slot to send the request, except for pipelines whose steps wait for their own slots
+	if service.Type != "pipeline" {
+		i.mu.RLock()
+		limiter := i.concurrency
+		i.mu.RUnlock()
+		release, err := limiter.acquire(ctx, service)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
 
 	// Call the appropriate service based on its type
 	var result interface{}
 	switch service.Type {
 	case "v1/completions":
-		result, err = i.getCompletion(ctx, service, preparedParams)
+		if onDelta != nil {
+			result, err = i.getCompletionStream(ctx, service, preparedParams, onDelta)
+		} else {
+			result, err = i.getCompletion(ctx, service, preparedParams)
+		}
 	case "v1/embeddings":
 		result, err = i.getEmbeddings(ctx, service, preparedParams)
 	case "v1/moderations":
 		result, err = i.getModeration(ctx, service, preparedParams)
 	case "v1/images/generations":
 		result, err = i.getImageGenerations(ctx, service, preparedParams)
+	case "pipeline":
+		result, err = i.getPipeline(ctx, service, preparedParams)
 	default:
-		err = fmt.Errorf("unsupported service type: %s", service.Type)
+		err = newError(ErrorCodeInternal, service.Name, "unsupported service type: %s", service.Type)
 	}
 
 	if err == nil {
-		// Attempt to parse the result as JSON if it's a string
-		switch v := result.(type) {
-		case string:
+		result = parseResult(result)
+	}
+
+	return result, err
+}
+
+// Parses the result as JSON if it's a string, otherwise returning it as is
+func parseResult(result interface{}) interface{} {
+	switch v := result.(type) {
+	case string:
+		var parsedResult interface{}
+		if err := json.Unmarshal([]byte(v), &parsedResult); err == nil {
+			return parsedResult
+		}
+	case *string:
+		if v != nil {
 			var parsedResult interface{}
-			if err := json.Unmarshal([]byte(v), &parsedResult); err == nil {
-				result = parsedResult
-			}
-		case *string:
-			if v != nil {
-				var parsedResult interface{}
-				if err := json.Unmarshal([]byte(*v), &parsedResult); err == nil {
-					result = parsedResult
-				}
+			if err := json.Unmarshal([]byte(*v), &parsedResult); err == nil {
+				return parsedResult
 			}
 		}
 	}
-
-	return result, err
+	return result
 }
 
 // Validates and applies default values to parameters
@@ -229,7 +305,7 @@ func (i *Intelligence) prepareParams(service Service, params map[string]interfac
 		value, exists := params[paramName]
 
 		if paramConfig.Required && !exists {
-			return nil, fmt.Errorf("required parameter '%s' is missing", paramName)
+			return nil, newError(ErrorCodeValidation, service.Name, "required parameter '%s' is missing", paramName)
 		}
 
 		if !exists && paramConfig.Default != nil {
@@ -244,6 +320,36 @@ func (i *Intelligence) prepareParams(service Service, params map[string]interfac
 
 // Sends a completions request and returns the result
 func (i *Intelligence) getCompletion(ctx context.Context, service Service, params map[string]interface{}) (*string, error) {
+	requestBody, err := json.Marshal(i.getCompletionRequestBody(service, params))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := i.doServiceRequest(ctx, service, requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return getCompletionContent(service, response)
+}
+
+// Extracts the completion content from a completions response
+func getCompletionContent(service Service, response map[string]interface{}) (*string, error) {
+	if choices, ok := response["choices"].([]interface{}); ok && len(choices) > 0 {
+		if choice, ok := choices[0].(map[string]interface{}); ok {
+			if message, ok := choice["message"].(map[string]interface{}); ok {
+				if content, ok := message["content"].(string); ok {
+					return &content, nil
+				}
+			}
+		}
+	}
+
+	return nil, newError(ErrorCodeUpstreamError, service.Name, "no valid completion response found")
+}
+
+// Builds the completions request body by rendering the service messages with the parameters
+func (i *Intelligence) getCompletionRequestBody(service Service, params map[string]interface{}) map[string]interface{} {
 	var messages []CompletionsMessage
 	// Prepare messages by replacing parameter placeholders
 	for _, message := range service.Completions.Messages {
@@ -267,35 +373,14 @@ func (i *Intelligence) getCompletion(ctx context.Context, service Service, param
 	requestBodyMap := map[string]interface{}{
 		"model":       service.Model,
 		"messages":    messages,
-		"max_tokens":  i.calculateMaxTokens(service.Completions.MaxTokens, params),
+		"max_tokens":  i.calculateMaxTokens(service.Completions.MaxTokens, i.getEncoding(service.Model), params),
 		"temperature": service.Completions.Temperature,
 	}
 	if responseFormat := i.getServiceResponseFormat(service, params); responseFormat != nil {
 		requestBodyMap["response_format"] = responseFormat
 	}
 
-	requestBody, err := json.Marshal(requestBodyMap)
-	if err != nil {
-		return nil, err
-	}
-
-	response, err := i.doServiceRequest(ctx, service, requestBody)
-	if err != nil {
-		return nil, err
-	}
-
-	// Extract and return the completion content from the response
-	if choices, ok := response["choices"].([]interface{}); ok && len(choices) > 0 {
-		if choice, ok := choices[0].(map[string]interface{}); ok {
-			if message, ok := choice["message"].(map[string]interface{}); ok {
-				if content, ok := message["content"].(string); ok {
-					return &content, nil
-				}
-			}
-		}
-	}
-
-	return nil, fmt.Errorf("no valid completion response found")
+	return requestBodyMap
 }
 
 // Recursively adds any Blob content to the messages
@@ -360,20 +445,13 @@ func createBlobCompletionsMessage(base64 string, contentType string) Completions
 
 // Sends an embeddings request and returns the result
 func (i *Intelligence) getEmbeddings(ctx context.Context, service Service, params map[string]interface{}) ([][]float64, error) {
-	// Extract input texts parameter
-	inputsInterface, ok := params["texts"].([]interface{})
-	if !ok || len(inputsInterface) == 0 {
-		return nil, fmt.Errorf("invalid input: 'texts' parameter is required")
+	embeddingsRequest, err := getEmbeddingsRequestBody(service, params)
+	if err != nil {
+		return nil, err
 	}
 
-	// Convert input interfaces to strings
-	inputs := convertToStringSlice(inputsInterface)
-
 	// Prepare the request body
-	requestBody, err := json.Marshal(EmbeddingsRequest{
-		Model: service.Model,
-		Input: inputs,
-	})
+	requestBody, err := json.Marshal(embeddingsRequest)
 	if err != nil {
 		return nil, err
 	}
@@ -383,10 +461,30 @@ func (i *Intelligence) getEmbeddings(ctx context.Context, service Service, param
 		return nil, err
 	}
 
+	return getEmbeddingsResult(service, response)
+}
+
+// Builds the embeddings request body from the texts parameter
+func getEmbeddingsRequestBody(service Service, params map[string]interface{}) (*EmbeddingsRequest, error) {
+	// Extract input texts parameter
+	inputsInterface, ok := params["texts"].([]interface{})
+	if !ok || len(inputsInterface) == 0 {
+		return nil, newError(ErrorCodeValidation, service.Name, "invalid input: 'texts' parameter is required")
+	}
+
+	// Convert input interfaces to strings
+	return &EmbeddingsRequest{
+		Model: service.Model,
+		Input: convertToStringSlice(inputsInterface),
+	}, nil
+}
+
+// Extracts the embeddings from an embeddings response
+func getEmbeddingsResult(service Service, response map[string]interface{}) ([][]float64, error) {
 	// Extract the embeddings from the response
 	data, ok := response["data"].([]interface{})
 	if !ok {
-		return nil, fmt.Errorf("invalid embeddings response format")
+		return nil, newError(ErrorCodeUpstreamError, service.Name, "invalid embeddings response format")
 	}
 
 	// Convert embedding data to [][]float64
@@ -394,18 +492,18 @@ func (i *Intelligence) getEmbeddings(ctx context.Context, service Service, param
 	for _, item := range data {
 		itemMap, ok := item.(map[string]interface{})
 		if !ok {
-			return nil, fmt.Errorf("invalid embeddings data format")
+			return nil, newError(ErrorCodeUpstreamError, service.Name, "invalid embeddings data format")
 		}
 		embeddingInterface, ok := itemMap["embedding"].([]interface{})
 		if !ok {
-			return nil, fmt.Errorf("missing 'embedding' in data item")
+			return nil, newError(ErrorCodeUpstreamError, service.Name, "missing 'embedding' in data item")
 		}
 		var embedding []float64
 		for _, val := range embeddingInterface {
 			if num, ok := val.(float64); ok {
 				embedding = append(embedding, num)
 			} else {
-				return nil, fmt.Errorf("embedding values must be float64")
+				return nil, newError(ErrorCodeUpstreamError, service.Name, "embedding values must be float64")
 			}
 		}
 		embeddings = append(embeddings, embedding)
@@ -416,15 +514,13 @@ func (i *Intelligence) getEmbeddings(ctx context.Context, service Service, param
 
 // Sends a moderation request and returns the result
 func (i *Intelligence) getModeration(ctx context.Context, service Service, params map[string]interface{}) (map[string]interface{}, error) {
-	input, ok := params["text"].(string)
-	if !ok || input == "" {
-		return nil, fmt.Errorf("invalid input: 'text' parameter is required")
+	moderationRequest, err := getModerationRequestBody(service, params)
+	if err != nil {
+		return nil, err
 	}
 
 	// Prepare the request body
-	requestBody, err := json.Marshal(ModerationRequest{
-		Input: input,
-	})
+	requestBody, err := json.Marshal(moderationRequest)
 	if err != nil {
 		return nil, err
 	}
@@ -464,7 +560,7 @@ func (i *Intelligence) getModeration(ctx context.Context, service Service, param
 
 	// Return the first moderation result
 	if len(moderationResponse.Results) == 0 {
-		return nil, fmt.Errorf("no results found in moderation response")
+		return nil, newError(ErrorCodeUpstreamError, service.Name, "no results found in moderation response")
 	}
 
 	result := moderationResponse.Results[0]
@@ -477,13 +573,25 @@ func (i *Intelligence) getModeration(ctx context.Context, service Service, param
 	return moderation, nil
 }
 
-// Calculates the maximum number of tokens for a request
-func (i *Intelligence) calculateMaxTokens(maxTokensConfig MaxTokens, params map[string]interface{}) int {
+// Builds the moderation request body from the text parameter
+func getModerationRequestBody(service Service, params map[string]interface{}) (*ModerationRequest, error) {
+	input, ok := params["text"].(string)
+	if !ok || input == "" {
+		return nil, newError(ErrorCodeValidation, service.Name, "invalid input: 'text' parameter is required")
+	}
+
+	return &ModerationRequest{
+		Input: input,
+	}, nil
+}
+
+// Calculates the maximum number of tokens for a request, counting tokens with the encoding of the model
+func (i *Intelligence) calculateMaxTokens(maxTokensConfig MaxTokens, encoding *Encoding, params map[string]interface{}) int {
 	maxTokens := maxTokensConfig.Value
 
 	// Add dynamic token values based on parameter configuration
 	for _, paramConfig := range maxTokensConfig.Add {
-		maxTokens += i.calculateTokensForParam(paramConfig, params)
+		maxTokens += i.calculateTokensForParam(paramConfig, encoding, params)
 	}
 
 	// Apply min and max limits to the token count
@@ -498,7 +606,7 @@ func (i *Intelligence) calculateMaxTokens(maxTokensConfig MaxTokens, params map[
 }
 
 // Calculates token counts for a single parameter
-func (i *Intelligence) calculateTokensForParam(addConfig MaxTokensAdd, params map[string]interface{}) int {
+func (i *Intelligence) calculateTokensForParam(addConfig MaxTokensAdd, encoding *Encoding, params map[string]interface{}) int {
 	var value int
 	paramValue, ok := params[addConfig.Param]
 	if !ok {
@@ -513,6 +621,12 @@ func (i *Intelligence) calculateTokensForParam(addConfig MaxTokensAdd, params ma
 		value = sumParamItemLengths(paramValue)
 	case "max_item_length":
 		value = maxParamItemLength(paramValue)
+	case "tokens":
+		value = getParamTokens(encoding, paramValue)
+	case "sum_item_tokens":
+		value = sumParamItemTokens(encoding, paramValue)
+	case "max_item_tokens":
+		value = maxParamItemTokens(encoding, paramValue)
 	default:
 		value = getParamValueAsInt(paramValue)
 	}
@@ -528,24 +642,9 @@ func (i *Intelligence) calculateTokensForParam(addConfig MaxTokensAdd, params ma
 
 // Sends an image generation request and returns the result
 func (i *Intelligence) getImageGenerations(ctx context.Context, service Service, params map[string]interface{}) (*Blob, error) {
-	// Extract the prompt parameter
-	prompt, ok := params["prompt"].(string)
-	if !ok || prompt == "" {
-		return nil, fmt.Errorf("invalid input: 'prompt' parameter is required")
-	}
-
-	// Build the request body with optional parameters for size, quality, and style
-	requestBodyMap := map[string]interface{}{
-		"model":           service.Model,
-		"prompt":          prompt,
-		"response_format": "b64_json",
-	}
-
-	optionalParams := []string{"size", "quality", "style"}
-	for _, param := range optionalParams {
-		if val, ok := params[param].(string); ok && val != "" {
-			requestBodyMap[param] = val
-		}
+	requestBodyMap, err := getImageGenerationsRequestBody(service, params)
+	if err != nil {
+		return nil, err
 	}
 
 	// Marshal request body and send request
@@ -573,22 +672,107 @@ func (i *Intelligence) getImageGenerations(ctx context.Context, service Service,
 		}
 	}
 
-	return nil, fmt.Errorf("no results found in image generation response")
+	return nil, newError(ErrorCodeUpstreamError, service.Name, "no results found in image generation response")
+}
+
+// Builds the image generation request body from the prompt parameter and the optional size, quality, and style
+func getImageGenerationsRequestBody(service Service, params map[string]interface{}) (map[string]interface{}, error) {
+	// Extract the prompt parameter
+	prompt, ok := params["prompt"].(string)
+	if !ok || prompt == "" {
+		return nil, newError(ErrorCodeValidation, service.Name, "invalid input: 'prompt' parameter is required")
+	}
+
+	// Build the request body with optional parameters for size, quality, and style
+	requestBodyMap := map[string]interface{}{
+		"model":           service.Model,
+		"prompt":          prompt,
+		"response_format": "b64_json",
+	}
+
+	optionalParams := []string{"size", "quality", "style"}
+	for _, param := range optionalParams {
+		if val, ok := params[param].(string); ok && val != "" {
+			requestBodyMap[param] = val
+		}
+	}
+
+	return requestBodyMap, nil
 }
 
 // Sends an HTTP request to the specified service and returns the response
 func (i *Intelligence) doServiceRequest(ctx context.Context, service Service, requestBody []byte) (map[string]interface{}, error) {
+	resp, err := i.sendServiceRequest(ctx, service, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Parse and return the response
+	var responseMap map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&responseMap); err != nil {
+		return nil, newError(ErrorCodeUpstreamError, service.Name, "error decoding response from '%s' service: %v", service.Name, err)
+	}
+	i.recordUsage(ctx, service, requestBody, responseMap, false)
+	getMetadata(ctx).addResponse(resp.Header, responseMap)
+
+	return responseMap, nil
+}
+
+// Sends an HTTP request to the specified service and returns the successful response for the caller to read and close
+func (i *Intelligence) sendServiceRequest(ctx context.Context, service Service, requestBody []byte) (*http.Response, error) {
 	url, err := i.getServiceURL(service)
 	if err != nil {
 		return nil, err
 	}
 
+	// Reserve the request against the principal's quota before waiting for the provider, and keep the reservation
+	// until its usage is recorded so requests sent at the same time can't use more than the quota between them. Each
+	// image generation makes one image.
+	tokens := estimateRequestTokens(i.getEncoding(service.Model), requestBody)
+	usage := Usage{Requests: 1, TotalTokens: tokens}
+	if service.Type == "v1/images/generations" {
+		usage.Images = 1
+	}
+	release, err := i.reserveQuota(ctx, service, usage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait until the provider's rate limits for the model allow the request
+	i.mu.RLock()
+	limiter := i.rateLimits
+	i.mu.RUnlock()
+	if err := limiter.wait(ctx, service, tokens); err != nil {
+		release()
+		return nil, err
+	}
+
+	// Pace the next requests by the limits the provider reports
+	resp, err := i.sendProviderRequest(ctx, service, http.MethodPost, url, "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		release()
+		if serviceErr, ok := err.(*Error); ok && serviceErr.Code == ErrorCodeUpstreamRateLimited {
+			limiter.pause(service, serviceErr.RetryAfter)
+		}
+		return nil, err
+	}
+	limiter.observe(service, resp.Header)
+	resp.Body = &quotaReservedBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// Sends an HTTP request to a URL of the service's provider and returns the successful response for the caller to read
+// and close
+func (i *Intelligence) sendProviderRequest(ctx context.Context, service Service, method string, url string, contentType string, body io.Reader) (*http.Response, error) {
 	// Prepare and send the HTTP request
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(requestBody))
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
 
 	if err := i.addServiceHeaders(service, req); err != nil {
 		return nil, err
@@ -596,59 +780,84 @@ func (i *Intelligence) doServiceRequest(ctx context.Context, service Service, re
 
 	resp, err := i.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error making request to '%s' service: %v", service.Name, err)
+		return nil, newServiceRequestError(service, err)
 	}
-	defer resp.Body.Close()
 
 	// Check the response status and handle errors
 	if resp.StatusCode != http.StatusOK {
-		var errorMessage string
-		if bodyBytes, err := io.ReadAll(resp.Body); err == nil {
-			// Default the error message to the body contents
-			errorMessage = string(bodyBytes)
-
-			// If the body contents are a map, try to extract the error message
-			var bodyMap map[string]interface{}
-			if err := json.Unmarshal(bodyBytes, &bodyMap); err == nil {
-				if errorMap, ok := bodyMap["error"].(map[string]interface{}); ok {
-					if errorMsg, ok := errorMap["message"].(string); ok {
-						errorMessage = fmt.Sprintf("error from '%s' service: %v", service.Name, errorMsg)
-					}
+		defer resp.Body.Close()
+		return nil, getServiceError(service, resp)
+	}
+
+	return resp, nil
+}
+
+// Builds an error from a failed service response, preferring the provider's error message
+func getServiceError(service Service, resp *http.Response) *Error {
+	var errorMessage string
+	if bodyBytes, err := io.ReadAll(resp.Body); err == nil {
+		// Default the error message to the body contents
+		errorMessage = string(bodyBytes)
+
+		// If the body contents are a map, try to extract the error message
+		var bodyMap map[string]interface{}
+		if err := json.Unmarshal(bodyBytes, &bodyMap); err == nil {
+			if errorMap, ok := bodyMap["error"].(map[string]interface{}); ok {
+				if errorMsg, ok := errorMap["message"].(string); ok {
+					errorMessage = fmt.Sprintf("error from '%s' service: %v", service.Name, errorMsg)
 				}
 			}
-		} else {
-			errorMessage = fmt.Sprintf("error from '%s' service", service.Name)
 		}
-		return nil, errors.New(errorMessage)
+	} else {
+		errorMessage = fmt.Sprintf("error from '%s' service", service.Name)
 	}
+	return newServiceResponseError(service, resp, errorMessage)
+}
 
-	// Parse and return the response
-	var responseMap map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&responseMap); err != nil {
-		return nil, fmt.Errorf("error decoding response from '%s' service: %v", service.Name, err)
+// Returns the API URL based on the service provider and type
+func (i *Intelligence) getServiceURL(service Service) (string, error) {
+	baseURL, err := i.getProviderBaseURL(service)
+	if err != nil {
+		return "", err
 	}
+	path, err := getServicePath(service)
+	if err != nil {
+		return "", err
+	}
+	return baseURL + path, nil
+}
 
-	return responseMap, nil
+// Returns the base URL of the service provider's API, which can be overridden to use a proxy or a compatible API
+func (i *Intelligence) getProviderBaseURL(service Service) (string, error) {
+	switch service.Provider {
+	case "openai":
+		if baseURL := os.Getenv("OPENAI_BASE_URL"); baseURL != "" {
+			return strings.TrimSuffix(baseURL, "/"), nil
+		}
+		return "https://api.openai.com", nil
+	default:
+		return "", newError(ErrorCodeInternal, service.Name, "unsupported service provider: %s", service.Provider)
+	}
 }
 
-// Returns the API URL based on the service provider and type
-func (i *Intelligence) getServiceURL(service Service) (string, error) {
+// Returns the API path based on the service provider and type
+func getServicePath(service Service) (string, error) {
 	switch service.Provider {
 	case "openai":
 		switch service.Type {
 		case "v1/completions":
-			return "https://api.openai.com/v1/chat/completions", nil
+			return "/v1/chat/completions", nil
 		case "v1/embeddings":
-			return "https://api.openai.com/v1/embeddings", nil
+			return "/v1/embeddings", nil
 		case "v1/moderations":
-			return "https://api.openai.com/v1/moderations", nil
+			return "/v1/moderations", nil
 		case "v1/images/generations":
-			return "https://api.openai.com/v1/images/generations", nil
+			return "/v1/images/generations", nil
 		default:
-			return "", fmt.Errorf("unsupported service type: %s", service.Type)
+			return "", newError(ErrorCodeInternal, service.Name, "unsupported service type: %s", service.Type)
 		}
 	default:
-		return "", fmt.Errorf("unsupported service provider: %s", service.Provider)
+		return "", newError(ErrorCodeInternal, service.Name, "unsupported service provider: %s", service.Provider)
 	}
 }
 
@@ -658,12 +867,12 @@ func (i *Intelligence) addServiceHeaders(service Service, req *http.Request) err
 	case "openai":
 		apiKey := os.Getenv("OPENAI_API_KEY")
 		if apiKey == "" {
-			return fmt.Errorf("OPENAI_API_KEY environment variable not set")
+			return newError(ErrorCodeInternal, service.Name, "OPENAI_API_KEY environment variable not set")
 		}
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 		return nil
 	default:
-		return fmt.Errorf("no API key for provider: %s", service.Provider)
+		return newError(ErrorCodeInternal, service.Name, "no API key for provider: %s", service.Provider)
 	}
 }
 
@@ -687,37 +896,111 @@ func (i *Intelligence) getServiceResponseFormat(service Service, params map[stri
 // Processes incoming intelligence requests
 func (i *Intelligence) Handler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
+		ctx, err := i.Authenticate(r)
+		if err != nil {
+			writeAuthError(w, Errors{"request": AsError(err)})
+			return
+		}
+		ctx = WithNewCaller(ctx)
 
 		// Parse the incoming request to extract intelligence requests
-		requests, err := getRequests(r)
+		requests, err := getRequests(w, r)
 		if err != nil {
-			http.Error(w, fmt.Sprintf(`{"errors": {"request": "failed to read requests: %s"}}`, err.Error()), http.StatusBadRequest)
+			writeJSON(w, getRequestsErrorStatusCode(err), map[string]interface{}{
+				"errors": Errors{"request": newError(ErrorCodeValidation, "", "failed to read requests: %v", err)},
+			})
+			return
+		}
+
+		// Reject the requests if any of them use a service the API key can't use
+		if authErrors := authorizeRequests(ctx, requests); len(authErrors) > 0 {
+			writeAuthError(w, authErrors)
+			return
+		}
+
+		// Reject keys that the errors and metadata of the results would replace
+		if keyErrors := getReservedKeyErrors(requests); len(keyErrors) > 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": keyErrors})
+			return
+		}
+
+		// Collect the metadata of each result when the client asks for it
+		var metadata *requestsMetadata
+		if isMetadataRequest(r, requests) {
+			ctx, metadata = withRequestsMetadata(ctx)
+		}
+
+		// Stream the results as server-sent events when the client asks for it
+		if isStreamRequest(r, requests) {
+			i.streamRequests(ctx, w, requests)
 			return
 		}
 
 		// Process the requests and collect results/errors
-		results, errors := i.doRequests(ctx, requests)
+		results, errors := i.doRequests(ctx, requests, nil)
+		if metadata != nil {
+			results["metadata"] = metadata.values
+		}
 
-		// If there are errors, include them in the response and set status to BadRequest
+		// If there are errors, include them in the response and set the status based on what failed
+		statusCode := http.StatusOK
 		if len(errors) > 0 {
 			results["errors"] = errors
-			w.WriteHeader(http.StatusBadRequest)
-			if err := json.NewEncoder(w).Encode(results); err != nil {
-				http.Error(w, fmt.Sprintf(`{"errors": {"server": "failed to write errors: %s"}}`, err.Error()), http.StatusInternalServerError)
+			statusCode = getErrorsStatusCode(len(requests), errors)
+			if retryAfter := getErrorsRetryAfter(errors); (statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable) && retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
 			}
-			return
 		}
 
-		// Write the successful results back as a JSON response
-		if err := json.NewEncoder(w).Encode(results); err != nil {
-			http.Error(w, fmt.Sprintf(`{"errors": {"server": "failed to write results: %s"}}`, err.Error()), http.StatusInternalServerError)
-		}
+		// Write the results back as a JSON response
+		writeJSON(w, statusCode, results)
 	})
 }
 
+// Defines the keys of a response that hold the errors and metadata of the results, which can't be request keys
+var reservedRequestKeys = []string{"errors", "metadata"}
+
+// Returns an error for each request key that is reserved for the errors or metadata of the results
+func getReservedKeyErrors(requests Requests) Errors {
+	errors := make(Errors)
+	for _, key := range reservedRequestKeys {
+		if _, exists := requests[key]; exists {
+			errors[key] = newError(ErrorCodeValidation, "", "'%s' is reserved for the %s of the results", key, key)
+		}
+	}
+	return errors
+}
+
+// Returns the status code of a request that couldn't be read, which is 413 when its body is too large
+func getRequestsErrorStatusCode(err error) int {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Writes a value as a JSON response with the status code
+func writeJSON(w http.ResponseWriter, statusCode int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		body, _ = json.Marshal(map[string]interface{}{
+			"errors": Errors{"server": newError(ErrorCodeInternal, "", "failed to write results: %v", err)},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(append(body, '\n'))
+}
+
+// Defines the largest request body that is read, so a huge body can't use up memory or time counting its tokens
+const maxRequestSize = 50 << 20
+
 // Parses the incoming HTTP request to extract intelligence requests from either the body or multipart form data
-func getRequests(r *http.Request) (Requests, error) {
+func getRequests(w http.ResponseWriter, r *http.Request) (Requests, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	contentType := r.Header.Get("Content-Type")
 	requests := Requests{}
 	files := make(map[string]interface{})
@@ -727,7 +1010,7 @@ func getRequests(r *http.Request) (Requests, error) {
 	if strings.HasPrefix(contentType, "multipart/form-data") {
 		err = r.ParseMultipartForm(50 << 20) // Limit size to 50MB
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse multipart form: %v", err)
+			return nil, fmt.Errorf("failed to parse multipart form: %w", err)
 		}
 
 		// Process file parts from the multipart form
@@ -771,7 +1054,7 @@ func getRequests(r *http.Request) (Requests, error) {
 		// Handle non-multipart requests (typically JSON body)
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read request body: %v", err)
+			return nil, fmt.Errorf("failed to read request body: %w", err)
 		}
 		requests, err = requestsFromData(r, body)
 		if err != nil {
@@ -869,13 +1152,25 @@ func addToRequests(requests *Requests, key string, value interface{}) {
 	}
 }
 
-// Processes multiple intelligence requests concurrently and returns the results and errors
-func (i *Intelligence) doRequests(ctx context.Context, requests Requests) (Results, Errors) {
-	results := make(chan struct {
-		key    string
-		result interface{}
-		err    error
-	}, len(requests))
+// Processes multiple intelligence requests concurrently and returns the results and errors, passing
+// completion deltas for each request key to the callback when one is provided. Requests that reference the
+// results of other requests wait for them to complete and are skipped if any of them fail.
+func (i *Intelligence) doRequests(ctx context.Context, requests Requests, onDelta func(key string, delta string)) (Results, Errors) {
+	result := make(Results)
+	errors := make(Errors)
+	var mu sync.Mutex
+
+	// Find the requests each request depends on, failing any that reference unknown requests or form a cycle
+	dependencies, dependencyErrors := getRequestDependencies(requests)
+	for key, err := range dependencyErrors {
+		errors[key] = err
+	}
+
+	// Signal when each request is complete so its dependents can start
+	done := make(map[string]chan struct{}, len(requests))
+	for key := range requests {
+		done[key] = make(chan struct{})
+	}
 
 	var wg sync.WaitGroup
 
@@ -884,42 +1179,59 @@ func (i *Intelligence) doRequests(ctx context.Context, requests Requests) (Resul
 		wg.Add(1)
 		go func(key string, request Request) {
 			defer wg.Done()
+			defer close(done[key])
 
-			var result interface{}
-			var err error
+			if _, failed := dependencyErrors[key]; failed {
+				return
+			}
 
-			// Fetch the model and process the intelligence request
-			if model, exists := request["model"].(string); exists {
-				result, err = i.GetIntelligence(ctx, model, request)
-			} else {
-				err = fmt.Errorf("invalid input: 'model' parameter is required")
+			// Wait for the dependencies and resolve their results into the request
+			for _, dependency := range dependencies[key] {
+				<-done[dependency]
+			}
+			mu.Lock()
+			request, err := resolveRequestResults(key, request, dependencies[key], result, errors)
+			mu.Unlock()
+
+			// Collect the metadata of the request when it was asked for, keeping requests made for this one, like the
+			// steps of a pipeline, from adding their own keys
+			requestCtx := ctx
+			requestsMetadata := getRequestsMetadata(ctx)
+			if requestsMetadata != nil {
+				var metadata *Metadata
+				requestCtx, metadata = WithMetadata(context.WithValue(ctx, requestsMetadataContextKey{}, nil))
+				defer metadata.Finish()
+				requestsMetadata.set(key, metadata)
 			}
 
-			// Send the result and error to the results channel
-			results <- struct {
-				key    string
-				result interface{}
-				err    error
-			}{key: key, result: result, err: err}
+			// Fetch the model and process the intelligence request, unless it was skipped
+			var value interface{}
+			if err == nil {
+				if model, exists := request["model"].(string); !exists {
+					err = newError(ErrorCodeValidation, "", "invalid input: 'model' parameter is required")
+				} else if isDryRunRequest(request) {
+					value, err = i.DryRun(requestCtx, model, request)
+				} else if onDelta != nil {
+					value, err = i.GetIntelligenceStream(requestCtx, model, request, func(delta string) {
+						onDelta(key, delta)
+					})
+				} else {
+					value, err = i.GetIntelligence(requestCtx, model, request)
+				}
+			}
+
+			// Record the result or error
+			mu.Lock()
+			if err != nil {
+				errors[key] = AsError(err)
+			} else {
+				result[key] = value
+			}
+			mu.Unlock()
 		}(key, request)
 	}
 
-	// Close the results channel once all requests are processed
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-
-	// Collect the results and errors from the channel
-	result := make(Results)
-	errors := make(Errors)
-	for res := range results {
-		if res.err != nil {
-			errors[res.key] = res.err.Error()
-		} else {
-			result[res.key] = res.result
-		}
-	}
+	wg.Wait()
 
 	return result, errors
 }
@@ -1025,6 +1337,43 @@ func maxParamItemLength(paramValue interface{}) int {
 	return maxLength
 }
 
+// Counts the tokens of a parameter as it is rendered in messages, where arrays are joined by commas
+func getParamTokens(encoding *Encoding, paramValue interface{}) int {
+	switch v := paramValue.(type) {
+	case string:
+		return encoding.count(v)
+	case []interface{}:
+		return encoding.count(strings.Join(convertToStringSlice(v), ", "))
+	default:
+		return 0
+	}
+}
+
+// Sums the tokens of items in an array parameter
+func sumParamItemTokens(encoding *Encoding, paramValue interface{}) int {
+	sum := 0
+	if arr, ok := paramValue.([]interface{}); ok {
+		for _, item := range arr {
+			sum += encoding.count(fmt.Sprintf("%v", item))
+		}
+	}
+	return sum
+}
+
+// Gets the maximum tokens of items in an array parameter
+func maxParamItemTokens(encoding *Encoding, paramValue interface{}) int {
+	maxTokens := 0
+	if arr, ok := paramValue.([]interface{}); ok {
+		for _, item := range arr {
+			tokens := encoding.count(fmt.Sprintf("%v", item))
+			if tokens > maxTokens {
+				maxTokens = tokens
+			}
+		}
+	}
+	return maxTokens
+}
+
 // Gets the parameter value as an integer
 func getParamValueAsInt(paramValue interface{}) int {
 	switch v := paramValue.(type) {
@@ -0,0 +1,161 @@
+package intelligence
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Sends the requests of a test to a stub instead of a provider
+type stubTransport func(r *http.Request) (*http.Response, error)
+
+func (f stubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Returns a successful provider response with a JSON body
+func stubResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// Returns an Intelligence with the shipped config whose provider requests go to a stub
+func newTestIntelligence(t *testing.T, transport stubTransport) *Intelligence {
+	t.Helper()
+	t.Setenv("OPENAI_API_KEY", "test")
+	i, err := NewIntelligence("../intelligence.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport == nil {
+		transport = func(r *http.Request) (*http.Response, error) {
+			t.Errorf("unexpected provider request to %s", r.URL)
+			return nil, http.ErrNotSupported
+		}
+	}
+	i.httpClient.Transport = transport
+	return i
+}
+
+func TestHandlerRequestSize(t *testing.T) {
+	i := newTestIntelligence(t, nil)
+	body := `{"sentiment": {"model": "sentiment", "text": "` + strings.Repeat("a", maxRequestSize) + `"}}`
+	request := httptest.NewRequest(http.MethodPost, "/intelligence", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	i.Handler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d: %s", recorder.Code, http.StatusRequestEntityTooLarge, recorder.Body)
+	}
+}
+
+func TestHandlerRetryAfter(t *testing.T) {
+	// The provider rate limits the requests that say to wait, and answers the others
+	rateLimited := func(r *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "wait") {
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     http.Header{"Retry-After": {"7"}},
+				Body:       io.NopCloser(strings.NewReader(`{"error":{"message":"rate limited"}}`)),
+			}, nil
+		}
+		return stubResponse(`{"choices":[{"message":{"content":"positive"}}]}`), nil
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		statusCode int
+		retryAfter string
+	}{
+		{
+			name:       "rate limited",
+			body:       `{"first": {"model": "sentiment", "text": "wait"}}`,
+			statusCode: http.StatusTooManyRequests,
+			retryAfter: "7",
+		},
+		{
+			name:       "rate limited over invalid",
+			body:       `{"first": {"model": "sentiment", "text": "wait"}, "second": {"model": "missing"}}`,
+			statusCode: http.StatusTooManyRequests,
+			retryAfter: "7",
+		},
+		{
+			name:       "some requests rate limited",
+			body:       `{"first": {"model": "sentiment", "text": "wait"}, "second": {"model": "sentiment", "text": "I love it", "dry_run": true}}`,
+			statusCode: http.StatusMultiStatus,
+		},
+		{
+			name:       "missing model",
+			body:       `{"first": {"model": "missing"}}`,
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "no requests rate limited",
+			body:       `{"first": {"model": "sentiment", "text": "I love it"}}`,
+			statusCode: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := newTestIntelligence(t, rateLimited)
+			request := httptest.NewRequest(http.MethodPost, "/intelligence", strings.NewReader(test.body))
+			recorder := httptest.NewRecorder()
+			i.Handler().ServeHTTP(recorder, request)
+			if recorder.Code != test.statusCode {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, test.statusCode, recorder.Body)
+			}
+			if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != test.retryAfter {
+				t.Errorf("got Retry-After %q, want %q", retryAfter, test.retryAfter)
+			}
+		})
+	}
+}
+
+func TestHandlerReservedKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		query      string
+		statusCode int
+	}{
+		{name: "errors", key: "errors", statusCode: http.StatusBadRequest},
+		{name: "metadata", key: "metadata", query: "?include_metadata=true", statusCode: http.StatusBadRequest},
+		{name: "streamed metadata", key: "metadata", query: "?stream=true", statusCode: http.StatusBadRequest},
+		{name: "other key", key: "metadata_summary", query: "?include_metadata=true", statusCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The requests are dry runs, so only the reserved keys can fail them
+			i := newTestIntelligence(t, nil)
+			body := `{"` + test.key + `": {"model": "sentiment", "text": "I love it", "dry_run": true}}`
+			request := httptest.NewRequest(http.MethodPost, "/intelligence"+test.query, strings.NewReader(body))
+			recorder := httptest.NewRecorder()
+			i.Handler().ServeHTTP(recorder, request)
+			if recorder.Code != test.statusCode {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, test.statusCode, recorder.Body)
+			}
+
+			var response map[string]interface{}
+			json.Unmarshal(recorder.Body.Bytes(), &response)
+			if test.statusCode == http.StatusOK {
+				if response[test.key] == nil || response["metadata"] == nil {
+					t.Errorf("got %s, want the result of '%s' and its metadata", recorder.Body, test.key)
+				}
+				return
+			}
+			errors, _ := response["errors"].(map[string]interface{})
+			if keyErr, _ := errors[test.key].(map[string]interface{}); keyErr["code"] != ErrorCodeValidation {
+				t.Errorf("got %s, want a validation error for '%s'", recorder.Body, test.key)
+			}
+		})
+	}
+}
@@ -0,0 +1,657 @@
+package intelligence
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defines the states of a job
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusCanceled  = "canceled"
+)
+
+// Defines the modes a job can be processed in, where batch mode sends completions and embeddings through the
+// provider's Batch API
+const (
+	JobModeDirect = "direct"
+	JobModeBatch  = "batch"
+)
+
+// Defines how long finished jobs are kept before they are removed
+const jobRetention = 24 * time.Hour
+
+// Defines a batch of requests that is processed in the background. Jobs in batch mode keep the provider batches they
+// are waiting for by provider endpoint, and are waiting for them once every batch is submitted and every other
+// request is processed, so they can be resumed after a restart.
+type Job struct {
+	ID                        string                    `json:"id"`
+	Status                    string                    `json:"status"`
+	Mode                      string                    `json:"mode,omitempty"`
+	Requests                  Requests                  `json:"requests,omitempty"`
+	Results                   Results                   `json:"results,omitempty"`
+	Errors                    Errors                    `json:"errors,omitempty"`
+	Callback                  *JobCallback              `json:"callback,omitempty"`
+	ProviderBatches           map[string]*ProviderBatch `json:"provider_batches,omitempty"`
+	WaitingForProviderBatches bool                      `json:"waiting_for_provider_batches,omitempty"`
+	Principal                 *Principal                `json:"principal,omitempty"`
+	CreatedAt                 time.Time                 `json:"created_at"`
+	StartedAt                 *time.Time                `json:"started_at,omitempty"`
+	FinishedAt                *time.Time                `json:"finished_at,omitempty"`
+}
+
+// Returns a copy of the job that does not share its callback, so the copy can be read while the job changes
+func (job *Job) clone() Job {
+	copied := *job
+	if job.ProviderBatches != nil {
+		copied.ProviderBatches = make(map[string]*ProviderBatch, len(job.ProviderBatches))
+		for key, batch := range job.ProviderBatches {
+			copied.ProviderBatches[key] = batch
+		}
+	}
+	if job.Callback != nil {
+		callback := *job.Callback
+		callback.Attempts = append([]CallbackAttempt(nil), job.Callback.Attempts...)
+		copied.Callback = &callback
+	}
+	return copied
+}
+
+// Returns whether the job has finished, whether it completed or was canceled
+func (job *Job) isFinished() bool {
+	return job.Status == JobStatusCompleted || job.Status == JobStatusCanceled
+}
+
+// Stores jobs in memory and, when it has a directory, as JSON files so they survive a restart
+type JobStore struct {
+	dir  string
+	jobs map[string]*Job
+	mu   sync.RWMutex
+}
+
+// Creates a job store that persists jobs to a directory, loading the jobs already in it, or that only keeps jobs in
+// memory if the directory is empty
+func NewJobStore(dir string) (*JobStore, error) {
+	store := &JobStore{
+		dir:  dir,
+		jobs: make(map[string]*Job),
+	}
+	if dir == "" {
+		return store, nil
+	}
+
+	// Only the service can read the jobs, since they hold the requests and callback secrets
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating job directory: %v", err)
+	}
+
+	// Load each job file, skipping any that cannot be read
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		jobBytes, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var job Job
+		if err := json.Unmarshal(jobBytes, &job); err != nil || job.ID == "" {
+			continue
+		}
+		store.jobs[job.ID] = &job
+	}
+	store.prune()
+
+	return store, nil
+}
+
+// Returns a copy of the job with the ID
+func (s *JobStore) Get(id string) (Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, exists := s.jobs[id]
+	if !exists {
+		return Job{}, false
+	}
+	return job.clone(), true
+}
+
+// Adds a job to the store and removes finished jobs that have expired
+func (s *JobStore) add(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.save(job); err != nil {
+		return err
+	}
+	s.jobs[job.ID] = job
+	s.prune()
+	return nil
+}
+
+// Applies a change to the job with the ID and saves it, returning a copy of the changed job
+func (s *JobStore) update(id string, change func(job *Job)) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, exists := s.jobs[id]
+	if !exists {
+		return Job{}, fmt.Errorf("job '%s' not found", id)
+	}
+	change(job)
+	return job.clone(), s.save(job)
+}
+
+// Returns the IDs of the jobs that have not finished and aren't waiting for provider batches, oldest first
+func (s *JobStore) unfinished() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var jobs []*Job
+	for _, job := range s.jobs {
+		if !job.isFinished() && !job.WaitingForProviderBatches {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a].CreatedAt.Before(jobs[b].CreatedAt)
+	})
+
+	ids := make([]string, len(jobs))
+	for i, job := range jobs {
+		ids[i] = job.ID
+	}
+	return ids
+}
+
+// Writes the job to a file only the service can read, replacing the previous file only once the new one is fully
+// written
+func (s *JobStore) save(job *Job) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	jobBytes, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, job.ID+".json")
+	if err := os.WriteFile(path+".tmp", jobBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Returns the IDs of the running jobs that are waiting for provider batches
+func (s *JobStore) waitingForProviderBatches() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	for id, job := range s.jobs {
+		if job.Status == JobStatusRunning && job.WaitingForProviderBatches {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Returns the IDs of the finished jobs with callbacks that have not been delivered
+func (s *JobStore) pendingCallbacks() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	for id, job := range s.jobs {
+		if job.isFinished() && job.Callback != nil && job.Callback.Status == CallbackStatusPending {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Removes finished jobs that have expired, which must be called with the lock held
+func (s *JobStore) prune() {
+	for id, job := range s.jobs {
+		if job.FinishedAt != nil && time.Since(*job.FinishedAt) > jobRetention {
+			delete(s.jobs, id)
+			if s.dir != "" {
+				os.Remove(filepath.Join(s.dir, id+".json"))
+			}
+		}
+	}
+}
+
+// Runs queued jobs on a fixed number of workers
+type jobRunner struct {
+	store   *JobStore
+	queue   chan string
+	cancels map[string]context.CancelFunc
+	mu      sync.Mutex
+}
+
+// Starts processing jobs from the store with a number of workers, accepting up to queueSize jobs that are waiting
+// for a worker. Jobs that had not finished when the service stopped are run again.
+func (i *Intelligence) StartJobs(store *JobStore, workers int, queueSize int) {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	runner := &jobRunner{
+		store:   store,
+		queue:   make(chan string, queueSize),
+		cancels: make(map[string]context.CancelFunc),
+	}
+	i.mu.Lock()
+	i.jobs = runner
+	i.mu.Unlock()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for id := range runner.queue {
+				i.runJob(runner, id)
+			}
+		}()
+	}
+
+	// Requeue the unfinished jobs without blocking startup when there are more of them than the queue holds
+	if unfinished := store.unfinished(); len(unfinished) > 0 {
+		go func() {
+			for _, id := range unfinished {
+				runner.queue <- id
+			}
+		}()
+	}
+
+	// Wait for the provider batches of jobs apart from the workers
+	go i.pollProviderBatches(store, providerBatchPollInterval)
+
+	// Resume delivering the callbacks of finished jobs
+	for _, id := range store.pendingCallbacks() {
+		go i.deliverJobCallback(store, id)
+	}
+}
+
+// Processes the requests of a job and records the results, unless the job was canceled while it was queued
+func (i *Intelligence) runJob(runner *jobRunner, id string) {
+	ctx, cancel := context.WithCancel(withCaller(context.Background(), "job:"+id))
+	defer cancel()
+
+	// Mark the job as running and make it cancelable while it is
+	runner.mu.Lock()
+	job, err := runner.store.update(id, func(job *Job) {
+		if job.Status == JobStatusCanceled {
+			return
+		}
+		now := time.Now()
+		job.Status = JobStatusRunning
+		job.StartedAt = &now
+	})
+	if err != nil || job.Status != JobStatusRunning {
+		runner.mu.Unlock()
+		return
+	}
+	runner.cancels[id] = cancel
+	runner.mu.Unlock()
+
+	// Count the job's usage against whoever submitted it
+	if job.Principal != nil {
+		ctx = WithPrincipal(ctx, job.Principal)
+	}
+
+	var results Results
+	var errors Errors
+	if job.Mode == JobModeBatch {
+		results, errors = i.doProviderBatchRequests(ctx, job.Requests, job.ProviderBatches, func(key string, batch *ProviderBatch) {
+			runner.store.update(id, func(job *Job) {
+				if job.ProviderBatches == nil {
+					job.ProviderBatches = make(map[string]*ProviderBatch)
+				}
+				job.ProviderBatches[key] = batch
+			})
+		})
+	} else {
+		results, errors = i.doRequests(ctx, job.Requests, nil)
+	}
+
+	// Leave a job that has submitted provider batches running for the poller to complete, unless it was canceled,
+	// holding the lock so the job can't be canceled between the worker and the poller
+	runner.mu.Lock()
+	delete(runner.cancels, id)
+	var canceledBatches map[string]*ProviderBatch
+	job, _ = runner.store.update(id, func(job *Job) {
+		job.Results = results
+		job.Errors = nil
+		if len(errors) > 0 {
+			job.Errors = errors
+		}
+
+		if ctx.Err() == nil && len(job.ProviderBatches) > 0 {
+			job.WaitingForProviderBatches = true
+			return
+		}
+		now := time.Now()
+		job.Status = JobStatusCompleted
+		if ctx.Err() != nil {
+			job.Status = JobStatusCanceled
+			canceledBatches = job.ProviderBatches
+			failProviderBatches(job, "canceled")
+		}
+		job.FinishedAt = &now
+	})
+	runner.mu.Unlock()
+	if job.Status == JobStatusRunning {
+		return
+	}
+
+	if len(canceledBatches) > 0 {
+		go i.cancelProviderBatches(canceledBatches)
+	}
+	go i.deliverJobCallback(runner.store, id)
+}
+
+// Fails the requests of the provider batches of a job that will no longer be waited for, and forgets the batches
+func failProviderBatches(job *Job, reason string) {
+	for _, batch := range job.ProviderBatches {
+		for key, serviceName := range batch.Services {
+			if job.Errors == nil {
+				job.Errors = make(Errors)
+			}
+			job.Errors[key] = newError(ErrorCodeUpstreamError, serviceName, "provider batch '%s' of request '%s' was %s", batch.ID, key, reason)
+		}
+	}
+	job.ProviderBatches = nil
+	job.WaitingForProviderBatches = false
+}
+
+// Creates a job for the requests and queues it to be processed in a mode, failing with a retryable error when the
+// queue is full. When the job has a callback, its results are posted to it when it finishes.
+func (i *Intelligence) submitJob(ctx context.Context, requests Requests, mode string, callback *JobCallback) (Job, error) {
+	i.mu.RLock()
+	runner := i.jobs
+	i.mu.RUnlock()
+	if runner == nil {
+		return Job{}, newError(ErrorCodeInternal, "", "jobs are not enabled")
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, newError(ErrorCodeInternal, "", "failed to create job: %v", err)
+	}
+
+	// Store file content as base64 so the requests can be read back from the job file
+	job := &Job{
+		ID:        id,
+		Status:    JobStatusQueued,
+		Mode:      mode,
+		Requests:  make(Requests, len(requests)),
+		Callback:  callback,
+		Principal: GetPrincipal(ctx),
+		CreatedAt: time.Now(),
+	}
+	for key, request := range requests {
+		job.Requests[key] = Request(encodeBlobs(map[string]interface{}(request)).(map[string]interface{}))
+	}
+
+	// Hold the lock so a full queue is detected before the job is stored
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if len(runner.queue) == cap(runner.queue) {
+		return Job{}, newError(ErrorCodeOverloaded, "", "job queue is full")
+	}
+	if err := runner.store.add(job); err != nil {
+		return Job{}, newError(ErrorCodeInternal, "", "failed to store job: %v", err)
+	}
+	select {
+	case runner.queue <- id:
+	default:
+		runner.store.update(id, func(job *Job) {
+			now := time.Now()
+			job.Status = JobStatusCanceled
+			job.FinishedAt = &now
+		})
+		return Job{}, newError(ErrorCodeOverloaded, "", "job queue is full")
+	}
+
+	return job.clone(), nil
+}
+
+// Cancels a job of the principal of the context, either before it starts or while it is running, and returns its
+// state
+func (i *Intelligence) cancelJob(ctx context.Context, id string) (Job, error) {
+	i.mu.RLock()
+	runner := i.jobs
+	i.mu.RUnlock()
+	if runner == nil {
+		return Job{}, newError(ErrorCodeInternal, "", "jobs are not enabled")
+	}
+
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	// Jobs of other principals are reported as not found so their IDs aren't confirmed
+	if job, exists := runner.store.Get(id); !exists || !canAccessJob(ctx, job) {
+		return Job{}, newError(ErrorCodeNotFound, "", "job '%s' not found", id)
+	}
+
+	// Cancel a running job through its context, and the worker records it as canceled when it stops
+	if cancel, running := runner.cancels[id]; running {
+		cancel()
+		job, _ := runner.store.Get(id)
+		return job, nil
+	}
+
+	// Cancel a queued job, or a job that is waiting for provider batches along with its batches
+	canceled := false
+	var canceledBatches map[string]*ProviderBatch
+	job, err := runner.store.update(id, func(job *Job) {
+		if job.Status == JobStatusQueued || (job.Status == JobStatusRunning && job.WaitingForProviderBatches) {
+			now := time.Now()
+			job.Status = JobStatusCanceled
+			job.FinishedAt = &now
+			canceledBatches = job.ProviderBatches
+			failProviderBatches(job, "canceled")
+			canceled = true
+		}
+	})
+	if err != nil {
+		return Job{}, newError(ErrorCodeNotFound, "", "%v", err)
+	}
+	if len(canceledBatches) > 0 {
+		go i.cancelProviderBatches(canceledBatches)
+	}
+	if canceled {
+		go i.deliverJobCallback(runner.store, id)
+	}
+	return job, nil
+}
+
+// Handles requests to submit jobs at /intelligence/jobs, check their status at /intelligence/jobs/{id} and cancel
+// them at /intelligence/jobs/{id}/cancel
+func (i *Intelligence) JobsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := i.Authenticate(r)
+		if err != nil {
+			writeAuthError(w, Errors{"request": AsError(err)})
+			return
+		}
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/intelligence/jobs"), "/")
+		segments := strings.Split(path, "/")
+
+		switch {
+		case path == "" && r.Method == http.MethodPost:
+			i.handleSubmitJob(ctx, w, r)
+		case len(segments) == 1 && path != "" && r.Method == http.MethodGet:
+			job, exists := i.getJob(segments[0])
+			if !exists || !canAccessJob(ctx, job) {
+				writeJobError(w, http.StatusNotFound, newError(ErrorCodeNotFound, "", "job '%s' not found", segments[0]))
+				return
+			}
+			writeJSON(w, http.StatusOK, jobResponse(job))
+		case len(segments) == 2 && segments[1] == "cancel" && r.Method == http.MethodPost:
+			job, err := i.cancelJob(ctx, segments[0])
+			if err != nil {
+				jobErr := AsError(err)
+				writeJobError(w, getErrorCodeStatusCode(jobErr.Code), jobErr)
+				return
+			}
+			writeJSON(w, http.StatusOK, jobResponse(job))
+		case path == "":
+			w.Header().Set("Allow", http.MethodPost)
+			writeJobError(w, http.StatusMethodNotAllowed, newError(ErrorCodeValidation, "", "method not allowed"))
+		case len(segments) == 1:
+			w.Header().Set("Allow", http.MethodGet)
+			writeJobError(w, http.StatusMethodNotAllowed, newError(ErrorCodeValidation, "", "method not allowed"))
+		default:
+			writeJobError(w, http.StatusNotFound, newError(ErrorCodeNotFound, "", "not found"))
+		}
+	})
+}
+
+// Reads the requests, queues them as a job and responds with where to check on it
+func (i *Intelligence) handleSubmitJob(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	requests, err := getRequests(w, r)
+	if err != nil {
+		writeJobError(w, getRequestsErrorStatusCode(err), newError(ErrorCodeValidation, "", "failed to read requests: %v", err))
+		return
+	}
+	if authErrors := authorizeRequests(ctx, requests); len(authErrors) > 0 {
+		writeAuthError(w, authErrors)
+		return
+	}
+
+	callback, err := i.getJobCallback(r)
+	if err != nil {
+		writeJobError(w, http.StatusBadRequest, newError(ErrorCodeValidation, "", "%v", err))
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = JobModeDirect
+	}
+	if mode != JobModeDirect && mode != JobModeBatch {
+		writeJobError(w, http.StatusBadRequest, newError(ErrorCodeValidation, "", "invalid mode '%s'", mode))
+		return
+	}
+
+	job, err := i.submitJob(ctx, requests, mode, callback)
+	if err != nil {
+		jobErr := AsError(err)
+		if jobErr.Code == ErrorCodeOverloaded {
+			w.Header().Set("Retry-After", "1")
+		}
+		writeJobError(w, getErrorCodeStatusCode(jobErr.Code), jobErr)
+		return
+	}
+
+	w.Header().Set("Location", "/intelligence/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, jobResponse(job))
+}
+
+// Returns the job with the ID if jobs are enabled
+func (i *Intelligence) getJob(id string) (Job, bool) {
+	i.mu.RLock()
+	runner := i.jobs
+	i.mu.RUnlock()
+	if runner == nil {
+		return Job{}, false
+	}
+	return runner.store.Get(id)
+}
+
+// Returns whether the principal of the context can see and cancel a job, which is when requests aren't
+// authenticated, the principal submitted the job or the principal is an admin
+func canAccessJob(ctx context.Context, job Job) bool {
+	principal := GetPrincipal(ctx)
+	if principal == nil || principal.Admin {
+		return true
+	}
+	return job.Principal != nil && job.Principal.ID == principal.ID
+}
+
+// Returns the job as it is shown to clients, without the requests it was submitted with, its callback secret or its
+// provider batches
+func jobResponse(job Job) Job {
+	job.Requests = nil
+	job.ProviderBatches = nil
+	job.WaitingForProviderBatches = false
+	job.Principal = nil
+	if job.Callback != nil {
+		callback := *job.Callback
+		callback.Secret = ""
+		job.Callback = &callback
+	}
+	return job
+}
+
+// Writes an error for a jobs request with a status code
+func writeJobError(w http.ResponseWriter, statusCode int, err *Error) {
+	writeJSON(w, statusCode, map[string]interface{}{
+		"errors": Errors{"request": err},
+	})
+}
+
+// Creates a random job ID
+func newJobID() (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// Recursively replaces blobs with their base64 form, which is how blobs are read from JSON
+func encodeBlobs(value interface{}) interface{} {
+	switch v := value.(type) {
+	case Blob:
+		return blobToMap(v)
+	case *Blob:
+		return blobToMap(*v)
+	case []interface{}:
+		encoded := make([]interface{}, len(v))
+		for i, item := range v {
+			encoded[i] = encodeBlobs(item)
+		}
+		return encoded
+	case map[string]interface{}:
+		encoded := make(map[string]interface{}, len(v))
+		for key, nestedValue := range v {
+			encoded[key] = encodeBlobs(nestedValue)
+		}
+		return encoded
+	default:
+		return v
+	}
+}
+
+// Converts a blob to the map form of a blob with base64 content
+func blobToMap(blob Blob) map[string]interface{} {
+	base64Content := blob.Base64
+	if len(blob.Content) > 0 {
+		base64Content = base64.StdEncoding.EncodeToString(blob.Content)
+	}
+	return map[string]interface{}{
+		"content_type": blob.ContentType,
+		"base64":       base64Content,
+	}
+}
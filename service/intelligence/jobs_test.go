@@ -0,0 +1,197 @@
+package intelligence
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends a jobs request and returns the response
+func sendJobsRequest(handler http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestJobsHandler(t *testing.T) {
+	// The provider holds requests about waiting until they are canceled, so jobs can be canceled while they run
+	i := newTestIntelligence(t, func(r *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "waiting") {
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}
+		return stubResponse(`{"choices":[{"message":{"content":"positive"}}]}`), nil
+	})
+	store, _ := NewJobStore("")
+	i.StartJobs(store, 1, 10)
+	handler := i.JobsHandler()
+
+	// Submits a job and returns it as the response shows it
+	submit := func(text string) Job {
+		t.Helper()
+		recorder := sendJobsRequest(handler, http.MethodPost, "/intelligence/jobs", `{"positive": {"model": "sentiment", "text": "`+text+`"}}`)
+		if recorder.Code != http.StatusAccepted {
+			t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusAccepted, recorder.Body)
+		}
+		var job Job
+		json.Unmarshal(recorder.Body.Bytes(), &job)
+		if location := recorder.Header().Get("Location"); location != "/intelligence/jobs/"+job.ID {
+			t.Errorf("got location %q, want /intelligence/jobs/%s", location, job.ID)
+		}
+		if job.Status != JobStatusQueued || strings.Contains(recorder.Body.String(), text) {
+			t.Errorf("got %s, want a queued job without its requests", recorder.Body)
+		}
+		return job
+	}
+
+	// Returns the job as the response to a jobs request shows it, failing unless the request has a status code
+	getJob := func(method string, path string, statusCode int) Job {
+		t.Helper()
+		recorder := sendJobsRequest(handler, method, path, "")
+		if recorder.Code != statusCode {
+			t.Fatalf("got status %d, want %d: %s", recorder.Code, statusCode, recorder.Body)
+		}
+		var job Job
+		json.Unmarshal(recorder.Body.Bytes(), &job)
+		return job
+	}
+
+	t.Run("submit and get", func(t *testing.T) {
+		submitted := submit("I love it")
+		waitForJob(t, store, submitted.ID, func(job Job) bool { return job.isFinished() })
+
+		job := getJob(http.MethodGet, "/intelligence/jobs/"+submitted.ID, http.StatusOK)
+		if job.Status != JobStatusCompleted || job.Results["positive"] == nil || len(job.Errors) > 0 || job.FinishedAt == nil {
+			t.Errorf("got job %+v, want it completed with the result of positive", job)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		running := submit("waiting")
+		waitForJob(t, store, running.ID, func(job Job) bool { return job.Status == JobStatusRunning })
+
+		// The only worker is busy, so the next job stays queued until it is canceled
+		queued := submit("I love it")
+		if job := getJob(http.MethodPost, "/intelligence/jobs/"+queued.ID+"/cancel", http.StatusOK); job.Status != JobStatusCanceled {
+			t.Errorf("got status %s, want the queued job %s", job.Status, JobStatusCanceled)
+		}
+
+		// A running job is canceled once its worker stops
+		getJob(http.MethodPost, "/intelligence/jobs/"+running.ID+"/cancel", http.StatusOK)
+		waitForJob(t, store, running.ID, func(job Job) bool { return job.isFinished() })
+		for _, id := range []string{queued.ID, running.ID} {
+			if job := getJob(http.MethodGet, "/intelligence/jobs/"+id, http.StatusOK); job.Status != JobStatusCanceled || job.Results["positive"] != nil {
+				t.Errorf("got job %+v, want it %s without results", job, JobStatusCanceled)
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			method     string
+			path       string
+			body       string
+			statusCode int
+		}{
+			{name: "invalid mode", method: http.MethodPost, path: "/intelligence/jobs?mode=fast", body: `{"positive": {"model": "sentiment", "text": "I love it"}}`, statusCode: http.StatusBadRequest},
+			{name: "invalid requests", method: http.MethodPost, path: "/intelligence/jobs", body: `not json`, statusCode: http.StatusBadRequest},
+			{name: "list jobs", method: http.MethodGet, path: "/intelligence/jobs", statusCode: http.StatusMethodNotAllowed},
+			{name: "delete job", method: http.MethodDelete, path: "/intelligence/jobs/missing", statusCode: http.StatusMethodNotAllowed},
+			{name: "missing job", method: http.MethodGet, path: "/intelligence/jobs/missing", statusCode: http.StatusNotFound},
+			{name: "cancel missing job", method: http.MethodPost, path: "/intelligence/jobs/missing/cancel", statusCode: http.StatusNotFound},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				recorder := sendJobsRequest(handler, test.method, test.path, test.body)
+				if recorder.Code != test.statusCode {
+					t.Errorf("got status %d, want %d: %s", recorder.Code, test.statusCode, recorder.Body)
+				}
+			})
+		}
+	})
+}
+
+func TestJobStoreRestart(t *testing.T) {
+	received := make(chan error, 1)
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- VerifyCallbackSignature("secret", r.Header, body, 5*time.Minute, time.Now())
+	}))
+	defer receiver.Close()
+
+	// Store the jobs as they were when the service stopped, one waiting for a worker and one interrupted while it ran
+	dir := filepath.Join(t.TempDir(), "jobs")
+	store, err := NewJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := Requests{"positive": Request{"model": "sentiment", "text": "I love it"}}
+	started := time.Now()
+	jobs := []*Job{
+		{
+			ID:        "queued",
+			Status:    JobStatusQueued,
+			Requests:  requests,
+			Callback:  &JobCallback{URL: receiver.URL + "/results", Secret: "secret", Status: CallbackStatusPending},
+			CreatedAt: started,
+		},
+		{ID: "running", Status: JobStatusRunning, Requests: requests, CreatedAt: started, StartedAt: &started},
+	}
+	for _, job := range jobs {
+		if err := store.add(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The jobs hold callback secrets, so only the service can read them
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("got job directory %v and error %v, want mode 0700", info, err)
+	}
+	for _, job := range jobs {
+		if info, err := os.Stat(filepath.Join(dir, job.ID+".json")); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("got job file %v and error %v, want mode 0600", info, err)
+		}
+	}
+
+	// Restart the service with the jobs it saved
+	i := newTestIntelligence(t, func(r *http.Request) (*http.Response, error) {
+		return stubResponse(`{"choices":[{"message":{"content":"positive"}}]}`), nil
+	})
+	i.SetCallbackHosts([]string{"127.0.0.1"})
+	i.callbacks.Transport.(*http.Transport).TLSClientConfig = receiver.Client().Transport.(*http.Transport).TLSClientConfig
+	restarted, err := NewJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.StartJobs(restarted, 1, 10)
+
+	handler := i.JobsHandler()
+	for _, job := range jobs {
+		waitForJob(t, restarted, job.ID, func(job Job) bool { return job.isFinished() })
+		recorder := sendJobsRequest(handler, http.MethodGet, "/intelligence/jobs/"+job.ID, "")
+		var restored Job
+		json.Unmarshal(recorder.Body.Bytes(), &restored)
+		if recorder.Code != http.StatusOK || restored.Status != JobStatusCompleted || restored.Results["positive"] == nil {
+			t.Errorf("got status %d and job %s, want the job %s with the result of positive", recorder.Code, recorder.Body, JobStatusCompleted)
+		}
+	}
+
+	// The callback is signed with the secret the job was saved with
+	select {
+	case err := <-received:
+		if err != nil {
+			t.Errorf("got callback that doesn't verify: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback wasn't delivered after the restart")
+	}
+}
@@ -0,0 +1,397 @@
+package intelligence
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defines how bearer tokens are validated and how their claims map to the services a principal can use and its quota
+type JWTConfig struct {
+	JWKS           string      `json:"jwks"`
+	Issuer         string      `json:"issuer"`
+	Audience       string      `json:"audience"`
+	PrincipalClaim string      `json:"principal_claim"`
+	Rules          []ClaimRule `json:"rules"`
+}
+
+// Defines the services and quota of principals whose token has a claim with a value, and whether they can see the
+// usage of every principal, where a claim that holds a list or space-separated values, like groups or scope, matches
+// when any of them is the value
+type ClaimRule struct {
+	Claim    string   `json:"claim"`
+	Value    string   `json:"value"`
+	Services []string `json:"services"`
+	Quota    *Quota   `json:"quota,omitempty"`
+	Admin    bool     `json:"admin,omitempty"`
+}
+
+// Defines how many requests, tokens and images a principal can use each day and month, where zero means there is no limit
+type Quota struct {
+	RequestsPerDay   int `json:"requests_per_day,omitempty"`
+	RequestsPerMonth int `json:"requests_per_month,omitempty"`
+	TokensPerDay     int `json:"tokens_per_day,omitempty"`
+	TokensPerMonth   int `json:"tokens_per_month,omitempty"`
+	ImagesPerDay     int `json:"images_per_day,omitempty"`
+	ImagesPerMonth   int `json:"images_per_month,omitempty"`
+}
+
+// Defines how long a JWKS from a URL is used before it is fetched again, and how often an unknown key ID can cause it
+// to be fetched early, such as when the issuer rotates its keys
+const (
+	jwksRefreshInterval    = time.Hour
+	jwksMinRefreshInterval = time.Minute
+)
+
+// Defines how far the clocks of the issuer and the service can be apart
+const jwtLeeway = time.Minute
+
+// Loads the JWT configuration from a JSON file
+func LoadJWTConfig(path string) (JWTConfig, error) {
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return JWTConfig{}, fmt.Errorf("error reading JWT config file: %v", err)
+	}
+
+	var config JWTConfig
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return JWTConfig{}, fmt.Errorf("error parsing JWT config file: %v", err)
+	}
+	if config.JWKS == "" {
+		return JWTConfig{}, fmt.Errorf("JWT config must have a 'jwks' file or URL")
+	}
+	if config.PrincipalClaim == "" {
+		config.PrincipalClaim = "sub"
+	}
+	return config, nil
+}
+
+// Sets how bearer tokens are validated, loading the JWKS now so a bad file or URL is reported at startup
+func (i *Intelligence) SetJWTAuth(config JWTConfig) error {
+	validator := &jwtValidator{config: config, httpClient: i.httpClient}
+	if err := validator.loadKeys(context.Background()); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.jwt = validator
+	return nil
+}
+
+// Validates bearer tokens against the keys of a JWKS and maps their claims to a principal
+type jwtValidator struct {
+	config      JWTConfig
+	httpClient  *http.Client
+	keys        map[string]crypto.PublicKey
+	loadedAt    time.Time
+	attemptedAt time.Time
+	mu          sync.Mutex
+}
+
+// Returns whether a token is a JWT rather than an API key
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Validates the signature and claims of a token and returns the principal it was issued to
+func (v *jwtValidator) validate(ctx context.Context, token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, newError(ErrorCodeUnauthorized, "", "invalid token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, newError(ErrorCodeUnauthorized, "", "invalid token signature encoding")
+	}
+
+	key, err := v.getKey(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, newError(ErrorCodeUnauthorized, "", "invalid token: %v", err)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, newError(ErrorCodeUnauthorized, "", "invalid token claims: %v", err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, newError(ErrorCodeUnauthorized, "", "invalid token: %v", err)
+	}
+
+	return v.getPrincipal(claims), nil
+}
+
+// Checks that the token is current and was issued by the issuer for the audience
+func (v *jwtValidator) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	expiresAt, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token has no expiration")
+	}
+	if now.After(time.Unix(int64(expiresAt), 0).Add(jwtLeeway)) {
+		return fmt.Errorf("token has expired")
+	}
+	if notBefore, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(notBefore), 0)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return fmt.Errorf("token has the wrong issuer")
+	}
+	if v.config.Audience != "" && !getClaimValues(claims["aud"])[v.config.Audience] {
+		return fmt.Errorf("token has the wrong audience")
+	}
+	if _, exists := claims[v.config.PrincipalClaim]; !exists {
+		return fmt.Errorf("token has no '%s' claim", v.config.PrincipalClaim)
+	}
+	return nil
+}
+
+// Maps the claims of a token to a principal, allowing the services of every rule that matches and holding it to the
+// quota of the first rule that matches and has one
+func (v *jwtValidator) getPrincipal(claims map[string]interface{}) *Principal {
+	name := fmt.Sprintf("%v", claims[v.config.PrincipalClaim])
+	issuer, _ := claims["iss"].(string)
+	principal := &Principal{
+		ID:     "jwt:" + issuer + "/" + name,
+		Name:   name,
+		Claims: claims,
+	}
+	for _, rule := range v.config.Rules {
+		if !getClaimValues(claims[rule.Claim])[rule.Value] {
+			continue
+		}
+		principal.Services = append(principal.Services, rule.Services...)
+		principal.Admin = principal.Admin || rule.Admin
+		if principal.Quota == nil && rule.Quota != nil {
+			quota := *rule.Quota
+			principal.Quota = &quota
+		}
+	}
+	return principal
+}
+
+// Returns the values of a claim, which can be a string of space-separated values or a list
+func getClaimValues(claim interface{}) map[string]bool {
+	values := make(map[string]bool)
+	switch v := claim.(type) {
+	case string:
+		values[v] = true
+		for _, value := range strings.Fields(v) {
+			values[value] = true
+		}
+	case []interface{}:
+		for _, item := range v {
+			if value, ok := item.(string); ok {
+				values[value] = true
+			}
+		}
+	}
+	return values
+}
+
+// Returns the key with an ID, fetching the JWKS again when the key is unknown or the JWKS is stale
+func (v *jwtValidator) getKey(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	// Only try to fetch the JWKS once a minute so unknown key IDs or an unavailable URL can't flood the issuer
+	v.mu.Lock()
+	key, exists := v.keys[keyID]
+	isURL := isJWKSURL(v.config.JWKS)
+	stale := time.Since(v.loadedAt) > jwksRefreshInterval
+	refresh := isURL && (!exists || stale) && time.Since(v.attemptedAt) > jwksMinRefreshInterval
+	if refresh {
+		v.attemptedAt = time.Now()
+	}
+	v.mu.Unlock()
+
+	if refresh {
+		if err := v.loadKeys(ctx); err != nil && !exists {
+			return nil, newError(ErrorCodeUnauthorized, "", "failed to load token keys: %v", err)
+		}
+		v.mu.Lock()
+		key, exists = v.keys[keyID]
+		v.mu.Unlock()
+	}
+	if !exists {
+		return nil, newError(ErrorCodeUnauthorized, "", "token key '%s' is unknown", keyID)
+	}
+	return key, nil
+}
+
+// Returns whether the JWKS is fetched from a URL rather than read from a file
+func isJWKSURL(jwks string) bool {
+	return strings.HasPrefix(jwks, "https://") || strings.HasPrefix(jwks, "http://")
+}
+
+// Reads the JWKS from its file or URL and replaces the keys
+func (v *jwtValidator) loadKeys(ctx context.Context) error {
+	var jwksBytes []byte
+	var err error
+	if isJWKSURL(v.config.JWKS) {
+		jwksBytes, err = v.fetchJWKS(ctx)
+	} else {
+		jwksBytes, err = os.ReadFile(v.config.JWKS)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading JWKS: %v", err)
+	}
+
+	keys, err := parseJWKS(jwksBytes)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	v.loadedAt = time.Now()
+	return nil
+}
+
+// Fetches the JWKS from its URL
+func (v *jwtValidator) fetchJWKS(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.config.JWKS, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Parses the RSA and EC signing keys of a JWKS by their key IDs
+func parseJWKS(jwksBytes []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(jwksBytes, &jwks); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.KeyType {
+		case "RSA":
+			n, nErr := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, eErr := base64.RawURLEncoding.DecodeString(jwk.E)
+			if nErr != nil || eErr != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("JWKS key '%s' is not a valid RSA key", jwk.KeyID)
+			}
+			keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Curve {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("JWKS key '%s' has an unsupported curve '%s'", jwk.KeyID, jwk.Curve)
+			}
+			x, xErr := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, yErr := base64.RawURLEncoding.DecodeString(jwk.Y)
+			key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if xErr != nil || yErr != nil || !curve.IsOnCurve(key.X, key.Y) {
+				return nil, fmt.Errorf("JWKS key '%s' is not a valid EC key", jwk.KeyID)
+			}
+			keys[jwk.KeyID] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no RSA or EC signing keys")
+	}
+	return keys, nil
+}
+
+// Verifies the signature of a token with a key, only allowing the asymmetric algorithms that match the key type
+func verifyJWTSignature(algorithm string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch algorithm {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", algorithm)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(algorithm, "RS"):
+			if rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+				return fmt.Errorf("signature is invalid")
+			}
+			return nil
+		case strings.HasPrefix(algorithm, "PS"):
+			if rsa.VerifyPSS(key, hash, digest, signature, nil) != nil {
+				return fmt.Errorf("signature is invalid")
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		// ECDSA signatures are the two integers of the curve's size, one after the other
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(algorithm, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				return fmt.Errorf("signature is invalid")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("algorithm '%s' does not match the key", algorithm)
+}
+
+// Decodes a base64url encoded JSON part of a token
+func decodeJWTPart(part string, value interface{}) error {
+	partBytes, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(partBytes, value)
+}
@@ -0,0 +1,353 @@
+package intelligence
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Defines the keys the test tokens are signed with
+type testJWTKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+// Creates signing keys and writes their JWKS to a file, returning the keys and the path of the file
+func newTestJWTKeys(t *testing.T) (testJWTKeys, string) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "RSA", "kid": "encryption", "use": "enc", "n": encode(rsaKey.N.Bytes()), "e": "AQAB"},
+		},
+	})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return testJWTKeys{rsa: rsaKey, ec: ecKey}, path
+}
+
+// Returns a token with the claims signed with the algorithm and key ID
+func (k testJWTKeys) sign(t *testing.T, algorithm string, keyID string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": algorithm, "kid": keyID, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch algorithm {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, k.rsa, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "HS256":
+		// Signs with the public key as a secret, as an attacker would to confuse the algorithms
+		mac := hmac.New(sha256.New, k.rsa.N.Bytes())
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	keys, jwksPath := newTestJWTKeys(t)
+	i := newTestIntelligence(t, nil)
+	i.SetAPIKeys(testAPIKeys)
+	err := i.SetJWTAuth(JWTConfig{
+		JWKS:           jwksPath,
+		Issuer:         "https://issuer.example.com",
+		Audience:       "intelligence",
+		PrincipalClaim: "email",
+		Rules: []ClaimRule{
+			{Claim: "groups", Value: "analysts", Services: []string{"sentiment", "summary"}, Quota: &Quota{RequestsPerDay: 100}},
+			{Claim: "scope", Value: "intelligence:admin", Services: []string{"*"}, Quota: &Quota{RequestsPerDay: 1}, Admin: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Returns valid claims with changes, where nil values are removed
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"iss":    "https://issuer.example.com",
+			"aud":    "intelligence",
+			"email":  "ada@example.com",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"analysts"},
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		services []string
+		quota    *Quota
+		admin    bool
+		error    string
+	}{
+		{
+			name:     "RS256 token",
+			token:    keys.sign(t, "RS256", "rsa", claims(nil)),
+			services: []string{"sentiment", "summary"},
+			quota:    &Quota{RequestsPerDay: 100},
+		},
+		{
+			name:     "PS256 token",
+			token:    keys.sign(t, "PS256", "rsa", claims(nil)),
+			services: []string{"sentiment", "summary"},
+			quota:    &Quota{RequestsPerDay: 100},
+		},
+		{
+			name:     "ES256 token",
+			token:    keys.sign(t, "ES256", "ec", claims(nil)),
+			services: []string{"sentiment", "summary"},
+			quota:    &Quota{RequestsPerDay: 100},
+		},
+		{
+			name:     "rules add up with the quota of the first match",
+			token:    keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"scope": "openid intelligence:admin"})),
+			services: []string{"sentiment", "summary", "*"},
+			quota:    &Quota{RequestsPerDay: 100},
+			admin:    true,
+		},
+		{
+			name:  "no matching rules",
+			token: keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"groups": []string{"support"}})),
+		},
+		{
+			name:     "audience in a list",
+			token:    keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"aud": []string{"other", "intelligence"}})),
+			services: []string{"sentiment", "summary"},
+			quota:    &Quota{RequestsPerDay: 100},
+		},
+		{
+			name:  "expired",
+			token: keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"exp": time.Now().Add(-2 * jwtLeeway).Unix()})),
+			error: "token has expired",
+		},
+		{
+			name:  "no expiration",
+			token: keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"exp": nil})),
+			error: "token has no expiration",
+		},
+		{
+			name:  "not valid yet",
+			token: keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"nbf": time.Now().Add(2 * jwtLeeway).Unix()})),
+			error: "token is not valid yet",
+		},
+		{
+			name:  "wrong issuer",
+			token: keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"iss": "https://attacker.example.com"})),
+			error: "wrong issuer",
+		},
+		{
+			name:  "wrong audience",
+			token: keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"aud": "other"})),
+			error: "wrong audience",
+		},
+		{
+			name:  "no principal claim",
+			token: keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"email": nil})),
+			error: "no 'email' claim",
+		},
+		{
+			name:  "unknown key",
+			token: keys.sign(t, "RS256", "other", claims(nil)),
+			error: "token key 'other' is unknown",
+		},
+		{
+			name:  "encryption key",
+			token: keys.sign(t, "RS256", "encryption", claims(nil)),
+			error: "token key 'encryption' is unknown",
+		},
+		{
+			name:  "HMAC signed with the public key",
+			token: keys.sign(t, "HS256", "rsa", claims(nil)),
+			error: "unsupported algorithm 'HS256'",
+		},
+		{
+			name:  "no algorithm",
+			token: keys.sign(t, "none", "rsa", claims(nil)),
+			error: "unsupported algorithm 'none'",
+		},
+		{
+			name:  "algorithm of another key type",
+			token: keys.sign(t, "RS256", "ec", claims(nil)),
+			error: "does not match the key",
+		},
+		{
+			name:  "changed claims",
+			token: changeTestJWTClaims(keys.sign(t, "RS256", "rsa", claims(nil)), claims(map[string]interface{}{"groups": []string{"admins"}})),
+			error: "signature is invalid",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/intelligence", nil)
+			request.Header.Set("Authorization", "Bearer "+test.token)
+			ctx, err := i.Authenticate(request)
+			if test.error != "" {
+				if AsError(err) == nil || AsError(err).Code != ErrorCodeUnauthorized || !strings.Contains(err.Error(), test.error) {
+					t.Fatalf("got error %v, want an unauthorized error containing %q", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			principal := GetPrincipal(ctx)
+			if principal.Name != "ada@example.com" || principal.ID != "jwt:https://issuer.example.com/ada@example.com" {
+				t.Errorf("got principal %q with ID %q, want %q from the issuer", principal.Name, principal.ID, "ada@example.com")
+			}
+			if !reflect.DeepEqual(principal.Services, test.services) {
+				t.Errorf("got services %v, want %v", principal.Services, test.services)
+			}
+			if !reflect.DeepEqual(principal.Quota, test.quota) {
+				t.Errorf("got quota %+v, want %+v", principal.Quota, test.quota)
+			}
+			if principal.Admin != test.admin {
+				t.Errorf("got admin %v, want %v", principal.Admin, test.admin)
+			}
+		})
+	}
+
+	// API keys still work alongside tokens
+	request := httptest.NewRequest(http.MethodPost, "/intelligence", nil)
+	request.Header.Set("Authorization", "Bearer alice-key")
+	if ctx, err := i.Authenticate(request); err != nil || GetPrincipal(ctx).ID != "key:alice" {
+		t.Errorf("got error %v for an API key, want key:alice", err)
+	}
+}
+
+// Replaces the claims of a token and keeps its signature
+func changeTestJWTClaims(token string, claims map[string]interface{}) string {
+	parts := strings.Split(token, ".")
+	payload, _ := json.Marshal(claims)
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	keys, jwksPath := newTestJWTKeys(t)
+	jwks, _ := os.ReadFile(jwksPath)
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	i := newTestIntelligence(t, nil)
+	i.httpClient.Transport = http.DefaultTransport
+	if err := i.SetJWTAuth(JWTConfig{JWKS: server.URL, PrincipalClaim: "sub"}); err != nil {
+		t.Fatal(err)
+	}
+	token := keys.sign(t, "ES256", "unknown", map[string]interface{}{"sub": "ada", "exp": time.Now().Add(time.Hour).Unix()})
+
+	// Unknown key IDs fetch the JWKS again at most once a minute
+	for attempt := 0; attempt < 3; attempt++ {
+		request := httptest.NewRequest(http.MethodPost, "/intelligence", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		if _, err := i.Authenticate(request); AsError(err) == nil || AsError(err).Code != ErrorCodeUnauthorized {
+			t.Fatalf("got error %v, want unauthorized", err)
+		}
+	}
+	if fetches.Load() != 2 {
+		t.Errorf("got %d JWKS fetches, want 2", fetches.Load())
+	}
+}
+
+func TestJWTPrincipalIsNotAPIKey(t *testing.T) {
+	keys, jwksPath := newTestJWTKeys(t)
+	i := newTestIntelligence(t, func(r *http.Request) (*http.Response, error) {
+		return stubResponse(`{"choices":[{"message":{"content":"positive"}}],"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`), nil
+	})
+	i.SetAPIKeys(testAPIKeys)
+	err := i.SetJWTAuth(JWTConfig{
+		JWKS:           jwksPath,
+		PrincipalClaim: "sub",
+		Rules:          []ClaimRule{{Claim: "sub", Value: "alice", Services: []string{"*"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, _ := NewJobStore("")
+	i.StartJobs(store, 1, 10)
+
+	// A token whose subject has the same name as the alice API key
+	token := keys.sign(t, "RS256", "rsa", map[string]interface{}{"iss": "https://issuer.example.com", "sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	send := func(handler http.Handler, method string, path string, authorization string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("Authorization", authorization)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// The token can't see the job of the API key
+	submitted := send(i.JobsHandler(), http.MethodPost, "/intelligence/jobs", "Bearer alice-key", `{"positive": {"model": "sentiment", "text": "I love it"}}`)
+	var job Job
+	json.Unmarshal(submitted.Body.Bytes(), &job)
+	waitForJob(t, store, job.ID, func(job Job) bool { return job.isFinished() })
+	if recorder := send(i.JobsHandler(), http.MethodGet, "/intelligence/jobs/"+job.ID, "Bearer "+token, ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("got status %d for the job of the API key, want %d", recorder.Code, http.StatusNotFound)
+	}
+
+	// The usage and costs of the API key aren't reported to the token
+	for path, handler := range map[string]http.Handler{"/usage": i.UsageHandler(), "/usage/costs": i.CostsHandler()} {
+		own := send(handler, http.MethodGet, path, "Bearer alice-key", "")
+		other := send(handler, http.MethodGet, path, "Bearer "+token, "")
+		if !strings.Contains(own.Body.String(), `"requests":1`) || strings.Contains(other.Body.String(), `"requests":1`) {
+			t.Errorf("got %s for the API key and %s for the token from %s, want the request only reported to the API key", own.Body, other.Body, path)
+		}
+	}
+}
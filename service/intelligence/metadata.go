@@ -0,0 +1,149 @@
+package intelligence
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defines details about how a result was produced. Results that make more than one provider request, like pipelines,
+// have the tokens of every request and the model, request ID and finish reason of the last one.
+type Metadata struct {
+	Model            string `json:"model,omitempty"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+	CachedTokens     int    `json:"cached_tokens"`
+	Cache            string `json:"cache,omitempty"`
+	LatencyMs        int64  `json:"latency_ms"`
+	RequestID        string `json:"request_id,omitempty"`
+	FinishReason     string `json:"finish_reason,omitempty"`
+
+	started time.Time
+	parent  *Metadata
+	mu      sync.Mutex
+}
+
+// Defines the context key for the metadata of a result
+type metadataContextKey struct{}
+
+// Defines the context key for the metadata of a set of requests by request key
+type requestsMetadataContextKey struct{}
+
+// Defines the metadata of a set of requests by request key
+type requestsMetadata struct {
+	values map[string]*Metadata
+	mu     sync.Mutex
+}
+
+// Returns a context that collects the metadata of the provider requests made with it, which are also added to the
+// metadata the context already collects
+func WithMetadata(ctx context.Context) (context.Context, *Metadata) {
+	metadata := &Metadata{started: time.Now(), parent: getMetadata(ctx)}
+	return context.WithValue(ctx, metadataContextKey{}, metadata), metadata
+}
+
+// Returns the metadata collected by a context, or nil if it doesn't collect any
+func getMetadata(ctx context.Context) *Metadata {
+	metadata, _ := ctx.Value(metadataContextKey{}).(*Metadata)
+	return metadata
+}
+
+// Sets the latency to the time since the metadata started being collected
+func (m *Metadata) Finish() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.LatencyMs = time.Since(m.started).Milliseconds()
+}
+
+// Returns the metadata as JSON
+func (m *Metadata) MarshalJSON() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	type metadataJSON Metadata
+	return json.Marshal((*metadataJSON)(m))
+}
+
+// Adds the details of a provider response, which can be nil when the context doesn't collect metadata
+func (m *Metadata) addResponse(header http.Header, response map[string]interface{}) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	if model, ok := response["model"].(string); ok && model != "" {
+		m.Model = model
+	}
+	if usage, ok := response["usage"].(map[string]interface{}); ok {
+		promptTokens := getUsageCount(usage, "prompt_tokens")
+		completionTokens := getUsageCount(usage, "completion_tokens")
+		totalTokens := getUsageCount(usage, "total_tokens")
+		if _, ok := usage["total_tokens"]; !ok {
+			totalTokens = promptTokens + completionTokens
+		}
+		m.PromptTokens += promptTokens
+		m.CompletionTokens += completionTokens
+		m.TotalTokens += totalTokens
+
+		// Report whether the provider's prompt cache served any of the prompt tokens, which only responses with
+		// prompt token details say, so embeddings and images have no cache status
+		if details, ok := usage["prompt_tokens_details"].(map[string]interface{}); ok {
+			m.CachedTokens += getUsageCount(details, "cached_tokens")
+			m.Cache = "miss"
+			if m.CachedTokens > 0 {
+				m.Cache = "hit"
+			}
+		}
+	}
+
+	if header != nil {
+		if requestID := header.Get("X-Request-Id"); requestID != "" {
+			m.RequestID = requestID
+		}
+	}
+	if choices, ok := response["choices"].([]interface{}); ok && len(choices) > 0 {
+		if choice, ok := choices[0].(map[string]interface{}); ok {
+			if finishReason, ok := choice["finish_reason"].(string); ok && finishReason != "" {
+				m.FinishReason = finishReason
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	m.parent.addResponse(header, response)
+}
+
+// Returns a context that collects the metadata of each of a set of requests by request key
+func withRequestsMetadata(ctx context.Context) (context.Context, *requestsMetadata) {
+	metadata := &requestsMetadata{values: make(map[string]*Metadata)}
+	return context.WithValue(ctx, requestsMetadataContextKey{}, metadata), metadata
+}
+
+// Returns the collector of the metadata of a set of requests, or nil if metadata isn't collected
+func getRequestsMetadata(ctx context.Context) *requestsMetadata {
+	metadata, _ := ctx.Value(requestsMetadataContextKey{}).(*requestsMetadata)
+	return metadata
+}
+
+// Sets the metadata of a request
+func (r *requestsMetadata) set(key string, metadata *Metadata) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[key] = metadata
+}
+
+// Determines whether the client asked for the metadata of each result
+func isMetadataRequest(r *http.Request, requests Requests) bool {
+	if strings.EqualFold(r.URL.Query().Get("include_metadata"), "true") {
+		return true
+	}
+	for _, request := range requests {
+		if includeMetadata, ok := request["include_metadata"].(bool); ok && includeMetadata {
+			return true
+		}
+	}
+	return false
+}
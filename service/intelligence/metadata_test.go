@@ -0,0 +1,73 @@
+package intelligence
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestMetadataAddResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []string
+		want      *Metadata
+	}{
+		{
+			name:      "completion",
+			responses: []string{`{"model":"gpt-4o-mini-2024-07-18","choices":[{"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":2,"total_tokens":12,"prompt_tokens_details":{"cached_tokens":0}}}`},
+			want:      &Metadata{Model: "gpt-4o-mini-2024-07-18", PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12, Cache: "miss", FinishReason: "stop"},
+		},
+		{
+			name:      "cached prompt",
+			responses: []string{`{"usage":{"prompt_tokens":2000,"completion_tokens":5,"total_tokens":2005,"prompt_tokens_details":{"cached_tokens":1024}}}`},
+			want:      &Metadata{PromptTokens: 2000, CompletionTokens: 5, TotalTokens: 2005, CachedTokens: 1024, Cache: "hit"},
+		},
+		{
+			name:      "no total tokens",
+			responses: []string{`{"usage":{"prompt_tokens":10,"completion_tokens":2}}`},
+			want:      &Metadata{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12},
+		},
+		{
+			name:      "embeddings",
+			responses: []string{`{"model":"text-embedding-3-small","usage":{"prompt_tokens":8,"total_tokens":8}}`},
+			want:      &Metadata{Model: "text-embedding-3-small", PromptTokens: 8, TotalTokens: 8},
+		},
+		{
+			name:      "images",
+			responses: []string{`{"data":[{"url":"https://example.com/image.png"}]}`},
+			want:      &Metadata{},
+		},
+		{
+			name: "pipeline adds up its requests",
+			responses: []string{
+				`{"usage":{"prompt_tokens":2000,"completion_tokens":5,"total_tokens":2005,"prompt_tokens_details":{"cached_tokens":1024}}}`,
+				`{"model":"text-embedding-3-small","usage":{"prompt_tokens":8,"total_tokens":8}}`,
+			},
+			want: &Metadata{Model: "text-embedding-3-small", PromptTokens: 2008, CompletionTokens: 5, TotalTokens: 2013, CachedTokens: 1024, Cache: "hit"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, parent := WithMetadata(context.Background())
+			_, metadata := WithMetadata(ctx)
+			for _, response := range test.responses {
+				var responseMap map[string]interface{}
+				if err := json.Unmarshal([]byte(response), &responseMap); err != nil {
+					t.Fatal(err)
+				}
+				metadata.addResponse(http.Header{}, responseMap)
+			}
+
+			// The metadata of a result is also added to the metadata of the results it is part of
+			for _, got := range []*Metadata{metadata, parent} {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(test.want)
+				if string(gotJSON) != string(wantJSON) {
+					t.Errorf("got %s, want %s", gotJSON, wantJSON)
+				}
+			}
+		})
+	}
+}
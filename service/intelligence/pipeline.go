@@ -0,0 +1,171 @@
+package intelligence
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Matches a string that is only a parameter placeholder, such as {{params.text}}
+var paramPlaceholderPattern = regexp.MustCompile(`^\{\{params\.([^{}]+)\}\}$`)
+
+// Runs the steps of a pipeline as a batch of requests and returns the projected output
+func (i *Intelligence) getPipeline(ctx context.Context, service Service, params map[string]interface{}) (interface{}, error) {
+	// Create a request for each step with the pipeline params mapped into it
+	requests := make(Requests, len(service.Pipeline.Steps))
+	for key, step := range service.Pipeline.Steps {
+		request := Request(expandParams(step.Params, params).(map[string]interface{}))
+		model := step.Model
+		if model == "" {
+			model = key
+		}
+		request["model"] = model
+		requests[key] = request
+	}
+
+	// Check that the caller can use the service of every step, so a pipeline doesn't give access to other services
+	if authErrors := authorizeRequests(ctx, requests); len(authErrors) > 0 {
+		return nil, getPipelineError(service, authErrors)
+	}
+
+	// Run the steps, where steps that reference the results of other steps wait for them
+	results, errors := i.doRequests(ctx, requests, nil)
+	if len(errors) > 0 {
+		return nil, getPipelineError(service, errors)
+	}
+
+	// Project the output from the step results, or return all of them if there is no output
+	if service.Pipeline.Output == nil {
+		return map[string]interface{}(results), nil
+	}
+	output, err := resolveResultPlaceholders(deepCopyObject(service.Pipeline.Output), results)
+	if err != nil {
+		return nil, newError(ErrorCodeInternal, service.Name, "output of '%s' pipeline could not be resolved: %v", service.Name, err)
+	}
+	return output, nil
+}
+
+// Returns the error of a pipeline from the errors of its steps, which is the first failed step that did not fail
+// because of another step
+func getPipelineError(service Service, errors Errors) *Error {
+	keys := make([]string, 0, len(errors))
+	for key := range errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	failedKey := keys[0]
+	for _, key := range keys {
+		if errors[key].Code != ErrorCodeDependencyFailed {
+			failedKey = key
+			break
+		}
+	}
+	stepErr := errors[failedKey]
+	err := newError(stepErr.Code, service.Name, "step '%s' of '%s' pipeline failed: %s", failedKey, service.Name, stepErr.Message)
+	err.Retryable = stepErr.Retryable
+	err.StatusCode = stepErr.StatusCode
+	err.RetryAfter = stepErr.RetryAfter
+	return err
+}
+
+// Recursively replaces parameter placeholders in a value, keeping the type of the parameter when a string is only
+// a placeholder
+func expandParams(value interface{}, params map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if match := paramPlaceholderPattern.FindStringSubmatch(v); match != nil {
+			return params[match[1]]
+		}
+		return expandPlaceholders(v, params)
+	case []interface{}:
+		expanded := make([]interface{}, len(v))
+		for i, item := range v {
+			expanded[i] = expandParams(item, params)
+		}
+		return expanded
+	case map[string]interface{}:
+		expanded := make(map[string]interface{}, len(v))
+		for key, nestedValue := range v {
+			// Leave out values mapped from params that were not given so the step can apply its defaults
+			if placeholder, ok := nestedValue.(string); ok {
+				if match := paramPlaceholderPattern.FindStringSubmatch(placeholder); match != nil {
+					if _, exists := params[match[1]]; !exists {
+						continue
+					}
+				}
+			}
+			expanded[key] = expandParams(nestedValue, params)
+		}
+		return expanded
+	case nil:
+		return map[string]interface{}{}
+	default:
+		return v
+	}
+}
+
+// Ensures every pipeline step calls a service that exists and that pipelines do not call themselves through
+// their steps
+func validatePipelines(config map[string]Service) error {
+	// Returns the services called by the steps of a pipeline
+	getStepModels := func(service Service) []string {
+		var models []string
+		for key, step := range service.Pipeline.Steps {
+			model := step.Model
+			if model == "" {
+				model = key
+			}
+			models = append(models, model)
+		}
+		sort.Strings(models)
+		return models
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var visit func(name string) error
+	visit = func(name string) error {
+		state[name] = visiting
+		for _, model := range getStepModels(config[name]) {
+			stepService, exists := config[model]
+			if !exists {
+				return fmt.Errorf("pipeline '%s' calls unknown service '%s'", name, model)
+			}
+			if stepService.Type != "pipeline" {
+				continue
+			}
+			switch state[model] {
+			case unvisited:
+				if err := visit(model); err != nil {
+					return err
+				}
+			case visiting:
+				return fmt.Errorf("pipeline '%s' calls itself through '%s'", model, name)
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	names := make([]string, 0, len(config))
+	for name, service := range config {
+		if service.Type == "pipeline" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if state[name] == unvisited {
+			if err := visit(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package intelligence
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPipelineAuthorizesSteps(t *testing.T) {
+	pipelineSteps := []string{"enrich_review", "moderation", "sentiment", "extraction", "summary"}
+	tests := []struct {
+		name     string
+		services []string
+		code     string
+	}{
+		{"every service", []string{"*"}, ""},
+		{"pipeline and steps", pipelineSteps, ""},
+		{"pipeline without a step", []string{"enrich_review", "moderation", "sentiment", "extraction"}, ErrorCodeForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := newTestIntelligence(t, func(r *http.Request) (*http.Response, error) {
+				if strings.Contains(r.URL.Path, "moderations") {
+					return stubResponse(`{"results":[{"flagged":false,"categories":{},"category_scores":{}}]}`), nil
+				}
+				return stubResponse(`{"choices":[{"message":{"content":"{\"product\":\"blender\"}"}}]}`), nil
+			})
+			ctx := WithPrincipal(context.Background(), &Principal{Name: "test", Services: test.services})
+
+			for _, run := range []struct {
+				name string
+				run  func() error
+			}{
+				{"request", func() error {
+					_, err := i.GetIntelligence(ctx, "enrich_review", map[string]interface{}{"text": "Great blender"})
+					return err
+				}},
+				{"dry run", func() error {
+					_, err := i.DryRun(ctx, "enrich_review", map[string]interface{}{"text": "Great blender"})
+					return err
+				}},
+			} {
+				err := run.run()
+				if test.code == "" {
+					if err != nil {
+						t.Errorf("%s: %v", run.name, err)
+					}
+					continue
+				}
+				if err == nil || AsError(err).Code != test.code {
+					t.Errorf("%s: got error %v, want %s", run.name, err, test.code)
+				}
+			}
+		})
+	}
+}
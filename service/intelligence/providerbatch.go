@@ -0,0 +1,598 @@
+package intelligence
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defines the delay between checks on the status of the provider batches of jobs
+var providerBatchPollInterval = 30 * time.Second
+
+// Defines a provider batch that a job is waiting for, with the service and request body of each request in it so its
+// outputs can be mapped back to the requests and their cost computed after a restart
+type ProviderBatch struct {
+	ID       string                     `json:"id"`
+	Service  string                     `json:"service"`
+	Services map[string]string          `json:"services"`
+	Bodies   map[string]json.RawMessage `json:"bodies,omitempty"`
+}
+
+// Defines a request in a provider batch input file
+type providerBatchRequest struct {
+	CustomID string      `json:"custom_id"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Body     interface{} `json:"body"`
+}
+
+// Defines a line of a provider batch output or error file
+type providerBatchOutput struct {
+	CustomID string `json:"custom_id"`
+	Response *struct {
+		StatusCode int                    `json:"status_code"`
+		Body       map[string]interface{} `json:"body"`
+	} `json:"response"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Defines a group of requests that are sent to the same provider endpoint in one provider batch
+type providerBatchGroup struct {
+	service  Service
+	path     string
+	requests []providerBatchRequest
+	services map[string]Service
+	tokens   int
+	release  func()
+}
+
+// Submits the requests to the provider's Batch API, which is cheaper but can take up to a day. Completions and
+// embeddings requests are grouped into a provider batch per provider endpoint, which is passed to onBatch once it is
+// created, and other requests are processed directly. Groups that already have a batch in batches, such as before a
+// restart, are not submitted again. Returns the results of the direct requests and the errors of the requests that
+// could not be submitted, where the results of the provider batches are collected by pollProviderBatches.
+func (i *Intelligence) doProviderBatchRequests(ctx context.Context, requests Requests, batches map[string]*ProviderBatch, onBatch func(key string, batch *ProviderBatch)) (Results, Errors) {
+	results := make(Results)
+	errors := make(Errors)
+	directRequests := make(Requests)
+	groups := make(map[string]*providerBatchGroup)
+
+	// Results can't be chained through a provider batch since every request in it is sent at once
+	for key, request := range requests {
+		referenced := make(map[string]bool)
+		collectResultReferences(map[string]interface{}(request), referenced)
+		if len(referenced) > 0 {
+			errors[key] = newError(ErrorCodeValidation, "", "request '%s' can't reference the results of other requests in batch mode", key)
+		}
+	}
+
+	// Render the request body for each request, just like a direct request would
+	for key, request := range requests {
+		if _, failed := errors[key]; failed {
+			continue
+		}
+
+		model, exists := request["model"].(string)
+		if !exists {
+			errors[key] = newError(ErrorCodeValidation, "", "invalid input: 'model' parameter is required")
+			continue
+		}
+		i.mu.RLock()
+		service, exists := i.config[model]
+		i.mu.RUnlock()
+		if !exists {
+			errors[key] = newError(ErrorCodeNotFound, model, "model '%s' not found", model)
+			continue
+		}
+
+		// Dry runs are answered with what would be sent, at the batch price for the requests a batch would have
+		if isDryRunRequest(request) {
+			batched := service.Type == "v1/completions" || service.Type == "v1/embeddings"
+			if dryRun, err := i.dryRun(ctx, model, request, batched); err != nil {
+				errors[key] = AsError(err)
+			} else {
+				results[key] = dryRun
+			}
+			continue
+		}
+
+		var body interface{}
+		switch service.Type {
+		case "v1/completions", "v1/embeddings":
+			params, err := i.prepareParams(service, request)
+			if err == nil {
+				params, err = i.fitContextWindow(service, params)
+			}
+			if err != nil {
+				errors[key] = AsError(err)
+				continue
+			}
+			if service.Type == "v1/completions" {
+				body = i.getCompletionRequestBody(service, params)
+			} else if body, err = getEmbeddingsRequestBody(service, params); err != nil {
+				errors[key] = AsError(err)
+				continue
+			}
+		default:
+			directRequests[key] = request
+			continue
+		}
+
+		path, err := getServicePath(service)
+		if err != nil {
+			errors[key] = AsError(err)
+			continue
+		}
+
+		// Requests are batched by provider, endpoint and model, since a batch can only have requests for one model, and
+		// requests in a batch that was already submitted are waited for by the poller
+		groupKey := service.Provider + path + "/" + service.Model
+		if _, submitted := batches[groupKey]; submitted {
+			continue
+		}
+
+		group, exists := groups[groupKey]
+		if !exists {
+			group = &providerBatchGroup{service: service, path: path, services: make(map[string]Service)}
+			groups[groupKey] = group
+		}
+		group.requests = append(group.requests, providerBatchRequest{CustomID: key, Method: http.MethodPost, URL: path, Body: body})
+		group.services[key] = service
+		bodyBytes, _ := json.Marshal(body)
+		group.tokens += estimateRequestTokens(i.getEncoding(service.Model), bodyBytes)
+	}
+
+	// Reserve the requests of each group against the principal's quota before it is submitted, failing the whole group
+	// when it doesn't fit, and keep the reservation until the usage of its batch is recorded
+	for groupKey, group := range groups {
+		release, err := i.reserveQuota(ctx, group.service, Usage{Requests: len(group.requests), TotalTokens: group.tokens})
+		if err != nil {
+			for _, request := range group.requests {
+				errors[request.CustomID] = AsError(err)
+			}
+			delete(groups, groupKey)
+			continue
+		}
+		group.release = release
+	}
+
+	// Submit each group as its own provider batch while the other requests are processed directly
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for groupKey, group := range groups {
+		wg.Add(1)
+		go func(groupKey string, group *providerBatchGroup) {
+			defer wg.Done()
+			batch, err := i.submitProviderBatch(ctx, group)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				group.release()
+				for _, request := range group.requests {
+					errors[request.CustomID] = AsError(err)
+				}
+				return
+			}
+			i.mu.Lock()
+			i.batchReservations[batch.ID] = group.release
+			i.mu.Unlock()
+			if onBatch != nil {
+				onBatch(groupKey, batch)
+			}
+		}(groupKey, group)
+	}
+	if len(directRequests) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			directResults, directErrors := i.doRequests(ctx, directRequests, nil)
+			mu.Lock()
+			defer mu.Unlock()
+			for key, result := range directResults {
+				results[key] = result
+			}
+			for key, err := range directErrors {
+				errors[key] = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results, errors
+}
+
+// Uploads the requests of a group and creates a provider batch for them
+func (i *Intelligence) submitProviderBatch(ctx context.Context, group *providerBatchGroup) (*ProviderBatch, error) {
+	fileID, err := i.uploadProviderBatchFile(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	batchID, err := i.createProviderBatch(ctx, group, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &ProviderBatch{
+		ID:       batchID,
+		Service:  group.service.Name,
+		Services: make(map[string]string, len(group.services)),
+		Bodies:   make(map[string]json.RawMessage, len(group.requests)),
+	}
+	for key, service := range group.services {
+		batch.Services[key] = service.Name
+	}
+	for _, request := range group.requests {
+		body, err := json.Marshal(request.Body)
+		if err != nil {
+			return nil, err
+		}
+		batch.Bodies[request.CustomID] = body
+	}
+	return batch, nil
+}
+
+// Checks the provider batches of the jobs that are waiting for them on an interval, apart from the job workers since
+// a provider batch can take up to a day
+func (i *Intelligence) pollProviderBatches(store *JobStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, id := range store.waitingForProviderBatches() {
+			i.checkJobProviderBatches(store, id)
+		}
+	}
+}
+
+// Collects the results of the provider batches of a job that have finished, and completes the job once none are left
+func (i *Intelligence) checkJobProviderBatches(store *JobStore, id string) {
+	job, exists := store.Get(id)
+	if !exists || job.Status != JobStatusRunning {
+		return
+	}
+
+	// Count the usage of the batches against whoever submitted the job
+	ctx := context.Background()
+	if job.Principal != nil {
+		ctx = WithPrincipal(ctx, job.Principal)
+	}
+
+	for key, batch := range job.ProviderBatches {
+		results, errors, finished := i.getProviderBatchResults(ctx, batch)
+		if !finished {
+			continue
+		}
+		i.releaseProviderBatchReservation(batch.ID)
+		store.update(id, func(job *Job) {
+			if job.Status != JobStatusRunning {
+				return
+			}
+			if job.Results == nil {
+				job.Results = make(Results)
+			}
+			for resultKey, result := range results {
+				job.Results[resultKey] = result
+			}
+			if len(errors) > 0 && job.Errors == nil {
+				job.Errors = make(Errors)
+			}
+			for errorKey, err := range errors {
+				job.Errors[errorKey] = err
+			}
+			delete(job.ProviderBatches, key)
+		})
+	}
+
+	completed := false
+	store.update(id, func(job *Job) {
+		if job.Status == JobStatusRunning && len(job.ProviderBatches) == 0 {
+			now := time.Now()
+			job.Status = JobStatusCompleted
+			job.ProviderBatches = nil
+			job.WaitingForProviderBatches = false
+			job.FinishedAt = &now
+			completed = true
+		}
+	})
+	if completed {
+		go i.deliverJobCallback(store, id)
+	}
+}
+
+// Checks on a provider batch and, when it has finished, returns the results and errors of its requests mapped back to
+// their keys. A batch that can't be checked for a reason that may pass is checked again on the next poll.
+func (i *Intelligence) getProviderBatchResults(ctx context.Context, providerBatch *ProviderBatch) (Results, Errors, bool) {
+	i.mu.RLock()
+	service, exists := i.config[providerBatch.Service]
+	i.mu.RUnlock()
+
+	// Fails every request in the batch with the same error
+	failAll := func(err error) (Results, Errors, bool) {
+		errors := make(Errors)
+		for key := range providerBatch.Services {
+			errors[key] = AsError(err)
+		}
+		return nil, errors, true
+	}
+	if !exists {
+		return failAll(newError(ErrorCodeInternal, providerBatch.Service, "provider batch '%s' is for unknown service '%s'", providerBatch.ID, providerBatch.Service))
+	}
+
+	batch, err := i.doProviderRequest(ctx, service, http.MethodGet, "/v1/batches/"+providerBatch.ID, "", nil)
+	if err != nil {
+		if AsError(err).Retryable {
+			return nil, nil, false
+		}
+		return failAll(err)
+	}
+	status, _ := batch["status"].(string)
+	switch status {
+	case "completed", "expired", "cancelled":
+	case "failed":
+		return failAll(newError(ErrorCodeUpstreamError, service.Name, "provider batch '%s' failed: %s", providerBatch.ID, getProviderBatchErrorMessage(batch)))
+	default:
+		return nil, nil, false
+	}
+
+	// Read the outputs, along with the errors of requests that failed, which expired and cancelled batches can
+	// have some of
+	var outputs []providerBatchOutput
+	for _, field := range []string{"output_file_id", "error_file_id"} {
+		fileID, _ := batch[field].(string)
+		if fileID == "" {
+			continue
+		}
+		fileOutputs, err := i.downloadProviderBatchFile(ctx, service, fileID)
+		if err != nil {
+			if AsError(err).Retryable {
+				return nil, nil, false
+			}
+			return failAll(err)
+		}
+		outputs = append(outputs, fileOutputs...)
+	}
+
+	results := make(Results)
+	errors := make(Errors)
+	for _, output := range outputs {
+		serviceName, exists := providerBatch.Services[output.CustomID]
+		if !exists {
+			continue
+		}
+		i.mu.RLock()
+		requestService, exists := i.config[serviceName]
+		i.mu.RUnlock()
+		if !exists {
+			errors[output.CustomID] = newError(ErrorCodeInternal, serviceName, "model '%s' not found", serviceName)
+			continue
+		}
+		result, err := getProviderBatchResult(requestService, output)
+		if err != nil {
+			errors[output.CustomID] = AsError(err)
+		} else {
+			results[output.CustomID] = result
+			i.recordUsage(ctx, requestService, providerBatch.Bodies[output.CustomID], output.Response.Body, true)
+		}
+	}
+
+	// Fail the requests the batch did not get to
+	for key, serviceName := range providerBatch.Services {
+		if _, done := results[key]; done {
+			continue
+		}
+		if _, failed := errors[key]; !failed {
+			errors[key] = newError(ErrorCodeUpstreamError, serviceName, "no result for request '%s' in provider batch '%s', which is %s", key, providerBatch.ID, status)
+		}
+	}
+
+	return results, errors, true
+}
+
+// Gives back the quota reservation of a provider batch once the usage of its requests is recorded or it is canceled.
+// Reservations are kept in memory, so batches submitted before a restart only count against the quota once they
+// complete.
+func (i *Intelligence) releaseProviderBatchReservation(batchID string) {
+	i.mu.Lock()
+	release, exists := i.batchReservations[batchID]
+	delete(i.batchReservations, batchID)
+	i.mu.Unlock()
+	if exists {
+		release()
+	}
+}
+
+// Cancels the provider batches of a job that are no longer wanted
+func (i *Intelligence) cancelProviderBatches(batches map[string]*ProviderBatch) {
+	for _, batch := range batches {
+		i.releaseProviderBatchReservation(batch.ID)
+		i.mu.RLock()
+		service, exists := i.config[batch.Service]
+		i.mu.RUnlock()
+		if exists {
+			i.cancelProviderBatch(service, batch.ID)
+		}
+	}
+}
+
+// Uploads the requests of a group as a JSONL batch input file and returns its file ID
+func (i *Intelligence) uploadProviderBatchFile(ctx context.Context, group *providerBatchGroup) (string, error) {
+	// Write one request per line in key order so the file is the same for the same requests
+	sort.Slice(group.requests, func(a, b int) bool {
+		return group.requests[a].CustomID < group.requests[b].CustomID
+	})
+	var lines bytes.Buffer
+	for _, request := range group.requests {
+		line, err := json.Marshal(request)
+		if err != nil {
+			return "", err
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := writer.WriteField("purpose", "batch"); err != nil {
+		return "", err
+	}
+	part, err := writer.CreateFormFile("file", "batch.jsonl")
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(lines.Bytes()); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	file, err := i.doProviderRequest(ctx, group.service, http.MethodPost, "/v1/files", writer.FormDataContentType(), &body)
+	if err != nil {
+		return "", err
+	}
+	fileID, ok := file["id"].(string)
+	if !ok {
+		return "", newError(ErrorCodeUpstreamError, group.service.Name, "no file ID in provider file response")
+	}
+	return fileID, nil
+}
+
+// Creates a provider batch from an uploaded input file and returns its batch ID
+func (i *Intelligence) createProviderBatch(ctx context.Context, group *providerBatchGroup, fileID string) (string, error) {
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"input_file_id":     fileID,
+		"endpoint":          group.path,
+		"completion_window": "24h",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	batch, err := i.doProviderRequest(ctx, group.service, http.MethodPost, "/v1/batches", "application/json", bytes.NewReader(requestBody))
+	if err != nil {
+		return "", err
+	}
+	batchID, ok := batch["id"].(string)
+	if !ok {
+		return "", newError(ErrorCodeUpstreamError, group.service.Name, "no batch ID in provider batch response")
+	}
+	return batchID, nil
+}
+
+// Cancels a provider batch so the provider stops processing requests that are no longer wanted
+func (i *Intelligence) cancelProviderBatch(service Service, batchID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	i.doProviderRequest(ctx, service, http.MethodPost, "/v1/batches/"+batchID+"/cancel", "", nil)
+}
+
+// Downloads a provider batch output or error file and parses its lines
+func (i *Intelligence) downloadProviderBatchFile(ctx context.Context, service Service, fileID string) ([]providerBatchOutput, error) {
+	baseURL, err := i.getProviderBaseURL(service)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := i.sendProviderRequest(ctx, service, http.MethodGet, baseURL+"/v1/files/"+fileID+"/content", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var outputs []providerBatchOutput
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var output providerBatchOutput
+		if err := json.Unmarshal([]byte(line), &output); err != nil {
+			return nil, newError(ErrorCodeUpstreamError, service.Name, "error decoding provider batch file '%s': %v", fileID, err)
+		}
+		outputs = append(outputs, output)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, newServiceRequestError(service, err)
+	}
+
+	return outputs, nil
+}
+
+// Sends a request to a path of the service provider's API and decodes the JSON response
+func (i *Intelligence) doProviderRequest(ctx context.Context, service Service, method string, path string, contentType string, body io.Reader) (map[string]interface{}, error) {
+	baseURL, err := i.getProviderBaseURL(service)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := i.sendProviderRequest(ctx, service, method, baseURL+path, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var responseMap map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&responseMap); err != nil {
+		return nil, newError(ErrorCodeUpstreamError, service.Name, "error decoding response from '%s' service: %v", service.Name, err)
+	}
+	return responseMap, nil
+}
+
+// Converts a provider batch output to the result a direct request would have had
+func getProviderBatchResult(service Service, output providerBatchOutput) (interface{}, error) {
+	if output.Error != nil {
+		return nil, newError(ErrorCodeUpstreamError, service.Name, "error from '%s' service: %s", service.Name, output.Error.Message)
+	}
+	if output.Response == nil {
+		return nil, newError(ErrorCodeUpstreamError, service.Name, "no response from '%s' service", service.Name)
+	}
+
+	// Classify failed responses the same way as a direct request
+	if output.Response.StatusCode != http.StatusOK {
+		message := fmt.Sprintf("error from '%s' service", service.Name)
+		if errorMap, ok := output.Response.Body["error"].(map[string]interface{}); ok {
+			if errorMsg, ok := errorMap["message"].(string); ok {
+				message = fmt.Sprintf("error from '%s' service: %v", service.Name, errorMsg)
+			}
+		}
+		return nil, newServiceResponseError(service, &http.Response{StatusCode: output.Response.StatusCode, Header: http.Header{}}, message)
+	}
+
+	switch service.Type {
+	case "v1/completions":
+		content, err := getCompletionContent(service, output.Response.Body)
+		if err != nil {
+			return nil, err
+		}
+		return parseResult(content), nil
+	case "v1/embeddings":
+		return getEmbeddingsResult(service, output.Response.Body)
+	default:
+		return nil, newError(ErrorCodeInternal, service.Name, "unsupported service type: %s", service.Type)
+	}
+}
+
+// Returns the message of the first error of a failed provider batch
+func getProviderBatchErrorMessage(batch map[string]interface{}) string {
+	if batchErrors, ok := batch["errors"].(map[string]interface{}); ok {
+		if data, ok := batchErrors["data"].([]interface{}); ok && len(data) > 0 {
+			if errorMap, ok := data[0].(map[string]interface{}); ok {
+				if message, ok := errorMap["message"].(string); ok {
+					return message
+				}
+			}
+		}
+	}
+	return "unknown error"
+}
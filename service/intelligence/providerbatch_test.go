@@ -0,0 +1,265 @@
+package intelligence
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stubs the files and batches endpoints of a provider's Batch API, answering each batch request with its custom ID
+type stubBatchProvider struct {
+	t         *testing.T
+	finished  bool
+	inputs    map[string][]providerBatchRequest
+	batches   map[string]string
+	polls     int
+	cancelled []string
+	mu        sync.Mutex
+}
+
+// Returns a stub provider whose batches are in progress until they are finished
+func newStubBatchProvider(t *testing.T) *stubBatchProvider {
+	return &stubBatchProvider{t: t, inputs: make(map[string][]providerBatchRequest), batches: make(map[string]string)}
+}
+
+// Finishes the batches, so the next poll finds them completed
+func (p *stubBatchProvider) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finished = true
+}
+
+// Handles a provider request
+func (p *stubBatchProvider) roundTrip(r *http.Request) (*http.Response, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/files":
+		if err := r.ParseMultipartForm(1 << 20); err != nil || r.FormValue("purpose") != "batch" {
+			p.t.Errorf("invalid batch file upload: %v", err)
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		fileID := fmt.Sprintf("file-in-%d", len(p.inputs))
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var request providerBatchRequest
+			if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+				p.t.Errorf("invalid batch input line %q: %v", scanner.Text(), err)
+			}
+			p.inputs[fileID] = append(p.inputs[fileID], request)
+		}
+		return stubResponse(fmt.Sprintf(`{"id":%q}`, fileID)), nil
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/batches":
+		var create struct {
+			InputFileID string `json:"input_file_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&create)
+		batchID := fmt.Sprintf("batch-%d", len(p.batches))
+		p.batches[batchID] = create.InputFileID
+		return stubResponse(fmt.Sprintf(`{"id":%q,"status":"validating"}`, batchID)), nil
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/cancel"):
+		p.cancelled = append(p.cancelled, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/batches/"), "/cancel"))
+		return stubResponse(`{"status":"cancelling"}`), nil
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/batches/"):
+		p.polls++
+		batchID := strings.TrimPrefix(r.URL.Path, "/v1/batches/")
+		if !p.finished {
+			return stubResponse(fmt.Sprintf(`{"id":%q,"status":"in_progress"}`, batchID)), nil
+		}
+		return stubResponse(fmt.Sprintf(`{"id":%q,"status":"completed","output_file_id":"out-%s"}`, batchID, batchID)), nil
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/files/out-"):
+		batchID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/files/out-"), "/content")
+		var lines strings.Builder
+		for _, request := range p.inputs[p.batches[batchID]] {
+			body := map[string]interface{}{
+				"choices": []interface{}{map[string]interface{}{"message": map[string]interface{}{"content": "result of " + request.CustomID}}},
+				"usage":   map[string]interface{}{"prompt_tokens": 10, "completion_tokens": 2, "total_tokens": 12},
+			}
+			if request.URL == "/v1/embeddings" {
+				body = map[string]interface{}{
+					"data":  []interface{}{map[string]interface{}{"embedding": []float64{0.5}}},
+					"usage": map[string]interface{}{"prompt_tokens": 10, "total_tokens": 10},
+				}
+			}
+			line, _ := json.Marshal(map[string]interface{}{
+				"custom_id": request.CustomID,
+				"response":  map[string]interface{}{"status_code": 200, "body": body},
+			})
+			lines.Write(line)
+			lines.WriteByte('\n')
+		}
+		return stubResponse(lines.String()), nil
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/moderations":
+		return stubResponse(`{"results":[{"flagged":false,"categories":{},"category_scores":{}}]}`), nil
+	}
+	p.t.Errorf("unexpected provider request %s %s", r.Method, r.URL.Path)
+	return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+}
+
+// Waits for a job to reach a state, failing the test if it takes too long
+func waitForJob(t *testing.T, store *JobStore, id string, done func(job Job) bool) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, _ := store.Get(id)
+		if done(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job '%s' is %s with %+v", id, job.Status, job)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Sets how often provider batches are polled for the rest of a test
+func setProviderBatchPollInterval(t *testing.T, interval time.Duration) {
+	pollInterval := providerBatchPollInterval
+	providerBatchPollInterval = interval
+	t.Cleanup(func() { providerBatchPollInterval = pollInterval })
+}
+
+func TestProviderBatchJob(t *testing.T) {
+	setProviderBatchPollInterval(t, 5*time.Millisecond)
+	provider := newStubBatchProvider(t)
+	i := newTestIntelligence(t, provider.roundTrip)
+	store, _ := NewJobStore("")
+	i.StartJobs(store, 1, 10)
+
+	batchJob, err := i.submitJob(context.Background(), Requests{
+		"positive": {"model": "sentiment", "text": "I love it"},
+		"negative": {"model": "sentiment", "text": "It broke"},
+		"vectors":  {"model": "embeddings", "texts": []interface{}{"a"}},
+		"flagged":  {"model": "moderation", "text": "hello"},
+		"chained":  {"model": "sentiment", "text": "{{results.positive}}"},
+	}, JobModeBatch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The job waits for its batches apart from the only worker, which is free for other jobs in the meantime
+	waiting := waitForJob(t, store, batchJob.ID, func(job Job) bool { return job.WaitingForProviderBatches })
+	if waiting.Status != JobStatusRunning || len(waiting.ProviderBatches) != 2 {
+		t.Fatalf("got %s job with batches %v, want it running with 2 batches", waiting.Status, waiting.ProviderBatches)
+	}
+	if waiting.Results["flagged"] == nil {
+		t.Errorf("got results %v, want the direct request's result while waiting", waiting.Results)
+	}
+	directJob, err := i.submitJob(context.Background(), Requests{"flagged": {"model": "moderation", "text": "hello"}}, JobModeDirect, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForJob(t, store, directJob.ID, func(job Job) bool { return job.Status == JobStatusCompleted })
+
+	// Each batch has the requests for its endpoint, which are mapped back to their keys when it completes
+	provider.mu.Lock()
+	for _, batch := range waiting.ProviderBatches {
+		inputs := provider.inputs[provider.batches[batch.ID]]
+		if len(inputs) != len(batch.Services) {
+			t.Errorf("got %d requests in batch '%s', want %d", len(inputs), batch.ID, len(batch.Services))
+		}
+		for _, input := range inputs {
+			if batch.Services[input.CustomID] == "" || input.Method != http.MethodPost {
+				t.Errorf("unexpected request %+v in batch %+v", input, batch)
+			}
+		}
+	}
+	provider.mu.Unlock()
+	provider.finish()
+
+	completed := waitForJob(t, store, batchJob.ID, func(job Job) bool { return job.Status == JobStatusCompleted })
+	for key, result := range map[string]string{"positive": `"result of positive"`, "negative": `"result of negative"`} {
+		if resultBytes, _ := json.Marshal(completed.Results[key]); string(resultBytes) != result {
+			t.Errorf("got result %s for '%s', want %s", resultBytes, key, result)
+		}
+	}
+	if completed.Results["vectors"] == nil || completed.Results["flagged"] == nil {
+		t.Errorf("got results %v, want embeddings and moderation results", completed.Results)
+	}
+	if len(completed.Errors) != 1 || completed.Errors["chained"].Code != ErrorCodeValidation {
+		t.Errorf("got errors %v, want a validation error for 'chained'", completed.Errors)
+	}
+	if len(completed.ProviderBatches) != 0 || completed.WaitingForProviderBatches {
+		t.Errorf("got batches %v of a completed job", completed.ProviderBatches)
+	}
+}
+
+func TestProviderBatchModels(t *testing.T) {
+	provider := newStubBatchProvider(t)
+	i := newTestIntelligence(t, provider.roundTrip)
+	summary := i.config["summary"]
+	summary.Model = "gpt-4o"
+	i.config["summary"] = summary
+
+	batches := make(map[string]*ProviderBatch)
+	_, errors := i.doProviderBatchRequests(context.Background(), Requests{
+		"positive": {"model": "sentiment", "text": "I love it"},
+		"negative": {"model": "sentiment", "text": "It broke"},
+		"summary":  {"model": "summary", "text": "A long review"},
+	}, nil, func(key string, batch *ProviderBatch) {
+		batches[key] = batch
+	})
+	if len(errors) != 0 || len(batches) != 2 {
+		t.Fatalf("got errors %v and batches %v, want a batch for each model", errors, batches)
+	}
+
+	// Every request in a batch is for the same model
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	for _, batch := range batches {
+		models := make(map[string]bool)
+		for _, input := range provider.inputs[provider.batches[batch.ID]] {
+			body, _ := input.Body.(map[string]interface{})
+			models[fmt.Sprint(body["model"])] = true
+		}
+		if len(models) != 1 {
+			t.Errorf("got models %v in batch '%s', want one", models, batch.ID)
+		}
+	}
+}
+
+func TestCancelProviderBatchJob(t *testing.T) {
+	setProviderBatchPollInterval(t, 5*time.Millisecond)
+	provider := newStubBatchProvider(t)
+	i := newTestIntelligence(t, provider.roundTrip)
+	store, _ := NewJobStore("")
+	i.StartJobs(store, 1, 10)
+
+	job, err := i.submitJob(context.Background(), Requests{"positive": {"model": "sentiment", "text": "I love it"}}, JobModeBatch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiting := waitForJob(t, store, job.ID, func(job Job) bool { return job.WaitingForProviderBatches })
+
+	canceled, err := i.cancelJob(context.Background(), job.ID)
+	if err != nil || canceled.Status != JobStatusCanceled {
+		t.Fatalf("got %s job and error %v, want it canceled", canceled.Status, err)
+	}
+	if canceled.Errors["positive"] == nil {
+		t.Errorf("got errors %v, want the batched request to fail", canceled.Errors)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		provider.mu.Lock()
+		cancelled := append([]string(nil), provider.cancelled...)
+		provider.mu.Unlock()
+		if len(cancelled) == 1 && cancelled[0] == waiting.ProviderBatches["openai/v1/chat/completions/gpt-4o-mini"].ID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got cancelled batches %v, want %v", cancelled, waiting.ProviderBatches)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
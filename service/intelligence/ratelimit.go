@@ -0,0 +1,304 @@
+package intelligence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defines the requests and tokens per minute a provider allows for a model
+type RateLimit struct {
+	RequestsPerMinute int `json:"rpm"`
+	TokensPerMinute   int `json:"tpm"`
+}
+
+// Defines the tokens counted for each image sent to a completions service
+const imageTokenEstimate = 765
+
+// Loads rate limits from a JSON file that maps "provider/model" to its limits, such as
+// {"openai/gpt-4o-mini": {"rpm": 500, "tpm": 200000}}
+func LoadRateLimits(path string) (map[string]RateLimit, error) {
+	limitsBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rate limits file: %v", err)
+	}
+
+	var limits map[string]RateLimit
+	if err := json.Unmarshal(limitsBytes, &limits); err != nil {
+		return nil, fmt.Errorf("error parsing rate limits file: %v", err)
+	}
+	return limits, nil
+}
+
+// Sets the rate limits for each provider and model, and the longest a request waits for the limits before it is
+// rejected. Models without limits are paced by the limits their provider reports in its responses.
+func (i *Intelligence) SetRateLimits(limits map[string]RateLimit, maxWait time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rateLimits = newRateLimiter(limits, maxWait)
+}
+
+// Paces the requests to each provider and model to stay within their requests and tokens per minute
+type rateLimiter struct {
+	limits  map[string]RateLimit
+	maxWait time.Duration
+	buckets map[string]*rateBuckets
+	mu      sync.Mutex
+}
+
+// Defines the request and token budgets of a provider and model, and when the provider asked to wait until
+type rateBuckets struct {
+	requests    *tokenBucket
+	tokens      *tokenBucket
+	pausedUntil time.Time
+}
+
+// Creates a rate limiter for the limits
+func newRateLimiter(limits map[string]RateLimit, maxWait time.Duration) *rateLimiter {
+	if limits == nil {
+		limits = make(map[string]RateLimit)
+	}
+	return &rateLimiter{
+		limits:  limits,
+		maxWait: maxWait,
+		buckets: make(map[string]*rateBuckets),
+	}
+}
+
+// Returns the key of the rate limits of a service
+func getRateLimitKey(service Service) string {
+	return service.Provider + "/" + service.Model
+}
+
+// Returns the budgets for a service, creating them from the configured limits the first time
+func (l *rateLimiter) getBuckets(service Service) *rateBuckets {
+	key := getRateLimitKey(service)
+	buckets, exists := l.buckets[key]
+	if !exists {
+		limit := l.limits[key]
+		buckets = &rateBuckets{
+			requests: newTokenBucket(limit.RequestsPerMinute),
+			tokens:   newTokenBucket(limit.TokensPerMinute),
+		}
+		l.buckets[key] = buckets
+	}
+	return buckets
+}
+
+// Reserves a request and its estimated tokens from the budgets of the service, waiting until the budgets allow it.
+// Requests that would wait longer than the maximum are rejected with a rate limited error instead of being sent.
+func (l *rateLimiter) wait(ctx context.Context, service Service, tokens int) error {
+	l.mu.Lock()
+	buckets := l.getBuckets(service)
+	now := time.Now()
+	delay := buckets.requests.delay(1, now)
+	if tokenDelay := buckets.tokens.delay(float64(tokens), now); tokenDelay > delay {
+		delay = tokenDelay
+	}
+	if pause := buckets.pausedUntil.Sub(now); pause > delay {
+		delay = pause
+	}
+	if l.maxWait > 0 && delay > l.maxWait {
+		l.mu.Unlock()
+		err := newError(ErrorCodeUpstreamRateLimited, service.Name, "request to '%s' service would exceed the rate limit of '%s'", service.Name, getRateLimitKey(service))
+		err.RetryAfter = delay
+		return err
+	}
+
+	// Reserve the budget now so requests that arrive later wait behind this one
+	buckets.requests.take(1, now)
+	buckets.tokens.take(float64(tokens), now)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give back the budget of a request that won't be sent
+		l.mu.Lock()
+		buckets.requests.give(1)
+		buckets.tokens.give(float64(tokens))
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Updates the budgets of a service from the x-ratelimit headers of its provider's response, which know about requests
+// from other clients of the same organization
+func (l *rateLimiter) observe(service Service, header http.Header) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets := l.getBuckets(service)
+	now := time.Now()
+	for _, budget := range []struct {
+		name   string
+		bucket *tokenBucket
+	}{
+		{"requests", buckets.requests},
+		{"tokens", buckets.tokens},
+	} {
+		// Learn the limit from the provider when it isn't configured
+		if limit, err := strconv.Atoi(header.Get("x-ratelimit-limit-" + budget.name)); err == nil && budget.bucket.capacity == 0 {
+			budget.bucket.setLimit(limit, now)
+		}
+
+		remaining, err := strconv.Atoi(header.Get("x-ratelimit-remaining-" + budget.name))
+		if err != nil {
+			continue
+		}
+		budget.bucket.limitAvailable(float64(remaining), now)
+
+		// Wait for the provider's budget to reset once it runs out
+		if remaining == 0 {
+			if reset, err := parseRateLimitReset(header.Get("x-ratelimit-reset-" + budget.name)); err == nil {
+				if until := now.Add(reset); until.After(buckets.pausedUntil) {
+					buckets.pausedUntil = until
+				}
+			}
+		}
+	}
+}
+
+// Pauses the requests of a service until the time a provider that rate limited a request asked to wait
+func (l *rateLimiter) pause(service Service, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buckets := l.getBuckets(service)
+	if until := time.Now().Add(retryAfter); until.After(buckets.pausedUntil) {
+		buckets.pausedUntil = until
+	}
+}
+
+// Parses an x-ratelimit-reset header, which is a duration like "1s", "6m0s" or "20ms"
+func parseRateLimitReset(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, fmt.Errorf("no reset")
+	}
+	return time.ParseDuration(value)
+}
+
+// Refills a budget at a steady rate up to its limit per minute
+type tokenBucket struct {
+	capacity  float64
+	available float64
+	rate      float64
+	updated   time.Time
+}
+
+// Creates a bucket that allows a limit per minute, or that allows everything if the limit is zero
+func newTokenBucket(limit int) *tokenBucket {
+	bucket := &tokenBucket{}
+	bucket.setLimit(limit, time.Now())
+	return bucket
+}
+
+// Sets the limit per minute of the bucket and fills it
+func (b *tokenBucket) setLimit(limit int, now time.Time) {
+	b.capacity = float64(limit)
+	b.available = float64(limit)
+	b.rate = float64(limit) / 60
+	b.updated = now
+}
+
+// Adds the budget that has accumulated since the bucket was last updated
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.available = math.Min(b.capacity, b.available+elapsed*b.rate)
+		b.updated = now
+	}
+}
+
+// Returns how long to wait until the bucket has the amount, where amounts above the limit only need a full bucket
+func (b *tokenBucket) delay(amount float64, now time.Time) time.Duration {
+	if b.capacity == 0 {
+		return 0
+	}
+	b.refill(now)
+	needed := math.Min(amount, b.capacity) - b.available
+	if needed <= 0 {
+		return 0
+	}
+	return time.Duration(needed / b.rate * float64(time.Second))
+}
+
+// Takes an amount from the bucket, which can leave it owing budget that later requests wait for
+func (b *tokenBucket) take(amount float64, now time.Time) {
+	if b.capacity == 0 {
+		return
+	}
+	b.refill(now)
+	b.available -= math.Min(amount, b.capacity)
+}
+
+// Returns an amount that was taken but not used
+func (b *tokenBucket) give(amount float64) {
+	if b.capacity == 0 {
+		return
+	}
+	b.available = math.Min(b.capacity, b.available+math.Min(amount, b.capacity))
+}
+
+// Lowers the available budget to what the provider reports is remaining
+func (b *tokenBucket) limitAvailable(remaining float64, now time.Time) {
+	if b.capacity == 0 {
+		return
+	}
+	b.refill(now)
+	b.available = math.Min(b.available, remaining)
+}
+
+// Estimates the tokens a request body uses, counting its text with the model's encoding, or about four characters per
+// token when there is none, a fixed amount per image and the most tokens the completion can use
+func estimateRequestTokens(encoding *Encoding, requestBody []byte) int {
+	var body map[string]interface{}
+	if err := json.Unmarshal(requestBody, &body); err != nil {
+		return encoding.count(string(requestBody))
+	}
+
+	textTokens, images := 0, 0
+	var count func(value interface{})
+	count = func(value interface{}) {
+		switch v := value.(type) {
+		case string:
+			if strings.HasPrefix(v, "data:") {
+				images++
+			} else {
+				textTokens += encoding.count(v)
+			}
+		case []interface{}:
+			for _, item := range v {
+				count(item)
+			}
+		case map[string]interface{}:
+			for _, nestedValue := range v {
+				count(nestedValue)
+			}
+		}
+	}
+	for _, field := range []string{"messages", "input", "prompt"} {
+		count(body[field])
+	}
+
+	tokens := textTokens + images*imageTokenEstimate
+	if maxTokens, ok := body["max_tokens"].(float64); ok {
+		tokens += int(maxTokens)
+	}
+	return tokens
+}
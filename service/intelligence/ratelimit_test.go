@@ -0,0 +1,251 @@
+package intelligence
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// Uses the bucket before the delay of the amount is checked
+		use       func(bucket *tokenBucket)
+		limit     int
+		amount    float64
+		at        time.Duration
+		delay     time.Duration
+		available float64
+	}{
+		{
+			name:      "no limit",
+			use:       func(bucket *tokenBucket) { bucket.take(1000, start) },
+			limit:     0,
+			amount:    1000,
+			delay:     0,
+			available: 0,
+		},
+		{
+			name:      "full bucket",
+			use:       func(bucket *tokenBucket) {},
+			limit:     60,
+			amount:    10,
+			delay:     0,
+			available: 60,
+		},
+		{
+			name:      "empty bucket waits for the refill",
+			use:       func(bucket *tokenBucket) { bucket.take(60, start) },
+			limit:     60,
+			amount:    2,
+			delay:     2 * time.Second,
+			available: 0,
+		},
+		{
+			name:      "refills with time",
+			use:       func(bucket *tokenBucket) { bucket.take(60, start) },
+			limit:     60,
+			amount:    2,
+			at:        time.Second,
+			delay:     time.Second,
+			available: 1,
+		},
+		{
+			name:      "refills up to the limit",
+			use:       func(bucket *tokenBucket) { bucket.take(30, start) },
+			limit:     60,
+			amount:    60,
+			at:        time.Hour,
+			delay:     0,
+			available: 60,
+		},
+		{
+			name:      "owed budget is waited for",
+			use:       func(bucket *tokenBucket) { bucket.take(60, start); bucket.take(30, start) },
+			limit:     60,
+			amount:    30,
+			delay:     time.Minute,
+			available: -30,
+		},
+		{
+			name:      "amounts above the limit only need a full bucket",
+			use:       func(bucket *tokenBucket) { bucket.take(30, start) },
+			limit:     60,
+			amount:    600,
+			delay:     30 * time.Second,
+			available: 30,
+		},
+		{
+			name:      "given back budget is available again",
+			use:       func(bucket *tokenBucket) { bucket.take(60, start); bucket.give(20) },
+			limit:     60,
+			amount:    20,
+			delay:     0,
+			available: 20,
+		},
+		{
+			name:      "given back budget stays under the limit",
+			use:       func(bucket *tokenBucket) { bucket.take(10, start); bucket.give(50) },
+			limit:     60,
+			amount:    60,
+			delay:     0,
+			available: 60,
+		},
+		{
+			name:      "provider's remaining budget lowers the available budget",
+			use:       func(bucket *tokenBucket) { bucket.limitAvailable(6, start) },
+			limit:     60,
+			amount:    12,
+			delay:     6 * time.Second,
+			available: 6,
+		},
+		{
+			name:      "provider's remaining budget doesn't raise the available budget",
+			use:       func(bucket *tokenBucket) { bucket.take(50, start); bucket.limitAvailable(40, start) },
+			limit:     60,
+			amount:    10,
+			delay:     0,
+			available: 10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := &tokenBucket{}
+			bucket.setLimit(test.limit, start)
+			test.use(bucket)
+			if delay := bucket.delay(test.amount, start.Add(test.at)); delay != test.delay {
+				t.Errorf("got delay %v, want %v", delay, test.delay)
+			}
+			if bucket.available != test.available {
+				t.Errorf("got available %v, want %v", bucket.available, test.available)
+			}
+		})
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	service := Service{Name: "sentiment", Provider: "openai", Model: "gpt-4o-mini"}
+	tests := []struct {
+		name    string
+		limit   RateLimit
+		maxWait time.Duration
+		tokens  []int
+		errors  []bool
+	}{
+		{
+			name:   "no limits",
+			tokens: []int{1000, 1000, 1000},
+			errors: []bool{false, false, false},
+		},
+		{
+			name:    "requests per minute",
+			limit:   RateLimit{RequestsPerMinute: 2},
+			maxWait: time.Second,
+			tokens:  []int{1, 1, 1},
+			errors:  []bool{false, false, true},
+		},
+		{
+			name:    "tokens per minute",
+			limit:   RateLimit{TokensPerMinute: 1000},
+			maxWait: time.Second,
+			tokens:  []int{600, 400, 100},
+			errors:  []bool{false, false, true},
+		},
+		{
+			name:    "rejected requests don't use the budget",
+			limit:   RateLimit{TokensPerMinute: 1000},
+			maxWait: time.Second,
+			tokens:  []int{900, 500, 100},
+			errors:  []bool{false, true, false},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newRateLimiter(map[string]RateLimit{getRateLimitKey(service): test.limit}, test.maxWait)
+			for index, tokens := range test.tokens {
+				err := limiter.wait(context.Background(), service, tokens)
+				if (err != nil) != test.errors[index] {
+					t.Fatalf("got error %v for request %d, want an error %v", err, index, test.errors[index])
+				}
+				if err == nil {
+					continue
+				}
+				intelligenceErr := AsError(err)
+				if intelligenceErr.Code != ErrorCodeUpstreamRateLimited || intelligenceErr.RetryAfter <= test.maxWait {
+					t.Errorf("got error %#v for request %d, want a rate limited error to retry after %v", intelligenceErr, index, test.maxWait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterWaitCanceled(t *testing.T) {
+	service := Service{Name: "sentiment", Provider: "openai", Model: "gpt-4o-mini"}
+	limiter := newRateLimiter(map[string]RateLimit{getRateLimitKey(service): {RequestsPerMinute: 1}}, time.Minute)
+	if err := limiter.wait(context.Background(), service, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A request that stops waiting gives back its budget so it doesn't delay the requests after it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.wait(ctx, service, 0); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	buckets := limiter.getBuckets(service)
+	if delay := buckets.requests.delay(1, time.Now()); delay > time.Minute {
+		t.Errorf("got delay %v after the canceled request, want the budget of one request", delay)
+	}
+}
+
+func TestRateLimiterObserve(t *testing.T) {
+	service := Service{Name: "sentiment", Provider: "openai", Model: "gpt-4o-mini"}
+	tests := []struct {
+		name     string
+		limit    RateLimit
+		header   http.Header
+		capacity float64
+		paused   bool
+	}{
+		{
+			name:     "learns the limit from the provider",
+			header:   http.Header{"X-Ratelimit-Limit-Requests": {"500"}, "X-Ratelimit-Remaining-Requests": {"499"}},
+			capacity: 500,
+		},
+		{
+			name:     "keeps the configured limit",
+			limit:    RateLimit{RequestsPerMinute: 100},
+			header:   http.Header{"X-Ratelimit-Limit-Requests": {"500"}, "X-Ratelimit-Remaining-Requests": {"499"}},
+			capacity: 100,
+		},
+		{
+			name:     "pauses until the reset when the budget runs out",
+			header:   http.Header{"X-Ratelimit-Limit-Tokens": {"1000"}, "X-Ratelimit-Remaining-Tokens": {"0"}, "X-Ratelimit-Reset-Tokens": {"6m0s"}},
+			capacity: 0,
+			paused:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newRateLimiter(map[string]RateLimit{getRateLimitKey(service): test.limit}, time.Second)
+			limiter.observe(service, test.header)
+			buckets := limiter.getBuckets(service)
+			if buckets.requests.capacity != test.capacity {
+				t.Errorf("got requests capacity %v, want %v", buckets.requests.capacity, test.capacity)
+			}
+			if paused := buckets.pausedUntil.After(time.Now().Add(5 * time.Minute)); paused != test.paused {
+				t.Errorf("got paused until %v, want paused %v", buckets.pausedUntil, test.paused)
+			}
+			if test.paused {
+				if err := limiter.wait(context.Background(), service, 1); AsError(err) == nil || AsError(err).Code != ErrorCodeUpstreamRateLimited {
+					t.Errorf("got error %v, want the paused request to be rate limited", err)
+				}
+			}
+		})
+	}
+}
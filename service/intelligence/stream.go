@@ -0,0 +1,201 @@
+package intelligence
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Sends a streaming completions request, passing each content delta to the callback, and returns the full result
+func (i *Intelligence) getCompletionStream(ctx context.Context, service Service, params map[string]interface{}, onDelta func(delta string)) (*string, error) {
+	requestBodyMap := i.getCompletionRequestBody(service, params)
+	requestBodyMap["stream"] = true
+	requestBodyMap["stream_options"] = map[string]interface{}{"include_usage": true}
+
+	requestBody, err := json.Marshal(requestBodyMap)
+	if err != nil {
+		return nil, err
+	}
+
+	// Accumulate the content deltas while forwarding them to the callback
+	var content strings.Builder
+	received := false
+	err = i.doServiceStreamRequest(ctx, service, requestBody, func(chunk map[string]interface{}) {
+		choices, ok := chunk["choices"].([]interface{})
+		if !ok || len(choices) == 0 {
+			return
+		}
+		if choice, ok := choices[0].(map[string]interface{}); ok {
+			if delta, ok := choice["delta"].(map[string]interface{}); ok {
+				if text, ok := delta["content"].(string); ok {
+					received = true
+					if text != "" {
+						content.WriteString(text)
+						onDelta(text)
+					}
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !received {
+		return nil, newError(ErrorCodeUpstreamError, service.Name, "no valid completion response found")
+	}
+
+	result := content.String()
+	return &result, nil
+}
+
+// Sends a streaming HTTP request to the specified service and passes each server-sent event payload to the callback
+func (i *Intelligence) doServiceStreamRequest(ctx context.Context, service Service, requestBody []byte, onChunk func(chunk map[string]interface{})) (err error) {
+	resp, err := i.sendServiceRequest(ctx, service, requestBody)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Keep the model, usage and finish reason the provider sends to record them once the stream completes
+	response := make(map[string]interface{})
+	defer func() {
+		if err == nil {
+			i.recordUsage(ctx, service, requestBody, response, false)
+			getMetadata(ctx).addResponse(resp.Header, response)
+		}
+	}()
+
+	// Read the event stream line by line until the provider signals completion
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return nil
+		}
+
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return newError(ErrorCodeUpstreamError, service.Name, "error decoding stream from '%s' service: %v", service.Name, err)
+		}
+
+		// Surface errors sent in the middle of the stream
+		if errorMap, ok := chunk["error"].(map[string]interface{}); ok {
+			if errorMsg, ok := errorMap["message"].(string); ok {
+				return newError(ErrorCodeUpstreamError, service.Name, "error from '%s' service: %v", service.Name, errorMsg)
+			}
+			return newError(ErrorCodeUpstreamError, service.Name, "error from '%s' service", service.Name)
+		}
+
+		if usage, ok := chunk["usage"].(map[string]interface{}); ok {
+			response["usage"] = usage
+		}
+		if model, ok := chunk["model"].(string); ok {
+			response["model"] = model
+		}
+		if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) > 0 {
+			if choice, ok := choices[0].(map[string]interface{}); ok && choice["finish_reason"] != nil {
+				response["choices"] = []interface{}{choice}
+			}
+		}
+		onChunk(chunk)
+	}
+	if err := scanner.Err(); err != nil {
+		return newServiceRequestError(service, err)
+	}
+
+	return nil
+}
+
+// Defines the name of the final event of a stream, which carries the results and errors
+const streamResultEvent = "result"
+
+// Determines whether the client asked for the results as server-sent events
+func isStreamRequest(r *http.Request, requests Requests) bool {
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return true
+	}
+	if r.URL.Query().Get("stream") == "true" {
+		return true
+	}
+	for _, request := range requests {
+		if stream, ok := request["stream"].(bool); ok && stream {
+			return true
+		}
+	}
+	return false
+}
+
+// Processes the requests and writes completion deltas as server-sent events named by request key, ending with a
+// "result" event that carries the same results and errors as a non-streaming response
+func (i *Intelligence) streamRequests(ctx context.Context, w http.ResponseWriter, requests Requests) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"errors": Errors{"server": newError(ErrorCodeInternal, "", "streaming is not supported")},
+		})
+		return
+	}
+
+	// Reject keys that can't name an event, since a line break would end the event name and "result" would be taken
+	// for the final event
+	if keyErrors := getStreamKeyErrors(requests); len(keyErrors) > 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": keyErrors})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Serialize writes since the requests are processed concurrently
+	var mu sync.Mutex
+	writeEvent := func(event string, data interface{}) {
+		dataBytes, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, dataBytes)
+		flusher.Flush()
+	}
+
+	results, errors := i.doRequests(ctx, requests, func(key string, delta string) {
+		writeEvent(key, map[string]interface{}{"delta": delta})
+	})
+
+	if metadata := getRequestsMetadata(ctx); metadata != nil {
+		results["metadata"] = metadata.values
+	}
+	if len(errors) > 0 {
+		results["errors"] = errors
+	}
+	writeEvent(streamResultEvent, results)
+}
+
+// Returns an error for each request key that can't be the name of a server-sent event
+func getStreamKeyErrors(requests Requests) Errors {
+	errors := make(Errors)
+	for key := range requests {
+		if strings.ContainsAny(key, "\r\n") {
+			errors[key] = newError(ErrorCodeValidation, "", "streamed request keys can't contain line breaks")
+		} else if key == streamResultEvent {
+			errors[key] = newError(ErrorCodeValidation, "", "'%s' is reserved for the final event of a stream", streamResultEvent)
+		}
+	}
+	return errors
+}
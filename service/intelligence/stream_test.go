@@ -0,0 +1,145 @@
+package intelligence
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetStreamKeyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		invalid bool
+	}{
+		{"plain key", "generated_text", false},
+		{"line feed", "a\ndata: injected", true},
+		{"carriage return", "a\rb", true},
+		{"reserved result", "result", true},
+		{"result prefix", "results", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := getStreamKeyErrors(Requests{test.key: Request{"model": "generated_text"}})
+			if invalid := errors[test.key] != nil; invalid != test.invalid {
+				t.Errorf("got invalid %v, want %v", invalid, test.invalid)
+			}
+		})
+	}
+}
+
+func TestStreamRequestsRejectsInvalidKeys(t *testing.T) {
+	i := newTestIntelligence(t, nil)
+	recorder := httptest.NewRecorder()
+	i.streamRequests(context.Background(), recorder, Requests{"result": Request{"model": "generated_text", "prompt": "hi"}})
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+	var response struct {
+		Errors map[string]Error `json:"errors"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Errors["result"].Code != ErrorCodeValidation {
+		t.Errorf("got errors %v, want a validation error for 'result'", response.Errors)
+	}
+}
+
+// Defines a server-sent event by its name and data
+type testStreamEvent struct {
+	name string
+	data map[string]interface{}
+}
+
+// Returns the events of a server-sent event stream in the order they were sent
+func getStreamEvents(t *testing.T, body string) []testStreamEvent {
+	t.Helper()
+	var events []testStreamEvent
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var event testStreamEvent
+		for _, line := range strings.Split(block, "\n") {
+			if name, ok := strings.CutPrefix(line, "event: "); ok {
+				event.name = name
+			} else if data, ok := strings.CutPrefix(line, "data: "); ok {
+				if err := json.Unmarshal([]byte(data), &event.data); err != nil {
+					t.Fatalf("got event data %s, want JSON: %v", data, err)
+				}
+			}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestStreamRequests(t *testing.T) {
+	// The provider streams a story in parts, and fails in the middle of the stream about a broken prompt
+	i := newTestIntelligence(t, func(r *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(r.Body)
+		chunks := []string{
+			`{"model":"gpt-4o-mini","choices":[{"delta":{"content":"Once"}}]}`,
+			`{"choices":[{"delta":{"content":" upon"}}]}`,
+			`{"choices":[{"delta":{},"finish_reason":"stop"}]}`,
+			`{"choices":[],"usage":{"prompt_tokens":10,"completion_tokens":2,"total_tokens":12}}`,
+			`[DONE]`,
+		}
+		if strings.Contains(string(body), "broken") {
+			chunks = []string{
+				`{"choices":[{"delta":{"content":"Part"}}]}`,
+				`{"error":{"message":"the server had an error"}}`,
+			}
+		}
+		var stream strings.Builder
+		for _, chunk := range chunks {
+			stream.WriteString("data: " + chunk + "\n\n")
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/event-stream"}},
+			Body:       io.NopCloser(strings.NewReader(stream.String())),
+		}, nil
+	})
+
+	body := `{"story": {"model": "generated_text", "prompt": "a story"}, "broken": {"model": "generated_text", "prompt": "broken"}}`
+	request := httptest.NewRequest(http.MethodPost, "/intelligence", strings.NewReader(body))
+	request.Header.Set("Accept", "text/event-stream")
+	recorder := httptest.NewRecorder()
+	i.Handler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got status %d and content type %q, want an event stream", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+
+	// Each delta is an event named by its request key, in the order the provider sent them
+	events := getStreamEvents(t, recorder.Body.String())
+	deltas := make(map[string]string)
+	for _, event := range events[:len(events)-1] {
+		delta, _ := event.data["delta"].(string)
+		deltas[event.name] += delta
+	}
+	if deltas["story"] != "Once upon" || deltas["broken"] != "Part" || len(deltas) != 2 {
+		t.Errorf("got deltas %v, want 'Once upon' for story and 'Part' for broken", deltas)
+	}
+
+	// The final event has the results and the error sent in the middle of the stream
+	result := events[len(events)-1]
+	if result.name != streamResultEvent || result.data["story"] != "Once upon" || result.data["broken"] != nil {
+		t.Fatalf("got final event %s %v, want the result of story", result.name, result.data)
+	}
+	errors, _ := result.data["errors"].(map[string]interface{})
+	brokenErr, _ := errors["broken"].(map[string]interface{})
+	message, _ := brokenErr["message"].(string)
+	if brokenErr["code"] != ErrorCodeUpstreamError || !strings.Contains(message, "the server had an error") {
+		t.Errorf("got errors %v, want the provider's error for broken", errors)
+	}
+
+	// Only the stream that completed records its usage
+	if report := i.usage.report(anonymousPrincipal, time.Now()); report.Day.Requests != 1 || report.Day.TotalTokens != 12 {
+		t.Errorf("got %d requests and %d tokens recorded, want 1 request and 12 tokens", report.Day.Requests, report.Day.TotalTokens)
+	}
+}
@@ -0,0 +1,339 @@
+package intelligence
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Defines a byte pair encoding that splits text into the tokens a model counts
+type Encoding struct {
+	Name    string
+	pattern *regexp.Regexp
+	ranks   map[string]int
+	tokens  map[int]string
+}
+
+// Defines the patterns that split text into pieces before they are encoded, by encoding name. The patterns end with
+// \s+ where the encodings use \s+(?!\S)|\s+, since Go doesn't support lookaheads, and Encode gives back the last
+// whitespace character instead.
+var encodingPatterns = map[string]string{
+	"cl100k_base": `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`,
+	"o200k_base": `[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?|` +
+		`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?|` +
+		`\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+`,
+}
+
+// Defines the longest piece of text that is encoded as a whole, where longer pieces such as long runs of letters are
+// encoded in parts of this length, which only changes how the few tokens at the cuts are merged
+const maxEncodePieceLength = 4096
+
+// Defines the encoding of the models that start with each prefix, where longer prefixes come first
+var modelEncodingPrefixes = []struct {
+	prefix   string
+	encoding string
+}{
+	{"gpt-4o", "o200k_base"},
+	{"gpt-4.1", "o200k_base"},
+	{"gpt-4.5", "o200k_base"},
+	{"o1", "o200k_base"},
+	{"o3", "o200k_base"},
+	{"o4", "o200k_base"},
+	{"gpt-4", "cl100k_base"},
+	{"gpt-3.5", "cl100k_base"},
+	{"text-embedding-", "cl100k_base"},
+}
+
+// Loads the encodings the models of the services count tokens with from their tiktoken files in a directory, such as
+// cl100k_base.tiktoken, and sets them. Returns the paths of the files that aren't there, whose models have their
+// tokens estimated instead.
+func (i *Intelligence) LoadEncodings(dir string) ([]string, error) {
+	encodings := make(map[string]*Encoding)
+	var missing []string
+	for _, name := range i.getEncodingNames() {
+		path := filepath.Join(dir, name+".tiktoken")
+		encoding, err := LoadEncoding(name, path)
+		if os.IsNotExist(err) {
+			missing = append(missing, path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		encodings[name] = encoding
+	}
+	i.SetEncodings(encodings)
+	return missing, nil
+}
+
+// Returns the names of the encodings the models of the services count tokens with, in order
+func (i *Intelligence) getEncodingNames() []string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	used := make(map[string]bool)
+	for _, service := range i.config {
+		if name := getModelEncodingName(service.Model); name != "" {
+			used[name] = true
+		}
+	}
+	names := make([]string, 0, len(used))
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Loads an encoding from a tiktoken file, which has a base64 token and its rank on each line
+func LoadEncoding(name string, path string) (*Encoding, error) {
+	pattern, exists := encodingPatterns[name]
+	if !exists {
+		return nil, fmt.Errorf("unsupported encoding '%s'", name)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	encoding := &Encoding{
+		Name:    name,
+		pattern: compileEncodingPattern(pattern),
+		ranks:   make(map[string]int),
+		tokens:  make(map[int]string),
+	}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("error parsing encoding file '%s' at line %d", path, line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing encoding file '%s' at line %d: %v", path, line, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing encoding file '%s' at line %d: %v", path, line, err)
+		}
+		encoding.ranks[string(token)] = rank
+		encoding.tokens[rank] = string(token)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading encoding file '%s': %v", path, err)
+	}
+	return encoding, nil
+}
+
+// Compiles the pattern of an encoding, where \s matches all Unicode whitespace as it does in the encodings instead of
+// only ASCII whitespace as it does in Go
+func compileEncodingPattern(pattern string) *regexp.Regexp {
+	const whitespace = `\s\x0B\x{85}\p{Z}`
+	pattern = strings.ReplaceAll(pattern, `[^\s`, "[^\x00")
+	pattern = strings.ReplaceAll(pattern, `\s`, "["+whitespace+"]")
+	pattern = strings.ReplaceAll(pattern, "\x00", whitespace)
+	return regexp.MustCompile(pattern)
+}
+
+// Sets the encodings that tokens are counted with, where models without an encoding have their tokens estimated
+func (i *Intelligence) SetEncodings(encodings map[string]*Encoding) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.encodings = encodings
+}
+
+// Returns the encoding of a model, or nil if it has none or it isn't loaded
+func (i *Intelligence) getEncoding(model string) *Encoding {
+	name := getModelEncodingName(model)
+	if name == "" {
+		return nil
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.encodings[name]
+}
+
+// Returns the name of the encoding of a model, or an empty string if it has none
+func getModelEncodingName(model string) string {
+	for _, modelEncoding := range modelEncodingPrefixes {
+		if strings.HasPrefix(model, modelEncoding.prefix) {
+			return modelEncoding.encoding
+		}
+	}
+	return ""
+}
+
+// Returns the tokens of a text
+func (e *Encoding) Encode(text string) []int {
+	var tokens []int
+	for _, piece := range e.split(text) {
+		// Encode long pieces in parts, cut at the start of a character
+		for len(piece) > maxEncodePieceLength {
+			end := maxEncodePieceLength
+			for end > 1 && !utf8.RuneStart(piece[end]) {
+				end--
+			}
+			tokens = e.appendPiece(tokens, piece[:end])
+			piece = piece[end:]
+		}
+		tokens = e.appendPiece(tokens, piece)
+	}
+	return tokens
+}
+
+// Returns the pieces that the pattern of the encoding splits a text into, which are encoded separately
+func (e *Encoding) split(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		end := len(text)
+		if location := e.pattern.FindStringIndex(text); location != nil && location[1] > 0 {
+			end = location[1]
+		}
+
+		// Give back the last whitespace character before text that isn't whitespace, as \s+(?!\S) does
+		piece := text[:end]
+		if end < len(text) && strings.TrimSpace(piece) == "" && !strings.HasSuffix(piece, "\n") && !strings.HasSuffix(piece, "\r") {
+			if _, size := utf8.DecodeLastRuneInString(piece); size < len(piece) {
+				piece = piece[:len(piece)-size]
+			}
+		}
+		pieces = append(pieces, piece)
+		text = text[len(piece):]
+	}
+	return pieces
+}
+
+// Appends the tokens of a piece of text
+func (e *Encoding) appendPiece(tokens []int, piece string) []int {
+	if rank, exists := e.ranks[piece]; exists {
+		return append(tokens, rank)
+	}
+	return append(tokens, e.encodePiece(piece)...)
+}
+
+// Defines a pair of adjacent parts of a piece that can be merged, by where the first part starts, where the second
+// part starts and where it ends
+type encodingMerge struct {
+	rank   int
+	start  int
+	middle int
+	end    int
+}
+
+// Defines a heap of merges where the merge with the lowest rank comes first, and the leftmost of merges with the
+// same rank
+type encodingMerges []encodingMerge
+
+func (m encodingMerges) Len() int      { return len(m) }
+func (m encodingMerges) Swap(a, b int) { m[a], m[b] = m[b], m[a] }
+func (m encodingMerges) Less(a, b int) bool {
+	return m[a].rank < m[b].rank || (m[a].rank == m[b].rank && m[a].start < m[b].start)
+}
+func (m *encodingMerges) Push(merge interface{}) { *m = append(*m, merge.(encodingMerge)) }
+func (m *encodingMerges) Pop() interface{} {
+	merge := (*m)[len(*m)-1]
+	*m = (*m)[:len(*m)-1]
+	return merge
+}
+
+// Returns the tokens of a piece of text by merging the pair of adjacent parts with the lowest rank until no pair has
+// a rank. The parts are a linked list of the bytes of the piece and the pairs that can be merged are kept in a heap,
+// so each merge only looks at the pairs next to it.
+func (e *Encoding) encodePiece(piece string) []int {
+	// Link each part to the start of the next and previous parts, where a part that has been merged links to -1
+	next := make([]int, len(piece)+1)
+	previous := make([]int, len(piece)+1)
+	for index := range next {
+		next[index] = index + 1
+		previous[index] = index - 1
+	}
+	getMerge := func(start int) (encodingMerge, bool) {
+		if start < 0 || next[start] >= len(piece) {
+			return encodingMerge{}, false
+		}
+		middle := next[start]
+		rank, exists := e.ranks[piece[start:next[middle]]]
+		return encodingMerge{rank: rank, start: start, middle: middle, end: next[middle]}, exists
+	}
+
+	merges := &encodingMerges{}
+	for start := 0; start < len(piece); start++ {
+		if merge, exists := getMerge(start); exists {
+			*merges = append(*merges, merge)
+		}
+	}
+	heap.Init(merges)
+	for merges.Len() > 0 {
+		merge := heap.Pop(merges).(encodingMerge)
+
+		// Skip merges of parts that have been merged with other parts since
+		if next[merge.start] != merge.middle || next[merge.middle] != merge.end {
+			continue
+		}
+		next[merge.start] = merge.end
+		previous[merge.end] = merge.start
+		next[merge.middle] = -1
+		for _, start := range []int{previous[merge.start], merge.start} {
+			if merge, exists := getMerge(start); exists {
+				heap.Push(merges, merge)
+			}
+		}
+	}
+
+	var tokens []int
+	for start := 0; start < len(piece); start = next[start] {
+		tokens = append(tokens, e.ranks[piece[start:next[start]]])
+	}
+	return tokens
+}
+
+// Returns the text of tokens
+func (e *Encoding) Decode(tokens []int) string {
+	var text strings.Builder
+	for _, token := range tokens {
+		text.WriteString(e.tokens[token])
+	}
+	return text.String()
+}
+
+// Returns the number of tokens in a text, which is estimated from its length when there is no encoding
+func (e *Encoding) count(text string) int {
+	if e == nil {
+		return int(math.Ceil(float64(len(text)) / 4))
+	}
+	return len(e.Encode(text))
+}
+
+// Returns the start of a text that has at most a number of tokens, which is cut by its estimated length when there
+// is no encoding
+func (e *Encoding) truncate(text string, tokens int) string {
+	if tokens <= 0 {
+		return ""
+	}
+	if e == nil {
+		if tokens*4 >= len(text) {
+			return text
+		}
+		return strings.ToValidUTF8(text[:tokens*4], "")
+	}
+
+	encoded := e.Encode(text)
+	if len(encoded) <= tokens {
+		return text
+	}
+	return strings.ToValidUTF8(e.Decode(encoded[:tokens]), "")
+}
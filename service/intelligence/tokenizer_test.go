@@ -0,0 +1,282 @@
+package intelligence
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a tiktoken file with every byte as a token followed by the merges, in rank order, and returns its path
+func writeTestEncoding(t *testing.T, dir string, name string, merges []string) string {
+	t.Helper()
+	var lines strings.Builder
+	for rank := 0; rank < 256; rank++ {
+		fmt.Fprintf(&lines, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(rank)}), rank)
+	}
+	for index, merge := range merges {
+		fmt.Fprintf(&lines, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(merge)), 256+index)
+	}
+	path := filepath.Join(dir, name+".tiktoken")
+	if err := os.WriteFile(path, []byte(lines.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncodingGolden(t *testing.T) {
+	// The fixtures hold the byte tokens of the encodings and a few of their other tokens with their ranks, so the pieces
+	// that aren't one of those tokens are encoded as bytes
+	tests := []struct {
+		encoding string
+		text     string
+		tokens   []int
+	}{
+		{encoding: "cl100k_base", text: "hello world", tokens: []int{15339, 1917}},
+		{encoding: "cl100k_base", text: "Hello world", tokens: []int{9906, 1917}},
+		{encoding: "cl100k_base", text: "hello  world", tokens: []int{15339, 220, 1917}},
+		{encoding: "cl100k_base", text: "hello\n\n world", tokens: []int{15339, 198, 198, 1917}},
+		{encoding: "cl100k_base", text: "hello world  ", tokens: []int{15339, 1917, 220, 220}},
+		{encoding: "cl100k_base", text: " 你好", tokens: []int{220, 160, 121, 254, 161, 98, 121}},
+		{encoding: "cl100k_base", text: "don't", tokens: []int{67, 78, 77, 6, 83}},
+		{encoding: "cl100k_base", text: "2024", tokens: []int{2366, 19}},
+		{encoding: "o200k_base", text: "hello world", tokens: []int{24912, 2375}},
+		{encoding: "o200k_base", text: "hello \t world", tokens: []int{24912, 220, 197, 2375}},
+		{encoding: "o200k_base", text: " 你好", tokens: []int{220, 160, 121, 254, 161, 98, 121}},
+		{encoding: "o200k_base", text: "2024", tokens: []int{17, 15, 17, 19}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.encoding+" "+test.text, func(t *testing.T) {
+			encoding, err := LoadEncoding(test.encoding, filepath.Join("testdata", test.encoding+".tiktoken"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tokens := encoding.Encode(test.text); !reflect.DeepEqual(tokens, test.tokens) {
+				t.Errorf("got tokens %v, want %v", tokens, test.tokens)
+			}
+			if text := encoding.Decode(test.tokens); text != test.text {
+				t.Errorf("got text %q, want %q", text, test.text)
+			}
+		})
+	}
+}
+
+func TestEncodingSplit(t *testing.T) {
+	tests := []struct {
+		encoding string
+		text     string
+		pieces   []string
+	}{
+		{encoding: "cl100k_base", text: "hello  world", pieces: []string{"hello", " ", " world"}},
+		{encoding: "cl100k_base", text: "   hello", pieces: []string{"  ", " hello"}},
+		{encoding: "cl100k_base", text: "a\n\n b", pieces: []string{"a", "\n\n", " b"}},
+		{encoding: "cl100k_base", text: "a\u00a0\u3000b", pieces: []string{"a", "\u00a0", "\u3000b"}},
+		{encoding: "cl100k_base", text: "hello!!!\n", pieces: []string{"hello", "!!!\n"}},
+		{encoding: "cl100k_base", text: " 你好世界", pieces: []string{" 你好世界"}},
+		{encoding: "cl100k_base", text: "don't DON'T", pieces: []string{"don", "'t", " DON", "'T"}},
+		{encoding: "cl100k_base", text: "HelloWorld", pieces: []string{"HelloWorld"}},
+		{encoding: "cl100k_base", text: "12345 2024", pieces: []string{"123", "45", " ", "202", "4"}},
+		{encoding: "o200k_base", text: "hello  world", pieces: []string{"hello", " ", " world"}},
+		{encoding: "o200k_base", text: " 你好世界", pieces: []string{" 你好世界"}},
+		{encoding: "o200k_base", text: "don't DON'T", pieces: []string{"don't", " DON'T"}},
+		{encoding: "o200k_base", text: "HelloWorld", pieces: []string{"Hello", "World"}},
+		{encoding: "o200k_base", text: "12345 2024", pieces: []string{"123", "45", " ", "202", "4"}},
+		{encoding: "o200k_base", text: "a/b//\n", pieces: []string{"a", "/b", "//\n"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.encoding+" "+test.text, func(t *testing.T) {
+			encoding, err := LoadEncoding(test.encoding, filepath.Join("testdata", test.encoding+".tiktoken"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pieces := encoding.split(test.text); !reflect.DeepEqual(pieces, test.pieces) {
+				t.Errorf("got pieces %q, want %q", pieces, test.pieces)
+			}
+		})
+	}
+}
+
+func TestEncodingEncode(t *testing.T) {
+	path := writeTestEncoding(t, t.TempDir(), "cl100k_base", []string{"he", "ll", "hell", " world", " b"})
+	encoding, err := LoadEncoding("cl100k_base", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		text   string
+		tokens []int
+	}{
+		{name: "merges the lowest rank first", text: "hello", tokens: []int{258, 'o'}},
+		{name: "whole pieces", text: "hello world", tokens: []int{258, 'o', 259}},
+		{name: "gives back the last space before a word", text: "a  b", tokens: []int{'a', ' ', 260}},
+		{name: "keeps trailing spaces", text: "a  ", tokens: []int{'a', ' ', ' '}},
+		{name: "newlines", text: "a\n\nb", tokens: []int{'a', '\n', '\n', 'b'}},
+		{name: "bytes of other characters", text: "é", tokens: []int{0xc3, 0xa9}},
+		{name: "empty", text: "", tokens: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokens := encoding.Encode(test.text)
+			if !reflect.DeepEqual(tokens, test.tokens) {
+				t.Errorf("got tokens %v, want %v", tokens, test.tokens)
+			}
+			if text := encoding.Decode(tokens); text != test.text {
+				t.Errorf("got text %q, want %q", text, test.text)
+			}
+			if count := encoding.count(test.text); count != len(test.tokens) {
+				t.Errorf("got count %d, want %d", count, len(test.tokens))
+			}
+		})
+	}
+}
+
+func TestEncodingLongPieces(t *testing.T) {
+	path := writeTestEncoding(t, t.TempDir(), "cl100k_base", []string{"aa", "aaaa", "ab", "aab", "ba"})
+	encoding, err := LoadEncoding("cl100k_base", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A huge run of letters is encoded quickly, in parts that each merge into whole tokens
+	start := time.Now()
+	tokens := encoding.Encode(strings.Repeat("a", 100000))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("got %v to encode 100000 letters, want it to be quick", elapsed)
+	}
+	if len(tokens) != 25000 || tokens[0] != 257 || tokens[len(tokens)-1] != 257 {
+		t.Errorf("got %d tokens starting with %d, want 25000 of 257", len(tokens), tokens[0])
+	}
+
+	// Merges pick the lowest rank and then the leftmost pair, as merging by scanning every pair does
+	random := rand.New(rand.NewSource(1))
+	for test := 0; test < 200; test++ {
+		piece := make([]byte, 1+random.Intn(40))
+		for index := range piece {
+			piece[index] = "ab"[random.Intn(2)]
+		}
+		if got, want := encoding.encodePiece(string(piece)), encodeTestPiece(encoding, string(piece)); !reflect.DeepEqual(got, want) {
+			t.Errorf("got tokens %v for %q, want %v", got, piece, want)
+		}
+	}
+}
+
+// Returns the tokens of a piece by scanning every pair of parts for the lowest rank before each merge
+func encodeTestPiece(encoding *Encoding, piece string) []int {
+	boundaries := make([]int, len(piece)+1)
+	for index := range boundaries {
+		boundaries[index] = index
+	}
+	for {
+		lowestRank, lowestIndex := -1, -1
+		for index := 0; index+2 < len(boundaries); index++ {
+			rank, exists := encoding.ranks[piece[boundaries[index]:boundaries[index+2]]]
+			if exists && (lowestIndex < 0 || rank < lowestRank) {
+				lowestRank, lowestIndex = rank, index
+			}
+		}
+		if lowestIndex < 0 {
+			break
+		}
+		boundaries = append(boundaries[:lowestIndex+1], boundaries[lowestIndex+2:]...)
+	}
+	var tokens []int
+	for index := 0; index+1 < len(boundaries); index++ {
+		tokens = append(tokens, encoding.ranks[piece[boundaries[index]:boundaries[index+1]]])
+	}
+	return tokens
+}
+
+func TestEncodingTruncate(t *testing.T) {
+	path := writeTestEncoding(t, t.TempDir(), "cl100k_base", []string{"he", "ll", "hell", " world"})
+	encoding, err := LoadEncoding("cl100k_base", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		encoding *Encoding
+		text     string
+		tokens   int
+		want     string
+	}{
+		{name: "fits", encoding: encoding, text: "hello world", tokens: 3, want: "hello world"},
+		{name: "cut by tokens", encoding: encoding, text: "hello world", tokens: 2, want: "hello"},
+		{name: "no tokens", encoding: encoding, text: "hello world", tokens: 0, want: ""},
+		{name: "cut in a character", encoding: encoding, text: "éé", tokens: 3, want: "é"},
+		{name: "no encoding", text: "hello world", tokens: 2, want: "hello wo"},
+		{name: "no encoding cut in a character", text: "aaaéé", tokens: 1, want: "aaa"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.encoding.truncate(test.text, test.tokens); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEstimateRequestTokens(t *testing.T) {
+	path := writeTestEncoding(t, t.TempDir(), "cl100k_base", []string{"he", "ll", "hell", " world"})
+	encoding, err := LoadEncoding("cl100k_base", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		encoding *Encoding
+		body     string
+		tokens   int
+	}{
+		{name: "input", encoding: encoding, body: `{"input":["hello world"]}`, tokens: 3},
+		{name: "input without an encoding", body: `{"input":["hello world"]}`, tokens: 3},
+		{name: "long input without an encoding", body: `{"input":"hello hello hello hello"}`, tokens: 6},
+		{name: "long input", encoding: encoding, body: `{"input":"hello hello hello hello"}`, tokens: 11},
+		{name: "messages and max tokens", encoding: encoding, body: `{"messages":[{"role":"user","content":"hello"}],"max_tokens":10}`, tokens: 4 + 2 + 10},
+		{name: "images", encoding: encoding, body: `{"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]}]}`, tokens: 4 + len("image_url") + imageTokenEstimate},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if tokens := estimateRequestTokens(test.encoding, []byte(test.body)); tokens != test.tokens {
+				t.Errorf("got %d tokens, want %d", tokens, test.tokens)
+			}
+		})
+	}
+}
+
+func TestLoadEncodings(t *testing.T) {
+	i := newTestIntelligence(t, nil)
+	dir := t.TempDir()
+	writeTestEncoding(t, dir, "cl100k_base", []string{"he", "ll", "hell", " world"})
+
+	// The embeddings model's encoding is loaded and the missing encoding of the completions models is reported
+	missing, err := i.LoadEncodings(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, "o200k_base.tiktoken")}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("got missing %v, want %v", missing, want)
+	}
+	if i.getEncoding("text-embedding-3-small") == nil || i.getEncoding("gpt-4o-mini") != nil {
+		t.Errorf("got encodings %v, want only cl100k_base", i.encodings)
+	}
+
+	// A file that can't be parsed fails the load
+	os.WriteFile(filepath.Join(dir, "o200k_base.tiktoken"), []byte("not a token file\n"), 0644)
+	if _, err := i.LoadEncodings(dir); err == nil || !strings.Contains(err.Error(), "o200k_base.tiktoken") {
+		t.Errorf("got error %v, want an error about o200k_base.tiktoken", err)
+	}
+}
@@ -0,0 +1,432 @@
+package intelligence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defines the requests, tokens and images used by a principal, and what they cost
+type Usage struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	CachedTokens     int     `json:"cached_tokens"`
+	Images           int     `json:"images"`
+	Cost             float64 `json:"cost"`
+}
+
+// Defines the usage of a principal in a day or month
+type UsageWindow struct {
+	Window string `json:"window"`
+	Usage
+}
+
+// Defines the usage of a principal today and this month, and the quota it is held to
+type UsageReport struct {
+	Principal string      `json:"principal"`
+	Quota     *Quota      `json:"quota,omitempty"`
+	Day       UsageWindow `json:"day"`
+	Month     UsageWindow `json:"month"`
+}
+
+// Defines the name usage is recorded under for requests that aren't authenticated
+const anonymousPrincipal = "anonymous"
+
+// Defines the layouts of the daily and monthly windows, which are in UTC
+const (
+	usageDayLayout   = "2006-01-02"
+	usageMonthLayout = "2006-01"
+)
+
+// Defines how many daily and monthly windows are kept, where the daily usage by service is kept longer for cost reports
+const (
+	usageDaysKept        = 62
+	usageMonthsKept      = 24
+	serviceUsageDaysKept = 400
+)
+
+// Defines how long usage changes are collected before they are saved
+var usageSaveDelay = 5 * time.Second
+
+// Defines the usage of a principal by window and by day and service, and the quota it was last held to
+type principalUsage struct {
+	Quota    *Quota                       `json:"quota,omitempty"`
+	Days     map[string]*Usage            `json:"days"`
+	Months   map[string]*Usage            `json:"months"`
+	Services map[string]map[string]*Usage `json:"services,omitempty"`
+}
+
+// Keeps the usage of each principal, saving it to a file so it survives a restart, and the usage reserved by the
+// requests of each principal that haven't completed
+type UsageStore struct {
+	path      string
+	usage     map[string]*principalUsage
+	reserved  map[string]*Usage
+	saveTimer *time.Timer
+	mu        sync.Mutex
+}
+
+// Creates a usage store that is saved to a file, loading the usage already saved there. An empty path keeps the
+// usage in memory only.
+func NewUsageStore(path string) (*UsageStore, error) {
+	store := newUsageStore(path)
+	if path == "" {
+		return store, nil
+	}
+
+	usageBytes, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading usage file: %v", err)
+	}
+	if err := json.Unmarshal(usageBytes, &store.usage); err != nil {
+		return nil, fmt.Errorf("error parsing usage file: %v", err)
+	}
+	return store, nil
+}
+
+// Creates an empty usage store that is saved to a file, or kept in memory only when the path is empty
+func newUsageStore(path string) *UsageStore {
+	return &UsageStore{path: path, usage: make(map[string]*principalUsage), reserved: make(map[string]*Usage)}
+}
+
+// Sets where usage is kept
+func (i *Intelligence) SetUsageStore(store *UsageStore) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.usage = store
+}
+
+// Adds the usage of a service to the principal's windows for the time
+func (s *UsageStore) record(principal string, service string, quota *Quota, usage Usage, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.usage[principal]
+	if !exists {
+		entry = &principalUsage{Days: make(map[string]*Usage), Months: make(map[string]*Usage)}
+		s.usage[principal] = entry
+	}
+	if entry.Services == nil {
+		entry.Services = make(map[string]map[string]*Usage)
+	}
+	if entry.Services[service] == nil {
+		entry.Services[service] = make(map[string]*Usage)
+	}
+	if quota != nil {
+		entry.Quota = quota
+	}
+	day := now.UTC().Format(usageDayLayout)
+	addUsage(entry.Days, day, usage, usageDaysKept)
+	addUsage(entry.Months, now.UTC().Format(usageMonthLayout), usage, usageMonthsKept)
+	addUsage(entry.Services[service], day, usage, serviceUsageDaysKept)
+	s.scheduleSave()
+}
+
+// Adds usage to a window, dropping the oldest windows beyond the number kept
+func addUsage(windows map[string]*Usage, window string, usage Usage, kept int) {
+	total, exists := windows[window]
+	if !exists {
+		total = &Usage{}
+		windows[window] = total
+	}
+	total.add(usage)
+
+	if len(windows) > kept {
+		keys := make([]string, 0, len(windows))
+		for key := range windows {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys[:len(keys)-kept] {
+			delete(windows, key)
+		}
+	}
+}
+
+// Adds other usage to the usage
+func (u *Usage) add(other Usage) {
+	u.Requests += other.Requests
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+	u.CachedTokens += other.CachedTokens
+	u.Images += other.Images
+	u.Cost += other.Cost
+}
+
+// Returns the usage of a principal today and this month
+func (s *UsageStore) report(principal string, now time.Time) UsageReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getReport(principal, now)
+}
+
+// Returns the usage of a principal today and this month, which must be called with the lock held
+func (s *UsageStore) getReport(principal string, now time.Time) UsageReport {
+	day := now.UTC().Format(usageDayLayout)
+	month := now.UTC().Format(usageMonthLayout)
+	report := UsageReport{
+		Principal: principal,
+		Day:       UsageWindow{Window: day},
+		Month:     UsageWindow{Window: month},
+	}
+	if entry, exists := s.usage[principal]; exists {
+		report.Quota = entry.Quota
+		if usage, exists := entry.Days[day]; exists {
+			report.Day.Usage = *usage
+		}
+		if usage, exists := entry.Months[month]; exists {
+			report.Month.Usage = *usage
+		}
+	}
+	return report
+}
+
+// Returns the principals that have usage, in order
+func (s *UsageStore) principals() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	principals := make([]string, 0, len(s.usage))
+	for principal := range s.usage {
+		principals = append(principals, principal)
+	}
+	sort.Strings(principals)
+	return principals
+}
+
+// Saves the usage after a delay so a burst of requests is saved once, which must be called with the lock held
+func (s *UsageStore) scheduleSave() {
+	if s.path == "" || s.saveTimer != nil {
+		return
+	}
+	s.saveTimer = time.AfterFunc(usageSaveDelay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.saveTimer = nil
+		s.save()
+	})
+}
+
+// Writes the usage to its file, replacing the file at once so a crash can't leave it half written, which must be
+// called with the lock held
+func (s *UsageStore) save() {
+	usageBytes, err := json.Marshal(s.usage)
+	if err != nil {
+		return
+	}
+	if dir := filepath.Dir(s.path); dir != "" {
+		os.MkdirAll(dir, 0755)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, usageBytes, 0644); err != nil {
+		return
+	}
+	os.Rename(tmpPath, s.path)
+}
+
+// Returns the ID usage is recorded under for the principal of a context, and the quota it is held to
+func getUsagePrincipal(ctx context.Context) (string, *Quota) {
+	principal := GetPrincipal(ctx)
+	if principal == nil {
+		return anonymousPrincipal, nil
+	}
+	return principal.ID, principal.Quota
+}
+
+// Defines a limit of a quota that a reservation doesn't fit in
+type quotaLimit struct {
+	period string
+	unit   string
+	limit  int
+	resets time.Time
+}
+
+// Reserves usage for requests of a principal that are about to be sent, unless the usage recorded in the current day
+// or month, the usage reserved by its other requests and the reservation together are more than its quota, and
+// returns the limit it doesn't fit in
+func (s *UsageStore) reserve(principal string, quota *Quota, usage Usage, now time.Time) *quotaLimit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := s.getReport(principal, now)
+	reserved, exists := s.reserved[principal]
+	if !exists {
+		reserved = &Usage{}
+	}
+	nextDay := time.Date(now.UTC().Year(), now.UTC().Month(), now.UTC().Day()+1, 0, 0, 0, 0, time.UTC)
+	nextMonth := time.Date(now.UTC().Year(), now.UTC().Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	for _, limit := range []struct {
+		quotaLimit
+		used      int
+		requested int
+	}{
+		{quotaLimit{"daily", "requests", quota.RequestsPerDay, nextDay}, report.Day.Requests + reserved.Requests, usage.Requests},
+		{quotaLimit{"daily", "tokens", quota.TokensPerDay, nextDay}, report.Day.TotalTokens + reserved.TotalTokens, usage.TotalTokens},
+		{quotaLimit{"monthly", "requests", quota.RequestsPerMonth, nextMonth}, report.Month.Requests + reserved.Requests, usage.Requests},
+		{quotaLimit{"monthly", "tokens", quota.TokensPerMonth, nextMonth}, report.Month.TotalTokens + reserved.TotalTokens, usage.TotalTokens},
+		{quotaLimit{"daily", "images", quota.ImagesPerDay, nextDay}, report.Day.Images + reserved.Images, usage.Images},
+		{quotaLimit{"monthly", "images", quota.ImagesPerMonth, nextMonth}, report.Month.Images + reserved.Images, usage.Images},
+	} {
+		if limit.limit > 0 && limit.used+limit.requested > limit.limit {
+			return &limit.quotaLimit
+		}
+	}
+
+	reserved.add(usage)
+	s.reserved[principal] = reserved
+	return nil
+}
+
+// Gives back usage that was reserved for requests of a principal once their usage is recorded or they fail
+func (s *UsageStore) release(principal string, usage Usage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reserved, exists := s.reserved[principal]
+	if !exists {
+		return
+	}
+	reserved.Requests -= usage.Requests
+	reserved.TotalTokens -= usage.TotalTokens
+	reserved.Images -= usage.Images
+	if reserved.Requests <= 0 {
+		delete(s.reserved, principal)
+	}
+}
+
+// Reserves the requests to a service and the tokens and images they are estimated to use against the quota of the
+// principal of the context before they are sent, so requests that run at the same time and provider batches can't
+// use more than the quota between them. Returns a function that gives the reservation back, which is called once
+// the usage of the requests is recorded or they fail.
+func (i *Intelligence) reserveQuota(ctx context.Context, service Service, usage Usage) (func(), error) {
+	principal, quota := getUsagePrincipal(ctx)
+	if quota == nil {
+		return func() {}, nil
+	}
+
+	i.mu.RLock()
+	store := i.usage
+	i.mu.RUnlock()
+
+	now := time.Now()
+	if limit := store.reserve(principal, quota, usage, now); limit != nil {
+		err := newError(ErrorCodeQuotaExceeded, service.Name, "'%s' has used its %s quota of %d %s", principal, limit.period, limit.limit, limit.unit)
+		if usage.Requests > 1 {
+			err = newError(ErrorCodeQuotaExceeded, service.Name, "%d requests of '%s' don't fit in its %s quota of %d %s", usage.Requests, principal, limit.period, limit.limit, limit.unit)
+		}
+		err.RetryAfter = limit.resets.Sub(now)
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { store.release(principal, usage) })
+	}, nil
+}
+
+// Gives back the quota reservation of a request when its response body is closed, which is after its usage has been
+// recorded
+type quotaReservedBody struct {
+	io.ReadCloser
+	release func()
+}
+
+// Closes the body and gives back the reservation
+func (b *quotaReservedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// Records a request to a service, the usage in its response and what it cost for the principal of the context
+func (i *Intelligence) recordUsage(ctx context.Context, service Service, requestBody []byte, response map[string]interface{}, batch bool) {
+	usage := Usage{Requests: 1}
+	if usageMap, ok := response["usage"].(map[string]interface{}); ok {
+		usage.PromptTokens = getUsageCount(usageMap, "prompt_tokens")
+		usage.CompletionTokens = getUsageCount(usageMap, "completion_tokens")
+		usage.TotalTokens = getUsageCount(usageMap, "total_tokens")
+		if usage.TotalTokens == 0 {
+			usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+		}
+		if details, ok := usageMap["prompt_tokens_details"].(map[string]interface{}); ok {
+			usage.CachedTokens = getUsageCount(details, "cached_tokens")
+		}
+	}
+	if service.Type == "v1/images/generations" {
+		if data, ok := response["data"].([]interface{}); ok {
+			usage.Images = len(data)
+		}
+	}
+
+	i.mu.RLock()
+	store := i.usage
+	prices := i.prices
+	metrics := i.metrics
+	i.mu.RUnlock()
+	usage.Cost = getCost(prices, service, requestBody, usage, batch)
+
+	principal, quota := getUsagePrincipal(ctx)
+	store.record(principal, service.Name, quota, usage, time.Now())
+	metrics.record(principal, service.Name, usage)
+}
+
+// Returns a count from a usage block, or zero if it has none
+func getUsageCount(usage map[string]interface{}, name string) int {
+	count, _ := usage[name].(float64)
+	return int(count)
+}
+
+// Reports the usage of the principal making the request today and this month. Admins, and every request when
+// requests aren't authenticated, get the usage of every principal, or of the one named by the principal parameter.
+func (i *Intelligence) UsageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{
+				"errors": Errors{"request": newError(ErrorCodeValidation, "", "method not allowed")},
+			})
+			return
+		}
+		ctx, err := i.Authenticate(r)
+		if err != nil {
+			writeAuthError(w, Errors{"request": AsError(err)})
+			return
+		}
+
+		i.mu.RLock()
+		store := i.usage
+		i.mu.RUnlock()
+
+		// Only report the principal's own usage, with its current quota, unless it can see everyone's
+		now := time.Now()
+		var reports []UsageReport
+		if principal := GetPrincipal(ctx); principal != nil && !principal.Admin {
+			report := store.report(principal.ID, now)
+			report.Quota = principal.Quota
+			reports = []UsageReport{report}
+		} else {
+			principals := store.principals()
+			if name := r.URL.Query().Get("principal"); name != "" {
+				principals = []string{name}
+			}
+			reports = make([]UsageReport, 0, len(principals))
+			for _, principal := range principals {
+				reports = append(reports, store.report(principal, now))
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"usage": reports,
+		})
+	})
+}
@@ -0,0 +1,299 @@
+package intelligence
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUsageStoreReserve(t *testing.T) {
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		quota    Quota
+		recorded Usage
+		// Records the usage the day before, so it only counts against the month
+		yesterday bool
+		reserved  []Usage
+		request   Usage
+		limit     string
+	}{
+		{
+			name:    "no limits",
+			request: Usage{Requests: 100, TotalTokens: 100000},
+		},
+		{
+			name:     "fits in what is left",
+			quota:    Quota{RequestsPerDay: 10},
+			recorded: Usage{Requests: 5},
+			reserved: []Usage{{Requests: 2}},
+			request:  Usage{Requests: 3},
+		},
+		{
+			name:     "reservations count against the quota",
+			quota:    Quota{RequestsPerDay: 10},
+			recorded: Usage{Requests: 5},
+			reserved: []Usage{{Requests: 2}, {Requests: 2}},
+			request:  Usage{Requests: 2},
+			limit:    "daily requests",
+		},
+		{
+			name:    "a batch must fit as a whole",
+			quota:   Quota{RequestsPerMonth: 10},
+			request: Usage{Requests: 11},
+			limit:   "monthly requests",
+		},
+		{
+			name:     "estimated tokens",
+			quota:    Quota{TokensPerDay: 1000},
+			recorded: Usage{Requests: 1, TotalTokens: 600},
+			reserved: []Usage{{Requests: 1, TotalTokens: 300}},
+			request:  Usage{Requests: 1, TotalTokens: 200},
+			limit:    "daily tokens",
+		},
+		{
+			name:      "monthly tokens",
+			quota:     Quota{TokensPerDay: 1000, TokensPerMonth: 5000},
+			recorded:  Usage{Requests: 1, TotalTokens: 4500},
+			yesterday: true,
+			request:   Usage{Requests: 1, TotalTokens: 600},
+			limit:     "monthly tokens",
+		},
+		{
+			name:     "daily images",
+			quota:    Quota{ImagesPerDay: 2},
+			recorded: Usage{Requests: 1, Images: 1},
+			reserved: []Usage{{Requests: 1, Images: 1}},
+			request:  Usage{Requests: 1, Images: 1},
+			limit:    "daily images",
+		},
+		{
+			name:     "images fit in what is left",
+			quota:    Quota{ImagesPerDay: 3, ImagesPerMonth: 10},
+			recorded: Usage{Requests: 1, Images: 1},
+			request:  Usage{Requests: 1, Images: 1},
+		},
+		{
+			name:      "monthly images",
+			quota:     Quota{ImagesPerDay: 5, ImagesPerMonth: 5},
+			recorded:  Usage{Requests: 5, Images: 5},
+			yesterday: true,
+			request:   Usage{Requests: 1, Images: 1},
+			limit:     "monthly images",
+		},
+		{
+			name:    "requests without images",
+			quota:   Quota{ImagesPerDay: 1},
+			request: Usage{Requests: 10, TotalTokens: 1000},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, _ := NewUsageStore("")
+			quota := test.quota
+			if test.recorded.Requests > 0 {
+				recordedAt := now
+				if test.yesterday {
+					recordedAt = now.AddDate(0, 0, -1)
+				}
+				store.record("ada", "sentiment", &quota, test.recorded, recordedAt)
+			}
+			for _, reserved := range test.reserved {
+				if limit := store.reserve("ada", &quota, reserved, now); limit != nil {
+					t.Fatalf("got limit %+v for the existing reservation", limit)
+				}
+			}
+
+			limit := store.reserve("ada", &quota, test.request, now)
+			if test.limit == "" {
+				if limit != nil {
+					t.Errorf("got %s %s limit, want the request to fit", limit.period, limit.unit)
+				}
+				return
+			}
+			if limit == nil || limit.period+" "+limit.unit != test.limit {
+				t.Fatalf("got limit %+v, want %s", limit, test.limit)
+			}
+
+			// A reservation that doesn't fit isn't kept
+			store.mu.Lock()
+			reserved := store.reserved["ada"]
+			store.mu.Unlock()
+			total := Usage{}
+			for _, usage := range test.reserved {
+				total.add(usage)
+			}
+			if (reserved == nil && total.Requests > 0) || (reserved != nil && *reserved != total) {
+				t.Errorf("got reserved %+v, want %+v", reserved, total)
+			}
+		})
+	}
+}
+
+func TestUsageStoreRelease(t *testing.T) {
+	now := time.Now()
+	store, _ := NewUsageStore("")
+	quota := &Quota{RequestsPerDay: 2}
+	first := Usage{Requests: 1, TotalTokens: 10}
+	if store.reserve("ada", quota, first, now) != nil || store.reserve("ada", quota, first, now) != nil {
+		t.Fatal("got a limit for requests within the quota")
+	}
+	if store.reserve("ada", quota, first, now) == nil {
+		t.Fatal("got no limit for a request over the quota")
+	}
+
+	// Once a request is recorded its reservation is given back, so it is only counted once
+	store.record("ada", "sentiment", quota, first, now)
+	store.release("ada", first)
+	if limit := store.reserve("ada", quota, first, now); limit == nil {
+		t.Error("got no limit after the recorded request and the reserved request used up the quota")
+	}
+	store.release("ada", first)
+	if limit := store.reserve("ada", quota, first, now); limit != nil {
+		t.Errorf("got %s %s limit after the reservation was given back", limit.period, limit.unit)
+	}
+}
+
+func TestImagesQuota(t *testing.T) {
+	i := newTestIntelligence(t, func(r *http.Request) (*http.Response, error) {
+		return stubResponse(`{"data":[{"b64_json":"aW1hZ2U="}]}`), nil
+	})
+	ctx := WithPrincipal(context.Background(), &Principal{ID: "key:ada", Name: "ada", Services: []string{"*"}, Quota: &Quota{ImagesPerDay: 2}})
+	params := map[string]interface{}{"prompt": "a blender"}
+	for image := 0; image < 2; image++ {
+		if _, err := i.GetIntelligence(ctx, "generated_image", params); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A third image is over the daily quota
+	_, err := i.GetIntelligence(ctx, "generated_image", params)
+	if AsError(err) == nil || AsError(err).Code != ErrorCodeQuotaExceeded || !strings.Contains(err.Error(), "daily quota of 2 images") {
+		t.Fatalf("got error %v, want %s for the daily images", err, ErrorCodeQuotaExceeded)
+	}
+	if report := i.usage.report("key:ada", time.Now()); report.Day.Images != 2 || len(i.usage.reserved) != 0 {
+		t.Errorf("got %d images recorded and reservations %v, want 2 recorded and none reserved", report.Day.Images, i.usage.reserved)
+	}
+}
+
+func TestConcurrentRequestsQuota(t *testing.T) {
+	// Hold every provider request until all the requests have been admitted or rejected
+	release := make(chan struct{})
+	var mu sync.Mutex
+	sent := 0
+	i := newTestIntelligence(t, func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		sent++
+		mu.Unlock()
+		<-release
+		return stubResponse(`{"choices":[{"message":{"content":"positive"}}],"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`), nil
+	})
+	ctx := WithPrincipal(context.Background(), &Principal{ID: "key:ada", Name: "ada", Services: []string{"*"}, Quota: &Quota{RequestsPerDay: 3}})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for request := 0; request < 5; request++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := i.GetIntelligence(ctx, "sentiment", map[string]interface{}{"text": "I love it"})
+			errs <- err
+		}()
+	}
+
+	// The requests over the quota are rejected while the others are still in flight
+	rejected := 0
+	for rejected < 2 {
+		select {
+		case err := <-errs:
+			if AsError(err) == nil || AsError(err).Code != ErrorCodeQuotaExceeded {
+				t.Fatalf("got error %v, want %s", err, ErrorCodeQuotaExceeded)
+			}
+			rejected++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d rejected requests, want 2", rejected)
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("got error %v, want the requests in the quota to complete", err)
+		}
+	}
+
+	report := i.usage.report("key:ada", time.Now())
+	if sent != 3 || report.Day.Requests != 3 {
+		t.Errorf("got %d requests sent and %d recorded, want 3", sent, report.Day.Requests)
+	}
+	if len(i.usage.reserved) != 0 {
+		t.Errorf("got reservations %v after every request completed", i.usage.reserved)
+	}
+}
+
+func TestProviderBatchQuota(t *testing.T) {
+	setProviderBatchPollInterval(t, 5*time.Millisecond)
+	tests := []struct {
+		name      string
+		quota     Quota
+		submitted bool
+	}{
+		{name: "group fits", quota: Quota{RequestsPerDay: 3}, submitted: true},
+		{name: "group doesn't fit", quota: Quota{RequestsPerDay: 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newStubBatchProvider(t)
+			i := newTestIntelligence(t, provider.roundTrip)
+			quota := test.quota
+			ctx := WithPrincipal(context.Background(), &Principal{ID: "key:ada", Name: "ada", Services: []string{"*"}, Quota: &quota})
+			requests := Requests{
+				"first":  {"model": "sentiment", "text": "I love it"},
+				"second": {"model": "sentiment", "text": "It broke"},
+				"third":  {"model": "sentiment", "text": "It's fine"},
+			}
+
+			batches := make(map[string]*ProviderBatch)
+			_, errors := i.doProviderBatchRequests(ctx, requests, nil, func(key string, batch *ProviderBatch) {
+				batches[key] = batch
+			})
+			if !test.submitted {
+				if len(errors) != 3 || len(provider.batches) != 0 {
+					t.Fatalf("got errors %v and batches %v, want every request rejected", errors, provider.batches)
+				}
+				for key, err := range errors {
+					if err.Code != ErrorCodeQuotaExceeded {
+						t.Errorf("got %s error for '%s', want %s", err.Code, key, ErrorCodeQuotaExceeded)
+					}
+				}
+				return
+			}
+			if len(errors) != 0 || len(batches) != 1 {
+				t.Fatalf("got errors %v and batches %v, want one batch", errors, batches)
+			}
+
+			// The batch holds its reservation while it is in progress, so no more requests fit
+			if _, err := i.GetIntelligence(ctx, "sentiment", map[string]interface{}{"text": "one more"}); AsError(err) == nil || AsError(err).Code != ErrorCodeQuotaExceeded {
+				t.Fatalf("got error %v while the batch is in progress, want %s", err, ErrorCodeQuotaExceeded)
+			}
+
+			// Once the batch completes its reservation is replaced by its usage
+			provider.finish()
+			for _, batch := range batches {
+				if _, _, finished := i.getProviderBatchResults(ctx, batch); !finished {
+					t.Fatal("got the batch unfinished")
+				}
+				i.releaseProviderBatchReservation(batch.ID)
+			}
+			if report := i.usage.report("key:ada", time.Now()); report.Day.Requests != 3 || len(i.usage.reserved) != 0 {
+				t.Errorf("got %d requests recorded and reservations %v, want 3 recorded and none reserved", report.Day.Requests, i.usage.reserved)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"intelligence/graphql"
 	"intelligence/intelligence"
@@ -18,6 +19,24 @@ func main() {
 	// Load environment variables
 	loadEnv()
 
+	// Enrich a file instead of starting the server when the enrich command is given
+	if len(os.Args) > 1 && os.Args[1] == "enrich" {
+		if err := runEnrich(os.Args[2:]); err != nil {
+			log.Fatalf("Enrich failed: %s", err)
+		}
+		return
+	}
+
+	// Create an API key and print it with the hash to add to the API keys file when the api-key command is given
+	if len(os.Args) > 1 && os.Args[1] == "api-key" {
+		key, err := intelligence.NewAPIKey()
+		if err != nil {
+			log.Fatalf("API key failed to be created: %s", err)
+		}
+		fmt.Printf("Key:  %s\nHash: %s\n", key, intelligence.HashAPIKey(key))
+		return
+	}
+
 	// Get the server port from the environment, default to 8080 if not set or invalid
 	portStr := os.Getenv("PORT")
 	port, err := strconv.Atoi(portStr)
@@ -25,21 +44,140 @@ func main() {
 		port = 8080
 	}
 
+	// Load the jobs that are kept in a directory so they survive a restart
+	jobStore, err := intelligence.NewJobStore(getEnv("INTELLIGENCE_JOBS_DIR", "jobs"))
+	if err != nil {
+		log.Fatalf("Intelligence jobs failed to load: %s", err)
+	}
+
+	// Load the usage of each principal that is kept in a file so quotas survive a restart
+	usageStore, err := intelligence.NewUsageStore(getEnv("INTELLIGENCE_USAGE_FILE", "usage.json"))
+	if err != nil {
+		log.Fatalf("Intelligence usage failed to load: %s", err)
+	}
+
+	// Load what each provider charges for each model that the cost of requests is computed from
+	prices, err := intelligence.LoadPrices(getEnv("INTELLIGENCE_PRICES", "prices.json"))
+	if err != nil {
+		log.Fatalf("Intelligence prices failed to load: %s", err)
+	}
+
+	// Get the concurrency limits for requests to providers from the environment, keeping the defaults for any that
+	// are not set
+	concurrencyLimits := intelligence.ConcurrencyLimits{
+		Global:      getEnvInt("INTELLIGENCE_MAX_CONCURRENCY", intelligence.DefaultConcurrencyLimits.Global),
+		PerProvider: getEnvIntMap("INTELLIGENCE_PROVIDER_MAX_CONCURRENCY"),
+		MaxQueue:    getEnvInt("INTELLIGENCE_MAX_QUEUE", intelligence.DefaultConcurrencyLimits.MaxQueue),
+		MaxWait:     time.Duration(getEnvInt("INTELLIGENCE_MAX_WAIT_SECONDS", int(intelligence.DefaultConcurrencyLimits.MaxWait/time.Second))) * time.Second,
+	}
+
+	// Load the requests and tokens per minute each provider allows for each model, if a file is set
+	var rateLimits map[string]intelligence.RateLimit
+	if rateLimitsPath := os.Getenv("INTELLIGENCE_RATE_LIMITS"); rateLimitsPath != "" {
+		rateLimits, err = intelligence.LoadRateLimits(rateLimitsPath)
+		if err != nil {
+			log.Fatalf("Intelligence rate limits failed to load: %s", err)
+		}
+	}
+
+	// Load the API keys that requests must have, if a file is set
+	var apiKeys []intelligence.APIKey
+	if apiKeysPath := os.Getenv("INTELLIGENCE_API_KEYS"); apiKeysPath != "" {
+		apiKeys, err = intelligence.LoadAPIKeys(apiKeysPath)
+		if err != nil {
+			log.Fatalf("Intelligence API keys failed to load: %s", err)
+		}
+	}
+
+	// Load how bearer tokens are validated, if a file is set
+	var jwtConfig *intelligence.JWTConfig
+	if jwtConfigPath := os.Getenv("INTELLIGENCE_JWT_CONFIG"); jwtConfigPath != "" {
+		config, err := intelligence.LoadJWTConfig(jwtConfigPath)
+		if err != nil {
+			log.Fatalf("Intelligence JWT config failed to load: %s", err)
+		}
+		jwtConfig = &config
+	}
+
 	// Initialize the intelligence service by loading configuration
 	intelligence, err := intelligence.NewIntelligence("intelligence.json")
 	if err != nil {
 		log.Fatalf("Intelligence failed to load: %s", err)
 	}
 
+	// Apply the concurrency and rate limits for requests to providers
+	intelligence.SetConcurrencyLimits(concurrencyLimits)
+	intelligence.SetRateLimits(rateLimits, concurrencyLimits.MaxWait)
+
+	// Track usage and enforce quotas with the loaded usage
+	intelligence.SetUsageStore(usageStore)
+
+	// Compute the cost of requests with the loaded prices
+	intelligence.SetPrices(prices)
+
+	// Count tokens with the encodings of the models from their tiktoken files, which are required when the directory
+	// is set. Otherwise models without their encoding have their tokens estimated, which is warned about since it
+	// skews max tokens, context windows, quotas and costs.
+	missingEncodings, err := intelligence.LoadEncodings(getEnv("INTELLIGENCE_TOKENIZER_DIR", "tokenizers"))
+	if err != nil {
+		log.Fatalf("Intelligence tokenizers failed to load: %s", err)
+	}
+	if len(missingEncodings) > 0 {
+		if os.Getenv("INTELLIGENCE_TOKENIZER_DIR") != "" {
+			log.Fatalf("Intelligence tokenizers are missing: %s", strings.Join(missingEncodings, ", "))
+		}
+		log.Printf("WARNING: Intelligence tokenizers are missing, so tokens are estimated from the length of text: %s", strings.Join(missingEncodings, ", "))
+	}
+
+	// Require an API key or token for every request when keys or a JWKS are set
+	intelligence.SetAPIKeys(apiKeys)
+	if jwtConfig != nil {
+		if err := intelligence.SetJWTAuth(*jwtConfig); err != nil {
+			log.Fatalf("Intelligence JWT keys failed to load: %s", err)
+		}
+	}
+
+	// Allow job callbacks to hosts inside the network, which can also be sent results over http
+	intelligence.SetCallbackHosts(strings.Split(os.Getenv("INTELLIGENCE_CALLBACK_HOSTS"), ","))
+
+	// Process jobs in the background
+	intelligence.StartJobs(jobStore, getEnvInt("INTELLIGENCE_JOB_WORKERS", 4), getEnvInt("INTELLIGENCE_JOB_QUEUE", 100))
+
 	// Initialize the GraphQL handler with the loaded intelligence service
 	graphQLHandler, err := graphql.NewGraphQLHandler("intelligence.graphql", intelligence)
 	if err != nil {
 		log.Fatalf("GraphQL handler failed to load: %s", err)
 	}
 
+	// Apply the GraphQL query limits from the environment, keeping the defaults for any that are not set
+	graphQLHandler.SetLimits(graphql.Limits{
+		MaxCost:    getEnvInt("GRAPHQL_MAX_COST", graphql.DefaultLimits.MaxCost),
+		MaxAliases: getEnvInt("GRAPHQL_MAX_ALIASES", graphql.DefaultLimits.MaxAliases),
+		MaxDepth:   getEnvInt("GRAPHQL_MAX_DEPTH", graphql.DefaultLimits.MaxDepth),
+		MaxBatch:   getEnvInt("GRAPHQL_MAX_BATCH", graphql.DefaultLimits.MaxBatch),
+	})
+
+	// Disable introspection and the explorer when set to false, such as in production
+	graphQLHandler.SetIntrospection(os.Getenv("GRAPHQL_INTROSPECTION") != "false")
+
+	// Persist queries to disk when a directory is configured, optionally only allowing the queries it contains
+	if persistedQueriesDir := os.Getenv("GRAPHQL_PERSISTED_QUERIES_DIR"); persistedQueriesDir != "" {
+		persistedQueries, err := graphql.NewPersistedQueryStore(persistedQueriesDir)
+		if err != nil {
+			log.Fatalf("GraphQL persisted queries failed to load: %s", err)
+		}
+		graphQLHandler.SetPersistedQueries(persistedQueries, os.Getenv("GRAPHQL_PERSISTED_QUERIES_ALLOWLIST") == "true")
+	}
+
 	// Set up the HTTP handlers for GraphQL and intelligence routes
 	http.Handle("/graphql", graphQLHandler.Handler())
 	http.Handle("/intelligence", intelligence.Handler())
+	http.Handle("/intelligence/bulk", intelligence.BulkHandler(getEnvInt("INTELLIGENCE_BULK_CONCURRENCY", 8)))
+	http.Handle("/intelligence/jobs", intelligence.JobsHandler())
+	http.Handle("/intelligence/jobs/", intelligence.JobsHandler())
+	http.Handle("/usage", intelligence.UsageHandler())
+	http.Handle("/usage/costs", intelligence.CostsHandler())
+	http.Handle("/metrics", intelligence.MetricsHandler())
 
 	// Start the HTTP server on the specified port
 	log.Printf("Server starting on port %d\n", port)
@@ -81,3 +219,36 @@ func loadEnv() {
 		os.Setenv(key, value)
 	}
 }
+
+// Returns the integer values of an environment variable with comma separated name=value pairs, such as
+// "openai=20", skipping any pairs that are invalid
+func getEnvIntMap(name string) map[string]int {
+	values := make(map[string]int)
+	for _, pair := range strings.Split(os.Getenv(name), ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if value, err := strconv.Atoi(strings.TrimSpace(parts[1])); err == nil {
+			values[strings.TrimSpace(parts[0])] = value
+		}
+	}
+	return values
+}
+
+// Returns the value of an environment variable, or the default if it is not set
+func getEnv(name string, defaultValue string) string {
+	if value, exists := os.LookupEnv(name); exists {
+		return value
+	}
+	return defaultValue
+}
+
+// Returns the integer value of an environment variable, or the default if it is not set or invalid
+func getEnvInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
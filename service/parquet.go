@@ -0,0 +1,790 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Defines the physical types of Parquet columns
+const (
+	parquetBoolean           = 0
+	parquetInt32             = 1
+	parquetInt64             = 2
+	parquetInt96             = 3
+	parquetFloat             = 4
+	parquetDouble            = 5
+	parquetByteArray         = 6
+	parquetFixedLenByteArray = 7
+)
+
+// Defines the Parquet page types, encodings, compression codecs and repetitions that can be read
+const (
+	parquetDataPage       = 0
+	parquetDictionaryPage = 2
+	parquetDataPageV2     = 3
+
+	parquetPlain           = 0
+	parquetPlainDictionary = 2
+	parquetRLE             = 3
+	parquetRLEDictionary   = 8
+
+	parquetUncompressed = 0
+	parquetSnappy       = 1
+	parquetGzip         = 2
+
+	parquetOptional = 1
+	parquetRepeated = 2
+)
+
+// Defines the converted type of INT32 columns that hold dates as days since 1970-01-01
+const parquetDate = 6
+
+// Defines the magic bytes at the start and end of a Parquet file
+const parquetMagic = "PAR1"
+
+// Defines the most values a page can have, which is far more than writers put in a page and keeps a corrupted count
+// from using up memory
+const maxParquetPageValues = 1 << 22
+
+// Defines how deeply Thrift structs and lists can be nested, which keeps a corrupted footer from using up the stack
+const maxThriftDepth = 64
+
+// Defines a column of a Parquet file
+type parquetColumn struct {
+	name        string
+	kind        int64
+	typeLength  int64
+	optional    bool
+	date        bool
+	values      []string
+	dictionary  []string
+	codec       int64
+	valuesCount int64
+}
+
+// Reads the header and rows of a Parquet file with flat columns, formatting each value the way it would be written
+// in a CSV file, where null values are empty. Pages can be uncompressed or compressed with snappy or gzip.
+func readParquet(path string) ([]string, [][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening input file: %v", err)
+	}
+	if len(data) < 12 || string(data[:4]) != parquetMagic || string(data[len(data)-4:]) != parquetMagic {
+		return nil, nil, fmt.Errorf("input file is not a Parquet file")
+	}
+	footerLength := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	if footerLength > len(data)-12 {
+		return nil, nil, fmt.Errorf("invalid Parquet footer")
+	}
+	metadata, err := (&thriftReader{data: data[len(data)-8-footerLength : len(data)-8]}).readStruct()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading Parquet footer: %v", err)
+	}
+
+	columns, err := getParquetColumns(metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := make([]string, len(columns))
+	for index, column := range columns {
+		header[index] = column.name
+	}
+
+	// Read each row group a column at a time and then put the values of each row together
+	var rows [][]string
+	for _, rowGroupValue := range getThriftList(metadata, 4) {
+		rowGroup, ok := rowGroupValue.(map[int16]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid Parquet row group")
+		}
+		chunks := getThriftList(rowGroup, 1)
+		if len(chunks) != len(columns) {
+			return nil, nil, fmt.Errorf("Parquet row group has %d columns, expected %d", len(chunks), len(columns))
+		}
+		rowCount := getThriftInt(rowGroup, 3)
+		if rowCount < 0 {
+			return nil, nil, fmt.Errorf("Parquet row group has %d rows", rowCount)
+		}
+		for index, chunkValue := range chunks {
+			chunk, ok := chunkValue.(map[int16]interface{})
+			if !ok {
+				return nil, nil, fmt.Errorf("invalid Parquet column chunk")
+			}
+			if err := columns[index].readChunk(data, getThriftStruct(chunk, 3), rowCount); err != nil {
+				return nil, nil, fmt.Errorf("error reading Parquet column '%s': %v", columns[index].name, err)
+			}
+		}
+		for row := int64(0); row < rowCount; row++ {
+			record := make([]string, len(columns))
+			for index, column := range columns {
+				record[index] = column.values[row]
+			}
+			rows = append(rows, record)
+		}
+		for _, column := range columns {
+			column.values = nil
+		}
+	}
+	return header, rows, nil
+}
+
+// Returns the columns of the schema of a Parquet file, which must all be at the top level and not repeated
+func getParquetColumns(metadata map[int16]interface{}) ([]*parquetColumn, error) {
+	schema := getThriftList(metadata, 2)
+	if len(schema) == 0 {
+		return nil, fmt.Errorf("Parquet file has no schema")
+	}
+	root, ok := schema[0].(map[int16]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid Parquet schema")
+	}
+	var columns []*parquetColumn
+	for _, elementValue := range schema[1:] {
+		element, ok := elementValue.(map[int16]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid Parquet schema")
+		}
+		name := string(getThriftBytes(element, 4))
+		if getThriftInt(element, 5) > 0 || getThriftInt(element, 3) == parquetRepeated {
+			return nil, fmt.Errorf("Parquet column '%s' is nested or repeated, which is not supported", name)
+		}
+		if getThriftInt(element, 1) == parquetFixedLenByteArray && getThriftInt(element, 2) < 0 {
+			return nil, fmt.Errorf("Parquet column '%s' has a length of %d", name, getThriftInt(element, 2))
+		}
+		logicalType := getThriftStruct(element, 10)
+		columns = append(columns, &parquetColumn{
+			name:       name,
+			kind:       getThriftInt(element, 1),
+			typeLength: getThriftInt(element, 2),
+			optional:   getThriftInt(element, 3) == parquetOptional,
+			date:       getThriftInt(element, 6) == parquetDate || getThriftStruct(logicalType, 6) != nil,
+		})
+	}
+	if int64(len(columns)) != getThriftInt(root, 5) {
+		return nil, fmt.Errorf("Parquet columns are nested, which is not supported")
+	}
+	return columns, nil
+}
+
+// Reads the pages of a column chunk until it has the values of every row of its row group. Every count in the headers
+// is checked against what is left of the chunk and the size of its page before anything is allocated for it.
+func (c *parquetColumn) readChunk(data []byte, metadata map[int16]interface{}, rowCount int64) error {
+	if metadata == nil {
+		return fmt.Errorf("column chunk has no metadata")
+	}
+	c.codec = getThriftInt(metadata, 4)
+	c.valuesCount = getThriftInt(metadata, 5)
+	c.dictionary = nil
+	if c.valuesCount != rowCount {
+		return fmt.Errorf("column has %d values, expected %d", c.valuesCount, rowCount)
+	}
+	offset := getThriftInt(metadata, 9)
+	if dictionaryOffset := getThriftInt(metadata, 11); dictionaryOffset > 0 && dictionaryOffset < offset {
+		offset = dictionaryOffset
+	}
+
+	for int64(len(c.values)) < c.valuesCount {
+		if offset < 0 || offset >= int64(len(data)) {
+			return fmt.Errorf("page is outside of the file")
+		}
+		reader := &thriftReader{data: data[offset:]}
+		pageHeader, err := reader.readStruct()
+		if err != nil {
+			return fmt.Errorf("error reading page header: %v", err)
+		}
+		pageStart := offset + int64(reader.pos)
+		pageSize := getThriftInt(pageHeader, 3)
+		if pageSize < 0 || pageSize > int64(len(data))-pageStart {
+			return fmt.Errorf("page is outside of the file")
+		}
+		page := data[pageStart : pageStart+pageSize]
+		offset = pageStart + pageSize
+
+		// Checks the number of values of a page against the values the chunk has left
+		remaining := c.valuesCount - int64(len(c.values))
+		checkCount := func(count int64) error {
+			if count < 0 || count > remaining || count > maxParquetPageValues {
+				return fmt.Errorf("page has %d values, expected at most %d", count, min(remaining, maxParquetPageValues))
+			}
+			return nil
+		}
+
+		switch getThriftInt(pageHeader, 1) {
+		case parquetDictionaryPage:
+			dictionaryHeader := getThriftStruct(pageHeader, 7)
+			count := getThriftInt(dictionaryHeader, 1)
+			if count < 0 || count > maxParquetPageValues {
+				return fmt.Errorf("dictionary page has %d values", count)
+			}
+			if page, err = c.decompress(page, getThriftInt(pageHeader, 2)); err != nil {
+				return err
+			}
+			if c.dictionary, err = c.decodePlain(page, int(count)); err != nil {
+				return err
+			}
+		case parquetDataPage:
+			if page, err = c.decompress(page, getThriftInt(pageHeader, 2)); err != nil {
+				return err
+			}
+			dataHeader := getThriftStruct(pageHeader, 5)
+			count := getThriftInt(dataHeader, 1)
+			if err := checkCount(count); err != nil {
+				return err
+			}
+			levels := make([]int, count)
+			if c.optional {
+				if len(page) < 4 {
+					return fmt.Errorf("data page is too short")
+				}
+				length := int(binary.LittleEndian.Uint32(page))
+				if 4+length > len(page) {
+					return fmt.Errorf("data page is too short")
+				}
+				if levels, err = decodeRLEHybrid(page[4:4+length], 1, int(count)); err != nil {
+					return err
+				}
+				page = page[4+length:]
+			}
+			if err := c.readValues(page, getThriftInt(dataHeader, 2), levels); err != nil {
+				return err
+			}
+		case parquetDataPageV2:
+			dataHeader := getThriftStruct(pageHeader, 8)
+			count := getThriftInt(dataHeader, 1)
+			if err := checkCount(count); err != nil {
+				return err
+			}
+			repetitionLength := getThriftInt(dataHeader, 6)
+			definitionLength := getThriftInt(dataHeader, 5)
+			if repetitionLength < 0 || definitionLength < 0 || repetitionLength+definitionLength > int64(len(page)) {
+				return fmt.Errorf("data page is too short")
+			}
+			levels := make([]int, count)
+			if c.optional {
+				if levels, err = decodeRLEHybrid(page[repetitionLength:repetitionLength+definitionLength], 1, int(count)); err != nil {
+					return err
+				}
+			}
+			values := page[repetitionLength+definitionLength:]
+			if compressed, exists := dataHeader[7].(bool); !exists || compressed {
+				uncompressedSize := getThriftInt(pageHeader, 2) - repetitionLength - definitionLength
+				if values, err = c.decompress(values, uncompressedSize); err != nil {
+					return err
+				}
+			}
+			if err := c.readValues(values, getThriftInt(dataHeader, 4), levels); err != nil {
+				return err
+			}
+		}
+	}
+
+	if int64(len(c.values)) != rowCount {
+		return fmt.Errorf("column has %d values, expected %d", len(c.values), rowCount)
+	}
+	return nil
+}
+
+// Decodes the values of a data page, where values with a definition level of zero are null
+func (c *parquetColumn) readValues(data []byte, encoding int64, levels []int) error {
+	count := len(levels)
+	if c.optional {
+		count = 0
+		for _, level := range levels {
+			count += level
+		}
+	}
+
+	var values []string
+	var err error
+	switch encoding {
+	case parquetPlain:
+		values, err = c.decodePlain(data, count)
+	case parquetPlainDictionary, parquetRLEDictionary:
+		if len(data) == 0 {
+			if count > 0 {
+				return fmt.Errorf("data page is too short")
+			}
+			break
+		}
+		var indexes []int
+		if indexes, err = decodeRLEHybrid(data[1:], int(data[0]), count); err != nil {
+			return err
+		}
+		values = make([]string, count)
+		for index, dictionaryIndex := range indexes {
+			if dictionaryIndex >= len(c.dictionary) {
+				return fmt.Errorf("dictionary index %d is out of range", dictionaryIndex)
+			}
+			values[index] = c.dictionary[dictionaryIndex]
+		}
+	case parquetRLE:
+		if c.kind != parquetBoolean || len(data) < 4 {
+			return fmt.Errorf("unsupported encoding %d", encoding)
+		}
+		var bits []int
+		if bits, err = decodeRLEHybrid(data[4:], 1, count); err != nil {
+			return err
+		}
+		values = make([]string, count)
+		for index, bit := range bits {
+			values[index] = strconv.FormatBool(bit == 1)
+		}
+	default:
+		return fmt.Errorf("unsupported encoding %d", encoding)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Put the nulls back between the values
+	next := 0
+	for _, level := range levels {
+		if c.optional && level == 0 {
+			c.values = append(c.values, "")
+			continue
+		}
+		c.values = append(c.values, values[next])
+		next++
+	}
+	return nil
+}
+
+// Decodes a number of plain encoded values
+func (c *parquetColumn) decodePlain(data []byte, count int) ([]string, error) {
+	tooShort := fmt.Errorf("page is too short for %d values", count)
+
+	// Check that the page can have that many values before making room for them
+	sizes := map[int64]int{parquetInt32: 4, parquetInt64: 8, parquetInt96: 12, parquetFloat: 4, parquetDouble: 8, parquetByteArray: 4}
+	switch size, exists := sizes[c.kind]; {
+	case exists && count > len(data)/size:
+		return nil, tooShort
+	case c.kind == parquetBoolean && count > len(data)*8:
+		return nil, tooShort
+	case c.kind == parquetFixedLenByteArray && c.typeLength > 0 && int64(count) > int64(len(data))/c.typeLength:
+		return nil, tooShort
+	}
+	values := make([]string, 0, count)
+	for index := 0; index < count; index++ {
+		switch c.kind {
+		case parquetBoolean:
+			if index/8 >= len(data) {
+				return nil, tooShort
+			}
+			values = append(values, strconv.FormatBool(data[index/8]>>(index%8)&1 == 1))
+		case parquetInt32:
+			if len(data) < 4 {
+				return nil, tooShort
+			}
+			value := int32(binary.LittleEndian.Uint32(data))
+			if c.date {
+				values = append(values, time.Unix(int64(value)*24*60*60, 0).UTC().Format("2006-01-02"))
+			} else {
+				values = append(values, strconv.FormatInt(int64(value), 10))
+			}
+			data = data[4:]
+		case parquetInt64:
+			if len(data) < 8 {
+				return nil, tooShort
+			}
+			values = append(values, strconv.FormatInt(int64(binary.LittleEndian.Uint64(data)), 10))
+			data = data[8:]
+		case parquetInt96:
+			// Legacy timestamps are the nanoseconds of the day followed by the Julian day
+			if len(data) < 12 {
+				return nil, tooShort
+			}
+			nanoseconds := int64(binary.LittleEndian.Uint64(data))
+			days := int64(binary.LittleEndian.Uint32(data[8:])) - 2440588
+			values = append(values, time.Unix(days*24*60*60, nanoseconds).UTC().Format(time.RFC3339Nano))
+			data = data[12:]
+		case parquetFloat:
+			if len(data) < 4 {
+				return nil, tooShort
+			}
+			values = append(values, strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(data))), 'g', -1, 32))
+			data = data[4:]
+		case parquetDouble:
+			if len(data) < 8 {
+				return nil, tooShort
+			}
+			values = append(values, strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(data)), 'g', -1, 64))
+			data = data[8:]
+		case parquetByteArray:
+			if len(data) < 4 {
+				return nil, tooShort
+			}
+			length := int(binary.LittleEndian.Uint32(data))
+			if length > len(data)-4 {
+				return nil, tooShort
+			}
+			values = append(values, string(data[4:4+length]))
+			data = data[4+length:]
+		case parquetFixedLenByteArray:
+			length := int(c.typeLength)
+			if length > len(data) {
+				return nil, tooShort
+			}
+			values = append(values, string(data[:length]))
+			data = data[length:]
+		default:
+			return nil, fmt.Errorf("unsupported type %d", c.kind)
+		}
+	}
+	return values, nil
+}
+
+// Decompresses a page with the codec of the column
+func (c *parquetColumn) decompress(data []byte, uncompressedSize int64) ([]byte, error) {
+	if uncompressedSize < 0 {
+		return nil, fmt.Errorf("page has an uncompressed size of %d", uncompressedSize)
+	}
+	switch c.codec {
+	case parquetUncompressed:
+		return data, nil
+	case parquetSnappy:
+		return decodeSnappy(data)
+	case parquetGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(io.LimitReader(reader, uncompressedSize))
+	default:
+		return nil, fmt.Errorf("unsupported compression codec %d, only uncompressed, snappy and gzip pages can be read", c.codec)
+	}
+}
+
+// Decodes a number of values of a bit width from the run length encoding and bit packing hybrid that Parquet uses for
+// levels and dictionary indexes
+func decodeRLEHybrid(data []byte, bitWidth int, count int) ([]int, error) {
+	if bitWidth < 0 || bitWidth > 32 {
+		return nil, fmt.Errorf("invalid bit width %d", bitWidth)
+	}
+	if count < 0 {
+		return nil, fmt.Errorf("invalid value count %d", count)
+	}
+	values := make([]int, 0, count)
+	byteWidth := (bitWidth + 7) / 8
+	position := 0
+	for len(values) < count {
+		header, size := binary.Uvarint(data[position:])
+		if size <= 0 {
+			return nil, fmt.Errorf("invalid run header")
+		}
+		position += size
+
+		if header&1 == 0 {
+			// A run of the same value repeated
+			if position+byteWidth > len(data) {
+				return nil, fmt.Errorf("run is too short")
+			}
+			value := 0
+			for index := 0; index < byteWidth; index++ {
+				value |= int(data[position+index]) << (8 * index)
+			}
+			position += byteWidth
+			for run := uint64(0); run < header>>1 && len(values) < count; run++ {
+				values = append(values, value)
+			}
+			continue
+		}
+
+		// Groups of 8 values packed from the least significant bit, where a run without values can only be as long as
+		// the values left to read
+		if bitWidth > 0 && header>>1 > uint64(len(data)-position)/uint64(bitWidth) {
+			return nil, fmt.Errorf("bit packed run is too short")
+		}
+		groupCount := int(min(header>>1, uint64(count)))
+		packed := data[position : position+groupCount*bitWidth]
+		position += groupCount * bitWidth
+		for index := 0; index < groupCount*8 && len(values) < count; index++ {
+			value := 0
+			for bit := 0; bit < bitWidth; bit++ {
+				offset := index*bitWidth + bit
+				value |= int(packed[offset/8]>>(offset%8)&1) << bit
+			}
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// Decodes a block of snappy compressed data
+func decodeSnappy(data []byte) ([]byte, error) {
+	length, size := binary.Uvarint(data)
+	if size <= 0 || length > 1<<31 {
+		return nil, fmt.Errorf("invalid snappy length")
+	}
+
+	// Only make room for as much as the data can decode to, since a copy of at most 64 bytes takes at least 2 bytes
+	decoded := make([]byte, 0, min(length, uint64(len(data))*32))
+	for position := size; position < len(data); {
+		tag := data[position]
+		position++
+
+		var literalLength, copyLength, offset int
+		switch tag & 3 {
+		case 0:
+			literalLength = int(tag>>2) + 1
+			if extraBytes := literalLength - 60; extraBytes > 0 {
+				if position+extraBytes > len(data) {
+					return nil, fmt.Errorf("invalid snappy literal")
+				}
+				literalLength = 0
+				for index := 0; index < extraBytes; index++ {
+					literalLength |= int(data[position+index]) << (8 * index)
+				}
+				literalLength++
+				position += extraBytes
+			}
+			if position+literalLength > len(data) || uint64(len(decoded)+literalLength) > length {
+				return nil, fmt.Errorf("invalid snappy literal")
+			}
+			decoded = append(decoded, data[position:position+literalLength]...)
+			position += literalLength
+			continue
+		case 1:
+			if position >= len(data) {
+				return nil, fmt.Errorf("invalid snappy copy")
+			}
+			copyLength = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(data[position])
+			position++
+		case 2:
+			if position+2 > len(data) {
+				return nil, fmt.Errorf("invalid snappy copy")
+			}
+			copyLength = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(data[position:]))
+			position += 2
+		case 3:
+			if position+4 > len(data) {
+				return nil, fmt.Errorf("invalid snappy copy")
+			}
+			copyLength = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint32(data[position:]))
+			position += 4
+		}
+		if offset <= 0 || offset > len(decoded) {
+			return nil, fmt.Errorf("invalid snappy copy offset")
+		}
+		if uint64(len(decoded)+copyLength) > length {
+			return nil, fmt.Errorf("invalid snappy copy")
+		}
+		// Copy a byte at a time since the copy can overlap what it is copying
+		start := len(decoded) - offset
+		for index := 0; index < copyLength; index++ {
+			decoded = append(decoded, decoded[start+index])
+		}
+	}
+	if len(decoded) != int(length) {
+		return nil, fmt.Errorf("snappy data is %d bytes, expected %d", len(decoded), length)
+	}
+	return decoded, nil
+}
+
+// Reads the Thrift compact protocol that Parquet metadata is written in, where structs are read as maps of field IDs
+// to values so the fields that aren't needed can be skipped
+type thriftReader struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+// Defines the Thrift compact protocol types
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftMap    = 11
+	thriftStruct = 12
+)
+
+// Reads a struct
+func (r *thriftReader) readStruct() (map[int16]interface{}, error) {
+	fields := make(map[int16]interface{})
+	var id int16
+	for {
+		header, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if header == 0 {
+			return fields, nil
+		}
+		if delta := header >> 4; delta != 0 {
+			id += int16(delta)
+		} else {
+			value, err := r.readVarint()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(zigzag(value))
+		}
+
+		kind := header & 0x0f
+		switch kind {
+		case thriftTrue, thriftFalse:
+			fields[id] = kind == thriftTrue
+		default:
+			if fields[id], err = r.readValue(kind); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Reads a value of a type
+func (r *thriftReader) readValue(kind byte) (interface{}, error) {
+	if kind == thriftList || kind == thriftSet || kind == thriftMap || kind == thriftStruct {
+		if r.depth == maxThriftDepth {
+			return nil, fmt.Errorf("Thrift values are nested too deeply")
+		}
+		r.depth++
+		defer func() { r.depth-- }()
+	}
+
+	switch kind {
+	case thriftTrue, thriftFalse:
+		value, err := r.readByte()
+		return value == thriftTrue, err
+	case thriftByte:
+		value, err := r.readByte()
+		return int64(int8(value)), err
+	case thriftI16, thriftI32, thriftI64:
+		value, err := r.readVarint()
+		return zigzag(value), err
+	case thriftDouble:
+		if r.pos+8 > len(r.data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		value := math.Float64frombits(binary.LittleEndian.Uint64(r.data[r.pos:]))
+		r.pos += 8
+		return value, nil
+	case thriftBinary:
+		length, err := r.readVarint()
+		if err != nil {
+			return nil, err
+		}
+		if length > uint64(len(r.data)-r.pos) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		value := r.data[r.pos : r.pos+int(length)]
+		r.pos += int(length)
+		return value, nil
+	case thriftList, thriftSet:
+		header, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = r.readVarint(); err != nil {
+				return nil, err
+			}
+		}
+		if size > uint64(len(r.data)-r.pos) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		items := make([]interface{}, size)
+		for index := range items {
+			if items[index], err = r.readValue(header & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case thriftMap:
+		size, err := r.readVarint()
+		if err != nil || size == 0 {
+			return map[interface{}]interface{}{}, err
+		}
+		if size > uint64(len(r.data)-r.pos) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		kinds, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[interface{}]interface{}, size)
+		for index := uint64(0); index < size; index++ {
+			key, err := r.readValue(kinds >> 4)
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.readValue(kinds & 0x0f)
+			if err != nil {
+				return nil, err
+			}
+			entries[fmt.Sprint(key)] = value
+		}
+		return entries, nil
+	case thriftStruct:
+		return r.readStruct()
+	default:
+		return nil, fmt.Errorf("unknown Thrift type %d", kind)
+	}
+}
+
+// Reads a byte
+func (r *thriftReader) readByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	value := r.data[r.pos]
+	r.pos++
+	return value, nil
+}
+
+// Reads an unsigned variable length integer
+func (r *thriftReader) readVarint() (uint64, error) {
+	value, size := binary.Uvarint(r.data[r.pos:])
+	if size <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.pos += size
+	return value, nil
+}
+
+// Returns the signed integer of a zigzag encoded integer
+func zigzag(value uint64) int64 {
+	return int64(value>>1) ^ -int64(value&1)
+}
+
+// Returns an integer field of a Thrift struct, or zero if it isn't set
+func getThriftInt(fields map[int16]interface{}, id int16) int64 {
+	value, _ := fields[id].(int64)
+	return value
+}
+
+// Returns a binary field of a Thrift struct, or nil if it isn't set
+func getThriftBytes(fields map[int16]interface{}, id int16) []byte {
+	value, _ := fields[id].([]byte)
+	return value
+}
+
+// Returns a list field of a Thrift struct, or nil if it isn't set
+func getThriftList(fields map[int16]interface{}, id int16) []interface{} {
+	value, _ := fields[id].([]interface{})
+	return value
+}
+
+// Returns a struct field of a Thrift struct, or nil if it isn't set
+func getThriftStruct(fields map[int16]interface{}, id int16) map[int16]interface{} {
+	value, _ := fields[id].(map[int16]interface{})
+	return value
+}
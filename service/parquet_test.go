@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Defines a field of a Thrift struct written by the test Parquet writer
+type testThriftField struct {
+	id    int16
+	value interface{}
+}
+
+// Defines a Thrift list with the type of its items
+type testThriftList struct {
+	kind  byte
+	items []interface{}
+}
+
+// Writes a Thrift struct in the compact protocol
+func writeTestThriftStruct(buffer *bytes.Buffer, fields []testThriftField) {
+	var lastID int16
+	for _, field := range fields {
+		kind := getTestThriftType(field.value)
+		if value, isBool := field.value.(bool); isBool && !value {
+			kind = thriftFalse
+		}
+		if delta := field.id - lastID; delta > 0 && delta <= 15 {
+			buffer.WriteByte(byte(delta)<<4 | kind)
+		} else {
+			buffer.WriteByte(kind)
+			buffer.Write(binary.AppendUvarint(nil, uint64(field.id)<<1^uint64(field.id>>15)))
+		}
+		lastID = field.id
+		if kind != thriftTrue && kind != thriftFalse {
+			writeTestThriftValue(buffer, field.value)
+		}
+	}
+	buffer.WriteByte(0)
+}
+
+// Returns the compact protocol type of a value
+func getTestThriftType(value interface{}) byte {
+	switch value.(type) {
+	case bool:
+		return thriftTrue
+	case int32:
+		return thriftI32
+	case int64:
+		return thriftI64
+	case string:
+		return thriftBinary
+	case testThriftList:
+		return thriftList
+	default:
+		return thriftStruct
+	}
+}
+
+// Writes a value in the compact protocol
+func writeTestThriftValue(buffer *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case int32:
+		buffer.Write(binary.AppendVarint(nil, int64(v)))
+	case int64:
+		buffer.Write(binary.AppendVarint(nil, v))
+	case string:
+		buffer.Write(binary.AppendUvarint(nil, uint64(len(v))))
+		buffer.WriteString(v)
+	case testThriftList:
+		if len(v.items) < 15 {
+			buffer.WriteByte(byte(len(v.items))<<4 | v.kind)
+		} else {
+			buffer.WriteByte(0xf0 | v.kind)
+			buffer.Write(binary.AppendUvarint(nil, uint64(len(v.items))))
+		}
+		for _, item := range v.items {
+			writeTestThriftValue(buffer, item)
+		}
+	case []testThriftField:
+		writeTestThriftStruct(buffer, v)
+	}
+}
+
+// Defines a column written by the test Parquet writer, where nil values are null
+type testParquetColumn struct {
+	name       string
+	kind       int32
+	optional   bool
+	date       bool
+	dictionary bool
+	pageV2     bool
+	codec      int32
+	values     []interface{}
+	// Changes the fields of each page header before it is written, to write corrupted pages
+	corruptPage func(header []testThriftField)
+}
+
+// Writes a Parquet file with row groups of a number of rows and returns its path. The file has the extra metadata that
+// pyarrow and Spark write, such as the Arrow schema, statistics and logical types, which must be skipped when read.
+func writeTestParquet(t *testing.T, columns []testParquetColumn, rowGroupSize int) string {
+	t.Helper()
+	var file bytes.Buffer
+	file.WriteString(parquetMagic)
+
+	rowCount := len(columns[0].values)
+	var rowGroups []interface{}
+	for start := 0; start < rowCount; start += rowGroupSize {
+		end := min(start+rowGroupSize, rowCount)
+		var chunks []interface{}
+		for _, column := range columns {
+			chunks = append(chunks, writeTestParquetChunk(&file, column, column.values[start:end]))
+		}
+		rowGroups = append(rowGroups, []testThriftField{
+			{1, testThriftList{thriftStruct, chunks}},
+			{2, int64(0)},
+			{3, int64(end - start)},
+		})
+	}
+
+	schema := []interface{}{[]testThriftField{{4, "schema"}, {5, int32(len(columns))}}}
+	for _, column := range columns {
+		repetition := int32(0)
+		if column.optional {
+			repetition = parquetOptional
+		}
+		element := []testThriftField{{1, column.kind}, {3, repetition}, {4, column.name}}
+		switch {
+		case column.date:
+			element = append(element, testThriftField{6, int32(parquetDate)}, testThriftField{10, []testThriftField{{6, []testThriftField{}}}})
+		case column.kind == parquetByteArray:
+			element = append(element, testThriftField{6, int32(0)}, testThriftField{10, []testThriftField{{1, []testThriftField{}}}})
+		}
+		schema = append(schema, element)
+	}
+	return writeTestParquetFile(t, file.Bytes(), []testThriftField{
+		{1, int32(2)},
+		{2, testThriftList{thriftStruct, schema}},
+		{3, int64(rowCount)},
+		{4, testThriftList{thriftStruct, rowGroups}},
+		{5, testThriftList{thriftStruct, []interface{}{[]testThriftField{{1, "ARROW:schema"}, {2, "/////7AAAAAQAAAAAAAKAA4ABgAFAAgACgAAAAABBAA="}}}}},
+		{6, "parquet-cpp-arrow version 17.0.0"},
+	})
+}
+
+// Writes the magic bytes and column chunks followed by a footer with the file metadata and returns the path of the file
+func writeTestParquetFile(t *testing.T, chunks []byte, metadata []testThriftField) string {
+	t.Helper()
+	var file bytes.Buffer
+	file.Write(chunks)
+	var footer bytes.Buffer
+	writeTestThriftStruct(&footer, metadata)
+	file.Write(footer.Bytes())
+	file.Write(binary.LittleEndian.AppendUint32(nil, uint32(footer.Len())))
+	file.WriteString(parquetMagic)
+
+	path := filepath.Join(t.TempDir(), "input.parquet")
+	if err := os.WriteFile(path, file.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Writes the pages of a column chunk and returns its column chunk metadata
+func writeTestParquetChunk(file *bytes.Buffer, column testParquetColumn, values []interface{}) []testThriftField {
+	var levels []int
+	var present []interface{}
+	for _, value := range values {
+		if value == nil {
+			levels = append(levels, 0)
+			continue
+		}
+		levels = append(levels, 1)
+		present = append(present, value)
+	}
+
+	metadata := []testThriftField{
+		{1, column.kind},
+		{2, testThriftList{thriftI32, []interface{}{int32(parquetPlain), int32(parquetRLE)}}},
+		{3, testThriftList{thriftBinary, []interface{}{column.name}}},
+		{4, column.codec},
+		{5, int64(len(values))},
+		{6, int64(0)},
+		{7, int64(0)},
+	}
+	statistics := []testThriftField{{3, int64(len(values) - len(present))}}
+
+	// Write the values to a dictionary page followed by their indexes, or as plain values
+	encoding := int32(parquetPlain)
+	encoded := encodeTestParquetPlain(column.kind, present)
+	var dictionaryOffset int64
+	if column.dictionary {
+		var dictionary []interface{}
+		indexes := make([]int, len(present))
+		for valueIndex, value := range present {
+			indexes[valueIndex] = -1
+			for dictionaryIndex, entry := range dictionary {
+				if entry == value {
+					indexes[valueIndex] = dictionaryIndex
+				}
+			}
+			if indexes[valueIndex] < 0 {
+				indexes[valueIndex] = len(dictionary)
+				dictionary = append(dictionary, value)
+			}
+		}
+		dictionaryOffset = int64(file.Len())
+		page := encodeTestParquetPlain(column.kind, dictionary)
+		compressed := compressTestParquet(column.codec, page)
+		writeTestParquetPageHeader(file, column, []testThriftField{
+			{1, int32(parquetDictionaryPage)},
+			{2, int32(len(page))},
+			{3, int32(len(compressed))},
+			{7, []testThriftField{{1, int32(len(dictionary))}, {2, int32(parquetPlain)}}},
+		})
+		file.Write(compressed)
+
+		bitWidth := 0
+		for 1<<bitWidth < len(dictionary) {
+			bitWidth++
+		}
+		encoding = parquetRLEDictionary
+		encoded = append([]byte{byte(bitWidth)}, encodeTestRLEHybrid(indexes, bitWidth)...)
+	}
+
+	dataOffset := int64(file.Len())
+	var definitionLevels []byte
+	if column.optional {
+		definitionLevels = encodeTestRLEHybrid(levels, 1)
+	}
+	if column.pageV2 {
+		compressed := compressTestParquet(column.codec, encoded)
+		writeTestParquetPageHeader(file, column, []testThriftField{
+			{1, int32(parquetDataPageV2)},
+			{2, int32(len(definitionLevels) + len(encoded))},
+			{3, int32(len(definitionLevels) + len(compressed))},
+			{8, []testThriftField{
+				{1, int32(len(values))},
+				{2, int32(len(values) - len(present))},
+				{3, int32(len(values))},
+				{4, encoding},
+				{5, int32(len(definitionLevels))},
+				{6, int32(0)},
+				{8, statistics},
+			}},
+		})
+		file.Write(definitionLevels)
+		file.Write(compressed)
+	} else {
+		var page []byte
+		if column.optional {
+			page = binary.LittleEndian.AppendUint32(page, uint32(len(definitionLevels)))
+			page = append(page, definitionLevels...)
+		}
+		page = append(page, encoded...)
+		compressed := compressTestParquet(column.codec, page)
+		writeTestParquetPageHeader(file, column, []testThriftField{
+			{1, int32(parquetDataPage)},
+			{2, int32(len(page))},
+			{3, int32(len(compressed))},
+			{5, []testThriftField{{1, int32(len(values))}, {2, encoding}, {3, int32(parquetRLE)}, {4, int32(parquetRLE)}, {5, statistics}}},
+		})
+		file.Write(compressed)
+	}
+
+	metadata = append(metadata, testThriftField{9, dataOffset})
+	if column.dictionary {
+		metadata = append(metadata, testThriftField{11, dictionaryOffset})
+	}
+	metadata = append(metadata, testThriftField{12, statistics})
+	return []testThriftField{{2, int64(0)}, {3, metadata}}
+}
+
+// Writes the header of a page, corrupting it first if the column corrupts its pages
+func writeTestParquetPageHeader(file *bytes.Buffer, column testParquetColumn, header []testThriftField) {
+	if column.corruptPage != nil {
+		column.corruptPage(header)
+	}
+	writeTestThriftStruct(file, header)
+}
+
+// Returns a function that sets a field of a page header, following the IDs of the structs the field is in, for pages
+// of a type
+func setTestPageField(pageType int32, value interface{}, ids ...int16) func(header []testThriftField) {
+	return func(header []testThriftField) {
+		if header[0].value != pageType {
+			return
+		}
+		fields := header
+		for index, id := range ids {
+			for field := range fields {
+				if fields[field].id != id {
+					continue
+				}
+				if index == len(ids)-1 {
+					fields[field].value = value
+				} else {
+					fields = fields[field].value.([]testThriftField)
+				}
+				break
+			}
+		}
+	}
+}
+
+// Encodes values as plain Parquet values of a type
+func encodeTestParquetPlain(kind int32, values []interface{}) []byte {
+	var encoded []byte
+	switch kind {
+	case parquetBoolean:
+		encoded = make([]byte, (len(values)+7)/8)
+		for index, value := range values {
+			if value.(bool) {
+				encoded[index/8] |= 1 << (index % 8)
+			}
+		}
+	case parquetInt32:
+		for _, value := range values {
+			encoded = binary.LittleEndian.AppendUint32(encoded, uint32(value.(int32)))
+		}
+	case parquetInt64:
+		for _, value := range values {
+			encoded = binary.LittleEndian.AppendUint64(encoded, uint64(value.(int64)))
+		}
+	case parquetDouble:
+		for _, value := range values {
+			encoded = binary.LittleEndian.AppendUint64(encoded, math.Float64bits(value.(float64)))
+		}
+	case parquetByteArray:
+		for _, value := range values {
+			encoded = binary.LittleEndian.AppendUint32(encoded, uint32(len(value.(string))))
+			encoded = append(encoded, value.(string)...)
+		}
+	}
+	return encoded
+}
+
+// Encodes values as bit packed groups of 8
+func encodeTestRLEHybrid(values []int, bitWidth int) []byte {
+	groupCount := (len(values) + 7) / 8
+	encoded := binary.AppendUvarint(nil, uint64(groupCount)<<1|1)
+	packed := make([]byte, groupCount*bitWidth)
+	for index, value := range values {
+		for bit := 0; bit < bitWidth; bit++ {
+			offset := index*bitWidth + bit
+			packed[offset/8] |= byte(value>>bit&1) << (offset % 8)
+		}
+	}
+	return append(encoded, packed...)
+}
+
+// Compresses a page with a codec, writing snappy as literals
+func compressTestParquet(codec int32, page []byte) []byte {
+	switch codec {
+	case parquetSnappy:
+		compressed := binary.AppendUvarint(nil, uint64(len(page)))
+		for start := 0; start < len(page); start += 60 {
+			end := min(start+60, len(page))
+			compressed = append(compressed, byte(end-start-1)<<2)
+			compressed = append(compressed, page[start:end]...)
+		}
+		return compressed
+	case parquetGzip:
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(page)
+		writer.Close()
+		return compressed.Bytes()
+	default:
+		return page
+	}
+}
+
+func TestReadParquet(t *testing.T) {
+	longText := strings.Repeat("a long review ", 10)
+	tests := []struct {
+		name         string
+		columns      []testParquetColumn
+		rowGroupSize int
+		header       []string
+		rows         [][]string
+	}{
+		{
+			name: "plain values with nulls",
+			columns: []testParquetColumn{
+				{name: "id", kind: parquetInt64, values: []interface{}{int64(1), int64(2), int64(3)}},
+				{name: "review", kind: parquetByteArray, optional: true, values: []interface{}{"great", nil, longText}},
+				{name: "rating", kind: parquetDouble, optional: true, values: []interface{}{4.5, 1.0, nil}},
+				{name: "verified", kind: parquetBoolean, values: []interface{}{true, false, true}},
+			},
+			rowGroupSize: 3,
+			header:       []string{"id", "review", "rating", "verified"},
+			rows:         [][]string{{"1", "great", "4.5", "true"}, {"2", "", "1", "false"}, {"3", longText, "", "true"}},
+		},
+		{
+			name: "dictionary values compressed with snappy",
+			columns: []testParquetColumn{
+				{name: "store", kind: parquetByteArray, dictionary: true, codec: parquetSnappy, values: []interface{}{"Main Street", "Market", "Main Street", "Corner"}},
+				{name: "review", kind: parquetByteArray, codec: parquetSnappy, values: []interface{}{longText, "b", "c", "d"}},
+			},
+			rowGroupSize: 4,
+			header:       []string{"store", "review"},
+			rows:         [][]string{{"Main Street", longText}, {"Market", "b"}, {"Main Street", "c"}, {"Corner", "d"}},
+		},
+		{
+			name: "version 2 data pages compressed with gzip",
+			columns: []testParquetColumn{
+				{name: "review", kind: parquetByteArray, optional: true, pageV2: true, codec: parquetGzip, values: []interface{}{nil, "good", "bad"}},
+				{name: "tag", kind: parquetByteArray, optional: true, pageV2: true, dictionary: true, codec: parquetGzip, values: []interface{}{"x", nil, "x"}},
+			},
+			rowGroupSize: 3,
+			header:       []string{"review", "tag"},
+			rows:         [][]string{{"", "x"}, {"good", ""}, {"bad", "x"}},
+		},
+		{
+			name: "row groups and dates",
+			columns: []testParquetColumn{
+				{name: "day", kind: parquetInt32, date: true, values: []interface{}{int32(0), int32(19000), int32(-1)}},
+				{name: "count", kind: parquetInt32, optional: true, values: []interface{}{int32(-7), nil, int32(9)}},
+			},
+			rowGroupSize: 2,
+			header:       []string{"day", "count"},
+			rows:         [][]string{{"1970-01-01", "-7"}, {"2022-01-08", ""}, {"1969-12-31", "9"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeTestParquet(t, test.columns, test.rowGroupSize)
+			header, rows, err := readParquet(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(header, test.header) {
+				t.Errorf("got header %v, want %v", header, test.header)
+			}
+			if !reflect.DeepEqual(rows, test.rows) {
+				t.Errorf("got rows %q, want %q", rows, test.rows)
+			}
+		})
+	}
+}
+
+func TestReadParquetErrors(t *testing.T) {
+	notParquet := filepath.Join(t.TempDir(), "input.parquet")
+	os.WriteFile(notParquet, []byte("id,review\n1,great\n"), 0644)
+	schema := testThriftList{thriftStruct, []interface{}{
+		[]testThriftField{{4, "schema"}, {5, int32(1)}},
+		[]testThriftField{{1, int32(parquetByteArray)}, {3, int32(0)}, {4, "review"}},
+	}}
+	nested := interface{}([]testThriftField{})
+	for depth := 0; depth < 1000; depth++ {
+		nested = testThriftList{thriftList, []interface{}{nested}}
+	}
+	reviews := func(column testParquetColumn) string {
+		column.name = "review"
+		column.kind = parquetByteArray
+		column.values = []interface{}{"great", "bad"}
+		return writeTestParquet(t, []testParquetColumn{column}, 2)
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		error string
+	}{
+		{
+			name:  "not a Parquet file",
+			path:  notParquet,
+			error: "not a Parquet file",
+		},
+		{
+			name: "unsupported compression",
+			path: writeTestParquet(t, []testParquetColumn{
+				{name: "review", kind: parquetByteArray, codec: 6, values: []interface{}{"great"}},
+			}, 1),
+			error: "unsupported compression codec 6",
+		},
+		{
+			name:  "schema that isn't a struct",
+			path:  writeTestParquetFile(t, []byte(parquetMagic), []testThriftField{{2, testThriftList{thriftI32, []interface{}{int32(1)}}}}),
+			error: "invalid Parquet schema",
+		},
+		{
+			name:  "row group that isn't a struct",
+			path:  writeTestParquetFile(t, []byte(parquetMagic), []testThriftField{{2, schema}, {4, testThriftList{thriftI32, []interface{}{int32(1)}}}}),
+			error: "invalid Parquet row group",
+		},
+		{
+			name:  "column chunk that isn't a struct",
+			path:  writeTestParquetFile(t, []byte(parquetMagic), []testThriftField{{2, schema}, {4, testThriftList{thriftStruct, []interface{}{[]testThriftField{{1, testThriftList{thriftI32, []interface{}{int32(1)}}}}}}}}),
+			error: "invalid Parquet column chunk",
+		},
+		{
+			name:  "negative row count",
+			path:  writeTestParquetFile(t, []byte(parquetMagic), []testThriftField{{2, schema}, {4, testThriftList{thriftStruct, []interface{}{[]testThriftField{{1, testThriftList{thriftStruct, []interface{}{[]testThriftField{}}}}, {3, int64(-1)}}}}}}),
+			error: "Parquet row group has -1 rows",
+		},
+		{
+			name:  "structs nested too deeply",
+			path:  writeTestParquetFile(t, []byte(parquetMagic), []testThriftField{{2, nested}}),
+			error: "nested too deeply",
+		},
+		{
+			name:  "negative value count",
+			path:  reviews(testParquetColumn{corruptPage: setTestPageField(parquetDataPage, int32(-1), 5, 1)}),
+			error: "page has -1 values",
+		},
+		{
+			name:  "more values than the chunk",
+			path:  reviews(testParquetColumn{corruptPage: setTestPageField(parquetDataPage, int32(1<<30), 5, 1)}),
+			error: "page has 1073741824 values, expected at most 2",
+		},
+		{
+			name:  "more values than the page has room for",
+			path:  reviews(testParquetColumn{corruptPage: setTestPageField(parquetDictionaryPage, int32(maxParquetPageValues), 7, 1), dictionary: true}),
+			error: "page is too short for 4194304 values",
+		},
+		{
+			name:  "huge dictionary",
+			path:  reviews(testParquetColumn{corruptPage: setTestPageField(parquetDictionaryPage, int32(1<<30), 7, 1), dictionary: true}),
+			error: "dictionary page has 1073741824 values",
+		},
+		{
+			name:  "dictionary longer than its page",
+			path:  reviews(testParquetColumn{corruptPage: setTestPageField(parquetDictionaryPage, int32(1000), 7, 1), dictionary: true}),
+			error: "page is too short for 1000 values",
+		},
+		{
+			name:  "negative page size",
+			path:  reviews(testParquetColumn{corruptPage: setTestPageField(parquetDataPage, int32(-100), 3)}),
+			error: "page is outside of the file",
+		},
+		{
+			name:  "negative uncompressed size",
+			path:  reviews(testParquetColumn{corruptPage: setTestPageField(parquetDataPage, int32(-1), 2), codec: parquetGzip}),
+			error: "page has an uncompressed size of -1",
+		},
+		{
+			name:  "negative definition levels length",
+			path:  reviews(testParquetColumn{corruptPage: setTestPageField(parquetDataPageV2, int32(-4), 8, 5), pageV2: true, optional: true}),
+			error: "data page is too short",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := readParquet(test.path)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("got error %v, want it to contain %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestReadParquetCorrupted(t *testing.T) {
+	valid, err := os.ReadFile(writeTestParquet(t, []testParquetColumn{
+		{name: "id", kind: parquetInt64, values: []interface{}{int64(1), int64(2), int64(3)}},
+		{name: "store", kind: parquetByteArray, optional: true, dictionary: true, codec: parquetSnappy, values: []interface{}{"Main Street", nil, "Main Street"}},
+		{name: "review", kind: parquetByteArray, optional: true, pageV2: true, codec: parquetGzip, values: []interface{}{"great", "bad", nil}},
+		{name: "day", kind: parquetInt32, date: true, values: []interface{}{int32(0), int32(19000), int32(-1)}},
+	}, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every byte of the file is changed in turn, which must be read or fail with an error but never panic
+	path := filepath.Join(t.TempDir(), "corrupted.parquet")
+	for index := range valid {
+		for _, change := range []byte{0xff, 0x80, 0x01} {
+			corrupted := bytes.Clone(valid)
+			corrupted[index] ^= change
+			if err := os.WriteFile(path, corrupted, 0644); err != nil {
+				t.Fatal(err)
+			}
+			func() {
+				defer func() {
+					if recovered := recover(); recovered != nil {
+						t.Errorf("got a panic reading the file with byte %d changed by %#x: %v", index, change, recovered)
+					}
+				}()
+				readParquet(path)
+			}()
+		}
+	}
+}
+
+func TestDecodeRLEHybrid(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		bitWidth int
+		count    int
+		values   []int
+		error    bool
+	}{
+		{name: "repeated run", data: []byte{5 << 1, 1}, bitWidth: 1, count: 5, values: []int{1, 1, 1, 1, 1}},
+		{name: "repeated run of a wide value", data: []byte{3 << 1, 0x2c, 0x01}, bitWidth: 9, count: 3, values: []int{300, 300, 300}},
+		{name: "bit packed group", data: []byte{1<<1 | 1, 0x88, 0xc6, 0xfa}, bitWidth: 3, count: 8, values: []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		{name: "bit packed group with padding", data: []byte{1<<1 | 1, 0x05}, bitWidth: 1, count: 3, values: []int{1, 0, 1}},
+		{name: "runs in a row", data: []byte{3 << 1, 3, 1<<1 | 1, 0x06, 0x00}, bitWidth: 2, count: 6, values: []int{3, 3, 3, 2, 1, 0}},
+		{name: "zero bit width", data: []byte{4 << 1}, bitWidth: 0, count: 4, values: []int{0, 0, 0, 0}},
+		{name: "bit packed run longer than the data", data: []byte{0xff, 0xff, 0xff, 0xff, 0x0f, 0x01}, bitWidth: 8, count: 8, error: true},
+		{name: "bit width over 32", data: []byte{1 << 1, 0, 0, 0, 0, 0}, bitWidth: 40, count: 1, error: true},
+		{name: "negative count", data: []byte{1 << 1, 1}, bitWidth: 1, count: -1, error: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := decodeRLEHybrid(test.data, test.bitWidth, test.count)
+			if test.error {
+				if err == nil {
+					t.Errorf("got values %v, want an error", values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, test.values) {
+				t.Errorf("got values %v, want %v", values, test.values)
+			}
+		})
+	}
+}
+
+func TestDecodeSnappy(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		decoded string
+		error   bool
+	}{
+		{name: "literal", data: []byte{5, 4 << 2, 'h', 'e', 'l', 'l', 'o'}, decoded: "hello"},
+		{name: "overlapping copy with a 1 byte offset", data: []byte{6, 1 << 2, 'a', 'b', 0<<2 | 1, 2}, decoded: "ababab"},
+		{name: "copy with a 2 byte offset", data: []byte{6, 2 << 2, 'x', 'y', 'z', 2<<2 | 2, 3, 0}, decoded: "xyzxyz"},
+		{name: "copy before the start", data: []byte{4, 0 << 2, 'a', 0<<2 | 1, 2}, error: true},
+		{name: "wrong length", data: []byte{9, 4 << 2, 'h', 'e', 'l', 'l', 'o'}, error: true},
+		{name: "literal longer than the length", data: []byte{2, 4 << 2, 'h', 'e', 'l', 'l', 'o'}, error: true},
+		{name: "copy longer than the length", data: []byte{3, 0 << 2, 'a', 60<<2 | 2, 1, 0}, error: true},
+		{name: "length far over the data", data: []byte{0x80, 0x80, 0x80, 0x80, 0x07, 0 << 2, 'a'}, error: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := decodeSnappy(test.data)
+			if test.error {
+				if err == nil {
+					t.Errorf("got %q, want an error", decoded)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(decoded) != test.decoded {
+				t.Errorf("got %q, want %q", decoded, test.decoded)
+			}
+		})
+	}
+}